@@ -13,10 +13,9 @@ import (
 
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/labstack/echo/v4"
-	"go.mongodb.org/mongo-driver/bson"
 	"golang.org/x/crypto/bcrypt"
 
-	"github.com/whit3rabbit/beehive/manager/internal/mongodb"
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
 	"github.com/whit3rabbit/beehive/manager/models"
 )
 
@@ -126,84 +125,84 @@ func ValidateToken(tokenStr string, jwtSecret string) (*Claims, error) {
 }
 
 // LoginHandler handles POST /admin/login.
-// It verifies admin credentials and returns a JWT token on success.
-func LoginHandler(c echo.Context) error {
-	var req struct {
-		Username string `json:"username"`
-		Password string `json:"password"`
-	}
-	if err := c.Bind(&req); err != nil {
-		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid request payload"})
-	}
+// It verifies admin credentials against the given store and returns a JWT token on success.
+func LoginHandler(admins storage.AdminStore) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		}
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid request payload"})
+		}
 
-	// Get password policy from context
-	passwordPolicy, ok := c.Get("password_policy").(models.PasswordPolicy)
-	if !ok {
-		logger.Error("Password policy not properly configured")
-		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Internal server error"})
-	}
+		// Get password policy from context
+		passwordPolicy, ok := c.Get("password_policy").(models.PasswordPolicy)
+		if !ok {
+			logger.Error("Password policy not properly configured")
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Internal server error"})
+		}
 
-	// Validate password
-	if err := validatePassword(req.Password, passwordPolicy); err != nil {
-		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
-	}
+		// Validate password
+		if err := validatePassword(req.Password, passwordPolicy); err != nil {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+		}
 
-	username := req.Username
+		username := req.Username
 
-	loginMutex.Lock()
-	if attempts, exists := loginAttempts[username]; exists {
-		if attempts.count >= 5 && time.Since(attempts.lastAttempt) < 15*time.Minute {
-			loginMutex.Unlock()
-			return c.JSON(http.StatusTooManyRequests, echo.Map{"error": "Too many login attempts. Please wait 15 minutes."})
+		loginMutex.Lock()
+		if attempts, exists := loginAttempts[username]; exists {
+			if attempts.count >= 5 && time.Since(attempts.lastAttempt) < 15*time.Minute {
+				loginMutex.Unlock()
+				return c.JSON(http.StatusTooManyRequests, echo.Map{"error": "Too many login attempts. Please wait 15 minutes."})
+			}
 		}
-	}
-	loginMutex.Unlock()
-
-	// Retrieve the admin record from MongoDB.
-	dbName := c.Get("mongodb_database").(string)
-	collection := mongodb.Client.Database(dbName).Collection("admins")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	var admin models.Admin
-	if err := collection.FindOne(ctx, bson.M{"username": username}).Decode(&admin); err != nil {
-		logger.Warn("Invalid username or password", zap.Error(err), zap.String("username", username))
-		updateLoginAttempts(username, false)
-		return c.JSON(http.StatusUnauthorized, echo.Map{"error": "Invalid username or password"})
-	}
+		loginMutex.Unlock()
 
-	// Verify the provided password.
-	if err := VerifyPassword(admin.Password, req.Password); err != nil {
-		updateLoginAttempts(username, false)
-		return c.JSON(http.StatusUnauthorized, echo.Map{"error": "Invalid username or password"})
-	}
+		// Retrieve the admin record from storage.
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
 
-	// Retrieve jwt_secret from context
-	jwtSecret, ok := c.Get("jwt_secret").(string)
-	if !ok || jwtSecret == "" {
-		logger.Error("JWT secret not properly configured")
-		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Internal server error"})
-	}
+		admin, err := admins.GetByUsername(ctx, username)
+		if err != nil {
+			logger.Warn("Invalid username or password", zap.Error(err), zap.String("username", username))
+			updateLoginAttempts(username, false)
+			return c.JSON(http.StatusUnauthorized, echo.Map{"error": "Invalid username or password"})
+		}
 
-	tokenExpiration, ok := c.Get("token_expiration_hours").(int)
-	if !ok || tokenExpiration <= 0 {
-		logger.Error("Token expiration not properly configured")
-		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Internal server error"})
-	}
+		// Verify the provided password.
+		if err := VerifyPassword(admin.Password, req.Password); err != nil {
+			updateLoginAttempts(username, false)
+			return c.JSON(http.StatusUnauthorized, echo.Map{"error": "Invalid username or password"})
+		}
 
-	// Generate a JWT token with configured expiration
-	token, err := GenerateToken(admin.Username, jwtSecret, tokenExpiration)
-	if err != nil {
-		logger.Error("Could not generate token", zap.Error(err), zap.String("username", admin.Username))
-		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Could not generate token"})
-	}
+		// Retrieve jwt_secret from context
+		jwtSecret, ok := c.Get("jwt_secret").(string)
+		if !ok || jwtSecret == "" {
+			logger.Error("JWT secret not properly configured")
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Internal server error"})
+		}
 
-	updateLoginAttempts(username, true)
+		tokenExpiration, ok := c.Get("token_expiration_hours").(int)
+		if !ok || tokenExpiration <= 0 {
+			logger.Error("Token expiration not properly configured")
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Internal server error"})
+		}
 
-	return c.JSON(http.StatusOK, echo.Map{
-		"token":    token,
-		"username": admin.Username,
-	})
+		// Generate a JWT token with configured expiration
+		token, err := GenerateToken(admin.Username, jwtSecret, tokenExpiration)
+		if err != nil {
+			logger.Error("Could not generate token", zap.Error(err), zap.String("username", admin.Username))
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Could not generate token"})
+		}
+
+		updateLoginAttempts(username, true)
+
+		return c.JSON(http.StatusOK, echo.Map{
+			"token":    token,
+			"username": admin.Username,
+		})
+	}
 }
 
 // CleanupLoginAttempts periodically cleans up expired login attempts.
@@ -3,20 +3,17 @@ package handlers
 import (
 	"context"
 	"crypto/rand"
-	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"net/http"
 	"time"
 
 	"github.com/whit3rabbit/beehive/manager/internal/logger"
 	"github.com/labstack/echo/v4"
 
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo/options"
-
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
 	"github.com/whit3rabbit/beehive/manager/models"
-	"github.com/whit3rabbit/beehive/manager/internal/mongodb"
 	"go.uber.org/zap"
 )
 
@@ -30,89 +27,118 @@ type ErrorResponse struct {
 	Details string `json:"details,omitempty"`
 }
 
-// hashAPIKey hashes the provided API key using SHA256.
-func hashAPIKey(key string) string {
-	hash := sha256.Sum256([]byte(key))
-	return hex.EncodeToString(hash[:])
-}
-
 // RegisterAgent handles POST /agent/register.
-// @Summary Registers a new agent or updates an existing one
-// @Description Registers or updates an agent in the database.
+// @Summary Re-registers the calling agent and rotates its credentials
+// @Description Updates the identity of the authenticated agent and issues a new key ID and secret.
 // @Tags agent
 // @Accept json
 // @Produce json
 // @Param agent body models.Agent true "Agent registration info"
+// @Param Idempotency-Key header string false "Key under which a retry of the request gets the original response"
 // @Success 200 {object} models.AgentRegistrationResponse
 // @Failure 400 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Router /agent/register [post]
-func RegisterAgent(c echo.Context) error {
-	var agent models.Agent
-	if err := c.Bind(&agent); err != nil {
+func (h *Handler) RegisterAgent(c echo.Context) error {
+	var req models.Agent
+	if err := c.Bind(&req); err != nil {
 		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid request payload"})
 	}
 
-	// Set created_at if not provided
-	if agent.CreatedAt.IsZero() {
-		agent.CreatedAt = time.Now()
+	// An agent may only re-register itself; new agents enroll with a token.
+	callerUUID, _ := c.Get("agent_uuid").(string)
+	if req.UUID == "" {
+		req.UUID = callerUUID
+	}
+	if callerUUID == "" || req.UUID != callerUUID {
+		return c.JSON(http.StatusForbidden, ErrorResponse{Error: "Agents may only register themselves"})
 	}
 
-	// Set initial status to "active"
-	agent.Status = "active"
-	agent.LastSeen = time.Now()
-
-	dbName := c.Get("mongodb_database").(string)
-	collection := mongodb.Client.Database(dbName).Collection("agents")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
 	defer cancel()
 
-	filter := bson.M{"uuid": agent.UUID}
-	update := bson.M{"$set": agent}
-	opts := options.Update().SetUpsert(true)
-	_, err := collection.UpdateOne(ctx, filter, update, opts)
+	agent, err := h.store.Agents.GetByUUID(ctx, callerUUID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "Agent not found"})
+	}
 	if err != nil {
-		logger.Error("Failed to register agent", zap.Error(err), zap.String("agent_uuid", agent.UUID))
-		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to register agent"})
+		logger.Error("Failed to retrieve agent", zap.Error(err), zap.String("agent_uuid", callerUUID))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to register agent"})
 	}
 
-	// Generate and store API key
-	apiKey, err := generateSecureToken()
-	if err != nil {
-		logger.Error("Failed to generate API key", zap.Error(err), zap.String("agent_uuid", agent.UUID))
-		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to generate API key"})
+	if req.Hostname != "" {
+		agent.Hostname = req.Hostname
+	}
+	if req.MacHash != "" {
+		agent.MacHash = req.MacHash
+	}
+	if req.Nickname != "" {
+		agent.Nickname = req.Nickname
 	}
+	agent.Status = "active"
+	agent.LastSeen = time.Now()
 
-	// Generate and store API secret
-	apiSecret, err := generateSecureToken()
+	creds, err := h.issueCredentials(agent)
 	if err != nil {
-		logger.Error("Failed to generate API secret", zap.Error(err), zap.String("agent_uuid", agent.UUID))
-		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to generate API secret"})
+		logger.Error("Failed to generate API credentials", zap.Error(err), zap.String("agent_uuid", agent.UUID))
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to generate API credentials"})
 	}
 
-	// Hash API key and secret
-	hashedAPIKey := hashAPIKey(apiKey)
-	hashedAPISecret := hashAPIKey(apiSecret)
+	if err := h.store.Agents.Upsert(ctx, agent); err != nil {
+		logger.Error("Failed to register agent", zap.Error(err), zap.String("agent_uuid", agent.UUID))
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to register agent"})
+	}
 
-	// Update agent with hashed API key and secret
-	agent.APIKey = hashedAPIKey
-	agent.APISecret = hashedAPISecret
+	return c.JSON(http.StatusOK, creds.response())
+}
 
-	// Update document with hashed API key and secret
-	update = bson.M{"$set": agent}
-	_, err = collection.UpdateOne(ctx, filter, update, opts)
-	if err != nil {
-		logger.Error("Failed to store API key and secret", zap.Error(err), zap.String("agent_uuid", agent.UUID))
-		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to store API key and secret"})
-	}
+// agentCredentials are the raw values handed to an agent exactly once.
+type agentCredentials struct {
+	keyID  string
+	secret string
+}
 
-	// Update response to use AgentRegistrationResponse
-	response := models.AgentRegistrationResponse{
-		APIKey:    apiKey,     // unhashed
+func (creds agentCredentials) response() models.AgentRegistrationResponse {
+	return models.AgentRegistrationResponse{
+		KeyID:     creds.keyID,
+		APIKey:    creds.keyID,
+		APISecret: creds.secret,
 		Status:    "registered",
 		Timestamp: time.Now(),
 	}
-	return c.JSON(http.StatusOK, response)
+}
+
+// issueCredentials generates a new key ID and shared secret for the agent. The key ID is
+// stored as-is for lookups, the secret is stored encrypted so signatures can be verified,
+// and any legacy credentials are dropped. Shared-secret credentials being replaced are kept
+// as the previous ones, with which the agent may replay the rotation.
+func (h *Handler) issueCredentials(agent *models.Agent) (agentCredentials, error) {
+	keyBytes := make([]byte, 16)
+	if _, err := rand.Read(keyBytes); err != nil {
+		return agentCredentials{}, err
+	}
+	secret, err := generateSecureToken()
+	if err != nil {
+		return agentCredentials{}, err
+	}
+	encrypted, err := h.secrets.Encrypt(secret)
+	if err != nil {
+		return agentCredentials{}, err
+	}
+
+	if agent.CredentialVersion == models.CredentialVersionSharedSecret && agent.KeyID != "" {
+		agent.PreviousKeyID = agent.KeyID
+		agent.PreviousAPISecret = agent.APISecret
+	}
+	keyID := "bh_" + hex.EncodeToString(keyBytes)
+	agent.KeyID = keyID
+	agent.APIKey = ""
+	agent.APISecret = encrypted
+	agent.CredentialVersion = models.CredentialVersionSharedSecret
+	return agentCredentials{keyID: keyID, secret: secret}, nil
 }
 
 // generateSecureToken generates a secure random token for API key and secret.
@@ -137,23 +163,24 @@ func generateSecureToken() (string, error) {
 // @Failure 404 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Router /agent/{uuid}/summary [get]
-func GetAgentSummary(c echo.Context) error {
+func (h *Handler) GetAgentSummary(c echo.Context) error {
 	agentUUID := c.Param("uuid")
 	if agentUUID == "" {
 		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Missing agent UUID"})
 	}
 
-	dbName := c.Get("mongodb_database").(string)
-	collection := mongodb.Client.Database(dbName).Collection("agents")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
 	defer cancel()
 
-	var agent models.Agent
-	err := collection.FindOne(ctx, bson.M{"uuid": agentUUID}).Decode(&agent)
-	if err != nil {
+	agent, err := h.store.Agents.GetByUUID(ctx, agentUUID)
+	if errors.Is(err, storage.ErrNotFound) {
 		logger.Error("Agent not found", zap.Error(err), zap.String("agent_uuid", agentUUID))
 		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "Agent not found"})
 	}
+	if err != nil {
+		logger.Error("Failed to retrieve agent", zap.Error(err), zap.String("agent_uuid", agentUUID))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to retrieve agent"})
+	}
 
 	summary := agent.ToSummary()
 	return c.JSON(http.StatusOK, summary)
@@ -161,48 +188,71 @@ func GetAgentSummary(c echo.Context) error {
 
 // AgentHeartbeat handles POST /agent/heartbeat.
 // @Summary Updates the heartbeat of an agent
-// @Description Updates the last_seen timestamp of an agent.
+// @Description Sets the last_seen timestamp of the authenticated agent to the manager's time and marks it active; a uuid in the body must be the agent's own, or 403 is returned, and the timestamp in the body is ignored; decommissioned agents get 410 and stay decommissioned. cancel_tasks lists the tasks the authenticated agent holds that were cancelled and should be stopped. When task leases are enabled, the heartbeat also renews the leases of all tasks the authenticated agent holds until lease_expires_at.
 // @Tags agent
 // @Accept json
 // @Produce json
 // @Param body body models.HeartbeatRequest true "Agent UUID and timestamp"
 // @Success 200 {object} models.HeartbeatResponse
 // @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 410 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Router /agent/heartbeat [post]
-func AgentHeartbeat(c echo.Context) error {
+func (h *Handler) AgentHeartbeat(c echo.Context) error {
+    agentUUID, ok := c.Get("agent_uuid").(string)
+    if !ok || agentUUID == "" {
+        return c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "Unknown agent"})
+    }
+
     var req models.HeartbeatRequest
     if err := c.Bind(&req); err != nil {
         return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid request payload"})
     }
+    if req.UUID != "" && req.UUID != agentUUID {
+        return c.JSON(http.StatusForbidden, ErrorResponse{Error: "Agents may only send their own heartbeat"})
+    }
 
-    dbName := c.Get("mongodb_database").(string)
-    collection := mongodb.Client.Database(dbName).Collection("agents")
-    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
     defer cancel()
 
-    update := bson.M{
-        "$set": bson.M{
-            "status":    "active",
-            "last_seen": req.Timestamp,  // Use the provided timestamp
-        },
+    // Liveness is judged on the manager clock; the agent's timestamp is not trusted
+    now := time.Now()
+    err := h.store.Agents.Heartbeat(ctx, agentUUID, now)
+    if errors.Is(err, storage.ErrConflict) {
+        return c.JSON(http.StatusGone, ErrorResponse{Error: "Agent was decommissioned"})
     }
-    _, err := collection.UpdateOne(ctx, bson.M{"uuid": req.UUID}, update)
     if err != nil {
-        logger.Error("Failed to update agent heartbeat", zap.Error(err), zap.String("agent_uuid", req.UUID))
+        logger.Error("Failed to update agent heartbeat", zap.Error(err), zap.String("agent_uuid", agentUUID))
         return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to update agent heartbeat"})
     }
 
     response := models.HeartbeatResponse{
         Status:    "heartbeat_received",
-        Timestamp: time.Now(),
+        Timestamp: now,
+    }
+    cancelTasks, err := h.cancelRequested(ctx, agentUUID)
+    if err != nil {
+        logger.Error("Failed to look up cancelled tasks", zap.Error(err), zap.String("agent_uuid", agentUUID))
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to update agent heartbeat"})
+    }
+    response.CancelTasks = cancelTasks
+
+    if h.dispatch.Lease > 0 {
+        until := now.Add(h.dispatch.Lease)
+        if _, err := h.store.Tasks.RenewLeases(ctx, agentUUID, until); err != nil {
+            logger.Error("Failed to renew task leases", zap.Error(err), zap.String("agent_uuid", agentUUID))
+            return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to update agent heartbeat"})
+        }
+        response.LeaseExpiresAt = &until
     }
     return c.JSON(http.StatusOK, response)
 }
 
 // ListAgentTasks handles GET /agent/:agent_id/tasks.
 // @Summary Lists tasks for a specific agent
-// @Description Retrieves all tasks associated with a given agent ID.
+// @Description Retrieves all tasks associated with a given agent ID, highest priority first and then oldest first.
 // @Tags agent
 // @Accept json
 // @Produce json
@@ -212,26 +262,19 @@ func AgentHeartbeat(c echo.Context) error {
 // @Failure 404 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Router /agent/{agent_id}/tasks [get]
-func ListAgentTasks(c echo.Context) error {
+func (h *Handler) ListAgentTasks(c echo.Context) error {
 	agentID := c.Param("agent_id")
 	if agentID == "" {
 		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Missing agent ID"})
 	}
 
-	dbName := c.Get("mongodb_database").(string)
-	collection := mongodb.Client.Database(dbName).Collection("tasks")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
 	defer cancel()
 
-	cursor, err := collection.Find(ctx, bson.M{"agent_id": agentID})
+	tasks, err := h.store.Tasks.ListByAgent(ctx, agentID)
 	if err != nil {
+		logger.Error("Failed to retrieve tasks", zap.Error(err), zap.String("agent_id", agentID))
 		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to retrieve tasks"})
 	}
-	defer cursor.Close(ctx)
-
-	var tasks []models.Task
-	if err = cursor.All(ctx, &tasks); err != nil {
-		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to parse tasks"})
-	}
 	return c.JSON(http.StatusOK, tasks)
 }
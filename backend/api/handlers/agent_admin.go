@@ -0,0 +1,287 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+
+	"github.com/whit3rabbit/beehive/manager/internal/logger"
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+const (
+	// DefaultAgentPageSize is used when an agent listing does not set a limit.
+	DefaultAgentPageSize = 50
+	// MaxAgentPageSize caps the number of agents returned per page.
+	MaxAgentPageSize = 200
+)
+
+// ListAgents handles GET /admin/agents.
+// @Summary Lists registered agents
+// @Description Returns one page of agents matching the filters, sorted on any summary field. Pass next_cursor back as cursor to fetch the following page.
+// @Tags admin-agents
+// @Produce json
+// @Param status query string false "Agent status"
+// @Param role query string false "Agent role"
+// @Param hostname_prefix query string false "Hostname prefix"
+// @Param nickname query string false "Case-insensitive nickname substring"
+// @Param last_seen_after query string false "RFC 3339 timestamp"
+// @Param last_seen_before query string false "RFC 3339 timestamp"
+// @Param label query []string false "Label filter as key:value, repeatable"
+// @Param sort query string false "uuid, nickname, hostname, role, status, last_seen or created_at"
+// @Param order query string false "asc or desc"
+// @Param limit query int false "Page size, at most 200"
+// @Param cursor query string false "Cursor returned by the previous page"
+// @Success 200 {object} models.AgentListResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/agents [get]
+func (h *Handler) ListAgents(c echo.Context) error {
+	query, err := parseAgentQuery(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	page, err := h.store.Agents.List(ctx, query)
+	if errors.Is(err, storage.ErrInvalidCursor) {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid cursor"})
+	}
+	if err != nil {
+		logger.Error("Failed to list agents", zap.Error(err))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list agents"})
+	}
+
+	response := models.AgentListResponse{
+		Agents:     make([]models.AgentSummary, 0, len(page.Agents)),
+		Total:      page.Total,
+		NextCursor: page.NextCursor,
+	}
+	for i := range page.Agents {
+		response.Agents = append(response.Agents, page.Agents[i].ToSummary())
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// parseAgentQuery builds a storage query from the ListAgents query parameters.
+func parseAgentQuery(c echo.Context) (storage.AgentQuery, error) {
+	query := storage.AgentQuery{
+		Filter: storage.AgentFilter{
+			Status:         c.QueryParam("status"),
+			Role:           c.QueryParam("role"),
+			HostnamePrefix: c.QueryParam("hostname_prefix"),
+			Nickname:       c.QueryParam("nickname"),
+		},
+		SortBy: c.QueryParam("sort"),
+		Cursor: c.QueryParam("cursor"),
+		Limit:  DefaultAgentPageSize,
+	}
+
+	var err error
+	if query.Filter.LastSeenAfter, err = parseTimeParam(c, "last_seen_after"); err != nil {
+		return query, err
+	}
+	if query.Filter.LastSeenBefore, err = parseTimeParam(c, "last_seen_before"); err != nil {
+		return query, err
+	}
+
+	for _, label := range c.QueryParams()["label"] {
+		key, value, ok := strings.Cut(label, ":")
+		if !ok || !validLabelKey(key) {
+			return query, errors.New("Invalid label filter, expected key:value")
+		}
+		if query.Filter.Labels == nil {
+			query.Filter.Labels = make(map[string]string)
+		}
+		query.Filter.Labels[key] = value
+	}
+
+	if query.SortBy != "" && !storage.ValidAgentSortField(query.SortBy) {
+		return query, errors.New("Invalid sort field")
+	}
+	switch c.QueryParam("order") {
+	case "", "asc":
+	case "desc":
+		query.SortDesc = true
+	default:
+		return query, errors.New("Invalid sort order")
+	}
+
+	if limit := c.QueryParam("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > MaxAgentPageSize {
+			return query, errors.New("Invalid limit")
+		}
+		query.Limit = n
+	}
+	return query, nil
+}
+
+// parseTimeParam parses an optional RFC 3339 query parameter.
+func parseTimeParam(c echo.Context, name string) (time.Time, error) {
+	value := c.QueryParam(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, errors.New("Invalid " + name + ", expected an RFC 3339 timestamp")
+	}
+	return t, nil
+}
+
+// validLabelKey rejects label keys that would be interpreted as MongoDB paths or operators.
+func validLabelKey(key string) bool {
+	return key != "" && !strings.Contains(key, ".") && !strings.HasPrefix(key, "$")
+}
+
+// GetAgent handles GET /admin/agents/:uuid.
+// @Summary Retrieves an agent
+// @Description Returns the summary of a single agent and the task slots it is using against its concurrency limits. Credentials are never included.
+// @Tags admin-agents
+// @Produce json
+// @Param uuid path string true "Agent UUID"
+// @Success 200 {object} models.AgentDetail
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/agents/{uuid} [get]
+func (h *Handler) GetAgent(c echo.Context) error {
+	agentUUID := c.Param("uuid")
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	agent, err := h.store.Agents.GetByUUID(ctx, agentUUID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "Agent not found"})
+	}
+	if err != nil {
+		logger.Error("Failed to retrieve agent", zap.Error(err), zap.String("agent_uuid", agentUUID))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to retrieve agent"})
+	}
+
+	limits, err := h.concurrencyLimits(ctx, agent)
+	if err != nil {
+		logger.Error("Failed to look up concurrency limits", zap.Error(err), zap.String("agent_uuid", agentUUID))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to retrieve agent"})
+	}
+	held, err := h.store.Tasks.CountHeld(ctx, agentUUID)
+	if err != nil {
+		logger.Error("Failed to count agent tasks", zap.Error(err), zap.String("agent_uuid", agentUUID))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to retrieve agent"})
+	}
+
+	slots := models.AgentSlots{Max: limits.Max, Types: map[string]models.TypeSlots{}}
+	for taskType, used := range held {
+		slots.Used += used
+		slots.Types[taskType] = models.TypeSlots{Used: used, Max: limits.PerType[taskType]}
+	}
+	for taskType, max := range limits.PerType {
+		if _, ok := held[taskType]; !ok {
+			slots.Types[taskType] = models.TypeSlots{Max: max}
+		}
+	}
+	return c.JSON(http.StatusOK, models.AgentDetail{AgentSummary: agent.ToSummary(), Slots: slots})
+}
+
+// UpdateAgent handles PATCH /admin/agents/:uuid.
+// @Summary Edits an agent
+// @Description Changes the nickname, role and/or concurrency limit of an agent. Omitted fields are left unchanged. An agent assigned a new role gets the role's default tasks.
+// @Tags admin-agents
+// @Accept json
+// @Produce json
+// @Param uuid path string true "Agent UUID"
+// @Param agent body models.AgentUpdateRequest true "Fields to change"
+// @Success 200 {object} models.AgentSummary
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/agents/{uuid} [patch]
+func (h *Handler) UpdateAgent(c echo.Context) error {
+	agentUUID := c.Param("uuid")
+
+	var req models.AgentUpdateRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid request payload"})
+	}
+	if req.MaxConcurrent != nil && *req.MaxConcurrent < 0 {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "max_concurrent must not be negative"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	if req.Role != nil && *req.Role != "" {
+		if _, err := h.store.Roles.GetByName(ctx, *req.Role); err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Unknown role"})
+			}
+			logger.Error("Failed to look up role", zap.Error(err), zap.String("role_name", *req.Role))
+			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to update agent"})
+		}
+	}
+
+	previous, err := h.store.Agents.GetByUUID(ctx, agentUUID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "Agent not found"})
+	}
+	if err != nil {
+		logger.Error("Failed to retrieve agent", zap.Error(err), zap.String("agent_uuid", agentUUID))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to update agent"})
+	}
+
+	update := storage.AgentUpdate{Nickname: req.Nickname, Role: req.Role, MaxConcurrent: req.MaxConcurrent}
+	agent, err := h.store.Agents.Update(ctx, agentUUID, update)
+	if errors.Is(err, storage.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "Agent not found"})
+	}
+	if err != nil {
+		logger.Error("Failed to update agent", zap.Error(err), zap.String("agent_uuid", agentUUID))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to update agent"})
+	}
+
+	// An agent assigned a new role gets the role's default tasks
+	if agent.Role != "" && agent.Role != previous.Role && agent.Status != models.AgentStatusDecommissioned {
+		admin, _ := c.Get("admin").(string)
+		h.createDefaultTasks(ctx, agent.UUID, agent.Role, admin)
+	}
+	return c.JSON(http.StatusOK, agent.ToSummary())
+}
+
+// DecommissionAgent handles DELETE /admin/agents/:uuid.
+// @Summary Decommissions an agent
+// @Description Revokes the agent's credentials and marks it decommissioned. Its history is kept.
+// @Tags admin-agents
+// @Produce json
+// @Param uuid path string true "Agent UUID"
+// @Success 204
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/agents/{uuid} [delete]
+func (h *Handler) DecommissionAgent(c echo.Context) error {
+	agentUUID := c.Param("uuid")
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	if err := h.store.Agents.Decommission(ctx, agentUUID); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return c.JSON(http.StatusNotFound, ErrorResponse{Error: "Agent not found"})
+		}
+		logger.Error("Failed to decommission agent", zap.Error(err), zap.String("agent_uuid", agentUUID))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to decommission agent"})
+	}
+
+	admin, _ := c.Get("admin").(string)
+	logger.Info("Agent decommissioned", zap.String("agent_uuid", agentUUID), zap.String("admin", admin))
+	return c.NoContent(http.StatusNoContent)
+}
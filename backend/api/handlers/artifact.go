@@ -0,0 +1,358 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+
+	"github.com/whit3rabbit/beehive/manager/internal/logger"
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+// Artifact quotas used when ArtifactLimits leaves them unset.
+const (
+	DefaultMaxArtifactSize     = 32 << 20  // 32MB
+	DefaultMaxTaskArtifactSize = 256 << 20 // 256MB
+)
+
+// multipartOverhead bounds the form fields and framing sent along with an artifact upload.
+const multipartOverhead = 64 << 10 // 64KB
+
+// MaxArtifactNameLength is the longest artifact file name accepted, in bytes.
+const MaxArtifactNameLength = 255
+
+// ArtifactTransferTimeout bounds the upload or download of one artifact.
+var ArtifactTransferTimeout = 5 * time.Minute
+
+// ArtifactLimits caps the artifacts agents attach to their tasks. Zero values use the defaults.
+type ArtifactLimits struct {
+	// MaxFileBytes caps the size of one artifact.
+	MaxFileBytes int64
+	// MaxTaskBytes caps the combined size of the artifacts of one task.
+	MaxTaskBytes int64
+}
+
+func (l ArtifactLimits) maxFile() int64 {
+	if l.MaxFileBytes > 0 {
+		return l.MaxFileBytes
+	}
+	return DefaultMaxArtifactSize
+}
+
+// MaxUploadBytes is the largest request body an artifact upload may have: the largest artifact
+// and room for the other form fields and the multipart framing.
+func (l ArtifactLimits) MaxUploadBytes() int64 {
+	return l.maxFile() + multipartOverhead
+}
+
+func (l ArtifactLimits) maxTask() int64 {
+	if l.MaxTaskBytes > 0 {
+		return l.MaxTaskBytes
+	}
+	return DefaultMaxTaskArtifactSize
+}
+
+// previewTypes maps the media types shown inline by the preview endpoint to the content type
+// they are served with. Text is always served as plain text, and SVG images are left out, so
+// that a previewed artifact never runs script in the admin's browser.
+var previewTypes = map[string]string{
+	"image/png":        "image/png",
+	"image/jpeg":       "image/jpeg",
+	"image/gif":        "image/gif",
+	"image/webp":       "image/webp",
+	"text/plain":       "text/plain; charset=utf-8",
+	"text/csv":         "text/plain; charset=utf-8",
+	"application/json": "text/plain; charset=utf-8",
+}
+
+// UploadArtifact handles POST /task/artifacts/:task_id.
+// @Summary Attaches a file to a task
+// @Description Stores a file, such as a screenshot, produced by a task held by the authenticated agent. The upload is a multipart form with the file in "file", its hex-encoded SHA-256 digest in "sha256", and optionally its media type in "content_type" and a file name in "name". Files and the total size of a task's artifacts are subject to quotas.
+// @Tags task
+// @Accept multipart/form-data
+// @Produce json
+// @Param task_id path string true "Task ID"
+// @Param file formData file true "Artifact content"
+// @Param sha256 formData string true "Hex-encoded SHA-256 digest of the content"
+// @Param content_type formData string false "Media type, defaults to the one of the file part"
+// @Param name formData string false "File name, defaults to the one of the file part"
+// @Success 201 {object} models.Artifact
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 413 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /task/artifacts/{task_id} [post]
+func (h *Handler) UploadArtifact(c echo.Context) error {
+	agentUUID, ok := c.Get("agent_uuid").(string)
+	if !ok || agentUUID == "" {
+		return c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "Unknown agent"})
+	}
+	taskID := c.Param("task_id")
+	objID, err := primitive.ObjectIDFromHex(taskID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid task ID format"})
+	}
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Missing artifact file"})
+	}
+	name := c.FormValue("name")
+	if name == "" {
+		name = fileHeader.Filename
+	}
+	name, ok = artifactName(name)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid artifact name"})
+	}
+	contentType := c.FormValue("content_type")
+	if contentType == "" {
+		contentType = fileHeader.Header.Get(echo.HeaderContentType)
+	}
+	if contentType == "" {
+		contentType = echo.MIMEOctetStream
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid content type"})
+	}
+	digest := strings.ToLower(c.FormValue("sha256"))
+	if len(digest) != sha256.Size*2 {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid SHA-256 digest"})
+	}
+	if _, err := hex.DecodeString(digest); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid SHA-256 digest"})
+	}
+	if fileHeader.Size > h.artifacts.maxFile() {
+		logger.Error("Artifact exceeds size limit",
+			zap.Int64("artifact_size", fileHeader.Size),
+			zap.Int64("max_size", h.artifacts.maxFile()))
+		return c.JSON(http.StatusRequestEntityTooLarge, ErrorResponse{Error: "Artifact exceeds size limit"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ArtifactTransferTimeout)
+	defer cancel()
+
+	task, err := h.store.Tasks.Get(ctx, objID)
+	if errors.Is(err, storage.ErrNotFound) || (err == nil && task.AgentID != agentUUID) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "Task not found"})
+	}
+	if err != nil {
+		logger.Error("Failed to retrieve task", zap.Error(err), zap.String("task_id", taskID))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to store artifact"})
+	}
+	// Like logs, artifacts may trail the final update, but only once the agent has claimed the task
+	if task.Attempt == 0 {
+		return c.JSON(http.StatusConflict, ErrorResponse{Error: "Task has not been dispatched"})
+	}
+
+	// Reserve the quota before storing, so that concurrent uploads cannot exceed it together
+	err = h.store.Tasks.ReserveArtifactBytes(ctx, objID, fileHeader.Size, h.artifacts.maxTask())
+	if errors.Is(err, storage.ErrConflict) {
+		logger.Error("Task artifacts exceed quota",
+			zap.String("task_id", taskID),
+			zap.Int64("artifact_size", fileHeader.Size),
+			zap.Int64("quota", h.artifacts.maxTask()))
+		return c.JSON(http.StatusRequestEntityTooLarge, ErrorResponse{Error: "Task artifact quota exceeded"})
+	}
+	if err != nil {
+		logger.Error("Failed to reserve artifact quota", zap.Error(err), zap.String("task_id", taskID))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to store artifact"})
+	}
+	stored := false
+	defer func() {
+		if stored {
+			return
+		}
+		releaseCtx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+		defer cancel()
+		if err := h.store.Tasks.ReserveArtifactBytes(releaseCtx, objID, -fileHeader.Size, h.artifacts.maxTask()); err != nil {
+			logger.Error("Failed to release artifact quota", zap.Error(err), zap.String("task_id", taskID))
+		}
+	}()
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		logger.Error("Failed to open uploaded artifact", zap.Error(err), zap.String("task_id", taskID))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to store artifact"})
+	}
+	defer file.Close()
+
+	// Check the digest before anything is stored, then read the file again to store it
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		logger.Error("Failed to read uploaded artifact", zap.Error(err), zap.String("task_id", taskID))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to store artifact"})
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != digest {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "SHA-256 digest does not match the artifact"})
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		logger.Error("Failed to read uploaded artifact", zap.Error(err), zap.String("task_id", taskID))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to store artifact"})
+	}
+
+	artifact := models.Artifact{
+		TaskID:      objID,
+		AgentID:     agentUUID,
+		Attempt:     task.Attempt,
+		Name:        name,
+		ContentType: mime.FormatMediaType(mediaType, params),
+		SHA256:      digest,
+		CreatedAt:   time.Now(),
+	}
+	if err := h.store.Artifacts.Create(ctx, &artifact, file); err != nil {
+		logger.Error("Failed to store artifact", zap.Error(err), zap.String("task_id", taskID))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to store artifact"})
+	}
+	stored = true
+	return c.JSON(http.StatusCreated, artifact)
+}
+
+// artifactName returns the file name an artifact is stored under: the last element of name,
+// which must not be empty, too long or contain control characters.
+func artifactName(name string) (string, bool) {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == "/" || len(name) > MaxArtifactNameLength {
+		return "", false
+	}
+	if strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return "", false
+	}
+	return name, true
+}
+
+// ListTaskArtifacts handles GET /admin/tasks/:task_id/artifacts.
+// @Summary Lists the artifacts of a task
+// @Description Returns the files agents attached to a task, oldest first, with their combined size.
+// @Tags admin-tasks
+// @Produce json
+// @Param task_id path string true "Task ID"
+// @Success 200 {object} models.ArtifactListResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/tasks/{task_id}/artifacts [get]
+func (h *Handler) ListTaskArtifacts(c echo.Context) error {
+	taskID := c.Param("task_id")
+	objID, err := primitive.ObjectIDFromHex(taskID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid task ID format"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	if _, err := h.store.Tasks.Get(ctx, objID); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return c.JSON(http.StatusNotFound, ErrorResponse{Error: "Task not found"})
+		}
+		logger.Error("Failed to retrieve task", zap.Error(err), zap.String("task_id", taskID))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list artifacts"})
+	}
+	artifacts, err := h.store.Artifacts.List(ctx, objID)
+	if err != nil {
+		logger.Error("Failed to list artifacts", zap.Error(err), zap.String("task_id", taskID))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list artifacts"})
+	}
+	resp := models.ArtifactListResponse{Artifacts: artifacts}
+	for _, artifact := range artifacts {
+		resp.TotalSize += artifact.Size
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// DownloadArtifact handles GET /admin/artifacts/:artifact_id/download.
+// @Summary Downloads an artifact
+// @Description Returns the content of an artifact as an attachment, with the media type the agent gave and its SHA-256 digest in the Digest header.
+// @Tags admin-tasks
+// @Produce octet-stream
+// @Param artifact_id path string true "Artifact ID"
+// @Success 200 {file} file
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/artifacts/{artifact_id}/download [get]
+func (h *Handler) DownloadArtifact(c echo.Context) error {
+	return h.serveArtifact(c, false)
+}
+
+// PreviewArtifact handles GET /admin/artifacts/:artifact_id/preview.
+// @Summary Previews an artifact
+// @Description Returns the content of an image or text artifact for display in the browser. Text is served as plain text; other media types cannot be previewed and must be downloaded.
+// @Tags admin-tasks
+// @Produce image/png
+// @Produce image/jpeg
+// @Produce image/gif
+// @Produce image/webp
+// @Produce plain
+// @Param artifact_id path string true "Artifact ID"
+// @Success 200 {file} file
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 415 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/artifacts/{artifact_id}/preview [get]
+func (h *Handler) PreviewArtifact(c echo.Context) error {
+	return h.serveArtifact(c, true)
+}
+
+// serveArtifact writes the content of the artifact named in the request, inline for a preview
+// and as an attachment otherwise.
+func (h *Handler) serveArtifact(c echo.Context, preview bool) error {
+	artifactID := c.Param("artifact_id")
+	objID, err := primitive.ObjectIDFromHex(artifactID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid artifact ID format"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ArtifactTransferTimeout)
+	defer cancel()
+
+	artifact, content, err := h.store.Artifacts.Open(ctx, objID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "Artifact not found"})
+	}
+	if err != nil {
+		logger.Error("Failed to open artifact", zap.Error(err), zap.String("artifact_id", artifactID))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to retrieve artifact"})
+	}
+	defer content.Close()
+
+	contentType, disposition := artifact.ContentType, "attachment"
+	if preview {
+		mediaType, _, _ := mime.ParseMediaType(artifact.ContentType)
+		served, ok := previewTypes[mediaType]
+		if !ok {
+			return c.JSON(http.StatusUnsupportedMediaType, ErrorResponse{Error: "Artifact cannot be previewed"})
+		}
+		contentType, disposition = served, "inline"
+	}
+
+	header := c.Response().Header()
+	header.Set(echo.HeaderContentDisposition, mime.FormatMediaType(disposition, map[string]string{"filename": artifact.Name}))
+	header.Set(echo.HeaderContentLength, strconv.FormatInt(artifact.Size, 10))
+	if sum, err := hex.DecodeString(artifact.SHA256); err == nil {
+		header.Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(sum))
+	}
+	// Agents choose the content; keep browsers from sniffing or running it
+	header.Set(echo.HeaderXContentTypeOptions, "nosniff")
+	header.Set(echo.HeaderContentSecurityPolicy, "default-src 'none'; img-src 'self'; sandbox")
+	return c.Stream(http.StatusOK, contentType, content)
+}
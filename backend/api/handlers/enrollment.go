@@ -0,0 +1,248 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+
+	"github.com/whit3rabbit/beehive/manager/internal/logger"
+	"github.com/whit3rabbit/beehive/manager/internal/secrets"
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+const (
+	// DefaultEnrollmentTokenTTL is used when a token request does not set an expiry.
+	DefaultEnrollmentTokenTTL = 24 * time.Hour
+	// MaxEnrollmentTokenTTL caps how long an enrollment token may stay valid.
+	MaxEnrollmentTokenTTL = 30 * 24 * time.Hour
+)
+
+// CreateEnrollmentToken handles POST /admin/enrollment-tokens.
+// @Summary Creates an agent enrollment token
+// @Description Mints a token that new agents can exchange for API credentials. The raw token is only returned once.
+// @Tags enrollment
+// @Accept json
+// @Produce json
+// @Param token body models.EnrollmentTokenRequest true "Token settings"
+// @Success 201 {object} models.EnrollmentTokenResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/enrollment-tokens [post]
+func (h *Handler) CreateEnrollmentToken(c echo.Context) error {
+	var req models.EnrollmentTokenRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid request payload"})
+	}
+	if req.MaxUses < 0 || req.ExpiresInHours < 0 {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "max_uses and expires_in_hours must not be negative"})
+	}
+
+	ttl := DefaultEnrollmentTokenTTL
+	if req.ExpiresInHours > 0 {
+		ttl = time.Duration(req.ExpiresInHours) * time.Hour
+	}
+	if ttl > MaxEnrollmentTokenTTL {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Enrollment token lifetime is too long"})
+	}
+	maxUses := req.MaxUses
+	if maxUses == 0 {
+		maxUses = 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	if req.Role != "" {
+		if _, err := h.store.Roles.GetByName(ctx, req.Role); err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Unknown role"})
+			}
+			logger.Error("Failed to look up role", zap.Error(err), zap.String("role_name", req.Role))
+			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create enrollment token"})
+		}
+	}
+
+	rawToken, err := generateSecureToken()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to generate enrollment token"})
+	}
+
+	now := time.Now()
+	createdBy, _ := c.Get("admin").(string)
+	token := models.EnrollmentToken{
+		TokenHash:   secrets.Hash(rawToken),
+		Description: req.Description,
+		Role:        req.Role,
+		Labels:      req.Labels,
+		MaxUses:     maxUses,
+		ExpiresAt:   now.Add(ttl),
+		CreatedBy:   createdBy,
+		CreatedAt:   now,
+	}
+	if err := h.store.EnrollmentTokens.Create(ctx, &token); err != nil {
+		logger.Error("Failed to create enrollment token", zap.Error(err))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create enrollment token"})
+	}
+
+	return c.JSON(http.StatusCreated, models.EnrollmentTokenResponse{
+		Token:           rawToken,
+		EnrollmentToken: token,
+	})
+}
+
+// ListEnrollmentTokens handles GET /admin/enrollment-tokens.
+// @Summary Lists enrollment tokens
+// @Description Returns all enrollment tokens with their usage history. Raw token values are never returned.
+// @Tags enrollment
+// @Produce json
+// @Success 200 {array} models.EnrollmentToken
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/enrollment-tokens [get]
+func (h *Handler) ListEnrollmentTokens(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	tokens, err := h.store.EnrollmentTokens.List(ctx)
+	if err != nil {
+		logger.Error("Failed to retrieve enrollment tokens", zap.Error(err))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to retrieve enrollment tokens"})
+	}
+	return c.JSON(http.StatusOK, tokens)
+}
+
+// RevokeEnrollmentToken handles DELETE /admin/enrollment-tokens/:token_id.
+// @Summary Revokes an enrollment token
+// @Description Prevents any further enrollments with the token. Agents already enrolled are not affected.
+// @Tags enrollment
+// @Produce json
+// @Param token_id path string true "Enrollment token ID"
+// @Success 204
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/enrollment-tokens/{token_id} [delete]
+func (h *Handler) RevokeEnrollmentToken(c echo.Context) error {
+	objID, err := primitive.ObjectIDFromHex(c.Param("token_id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid token ID format"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	if err := h.store.EnrollmentTokens.Revoke(ctx, objID); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return c.JSON(http.StatusNotFound, ErrorResponse{Error: "Enrollment token not found"})
+		}
+		logger.Error("Failed to revoke enrollment token", zap.Error(err), zap.String("token_id", objID.Hex()))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to revoke enrollment token"})
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// EnrollAgent handles POST /api/agent/enroll.
+// @Summary Enrolls a new agent with an enrollment token
+// @Description Exchanges a valid enrollment token and the agent's identity for API credentials. No prior credentials are required.
+// @Tags agent
+// @Accept json
+// @Produce json
+// @Param enrollment body models.EnrollmentRequest true "Enrollment token and agent identity"
+// @Param Idempotency-Key header string false "Key under which a retry with the same token gets the original response"
+// @Success 200 {object} models.AgentRegistrationResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /agent/enroll [post]
+func (h *Handler) EnrollAgent(c echo.Context) error {
+	var req models.EnrollmentRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid request payload"})
+	}
+	if req.Token == "" || req.UUID == "" || req.Hostname == "" || req.MacHash == "" {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "token, uuid, hostname and mac_hash are required"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	// An enrollment token must never be usable to take over an existing agent.
+	if _, err := h.store.Agents.GetByUUID(ctx, req.UUID); err == nil {
+		return c.JSON(http.StatusConflict, ErrorResponse{Error: "Agent is already registered"})
+	} else if !errors.Is(err, storage.ErrNotFound) {
+		logger.Error("Failed to look up agent", zap.Error(err), zap.String("agent_uuid", req.UUID))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to enroll agent"})
+	}
+
+	now := time.Now()
+	token, err := h.store.EnrollmentTokens.Consume(ctx, secrets.Hash(req.Token), models.EnrollmentUsage{
+		AgentUUID: req.UUID,
+		Hostname:  req.Hostname,
+		UsedAt:    now,
+	})
+	if errors.Is(err, storage.ErrNotFound) {
+		logger.Warn("Rejected enrollment token", zap.String("agent_uuid", req.UUID))
+		return c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "Invalid or expired enrollment token"})
+	}
+	if err != nil {
+		logger.Error("Failed to consume enrollment token", zap.Error(err), zap.String("agent_uuid", req.UUID))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to enroll agent"})
+	}
+
+	agent := models.Agent{
+		UUID:              req.UUID,
+		Hostname:          req.Hostname,
+		MacHash:           req.MacHash,
+		Nickname:          req.Nickname,
+		Role:              token.Role,
+		Labels:            token.Labels,
+		Status:            "active",
+		LastSeen:          now,
+		CreatedAt:         now,
+		EnrollmentTokenID: token.ID.Hex(),
+	}
+	creds, err := h.issueCredentials(&agent)
+	if err != nil {
+		logger.Error("Failed to generate API credentials", zap.Error(err), zap.String("agent_uuid", agent.UUID))
+		h.releaseEnrollmentToken(token.ID, agent.UUID)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to generate API credentials"})
+	}
+
+	if err := h.store.Agents.Create(ctx, &agent); err != nil {
+		h.releaseEnrollmentToken(token.ID, agent.UUID)
+		if errors.Is(err, storage.ErrDuplicate) {
+			return c.JSON(http.StatusConflict, ErrorResponse{Error: "Agent is already registered"})
+		}
+		logger.Error("Failed to enroll agent", zap.Error(err), zap.String("agent_uuid", agent.UUID))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to enroll agent"})
+	}
+
+	logger.Info("Agent enrolled",
+		zap.String("agent_uuid", agent.UUID),
+		zap.String("enrollment_token_id", agent.EnrollmentTokenID))
+
+	if agent.Role != "" {
+		h.createDefaultTasks(ctx, agent.UUID, agent.Role, token.CreatedBy)
+	}
+
+	return c.JSON(http.StatusOK, creds.response())
+}
+
+// releaseEnrollmentToken gives back the token use consumed by an enrollment that failed, so a
+// single-use token is not lost to an error. It runs on a fresh context, as the failure may have
+// been the request's own timeout.
+func (h *Handler) releaseEnrollmentToken(id primitive.ObjectID, agentUUID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	if err := h.store.EnrollmentTokens.Release(ctx, id, agentUUID); err != nil {
+		logger.Error("Failed to release enrollment token use", zap.Error(err),
+			zap.String("enrollment_token_id", id.Hex()), zap.String("agent_uuid", agentUUID))
+	}
+}
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 
 	"github.com/labstack/echo/v4"
@@ -34,3 +35,21 @@ func CustomHTTPErrorHandler(err error, c echo.Context) {
 		}
 	}
 }
+
+// requestError is a problem with a request body, reported to the client as a 400.
+type requestError struct {
+	message string
+}
+
+func (e *requestError) Error() string { return e.message }
+
+// writeRequestError responds with a 400 for a *requestError, and otherwise logs err and
+// responds with a 500 carrying failure.
+func writeRequestError(c echo.Context, err error, failure string) error {
+	var invalid *requestError
+	if errors.As(err, &invalid) {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: invalid.message})
+	}
+	logger.Error(failure, zap.Error(err))
+	return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: failure})
+}
@@ -0,0 +1,28 @@
+package handlers
+
+import (
+	"sync/atomic"
+
+	"github.com/whit3rabbit/beehive/manager/internal/secrets"
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
+	"github.com/whit3rabbit/beehive/manager/internal/tasktypes"
+)
+
+// Handler serves the agent, task and role endpoints on top of a storage backend.
+type Handler struct {
+	store     *storage.Store
+	secrets   *secrets.Box
+	taskTypes *tasktypes.Registry
+	dispatch  storage.DispatchPolicy
+	artifacts ArtifactLimits
+	polls     PollLimits
+	waiting   atomic.Int64 // polls currently held open
+}
+
+// NewHandler creates a Handler that reads and writes through the given store,
+// encrypts issued agent secrets with box, validates task parameters against types, hands
+// queued tasks to polling agents as dispatch orders them, holds long polls within polls and
+// accepts task artifacts up to artifacts.
+func NewHandler(store *storage.Store, box *secrets.Box, types *tasktypes.Registry, dispatch storage.DispatchPolicy, artifacts ArtifactLimits, polls PollLimits) *Handler {
+	return &Handler{store: store, secrets: box, taskTypes: types, dispatch: dispatch, artifacts: artifacts, polls: polls}
+}
@@ -0,0 +1,476 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+
+	"github.com/whit3rabbit/beehive/manager/internal/logger"
+	"github.com/whit3rabbit/beehive/manager/internal/rollout"
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+const (
+	// MaxJobTasks caps the number of agents a job may target.
+	MaxJobTasks = 10000
+	// DefaultJobPageSize is used when a job listing does not set a limit.
+	DefaultJobPageSize = 50
+	// MaxJobPageSize caps the number of jobs returned by a listing.
+	MaxJobPageSize = 200
+	// JobStragglerLimit caps the stragglers reported in the progress of a job.
+	JobStragglerLimit = 20
+)
+
+// ListJobs handles GET /admin/jobs.
+// @Summary Lists jobs
+// @Description Returns the most recent jobs, newest first.
+// @Tags admin-jobs
+// @Produce json
+// @Param limit query int false "Number of jobs, at most 200"
+// @Success 200 {object} models.JobListResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/jobs [get]
+func (h *Handler) ListJobs(c echo.Context) error {
+	limit := DefaultJobPageSize
+	if value := c.QueryParam("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > MaxJobPageSize {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("limit must be between 1 and %d", MaxJobPageSize)})
+		}
+		limit = n
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	jobs, err := h.store.Jobs.List(ctx, int64(limit))
+	if err != nil {
+		logger.Error("Failed to list jobs", zap.Error(err))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list jobs"})
+	}
+	return c.JSON(http.StatusOK, models.JobListResponse{Jobs: jobs})
+}
+
+// CreateJob handles POST /admin/jobs.
+// @Summary Creates a fan-out job
+// @Description Creates one task from the template for every agent the target selects: a list of agent UUIDs, a role, or a label selector. With a rollout policy the tasks are created wave by wave.
+// @Tags admin-jobs
+// @Accept json
+// @Produce json
+// @Param job body models.JobRequest true "Job definition"
+// @Param Idempotency-Key header string false "Key under which a retry of the request gets the original response, or resumes the job if the request failed"
+// @Success 201 {object} models.JobResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/jobs [post]
+func (h *Handler) CreateJob(c echo.Context) error {
+	var req models.JobRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid request payload"})
+	}
+	if err := h.validateTaskTemplate(&req.Task); err != nil {
+		return writeRequestError(c, err, "Failed to create job")
+	}
+	if req.Rollout != nil {
+		if err := req.Rollout.Validate(); err != nil {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	agents, err := h.jobAgents(ctx, req.Target)
+	if err != nil {
+		return writeRequestError(c, err, "Failed to create job")
+	}
+
+	now := time.Now()
+	admin, _ := c.Get("admin").(string)
+	job := models.Job{
+		Name:      req.Name,
+		Task:      req.Task,
+		Target:    req.Target,
+		TaskCount: len(agents),
+		CreatedBy: admin,
+		CreatedAt: now,
+	}
+	if job.Name == "" {
+		job.Name = job.Task.Type
+	}
+	if req.Rollout != nil {
+		rollout.Start(&job, *req.Rollout, agents, models.AdminActor(admin), now)
+	}
+	job.IdempotencyKey, _ = c.Get("idempotency_key").(string)
+	err = h.store.Jobs.Create(ctx, &job)
+	if errors.Is(err, storage.ErrDuplicate) && job.IdempotencyKey != "" {
+		// An earlier request with the key stored the job but failed to create all of its tasks
+		existing, err := h.store.Jobs.GetByIdempotencyKey(ctx, admin, job.IdempotencyKey)
+		if err == nil && existing.Rollout == nil {
+			agents, err = h.jobAgents(ctx, existing.Target)
+		}
+		if err != nil {
+			logger.Error("Failed to resume job", zap.Error(err), zap.String("name", job.Name))
+			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create job"})
+		}
+		job = *existing
+	} else if err != nil {
+		logger.Error("Failed to create job", zap.Error(err), zap.String("name", job.Name))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create job"})
+	}
+
+	wave, firstWave := 0, agents
+	if job.Rollout != nil {
+		wave, firstWave = 1, job.Rollout.Waves[0].AgentIDs
+	}
+	if _, err := rollout.CreateTasks(ctx, h.store.Tasks, &job, firstWave, wave, now); err != nil {
+		logger.Error("Failed to create job tasks", zap.Error(err), zap.String("job_id", job.ID.Hex()))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create job"})
+	}
+
+	logger.Info("Created job", zap.String("job_id", job.ID.Hex()), zap.Int("agents", len(agents)), zap.String("admin", admin))
+	return h.respondWithJob(ctx, c, http.StatusCreated, &job)
+}
+
+// GetJob handles GET /admin/jobs/:job_id.
+// @Summary Retrieves a job and its progress
+// @Description Returns the job with the number of its tasks in each status, its success ratio and the unfinished tasks that have gone longest without an update.
+// @Tags admin-jobs
+// @Produce json
+// @Param job_id path string true "Job ID"
+// @Success 200 {object} models.JobResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/jobs/{job_id} [get]
+func (h *Handler) GetJob(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	job, err := h.jobFromParam(ctx, c)
+	if job == nil {
+		return err
+	}
+	return h.respondWithJob(ctx, c, http.StatusOK, job)
+}
+
+// GetJobResults handles GET /admin/jobs/:job_id/results.
+// @Summary Lists the results of a job
+// @Description Returns one page of the status and output of the job on each agent. Pass next_cursor back as cursor to fetch the following page.
+// @Tags admin-jobs
+// @Produce json
+// @Param job_id path string true "Job ID"
+// @Param status query string false "Task status"
+// @Param limit query int false "Page size, at most 200"
+// @Param cursor query string false "Cursor returned by the previous page"
+// @Success 200 {object} models.JobResultsResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/jobs/{job_id}/results [get]
+func (h *Handler) GetJobResults(c echo.Context) error {
+	query := storage.TaskQuery{
+		Filter: storage.TaskFilter{Status: c.QueryParam("status")},
+		Cursor: c.QueryParam("cursor"),
+		Limit:  DefaultTaskPageSize,
+	}
+	if value := c.QueryParam("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > MaxTaskPageSize {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("limit must be between 1 and %d", MaxTaskPageSize)})
+		}
+		query.Limit = n
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	job, err := h.jobFromParam(ctx, c)
+	if job == nil {
+		return err
+	}
+	query.Filter.JobID = job.ID.Hex()
+
+	page, err := h.store.Tasks.List(ctx, query)
+	if errors.Is(err, storage.ErrInvalidCursor) {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid cursor"})
+	}
+	if err != nil {
+		logger.Error("Failed to list job tasks", zap.Error(err), zap.String("job_id", job.ID.Hex()))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list job results"})
+	}
+
+	resp := models.JobResultsResponse{
+		Results:    make([]models.JobResult, 0, len(page.Tasks)),
+		Total:      page.Total,
+		NextCursor: page.NextCursor,
+	}
+	for i := range page.Tasks {
+		resp.Results = append(resp.Results, models.JobResultOf(&page.Tasks[i]))
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// CancelJob handles POST /admin/jobs/:job_id/cancel.
+// @Summary Cancels a job
+// @Description Cancels every task of the job that has not finished: queued tasks are cancelled and dispatched or running ones move to cancel_requested. A rollout is aborted so no further wave starts. Cancelling a job again cancels any task left over.
+// @Tags admin-jobs
+// @Produce json
+// @Param job_id path string true "Job ID"
+// @Success 200 {object} models.JobCancelResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/jobs/{job_id}/cancel [post]
+func (h *Handler) CancelJob(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	job, err := h.jobFromParam(ctx, c)
+	if job == nil {
+		return err
+	}
+
+	now := time.Now()
+	admin, _ := c.Get("admin").(string)
+	err = h.store.Jobs.MarkCancelled(ctx, job.ID, admin, now)
+	if err != nil && !errors.Is(err, storage.ErrConflict) {
+		logger.Error("Failed to cancel job", zap.Error(err), zap.String("job_id", job.ID.Hex()))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to cancel job"})
+	}
+	if job.Rollout != nil {
+		// Stop the rollout first so that no wave starts after its tasks were cancelled
+		_, err := rollout.Abort(ctx, h.store, job.ID, models.AdminActor(admin), "job cancelled", now)
+		if err != nil && !errors.Is(err, rollout.ErrRolloutStatus) {
+			logger.Error("Failed to abort rollout", zap.Error(err), zap.String("job_id", job.ID.Hex()))
+			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to cancel job"})
+		}
+	}
+	cancelled, err := h.store.Tasks.CancelMatching(ctx, storage.TaskFilter{JobID: job.ID.Hex()}, models.AdminActor(admin), now)
+	if err != nil {
+		logger.Error("Failed to cancel job tasks", zap.Error(err), zap.String("job_id", job.ID.Hex()))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to cancel job"})
+	}
+
+	logger.Info("Cancelled job", zap.String("job_id", job.ID.Hex()), zap.Int64("cancelled", cancelled), zap.String("admin", admin))
+	return c.JSON(http.StatusOK, models.JobCancelResponse{
+		JobID:     job.ID.Hex(),
+		Cancelled: cancelled,
+		Timestamp: now,
+	})
+}
+
+// ResumeJob handles POST /admin/jobs/:job_id/resume.
+// @Summary Resumes a halted rollout
+// @Description Starts the wave after the one that halted the rollout, or completes the rollout if that wave was the last.
+// @Tags admin-jobs
+// @Produce json
+// @Param job_id path string true "Job ID"
+// @Success 200 {object} models.JobResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/jobs/{job_id}/resume [post]
+func (h *Handler) ResumeJob(c echo.Context) error {
+	return h.changeRollout(c, "resume", func(ctx context.Context, id primitive.ObjectID, admin string, now time.Time) (*models.Job, error) {
+		return rollout.Resume(ctx, h.store, id, models.AdminActor(admin), now)
+	})
+}
+
+// AbortJob handles POST /admin/jobs/:job_id/abort.
+// @Summary Aborts a rollout
+// @Description Stops a running or halted rollout from starting further waves. Tasks already dispatched keep running; cancel the job to stop them too.
+// @Tags admin-jobs
+// @Produce json
+// @Param job_id path string true "Job ID"
+// @Success 200 {object} models.JobResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/jobs/{job_id}/abort [post]
+func (h *Handler) AbortJob(c echo.Context) error {
+	return h.changeRollout(c, "abort", func(ctx context.Context, id primitive.ObjectID, admin string, now time.Time) (*models.Job, error) {
+		return rollout.Abort(ctx, h.store, id, models.AdminActor(admin), "aborted by "+admin, now)
+	})
+}
+
+// changeRollout applies a rollout operation to the job named by the job_id path parameter
+// and responds with the updated job.
+func (h *Handler) changeRollout(c echo.Context, action string, change func(context.Context, primitive.ObjectID, string, time.Time) (*models.Job, error)) error {
+	objID, err := primitive.ObjectIDFromHex(c.Param("job_id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid job ID format"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	admin, _ := c.Get("admin").(string)
+	job, err := change(ctx, objID, admin, time.Now())
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "Job not found"})
+	case errors.Is(err, rollout.ErrNoRollout):
+		return c.JSON(http.StatusConflict, ErrorResponse{Error: "Job has no rollout"})
+	case errors.Is(err, rollout.ErrRolloutStatus), errors.Is(err, storage.ErrConflict):
+		return c.JSON(http.StatusConflict, ErrorResponse{Error: fmt.Sprintf("Cannot %s a rollout that is not halted or running", action)})
+	case err != nil:
+		logger.Error("Failed to change rollout", zap.Error(err), zap.String("job_id", objID.Hex()), zap.String("action", action))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to " + action + " rollout"})
+	}
+
+	logger.Info("Changed rollout", zap.String("job_id", objID.Hex()), zap.String("action", action), zap.String("status", job.Rollout.Status), zap.String("admin", admin))
+	return h.respondWithJob(ctx, c, http.StatusOK, job)
+}
+
+// jobFromParam loads the job named by the job_id path parameter. If it cannot, it writes the
+// error response and returns a nil job with the error, if any, of writing it.
+func (h *Handler) jobFromParam(ctx context.Context, c echo.Context) (*models.Job, error) {
+	objID, err := primitive.ObjectIDFromHex(c.Param("job_id"))
+	if err != nil {
+		return nil, c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid job ID format"})
+	}
+	job, err := h.store.Jobs.Get(ctx, objID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, c.JSON(http.StatusNotFound, ErrorResponse{Error: "Job not found"})
+	}
+	if err != nil {
+		logger.Error("Failed to retrieve job", zap.Error(err), zap.String("job_id", objID.Hex()))
+		return nil, c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to retrieve job"})
+	}
+	return job, nil
+}
+
+// respondWithJob writes the job and its progress with the given status code.
+func (h *Handler) respondWithJob(ctx context.Context, c echo.Context, code int, job *models.Job) error {
+	progress, err := h.jobProgress(ctx, job)
+	if err != nil {
+		logger.Error("Failed to compute job progress", zap.Error(err), zap.String("job_id", job.ID.Hex()))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to retrieve job"})
+	}
+	return c.JSON(code, models.JobResponse{Job: *job, Progress: progress})
+}
+
+// jobProgress aggregates the tasks of the job.
+func (h *Handler) jobProgress(ctx context.Context, job *models.Job) (models.JobProgress, error) {
+	jobID := job.ID.Hex()
+	counts, err := h.store.Tasks.CountByStatus(ctx, storage.TaskFilter{JobID: jobID})
+	if err != nil {
+		return models.JobProgress{}, err
+	}
+
+	progress := models.JobProgress{Counts: counts, Stragglers: []models.JobResult{}}
+	for status, n := range counts {
+		progress.Total += n
+		if (&models.Task{Status: status}).IsFinished() {
+			progress.Finished += n
+		}
+	}
+	progress.Succeeded = counts[models.TaskStatusCompleted]
+	if progress.Finished > 0 {
+		progress.SuccessRatio = float64(progress.Succeeded) / float64(progress.Finished)
+	}
+	progress.Done = progress.Finished == progress.Total
+	if job.Rollout != nil && (job.Rollout.Status == models.RolloutRunning || job.Rollout.Status == models.RolloutHalted) {
+		// Later waves have no tasks yet
+		progress.Done = false
+	}
+	if progress.Finished == progress.Total {
+		return progress, nil
+	}
+
+	// The least recently updated unfinished tasks, whatever their status
+	var stragglers []models.Task
+	for _, status := range append([]string{models.TaskStatusQueued}, models.HeldTaskStatuses...) {
+		if counts[status] == 0 {
+			continue
+		}
+		page, err := h.store.Tasks.List(ctx, storage.TaskQuery{
+			Filter: storage.TaskFilter{JobID: jobID, Status: status},
+			SortBy: storage.TaskSortUpdatedAt,
+			Limit:  JobStragglerLimit,
+		})
+		if err != nil {
+			return progress, err
+		}
+		stragglers = append(stragglers, page.Tasks...)
+	}
+	sort.Slice(stragglers, func(i, j int) bool { return stragglers[i].UpdatedAt.Before(stragglers[j].UpdatedAt) })
+	if len(stragglers) > JobStragglerLimit {
+		stragglers = stragglers[:JobStragglerLimit]
+	}
+	for i := range stragglers {
+		progress.Stragglers = append(progress.Stragglers, models.JobResultOf(&stragglers[i]))
+	}
+	return progress, nil
+}
+
+// jobAgents returns the UUIDs of the agents a job target selects. Problems with the target
+// are returned as *requestError.
+func (h *Handler) jobAgents(ctx context.Context, target models.JobTarget) ([]string, error) {
+	set := 0
+	for _, ok := range []bool{len(target.AgentIDs) > 0, target.Role != "", len(target.Labels) > 0} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, &requestError{"Target needs exactly one of agent_ids, role and labels"}
+	}
+
+	var agents []string
+	if len(target.AgentIDs) > 0 {
+		seen := make(map[string]bool, len(target.AgentIDs))
+		for _, uuid := range target.AgentIDs {
+			if seen[uuid] {
+				continue
+			}
+			seen[uuid] = true
+			agent, err := h.store.Agents.GetByUUID(ctx, uuid)
+			if errors.Is(err, storage.ErrNotFound) {
+				return nil, &requestError{fmt.Sprintf("Unknown agent %q", uuid)}
+			}
+			if err != nil {
+				return nil, err
+			}
+			if agent.Status == models.AgentStatusDecommissioned {
+				return nil, &requestError{fmt.Sprintf("Agent %q is decommissioned", uuid)}
+			}
+			agents = append(agents, uuid)
+		}
+	} else {
+		if target.Role != "" {
+			if err := h.checkRole(ctx, target.Role); err != nil {
+				return nil, err
+			}
+		}
+		matched, err := storage.MatchingAgents(ctx, h.store.Agents, storage.AgentFilter{Role: target.Role, Labels: target.Labels})
+		if err != nil {
+			return nil, err
+		}
+		for _, agent := range matched {
+			agents = append(agents, agent.UUID)
+		}
+	}
+
+	if len(agents) == 0 {
+		return nil, &requestError{"Target matches no agents"}
+	}
+	if len(agents) > MaxJobTasks {
+		return nil, &requestError{fmt.Sprintf("Target matches more than %d agents", MaxJobTasks)}
+	}
+	return agents, nil
+}
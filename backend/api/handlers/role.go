@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"time"
 
@@ -9,11 +10,10 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/labstack/echo/v4"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
 	"github.com/whit3rabbit/beehive/manager/models"
-	"github.com/whit3rabbit/beehive/manager/internal/mongodb"
 )
 
 // ListRoles retrieves all defined roles from the database.
@@ -26,30 +26,21 @@ import (
 // @Success 200 {array} models.Role
 // @Failure 500 {object} ErrorResponse
 // @Router /roles [get]
-func ListRoles(c echo.Context) error {
-	dbName := c.Get("mongodb_database").(string)
-	collection := mongodb.Client.Database(dbName).Collection("roles")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+func (h *Handler) ListRoles(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
 	defer cancel()
 
-	cursor, err := collection.Find(ctx, bson.M{})
+	roles, err := h.store.Roles.List(ctx)
 	if err != nil {
 		logger.Error("Failed to retrieve roles", zap.Error(err))
 		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to retrieve roles"})
 	}
-	defer cursor.Close(ctx)
-
-	var roles []models.Role
-	if err = cursor.All(ctx, &roles); err != nil {
-		logger.Error("Failed to parse roles", zap.Error(err))
-		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to parse roles"})
-	}
 	return c.JSON(http.StatusOK, roles)
 }
 
 // CreateRole handles POST /roles.
 // @Summary Creates a new role
-// @Description Adds a new role to the database.
+// @Description Adds a new role to the database. Its default_tasks name task templates that are instantiated, with their default variable values, for every agent that enrolls with or is assigned the role.
 // @Tags roles
 // @Accept json
 // @Produce json
@@ -58,7 +49,7 @@ func ListRoles(c echo.Context) error {
 // @Failure 400 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Router /roles [post]
-func CreateRole(c echo.Context) error {
+func (h *Handler) CreateRole(c echo.Context) error {
 	var role models.Role
 	if err := c.Bind(&role); err != nil {
 		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid request payload"})
@@ -68,12 +59,21 @@ func CreateRole(c echo.Context) error {
 	// Generate a unique ID for the role using MongoDB's ObjectID.
 	role.ID = primitive.NewObjectID()
 
-	dbName := c.Get("mongodb_database").(string)
-	collection := mongodb.Client.Database(dbName).Collection("roles")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	if role.MaxConcurrent < 0 {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "max_concurrent must not be negative"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
 	defer cancel()
 
-	if _, err := collection.InsertOne(ctx, role); err != nil {
+	// Default tasks name templates that are created for every agent joining the role
+	for _, name := range role.DefaultTasks {
+		if err := h.checkDefaultTask(ctx, name); err != nil {
+			return writeRequestError(c, err, "Failed to create role")
+		}
+	}
+
+	if err := h.store.Roles.Create(ctx, &role); err != nil {
 		logger.Error("Failed to create role", zap.Error(err), zap.String("role_name", role.Name))
 		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create role"})
 	}
@@ -92,27 +92,38 @@ func CreateRole(c echo.Context) error {
 // @Failure 404 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Router /roles/{role_id} [get]
-func GetRole(c echo.Context) error {
+func (h *Handler) GetRole(c echo.Context) error {
 	roleID := c.Param("role_id")
 	if roleID == "" {
 		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Missing role ID"})
 	}
 
-	dbName := c.Get("mongodb_database").(string)
-	collection := mongodb.Client.Database(dbName).Collection("roles")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
 	defer cancel()
 
-	var role models.Role
 	objID, err := primitive.ObjectIDFromHex(roleID)
 	if err != nil {
 		logger.Error("Invalid role ID format", zap.Error(err), zap.String("role_id", roleID))
 		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid role ID format"})
 	}
 
-	if err := collection.FindOne(ctx, bson.M{"_id": objID}).Decode(&role); err != nil {
+	role, err := h.store.Roles.Get(ctx, objID)
+	if errors.Is(err, storage.ErrNotFound) {
 		logger.Error("Role not found", zap.Error(err), zap.String("role_id", roleID))
 		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "Role not found"})
 	}
+	if err != nil {
+		logger.Error("Failed to retrieve role", zap.Error(err), zap.String("role_id", roleID))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to retrieve role"})
+	}
 	return c.JSON(http.StatusOK, role)
 }
+
+// checkRole returns a *requestError if no role is named name.
+func (h *Handler) checkRole(ctx context.Context, name string) error {
+	_, err := h.store.Roles.GetByName(ctx, name)
+	if errors.Is(err, storage.ErrNotFound) {
+		return &requestError{"Unknown role"}
+	}
+	return err
+}
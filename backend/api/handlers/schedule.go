@@ -0,0 +1,221 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+
+	"github.com/whit3rabbit/beehive/manager/internal/logger"
+	"github.com/whit3rabbit/beehive/manager/internal/scheduler"
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+// ListSchedules handles GET /admin/schedules.
+// @Summary Lists schedules
+// @Description Returns every schedule, oldest first.
+// @Tags admin-schedules
+// @Produce json
+// @Success 200 {object} models.ScheduleListResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/schedules [get]
+func (h *Handler) ListSchedules(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	schedules, err := h.store.Schedules.List(ctx)
+	if err != nil {
+		logger.Error("Failed to list schedules", zap.Error(err))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list schedules"})
+	}
+	return c.JSON(http.StatusOK, models.ScheduleListResponse{Schedules: schedules})
+}
+
+// CreateSchedule handles POST /admin/schedules.
+// @Summary Creates a schedule
+// @Description Creates tasks from a template on a cron expression, or once at run_at, for one agent or every agent with a role or labels.
+// @Tags admin-schedules
+// @Accept json
+// @Produce json
+// @Param schedule body models.ScheduleRequest true "Schedule definition"
+// @Success 201 {object} models.Schedule
+// @Failure 400 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/schedules [post]
+func (h *Handler) CreateSchedule(c echo.Context) error {
+	var req models.ScheduleRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid request payload"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	now := time.Now()
+	schedule, err := h.scheduleFromRequest(ctx, req, now)
+	if err != nil {
+		return writeRequestError(c, err, "Failed to save schedule")
+	}
+	schedule.CreatedBy, _ = c.Get("admin").(string)
+	schedule.CreatedAt = now
+	schedule.UpdatedAt = now
+
+	if err := h.store.Schedules.Create(ctx, schedule); err != nil {
+		logger.Error("Failed to create schedule", zap.Error(err), zap.String("name", schedule.Name))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create schedule"})
+	}
+	return c.JSON(http.StatusCreated, schedule)
+}
+
+// GetSchedule handles GET /admin/schedules/:schedule_id.
+// @Summary Retrieves a schedule
+// @Tags admin-schedules
+// @Produce json
+// @Param schedule_id path string true "Schedule ID"
+// @Success 200 {object} models.Schedule
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/schedules/{schedule_id} [get]
+func (h *Handler) GetSchedule(c echo.Context) error {
+	objID, err := primitive.ObjectIDFromHex(c.Param("schedule_id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid schedule ID format"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	schedule, err := h.store.Schedules.Get(ctx, objID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "Schedule not found"})
+	}
+	if err != nil {
+		logger.Error("Failed to retrieve schedule", zap.Error(err), zap.String("schedule_id", objID.Hex()))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to retrieve schedule"})
+	}
+	return c.JSON(http.StatusOK, schedule)
+}
+
+// ReplaceSchedule handles PUT /admin/schedules/:schedule_id.
+// @Summary Replaces a schedule
+// @Description Replaces the definition of a schedule. Its next run is computed again from the current time.
+// @Tags admin-schedules
+// @Accept json
+// @Produce json
+// @Param schedule_id path string true "Schedule ID"
+// @Param schedule body models.ScheduleRequest true "Schedule definition"
+// @Success 200 {object} models.Schedule
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/schedules/{schedule_id} [put]
+func (h *Handler) ReplaceSchedule(c echo.Context) error {
+	objID, err := primitive.ObjectIDFromHex(c.Param("schedule_id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid schedule ID format"})
+	}
+	var req models.ScheduleRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid request payload"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	existing, err := h.store.Schedules.Get(ctx, objID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "Schedule not found"})
+	}
+	if err != nil {
+		logger.Error("Failed to retrieve schedule", zap.Error(err), zap.String("schedule_id", objID.Hex()))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to update schedule"})
+	}
+
+	now := time.Now()
+	schedule, err := h.scheduleFromRequest(ctx, req, now)
+	if err != nil {
+		return writeRequestError(c, err, "Failed to save schedule")
+	}
+	schedule.ID = existing.ID
+	schedule.LastRunAt = existing.LastRunAt
+	schedule.CreatedBy = existing.CreatedBy
+	schedule.CreatedAt = existing.CreatedAt
+	schedule.UpdatedAt = now
+
+	err = h.store.Schedules.Replace(ctx, schedule)
+	if errors.Is(err, storage.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "Schedule not found"})
+	}
+	if err != nil {
+		logger.Error("Failed to replace schedule", zap.Error(err), zap.String("schedule_id", objID.Hex()))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to update schedule"})
+	}
+	return c.JSON(http.StatusOK, schedule)
+}
+
+// DeleteSchedule handles DELETE /admin/schedules/:schedule_id.
+// @Summary Deletes a schedule
+// @Description Deletes a schedule. Tasks it already created are left alone.
+// @Tags admin-schedules
+// @Param schedule_id path string true "Schedule ID"
+// @Success 204
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/schedules/{schedule_id} [delete]
+func (h *Handler) DeleteSchedule(c echo.Context) error {
+	objID, err := primitive.ObjectIDFromHex(c.Param("schedule_id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid schedule ID format"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	err = h.store.Schedules.Delete(ctx, objID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "Schedule not found"})
+	}
+	if err != nil {
+		logger.Error("Failed to delete schedule", zap.Error(err), zap.String("schedule_id", objID.Hex()))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to delete schedule"})
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// scheduleFromRequest validates a schedule request and returns the schedule it describes,
+// with its next run set. Validation errors are returned as *requestError.
+func (h *Handler) scheduleFromRequest(ctx context.Context, req models.ScheduleRequest, now time.Time) (*models.Schedule, error) {
+	if err := h.validateTaskTemplate(&req.Task); err != nil {
+		return nil, err
+	}
+
+	schedule := &models.Schedule{
+		Name:     req.Name,
+		Task:     req.Task,
+		Cron:     req.Cron,
+		RunAt:    req.RunAt,
+		Timezone: req.Timezone,
+		Target:   req.Target,
+		Misfire:  req.Misfire,
+		Enabled:  req.Enabled == nil || *req.Enabled,
+	}
+	if !schedule.RunAt.IsZero() {
+		schedule.RunAt = schedule.RunAt.UTC()
+	}
+	if err := scheduler.Prepare(schedule, now); err != nil {
+		return nil, &requestError{err.Error()}
+	}
+	if schedule.Target.Role != "" {
+		if err := h.checkRole(ctx, schedule.Target.Role); err != nil {
+			return nil, err
+		}
+	}
+	return schedule, nil
+}
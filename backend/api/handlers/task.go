@@ -2,7 +2,10 @@ package handlers
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/whit3rabbit/beehive/manager/internal/logger"
@@ -11,10 +14,10 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 
 	"github.com/labstack/echo/v4"
-	"go.mongodb.org/mongo-driver/bson"
 
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
+	"github.com/whit3rabbit/beehive/manager/internal/tasktypes"
 	"github.com/whit3rabbit/beehive/manager/models"
-	"github.com/whit3rabbit/beehive/manager/internal/mongodb"
 )
 
 // TaskRequest defines the structure for task creation requests.
@@ -27,16 +30,18 @@ const MaxTaskOutputSize = 1024 * 1024 // 1MB
 
 // CreateTask handles POST /task/create.
 // @Summary Creates a new task
-// @Description Adds a new task to the database.
+// @Description Adds a new task to the database. Parameters are normalized and validated against the schema of the task type.
 // @Tags task
 // @Accept json
 // @Produce json
 // @Param task body TaskRequest true "Task object to be created"
+// @Param Idempotency-Key header string false "Key under which a retry of the request gets the original response"
 // @Success 200 {object} models.TaskCreationResponse
 // @Failure 400 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Router /task/create [post]
-func CreateTask(c echo.Context) error {
+func (h *Handler) CreateTask(c echo.Context) error {
 	var req TaskRequest
 	if err := c.Bind(&req); err != nil {
 		logger.Error("Invalid request payload", zap.Error(err))
@@ -45,12 +50,6 @@ func CreateTask(c echo.Context) error {
 
 	c.Set("body", req)
 
-	var validTaskTypes = map[string]bool{
-		"scan":    true,
-		"execute": true,
-		// add other valid types
-	}
-
 	task := req.Task
 	now := time.Now()
 	if task.CreatedAt.IsZero() {
@@ -59,28 +58,42 @@ func CreateTask(c echo.Context) error {
 	if task.UpdatedAt.IsZero() {
 		task.UpdatedAt = now
 	}
-	// Set default task status if not provided
-	if task.Status == "" {
-		task.Status = "queued"
+	// Tasks always start queued; the state machine records how they got there
+	if task.Status != "" && task.Status != models.TaskStatusQueued {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid status"})
 	}
 
 	task.ID = primitive.NewObjectID()
 
-	var validStatuses = map[string]bool{
-		"queued":    true,
-		"running":   true,
-		"completed": true,
-		"failed":    true,
-		"cancelled": true,
-	}
+	// Provenance is recorded by the manager, never taken from the request
+	task.CreatedBy, _ = c.Get("agent_uuid").(string)
+	task.RerunOf = ""
 
-	if !validStatuses[task.Status] {
-		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid status"})
+	task.Status = ""
+	task.Events = nil
+	task.Attempt = 0
+	task.Attempts = nil
+	task.NextRetryAt = time.Time{}
+	if task.Retry != nil {
+		if err := task.Retry.Validate(); err != nil {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		}
+	}
+	if err := models.ValidatePriority(task.Priority); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+	}
+	if err := task.Transition(models.TaskStatusQueued, models.AgentActor(task.CreatedBy), "created", now); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
 	}
 
-	if !validTaskTypes[task.Type] {
+	params, err := h.taskTypes.Validate(task.Type, task.Parameters)
+	if errors.Is(err, tasktypes.ErrUnknownType) {
 		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid task type"})
 	}
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+	}
+	task.Parameters = params
 
 	// Validate task output size
 	if task.Output != nil {
@@ -99,19 +112,17 @@ func CreateTask(c echo.Context) error {
 		}
 	}
 
-	dbName := c.Get("mongodb_database").(string)
-	collection := mongodb.Client.Database(dbName).Collection("tasks")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
 	defer cancel()
 
-	if _, err := collection.InsertOne(ctx, task); err != nil {
+	if err := h.store.Tasks.Create(ctx, &task); err != nil {
 		logger.Error("Failed to create task", zap.Error(err), zap.String("task_type", task.Type), zap.String("agent_id", task.AgentID))
 		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create task"})
 	}
 
 	response := models.TaskCreationResponse{
 		TaskID:    task.ID.Hex(),
-		Status:    "queued", // initial status
+		Status:    task.Status,
 		Timestamp: now,
 	}
 	return c.JSON(http.StatusOK, response)
@@ -119,7 +130,7 @@ func CreateTask(c echo.Context) error {
 
 // GetTaskStatus handles GET /task/status/:task_id.
 // @Summary Retrieves the status of a specific task
-// @Description Gets the status and output of a task based on its ID.
+// @Description Gets the status, output and status history of a task based on its ID, with its current attempt number, past attempts and next retry time.
 // @Tags task
 // @Accept json
 // @Produce json
@@ -129,15 +140,13 @@ func CreateTask(c echo.Context) error {
 // @Failure 404 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Router /task/status/{task_id} [get]
-func GetTaskStatus(c echo.Context) error {
+func (h *Handler) GetTaskStatus(c echo.Context) error {
 	taskID := c.Param("task_id")
 	if taskID == "" {
 		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Missing task ID"})
 	}
 
-	dbName := c.Get("mongodb_database").(string)
-	collection := mongodb.Client.Database(dbName).Collection("tasks")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
 	defer cancel()
 
 	objID, err := primitive.ObjectIDFromHex(taskID)
@@ -145,28 +154,38 @@ func GetTaskStatus(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid task ID format"})
 	}
 
-	var task models.Task
-	if err := collection.FindOne(ctx, bson.M{"_id": objID}).Decode(&task); err != nil {
+	task, err := h.store.Tasks.Get(ctx, objID)
+	if errors.Is(err, storage.ErrNotFound) {
 		logger.Error("Task not found", zap.Error(err), zap.String("task_id", taskID))
 		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "Task not found"})
 	}
+	if err != nil {
+		logger.Error("Failed to retrieve task", zap.Error(err), zap.String("task_id", taskID))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to retrieve task status"})
+	}
 
 	// Check for timeout
-	if task.Status == "running" && task.Timeout > 0 && !task.StartedAt.IsZero() {
+	if models.CanTransition(task.Status, models.TaskStatusTimeout) && task.Timeout > 0 && !task.StartedAt.IsZero() {
 		if time.Since(task.StartedAt) > time.Duration(task.Timeout)*time.Second {
-			// Update task status to "timeout"
-			update := bson.M{
-				"$set": bson.M{
-					"status":     "timeout",
-					"updated_at": time.Now(),
-				},
+			event := models.TaskEvent{
+				Actor:     models.ActorSystem,
+				Reason:    fmt.Sprintf("exceeded timeout of %ds", task.Timeout),
+				Timestamp: time.Now(),
 			}
-			_, err := collection.UpdateOne(ctx, bson.M{"_id": objID}, update)
-			if err != nil {
+			timedOut, err := h.store.Tasks.Transition(ctx, objID, models.TaskStatusTimeout, event)
+			switch {
+			case err == nil:
+				task = timedOut
+			case errors.Is(err, storage.ErrConflict):
+				// The task finished or was reaped since it was read
+				if task, err = h.store.Tasks.Get(ctx, objID); err != nil {
+					logger.Error("Failed to retrieve task", zap.Error(err), zap.String("task_id", taskID))
+					return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to retrieve task status"})
+				}
+			default:
 				logger.Error("Failed to update task status to timeout", zap.Error(err), zap.String("task_id", taskID))
 				return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to retrieve task status"})
 			}
-			task.Status = "timeout" // Update local task status
 		}
 	}
 
@@ -175,24 +194,24 @@ func GetTaskStatus(c echo.Context) error {
 
 // CancelTask handles POST /task/cancel/:task_id.
 // @Summary Cancels a specific task
-// @Description Updates the status of a task to "cancelled".
+// @Description Cancels a queued task outright. A dispatched or running task moves to "cancel_requested" and is listed in cancel_tasks on its agent's next heartbeat or poll, until the agent acknowledges it or the cancellation grace period ends.
 // @Tags task
 // @Accept json
 // @Produce json
 // @Param task_id path string true "Task ID"
 // @Success 200 {object} models.TaskCancelResponse
 // @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Router /task/cancel/{task_id} [post]
-func CancelTask(c echo.Context) error {
+func (h *Handler) CancelTask(c echo.Context) error {
 	taskID := c.Param("task_id")
 	if taskID == "" {
 		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Missing task ID"})
 	}
 
-	dbName := c.Get("mongodb_database").(string)
-	collection := mongodb.Client.Database(dbName).Collection("tasks")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
 	defer cancel()
 
 	objID, err := primitive.ObjectIDFromHex(taskID)
@@ -200,22 +219,421 @@ func CancelTask(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid task ID format"})
 	}
 
-	update := bson.M{
-		"$set": bson.M{
-			"status":     "cancelled",
-			"updated_at": time.Now(),
-		},
+	task, err := h.store.Tasks.Get(ctx, objID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "Task not found"})
+	}
+	if err != nil {
+		logger.Error("Failed to retrieve task", zap.Error(err), zap.String("task_id", taskID))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to cancel task"})
 	}
-	res, err := collection.UpdateOne(ctx, bson.M{"_id": objID}, update)
-	if err != nil || res.MatchedCount == 0 {
+
+	target, ok := models.CancelTarget(task.Status)
+	if !ok {
+		return c.JSON(http.StatusConflict, ErrorResponse{Error: fmt.Sprintf("Task cannot be cancelled while %s", task.Status)})
+	}
+
+	now := time.Now()
+	agentUUID, _ := c.Get("agent_uuid").(string)
+	event := models.TaskEvent{Actor: models.AgentActor(agentUUID), Timestamp: now}
+	_, err = h.store.Tasks.Transition(ctx, objID, target, event)
+	if errors.Is(err, storage.ErrConflict) {
+		// The task changed status since it was read
+		return c.JSON(http.StatusConflict, ErrorResponse{Error: transitionMessage(err)})
+	}
+	if err != nil {
 		logger.Error("Failed to cancel task", zap.Error(err), zap.String("task_id", taskID))
 		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to cancel task"})
 	}
 
 	response := models.TaskCancelResponse{
 		TaskID:    taskID,
-		Status:    "cancelled",
-		Timestamp: time.Now(),
+		Status:    target,
+		Timestamp: now,
 	}
 	return c.JSON(http.StatusOK, response)
 }
+
+// AcknowledgeCancel handles POST /task/cancel/:task_id/ack.
+// @Summary Acknowledges the cancellation of a task
+// @Description Called by the agent holding a task in "cancel_requested" once it stopped the task, which moves the task to "cancelled" with any output it produced until then.
+// @Tags task
+// @Accept json
+// @Produce json
+// @Param task_id path string true "Task ID"
+// @Param ack body models.TaskCancelAckRequest false "Partial output"
+// @Success 200 {object} models.TaskCancelResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /task/cancel/{task_id}/ack [post]
+func (h *Handler) AcknowledgeCancel(c echo.Context) error {
+	agentUUID, ok := c.Get("agent_uuid").(string)
+	if !ok || agentUUID == "" {
+		return c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "Unknown agent"})
+	}
+
+	taskID := c.Param("task_id")
+	objID, err := primitive.ObjectIDFromHex(taskID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid task ID format"})
+	}
+
+	var req models.TaskCancelAckRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid request payload"})
+	}
+	if req.Output != nil {
+		if outputSize(req.Output) > MaxTaskOutputSize {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Task output exceeds size limit"})
+		}
+		if err := models.ValidateResults(req.Output.Results); err != nil {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	now := time.Now()
+	err = h.store.Tasks.Finish(ctx, objID, agentUUID, models.TaskStatusCancelled, req.Output, now)
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "Task not found"})
+	case errors.Is(err, storage.ErrConflict):
+		return c.JSON(http.StatusConflict, ErrorResponse{Error: transitionMessage(err)})
+	case err != nil:
+		logger.Error("Failed to acknowledge task cancellation", zap.Error(err), zap.String("task_id", taskID))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to acknowledge cancellation"})
+	}
+
+	return c.JSON(http.StatusOK, models.TaskCancelResponse{TaskID: taskID, Status: models.TaskStatusCancelled, Timestamp: now})
+}
+
+// RenewTaskLease handles POST /task/lease/:task_id.
+// @Summary Renews the lease on a task
+// @Description Called by the agent holding a task to keep it for another lease period. A task whose lease expires goes back to the queue and the attempt is recorded as lost. Heartbeats renew the leases of all tasks the agent holds.
+// @Tags task
+// @Produce json
+// @Param task_id path string true "Task ID"
+// @Success 200 {object} models.TaskLeaseResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /task/lease/{task_id} [post]
+func (h *Handler) RenewTaskLease(c echo.Context) error {
+	agentUUID, ok := c.Get("agent_uuid").(string)
+	if !ok || agentUUID == "" {
+		return c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "Unknown agent"})
+	}
+
+	taskID := c.Param("task_id")
+	objID, err := primitive.ObjectIDFromHex(taskID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid task ID format"})
+	}
+	if h.dispatch.Lease <= 0 {
+		return c.JSON(http.StatusConflict, ErrorResponse{Error: "Task leases are disabled"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	until := time.Now().Add(h.dispatch.Lease)
+	err = h.store.Tasks.RenewLease(ctx, objID, agentUUID, until)
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		// Also when the lease expired and the task went back to the queue
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "Task not found"})
+	case err != nil:
+		logger.Error("Failed to renew task lease", zap.Error(err), zap.String("task_id", taskID))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to renew task lease"})
+	}
+
+	return c.JSON(http.StatusOK, models.TaskLeaseResponse{TaskID: taskID, LeaseExpiresAt: until})
+}
+
+// Long poll caps used when PollLimits leaves them unset.
+const (
+	DefaultMaxPollWait     = 30 * time.Second
+	DefaultMaxWaitingPolls = 1000
+)
+
+// pollRecheckInterval is how often a held poll looks for a task without being woken, so that
+// retries whose backoff ends are still picked up.
+const pollRecheckInterval = 10 * time.Second
+
+// PollLimits caps the polls held open until a task is available. Zero values use the defaults.
+type PollLimits struct {
+	// MaxWait caps how long one poll is held.
+	MaxWait time.Duration
+	// MaxWaiting caps how many polls are held at once; further polls answer at once.
+	MaxWaiting int
+}
+
+func (l PollLimits) maxWait() time.Duration {
+	if l.MaxWait > 0 {
+		return l.MaxWait
+	}
+	return DefaultMaxPollWait
+}
+
+func (l PollLimits) maxWaiting() int64 {
+	if l.MaxWaiting > 0 {
+		return int64(l.MaxWaiting)
+	}
+	return DefaultMaxWaitingPolls
+}
+
+// PollTask handles GET /task/poll.
+// @Summary Claims the next queued task for the calling agent
+// @Description Atomically moves the next queued task assigned to the authenticated agent to "dispatched" and returns it. Higher priority tasks go first; tasks of equal priority are shared out between jobs and submitters by weight, oldest first within each. No task is returned while the agent holds as many tasks as its concurrency limits allow. cancel_tasks lists the tasks the agent holds that were cancelled and should be stopped. When task leases are enabled, the task carries lease_expires_at, by which the agent must renew the lease or lose the task. With wait, the request is held until there is a task or a cancellation for the agent, or until wait seconds pass; wait is capped by the server, and polls beyond the server's limit on held polls answer at once.
+// @Tags task
+// @Accept json
+// @Produce json
+// @Param wait query int false "Seconds to wait for a task when none is queued"
+// @Success 200 {object} models.TaskPollResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /task/poll [get]
+func (h *Handler) PollTask(c echo.Context) error {
+	agentUUID, ok := c.Get("agent_uuid").(string)
+	if !ok || agentUUID == "" {
+		return c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "Unknown agent"})
+	}
+
+	var wait time.Duration
+	if raw := c.QueryParam("wait"); raw != "" {
+		seconds, err := strconv.Atoi(raw)
+		if err != nil || seconds < 0 {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid wait"})
+		}
+		wait = min(time.Duration(seconds)*time.Second, h.polls.maxWait())
+	}
+	deadline := time.Now().Add(wait)
+
+	// Subscribe before the first claim so that a task queued in between is not missed
+	var wake <-chan struct{}
+	if wait > 0 && h.store.TaskChanges != nil {
+		if h.waiting.Add(1) <= h.polls.maxWaiting() {
+			var stop func()
+			wake, stop = h.store.TaskChanges.Subscribe(agentUUID)
+			defer stop()
+		}
+		defer h.waiting.Add(-1)
+	}
+
+	for {
+		response, err := h.claimTask(agentUUID)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to poll for task"})
+		}
+		remaining := time.Until(deadline)
+		if response.Task != nil || len(response.CancelTasks) > 0 || wake == nil || remaining <= 0 {
+			return c.JSON(http.StatusOK, response)
+		}
+
+		timer := time.NewTimer(min(remaining, pollRecheckInterval))
+		select {
+		case <-wake:
+		case <-timer.C:
+		case <-c.Request().Context().Done():
+			// The agent went away; stop before claiming a task it would never receive
+			timer.Stop()
+			return nil
+		}
+		timer.Stop()
+	}
+}
+
+// claimTask claims the next task the agent may run, and lists the tasks it should stop.
+func (h *Handler) claimTask(agentUUID string) (models.TaskPollResponse, error) {
+	var response models.TaskPollResponse
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	agent, err := h.store.Agents.GetByUUID(ctx, agentUUID)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		logger.Error("Failed to retrieve agent", zap.Error(err), zap.String("agent_uuid", agentUUID))
+		return response, err
+	}
+	policy := h.dispatch
+	if policy.Limits, err = h.concurrencyLimits(ctx, agent); err != nil {
+		logger.Error("Failed to look up concurrency limits", zap.Error(err), zap.String("agent_uuid", agentUUID))
+		return response, err
+	}
+
+	if response.CancelTasks, err = h.cancelRequested(ctx, agentUUID); err != nil {
+		logger.Error("Failed to look up cancelled tasks", zap.Error(err), zap.String("agent_uuid", agentUUID))
+		return response, err
+	}
+
+	task, err := h.store.Tasks.ClaimNext(ctx, agentUUID, policy, time.Now())
+	if errors.Is(err, storage.ErrNotFound) {
+		return response, nil
+	}
+	if err != nil {
+		logger.Error("Failed to claim task", zap.Error(err), zap.String("agent_uuid", agentUUID))
+		return response, err
+	}
+
+	response.Task = task.ToAgentTask()
+	return response, nil
+}
+
+// cancelRequested returns the IDs of the tasks the agent holds that were cancelled, for it to stop.
+func (h *Handler) cancelRequested(ctx context.Context, agentUUID string) ([]string, error) {
+	ids, err := h.store.Tasks.CancelRequested(ctx, agentUUID)
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	taskIDs := make([]string, len(ids))
+	for i, id := range ids {
+		taskIDs[i] = id.Hex()
+	}
+	return taskIDs, nil
+}
+
+// concurrencyLimits returns how many tasks the agent may hold: the lower of its own limit and
+// its role's in all, and the limit of each task type. A nil agent only has the type limits.
+func (h *Handler) concurrencyLimits(ctx context.Context, agent *models.Agent) (storage.ConcurrencyLimits, error) {
+	limits := storage.ConcurrencyLimits{PerType: h.taskTypes.Limits()}
+	if agent == nil {
+		return limits, nil
+	}
+	limits.Max = agent.MaxConcurrent
+	if agent.Role == "" {
+		return limits, nil
+	}
+	role, err := h.store.Roles.GetByName(ctx, agent.Role)
+	if errors.Is(err, storage.ErrNotFound) {
+		return limits, nil
+	}
+	if err != nil {
+		return limits, err
+	}
+	if role.MaxConcurrent > 0 && (limits.Max == 0 || role.MaxConcurrent < limits.Max) {
+		limits.Max = role.MaxConcurrent
+	}
+	return limits, nil
+}
+
+// UpdateTask handles POST /task/update.
+// @Summary Reports progress or the result of a claimed task
+// @Description Marks a task claimed by the authenticated agent as running, or stores its output and finalizes its status. Typed results in the output are checked against the result schema of the task type, if it declares one.
+// @Tags task
+// @Accept json
+// @Produce json
+// @Param update body models.TaskUpdateRequest true "Task result"
+// @Success 200 {object} models.TaskUpdateResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /task/update [post]
+func (h *Handler) UpdateTask(c echo.Context) error {
+	agentUUID, ok := c.Get("agent_uuid").(string)
+	if !ok || agentUUID == "" {
+		return c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "Unknown agent"})
+	}
+
+	var req models.TaskUpdateRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid request payload"})
+	}
+
+	var finalStatus string
+	switch req.Status {
+	case "running":
+	case "success":
+		finalStatus = models.TaskStatusCompleted
+	case "failure":
+		finalStatus = models.TaskStatusFailed
+	default:
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid status"})
+	}
+
+	if finalStatus != "" && req.Output == nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Missing task output"})
+	}
+	if req.Output != nil {
+		if size := outputSize(req.Output); size > MaxTaskOutputSize {
+			logger.Error("Task output exceeds size limit",
+				zap.Int("output_size", size),
+				zap.Int("max_size", MaxTaskOutputSize))
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Task output exceeds size limit"})
+		}
+		if err := models.ValidateResults(req.Output.Results); err != nil {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		}
+	}
+
+	objID, err := primitive.ObjectIDFromHex(req.TaskID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid task ID format"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	// Successful tasks must report the results their type declares; failed ones may report none
+	if finalStatus == models.TaskStatusCompleted || (finalStatus != "" && len(req.Output.Results) > 0) {
+		task, err := h.store.Tasks.Get(ctx, objID)
+		if errors.Is(err, storage.ErrNotFound) || (err == nil && task.AgentID != agentUUID) {
+			return c.JSON(http.StatusNotFound, ErrorResponse{Error: "Task not found"})
+		}
+		if err != nil {
+			logger.Error("Failed to retrieve task", zap.Error(err), zap.String("task_id", req.TaskID))
+			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to update task"})
+		}
+		if err := h.taskTypes.ValidateResults(task.Type, models.ResultValues(req.Output.Results)); err != nil {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		}
+	}
+
+	if finalStatus == "" {
+		err = h.store.Tasks.Start(ctx, objID, agentUUID, time.Now())
+	} else {
+		err = h.store.Tasks.Finish(ctx, objID, agentUUID, finalStatus, req.Output, time.Now())
+	}
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "Task not found"})
+	case errors.Is(err, storage.ErrConflict):
+		return c.JSON(http.StatusConflict, ErrorResponse{Error: transitionMessage(err)})
+	case err != nil:
+		logger.Error("Failed to update task", zap.Error(err), zap.String("task_id", req.TaskID))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to update task"})
+	}
+
+	return c.JSON(http.StatusOK, models.TaskUpdateResponse{Status: "acknowledged"})
+}
+
+// outputSize is the size of the text in output that counts towards MaxTaskOutputSize.
+func outputSize(output *models.Output) int {
+	size := len(output.Logs) + len(output.Error)
+	for _, result := range output.Results {
+		if text, ok := result.Value.(string); ok {
+			size += len(text)
+		}
+	}
+	return size
+}
+
+// transitionMessage describes a storage conflict caused by the task state machine.
+func transitionMessage(err error) string {
+	var transition *models.TransitionError
+	if errors.As(err, &transition) {
+		if transition.From == models.TaskStatusCancelled {
+			return "Task was cancelled"
+		}
+		return fmt.Sprintf("Task cannot move from %q to %q", transition.From, transition.To)
+	}
+	return "Task status does not allow this change"
+}
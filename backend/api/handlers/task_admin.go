@@ -0,0 +1,282 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+
+	"github.com/whit3rabbit/beehive/manager/internal/logger"
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+const (
+	// DefaultTaskPageSize is used when a task listing does not set a limit.
+	DefaultTaskPageSize = 50
+	// MaxTaskPageSize caps the number of tasks returned per page.
+	MaxTaskPageSize = 200
+)
+
+// ListTasks handles GET /admin/tasks.
+// @Summary Lists and searches tasks
+// @Description Returns one page of tasks matching the filters, newest first by default. Pass next_cursor back as cursor to fetch the following page.
+// @Tags admin-tasks
+// @Produce json
+// @Param agent_id query string false "Agent UUID"
+// @Param job_id query string false "Job ID"
+// @Param workflow_run_id query string false "Workflow run ID"
+// @Param type query string false "Task type"
+// @Param status query string false "Task status"
+// @Param created_by query string false "Admin username or agent UUID that created the task"
+// @Param created_after query string false "RFC 3339 timestamp"
+// @Param created_before query string false "RFC 3339 timestamp"
+// @Param updated_after query string false "RFC 3339 timestamp"
+// @Param updated_before query string false "RFC 3339 timestamp"
+// @Param q query string false "Case-insensitive text searched in parameter keys and values"
+// @Param sort query string false "created_at or updated_at"
+// @Param order query string false "asc or desc (default)"
+// @Param limit query int false "Page size, at most 200"
+// @Param cursor query string false "Cursor returned by the previous page"
+// @Success 200 {object} models.TaskListResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/tasks [get]
+func (h *Handler) ListTasks(c echo.Context) error {
+	query, err := parseTaskQuery(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	page, err := h.store.Tasks.List(ctx, query)
+	if errors.Is(err, storage.ErrInvalidCursor) {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid cursor"})
+	}
+	if err != nil {
+		logger.Error("Failed to list tasks", zap.Error(err))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list tasks"})
+	}
+
+	return c.JSON(http.StatusOK, models.TaskListResponse{
+		Tasks:      page.Tasks,
+		Total:      page.Total,
+		NextCursor: page.NextCursor,
+	})
+}
+
+// parseTaskQuery builds a storage query from the ListTasks query parameters.
+func parseTaskQuery(c echo.Context) (storage.TaskQuery, error) {
+	query := storage.TaskQuery{
+		Filter: storage.TaskFilter{
+			AgentID:       c.QueryParam("agent_id"),
+			JobID:         c.QueryParam("job_id"),
+			WorkflowRunID: c.QueryParam("workflow_run_id"),
+			Type:          c.QueryParam("type"),
+			Status:        c.QueryParam("status"),
+			CreatedBy:     c.QueryParam("created_by"),
+			Text:          c.QueryParam("q"),
+		},
+		SortBy:   c.QueryParam("sort"),
+		SortDesc: true,
+		Cursor:   c.QueryParam("cursor"),
+		Limit:    DefaultTaskPageSize,
+	}
+
+	var err error
+	for name, target := range map[string]*time.Time{
+		"created_after":  &query.Filter.CreatedAfter,
+		"created_before": &query.Filter.CreatedBefore,
+		"updated_after":  &query.Filter.UpdatedAfter,
+		"updated_before": &query.Filter.UpdatedBefore,
+	} {
+		if *target, err = parseTimeParam(c, name); err != nil {
+			return query, err
+		}
+	}
+
+	if query.SortBy != "" && !storage.ValidTaskSortField(query.SortBy) {
+		return query, errors.New("Invalid sort field")
+	}
+	switch c.QueryParam("order") {
+	case "", "desc":
+	case "asc":
+		query.SortDesc = false
+	default:
+		return query, errors.New("Invalid sort order")
+	}
+
+	if limit := c.QueryParam("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > MaxTaskPageSize {
+			return query, errors.New("Invalid limit")
+		}
+		query.Limit = n
+	}
+	return query, nil
+}
+
+// BulkCancelTasks handles POST /admin/tasks/cancel.
+// @Summary Cancels all active tasks matching a filter
+// @Description Cancels the queued tasks matching the filter and requests cancellation of the dispatched and running ones. An empty filter is rejected unless "all" is set.
+// @Tags admin-tasks
+// @Accept json
+// @Produce json
+// @Param filter body models.TaskBulkCancelRequest true "Tasks to cancel"
+// @Success 200 {object} models.TaskBulkCancelResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/tasks/cancel [post]
+func (h *Handler) BulkCancelTasks(c echo.Context) error {
+	var req models.TaskBulkCancelRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid request payload"})
+	}
+
+	filter := bulkTaskFilter(&req)
+	if filter.IsEmpty() && !req.All {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Refusing to cancel every task without \"all\": true"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	now := time.Now()
+	admin, _ := c.Get("admin").(string)
+	cancelled, err := h.store.Tasks.CancelMatching(ctx, filter, models.AdminActor(admin), now)
+	if err != nil {
+		logger.Error("Failed to cancel tasks", zap.Error(err))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to cancel tasks"})
+	}
+
+	logger.Info("Bulk cancelled tasks", zap.Int64("cancelled", cancelled), zap.String("admin", admin))
+	return c.JSON(http.StatusOK, models.TaskBulkCancelResponse{Cancelled: cancelled, Timestamp: now})
+}
+
+// BulkSetTaskPriority handles POST /admin/tasks/priority.
+// @Summary Changes the priority of queued tasks matching a filter
+// @Description Sets the priority of the queued tasks matching the filter, from -100 to 100. Tasks already handed to an agent keep theirs. An empty filter is rejected unless "all" is set.
+// @Tags admin-tasks
+// @Accept json
+// @Produce json
+// @Param filter body models.TaskPriorityRequest true "Tasks to change and their new priority"
+// @Success 200 {object} models.TaskPriorityResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/tasks/priority [post]
+func (h *Handler) BulkSetTaskPriority(c echo.Context) error {
+	var req models.TaskPriorityRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid request payload"})
+	}
+	if req.Priority == nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Priority is required"})
+	}
+	if err := models.ValidatePriority(*req.Priority); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+	}
+
+	filter := bulkTaskFilter(&req.TaskBulkCancelRequest)
+	if filter.IsEmpty() && !req.All {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Refusing to change every queued task without \"all\": true"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	now := time.Now()
+	admin, _ := c.Get("admin").(string)
+	updated, err := h.store.Tasks.SetPriority(ctx, filter, *req.Priority, now)
+	if err != nil {
+		logger.Error("Failed to change task priorities", zap.Error(err))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to change task priorities"})
+	}
+
+	logger.Info("Changed task priorities", zap.Int64("updated", updated), zap.Int("priority", *req.Priority), zap.String("admin", admin))
+	return c.JSON(http.StatusOK, models.TaskPriorityResponse{Updated: updated, Timestamp: now})
+}
+
+// bulkTaskFilter returns the task filter described by the body of a bulk task endpoint.
+func bulkTaskFilter(req *models.TaskBulkCancelRequest) storage.TaskFilter {
+	return storage.TaskFilter{
+		AgentID:       req.AgentID,
+		JobID:         req.JobID,
+		Type:          req.Type,
+		Status:        req.Status,
+		CreatedBy:     req.CreatedBy,
+		CreatedAfter:  req.CreatedAfter,
+		CreatedBefore: req.CreatedBefore,
+		UpdatedAfter:  req.UpdatedAfter,
+		UpdatedBefore: req.UpdatedBefore,
+		Text:          req.Query,
+	}
+}
+
+// RerunTask handles POST /admin/tasks/:task_id/rerun.
+// @Summary Re-runs a finished task
+// @Description Queues a copy of a finished task for the same agent. The copy records the original in rerun_of.
+// @Tags admin-tasks
+// @Produce json
+// @Param task_id path string true "Task ID"
+// @Success 201 {object} models.TaskCreationResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/tasks/{task_id}/rerun [post]
+func (h *Handler) RerunTask(c echo.Context) error {
+	taskID := c.Param("task_id")
+	objID, err := primitive.ObjectIDFromHex(taskID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid task ID format"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	original, err := h.store.Tasks.Get(ctx, objID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "Task not found"})
+	}
+	if err != nil {
+		logger.Error("Failed to retrieve task", zap.Error(err), zap.String("task_id", taskID))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to re-run task"})
+	}
+	if !original.IsFinished() {
+		return c.JSON(http.StatusConflict, ErrorResponse{Error: "Only finished tasks can be re-run"})
+	}
+
+	now := time.Now()
+	admin, _ := c.Get("admin").(string)
+	rerun := models.Task{
+		AgentID:    original.AgentID,
+		Type:       original.Type,
+		Parameters: original.Parameters,
+		Timeout:    original.Timeout,
+		Retry:      original.Retry,
+		Priority:   original.Priority,
+		CreatedAt:  now,
+		CreatedBy:  admin,
+		RerunOf:    original.ID.Hex(),
+	}
+	if err := rerun.Transition(models.TaskStatusQueued, models.AdminActor(admin), "rerun of "+rerun.RerunOf, now); err != nil {
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to re-run task"})
+	}
+	if err := h.store.Tasks.Create(ctx, &rerun); err != nil {
+		logger.Error("Failed to create task", zap.Error(err), zap.String("rerun_of", taskID))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to re-run task"})
+	}
+
+	return c.JSON(http.StatusCreated, models.TaskCreationResponse{
+		TaskID:    rerun.ID.Hex(),
+		Status:    rerun.Status,
+		Timestamp: now,
+	})
+}
@@ -0,0 +1,299 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+
+	"github.com/whit3rabbit/beehive/manager/internal/logger"
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+// MaxLogChunkSize is the largest log chunk an agent may append at once (in bytes). A task log
+// has no overall limit.
+const MaxLogChunkSize = 256 * 1024 // 256KB
+
+// MaxLogPageSize is the largest number of log chunks returned by one request.
+const MaxLogPageSize = 1000
+
+// LogFollowInterval is how often a followed task log is checked for new chunks.
+var LogFollowInterval = time.Second
+
+// LogGapTimeout is how long a followed task log waits for a missing chunk below chunks it
+// already sent before it moves on without it.
+var LogGapTimeout = 30 * time.Second
+
+// AppendTaskLog handles POST /task/logs/:task_id.
+// @Summary Appends a chunk to the log of a task
+// @Description Stores a chunk of the stdout or stderr of a task held by the authenticated agent. Chunks are numbered by the agent from 0 for each attempt; resending a sequence number is acknowledged without storing it again.
+// @Tags task
+// @Accept json
+// @Produce json
+// @Param task_id path string true "Task ID"
+// @Param chunk body models.TaskLogAppendRequest true "Log chunk"
+// @Success 200 {object} models.TaskLogAppendResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /task/logs/{task_id} [post]
+func (h *Handler) AppendTaskLog(c echo.Context) error {
+	agentUUID, ok := c.Get("agent_uuid").(string)
+	if !ok || agentUUID == "" {
+		return c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "Unknown agent"})
+	}
+	taskID := c.Param("task_id")
+	objID, err := primitive.ObjectIDFromHex(taskID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid task ID format"})
+	}
+
+	var req models.TaskLogAppendRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid request payload"})
+	}
+	if req.Sequence == nil || *req.Sequence < 0 {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid sequence number"})
+	}
+	switch req.Stream {
+	case "":
+		req.Stream = models.LogStreamStdout
+	case models.LogStreamStdout, models.LogStreamStderr:
+	default:
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid log stream"})
+	}
+	if len(req.Data) > MaxLogChunkSize {
+		logger.Error("Log chunk exceeds size limit",
+			zap.Int("chunk_size", len(req.Data)),
+			zap.Int("max_size", MaxLogChunkSize))
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Log chunk exceeds size limit"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	task, err := h.store.Tasks.Get(ctx, objID)
+	if errors.Is(err, storage.ErrNotFound) || (err == nil && task.AgentID != agentUUID) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "Task not found"})
+	}
+	if err != nil {
+		logger.Error("Failed to retrieve task", zap.Error(err), zap.String("task_id", taskID))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to append log"})
+	}
+	// Logs may trail the final update, but only once the agent has claimed the task
+	if task.Attempt == 0 {
+		return c.JSON(http.StatusConflict, ErrorResponse{Error: "Task has not been dispatched"})
+	}
+
+	chunk := models.TaskLogChunk{
+		TaskID:    objID,
+		AgentID:   agentUUID,
+		Attempt:   task.Attempt,
+		Sequence:  *req.Sequence,
+		Stream:    req.Stream,
+		Data:      req.Data,
+		CreatedAt: time.Now(),
+	}
+	resp := models.TaskLogAppendResponse{TaskID: taskID, Sequence: chunk.Sequence}
+	err = h.store.TaskLogs.Append(ctx, &chunk)
+	if errors.Is(err, storage.ErrDuplicate) {
+		resp.Duplicate = true
+		return c.JSON(http.StatusOK, resp)
+	}
+	if err != nil {
+		logger.Error("Failed to append log", zap.Error(err), zap.String("task_id", taskID))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to append log"})
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// GetTaskLog handles GET /admin/tasks/:task_id/logs.
+// @Summary Reads the log of a task
+// @Description Returns the log chunks of a task attempt from a sequence number on. With follow=true the chunks are streamed as Server-Sent Events until the attempt has ended and its log is read.
+// @Tags admin-tasks
+// @Produce json
+// @Produce text/event-stream
+// @Param task_id path string true "Task ID"
+// @Param attempt query int false "Attempt, defaults to the current one"
+// @Param from query int false "First sequence number, defaults to 0"
+// @Param limit query int false "Chunks per page, at most 1000"
+// @Param follow query bool false "Stream new chunks as Server-Sent Events"
+// @Success 200 {object} models.TaskLogResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/tasks/{task_id}/logs [get]
+func (h *Handler) GetTaskLog(c echo.Context) error {
+	taskID := c.Param("task_id")
+	objID, err := primitive.ObjectIDFromHex(taskID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid task ID format"})
+	}
+
+	params := map[string]int64{"attempt": 0, "from": 0, "limit": MaxLogPageSize}
+	for name := range params {
+		if value := c.QueryParam(name); value != "" {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 0 || (name == "limit" && (n < 1 || n > MaxLogPageSize)) {
+				return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid " + name})
+			}
+			params[name] = n
+		}
+	}
+	from := params["from"]
+	// A reconnecting event stream resumes after the last chunk it received
+	if lastID := c.Request().Header.Get("Last-Event-ID"); lastID != "" {
+		if n, err := strconv.ParseInt(lastID, 10, 64); err == nil {
+			from = n + 1
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	task, err := h.store.Tasks.Get(ctx, objID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "Task not found"})
+	}
+	if err != nil {
+		logger.Error("Failed to retrieve task", zap.Error(err), zap.String("task_id", taskID))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to retrieve task log"})
+	}
+	attempt := int(params["attempt"])
+	if attempt == 0 {
+		attempt = task.Attempt
+	}
+
+	if c.QueryParam("follow") == "true" {
+		return h.followTaskLog(c, objID, attempt, from)
+	}
+
+	chunks, err := h.store.TaskLogs.List(ctx, objID, attempt, from, int(params["limit"]))
+	if err != nil {
+		logger.Error("Failed to list task log", zap.Error(err), zap.String("task_id", taskID))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to retrieve task log"})
+	}
+	resp := models.TaskLogResponse{Attempt: attempt, Chunks: chunks, NextSequence: from}
+	if len(chunks) > 0 {
+		resp.NextSequence = chunks[len(chunks)-1].Sequence + 1
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// followTaskLog streams the log of the attempt of the task as Server-Sent Events, one "stdout"
+// or "stderr" event per chunk with the sequence number as event ID. It sends an "end" event
+// once the attempt has ended and every chunk stored by then was sent, and stops early when the
+// client goes away.
+//
+// Appends may commit out of order, so a chunk can show up below one already sent. Each check
+// re-reads the log from the lowest sequence number not sent yet and skips the chunks it sent.
+// A gap the agent leaves unfilled for LogGapTimeout, or below more than a page of sent chunks,
+// is given up on so that the checks and what they remember stay bounded.
+func (h *Handler) followTaskLog(c echo.Context, taskID primitive.ObjectID, attempt int, from int64) error {
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set(echo.HeaderCacheControl, "no-cache")
+	res.Header().Set(echo.HeaderConnection, "keep-alive")
+	res.WriteHeader(http.StatusOK)
+	res.Flush()
+
+	done := c.Request().Context().Done()
+	sent := make(map[int64]bool) // sequences above from that were sent
+	next := from                 // one past the highest sequence sent
+	var gapSince time.Time       // when the chunk at from was found missing below sent chunks
+	for {
+		// The attempt must have ended before the first page is read for its log to be complete
+		ended := false
+		for cursor, first := from, true; ; first = false {
+			pageEnded, chunks, err := h.readTaskLog(taskID, attempt, cursor)
+			if err != nil {
+				logger.Error("Failed to follow task log", zap.Error(err), zap.String("task_id", taskID.Hex()))
+				fmt.Fprintf(res, "event: error\ndata: %q\n\n", "Failed to retrieve task log")
+				res.Flush()
+				return nil
+			}
+			if first {
+				ended = pageEnded
+			}
+			for _, chunk := range chunks {
+				cursor = chunk.Sequence + 1
+				if sent[chunk.Sequence] {
+					continue
+				}
+				data, _ := json.Marshal(chunk)
+				fmt.Fprintf(res, "id: %d\nevent: %s\ndata: %s\n\n", chunk.Sequence, chunk.Stream, data)
+				sent[chunk.Sequence] = true
+				if cursor > next {
+					next = cursor
+				}
+			}
+			if len(chunks) < MaxLogPageSize {
+				break
+			}
+		}
+		from = skipSent(sent, from)
+		switch {
+		case len(sent) == 0:
+			gapSince = time.Time{}
+		case gapSince.IsZero():
+			gapSince = time.Now()
+		}
+		for len(sent) > 0 && (time.Since(gapSince) >= LogGapTimeout || len(sent) > MaxLogPageSize) {
+			// Move on to the lowest chunk sent above the gap; a chunk filling it later is not sent
+			from = -1
+			for seq := range sent {
+				if from < 0 || seq < from {
+					from = seq
+				}
+			}
+			from = skipSent(sent, from)
+			gapSince = time.Now()
+		}
+		res.Flush()
+
+		if ended {
+			fmt.Fprintf(res, "event: end\ndata: {\"next_sequence\":%d}\n\n", next)
+			res.Flush()
+			return nil
+		}
+		select {
+		case <-done:
+			return nil
+		case <-time.After(LogFollowInterval):
+		}
+	}
+}
+
+// skipSent forgets the chunks sent from from on without a gap and returns the first sequence
+// after them.
+func skipSent(sent map[int64]bool, from int64) int64 {
+	for sent[from] {
+		delete(sent, from)
+		from++
+	}
+	return from
+}
+
+// readTaskLog returns the next page of the log of the attempt of the task, and whether the
+// attempt had ended before the page was read.
+func (h *Handler) readTaskLog(taskID primitive.ObjectID, attempt int, from int64) (bool, []models.TaskLogChunk, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	task, err := h.store.Tasks.Get(ctx, taskID)
+	if err != nil {
+		return false, nil, err
+	}
+	ended := task.Attempt != attempt || !models.IsHeldStatus(task.Status)
+	chunks, err := h.store.TaskLogs.List(ctx, taskID, attempt, from, MaxLogPageSize)
+	return ended, chunks, err
+}
@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+
+	"github.com/whit3rabbit/beehive/manager/internal/logger"
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+const (
+	// DefaultResultQueryLimit is used when a result query does not set a limit.
+	DefaultResultQueryLimit = 100
+	// MaxResultQueryLimit caps the number of tasks or groups a result query returns.
+	MaxResultQueryLimit = 1000
+)
+
+// QueryTaskResults handles POST /admin/tasks/results.
+// @Summary Queries and aggregates the typed results of tasks
+// @Description Selects tasks by the filter fields of a bulk cancellation and by conditions on their results, such as {"field": "open_ports", "op": "gt", "value": 0}. Without group_by or aggregates the matching tasks are listed with their results, most recently updated first; otherwise they are counted per group and the aggregates are computed over each group's numeric results.
+// @Tags admin-tasks
+// @Accept json
+// @Produce json
+// @Param query body models.TaskResultQueryRequest true "Result query"
+// @Success 200 {object} models.TaskResultQueryResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/tasks/results [post]
+func (h *Handler) QueryTaskResults(c echo.Context) error {
+	var req models.TaskResultQueryRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid request payload"})
+	}
+	if req.Limit == 0 {
+		req.Limit = DefaultResultQueryLimit
+	}
+	if req.Limit < 1 || req.Limit > MaxResultQueryLimit {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid limit"})
+	}
+
+	query := storage.ResultQuery{
+		Filter:  bulkTaskFilter(&req.TaskBulkCancelRequest),
+		GroupBy: req.GroupBy,
+		Limit:   req.Limit,
+	}
+	for _, cond := range req.Where {
+		query.Where = append(query.Where, storage.ResultCondition{Field: cond.Field, Op: cond.Op, Value: cond.Value})
+	}
+	for _, agg := range req.Aggregates {
+		query.Aggregates = append(query.Aggregates, storage.ResultAggregate{Field: agg.Field, Op: agg.Op})
+	}
+	if err := storage.ValidateResultQuery(query); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	if query.GroupBy == "" && len(query.Aggregates) == 0 {
+		tasks, err := h.store.Tasks.QueryResults(ctx, query)
+		if err != nil {
+			logger.Error("Failed to query task results", zap.Error(err))
+			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to query task results"})
+		}
+		resp := models.TaskResultQueryResponse{Tasks: make([]models.TaskResultRow, len(tasks))}
+		for i, task := range tasks {
+			row := models.TaskResultRow{
+				TaskID:    task.ID.Hex(),
+				AgentID:   task.AgentID,
+				Type:      task.Type,
+				Status:    task.Status,
+				JobID:     task.JobID,
+				UpdatedAt: task.UpdatedAt,
+				Results:   map[string]models.TaskOutput{},
+			}
+			if task.Output != nil && task.Output.Results != nil {
+				row.Results = task.Output.Results
+			}
+			resp.Tasks[i] = row
+		}
+		return c.JSON(http.StatusOK, resp)
+	}
+
+	groups, err := h.store.Tasks.AggregateResults(ctx, query)
+	if err != nil {
+		logger.Error("Failed to aggregate task results", zap.Error(err))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to query task results"})
+	}
+	resp := models.TaskResultQueryResponse{Groups: make([]models.TaskResultGroup, len(groups))}
+	for i, group := range groups {
+		resp.Groups[i] = models.TaskResultGroup{Key: group.Key, Count: group.Count, Values: group.Values}
+	}
+	return c.JSON(http.StatusOK, resp)
+}
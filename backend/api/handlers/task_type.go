@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/whit3rabbit/beehive/manager/internal/tasktypes"
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+// ListTaskTypes handles GET /admin/task-types.
+// @Summary Lists the registered task types
+// @Description Returns every task type tasks can be created with, the JSON Schema its parameters must match and, if it declares one, the JSON Schema of its results.
+// @Tags admin-tasks
+// @Produce json
+// @Success 200 {object} models.TaskTypeListResponse
+// @Router /admin/task-types [get]
+func (h *Handler) ListTaskTypes(c echo.Context) error {
+	types := h.taskTypes.List()
+	resp := models.TaskTypeListResponse{TaskTypes: make([]models.TaskTypeInfo, 0, len(types))}
+	for _, t := range types {
+		resp.TaskTypes = append(resp.TaskTypes, models.TaskTypeInfo{
+			Name:          t.Name,
+			Description:   t.Description,
+			Schema:        t.Schema,
+			ResultSchema:  t.ResultSchema,
+			MaxConcurrent: t.MaxConcurrent,
+		})
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// validateTaskTemplate checks a task template against its task type, normalizing its
+// parameters, and checks its timeout, retry policy and priority. Problems are returned as *requestError.
+func (h *Handler) validateTaskTemplate(template *models.TaskTemplate) error {
+	params, err := h.taskTypes.Validate(template.Type, template.Parameters)
+	if errors.Is(err, tasktypes.ErrUnknownType) {
+		return &requestError{"Invalid task type"}
+	}
+	if err != nil {
+		return &requestError{err.Error()}
+	}
+	template.Parameters = params
+	if template.Timeout < 0 {
+		return &requestError{"Task timeout must not be negative"}
+	}
+	if template.Retry != nil {
+		if err := template.Retry.Validate(); err != nil {
+			return &requestError{err.Error()}
+		}
+	}
+	if err := models.ValidatePriority(template.Priority); err != nil {
+		return &requestError{err.Error()}
+	}
+	return nil
+}
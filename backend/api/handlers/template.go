@@ -0,0 +1,422 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+
+	"github.com/whit3rabbit/beehive/manager/internal/logger"
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+const (
+	// MaxTemplateImportSize caps the size of a YAML template import.
+	MaxTemplateImportSize = 1024 * 1024 // 1MB
+	// MaxTemplateImportCount caps the number of templates imported at once.
+	MaxTemplateImportCount = 100
+)
+
+// ListTemplates handles GET /admin/templates.
+// @Summary Lists task templates
+// @Description Returns the latest version of every task template, by name.
+// @Tags admin-templates
+// @Produce json
+// @Success 200 {object} models.TemplateListResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/templates [get]
+func (h *Handler) ListTemplates(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	templates, err := h.store.Templates.List(ctx)
+	if err != nil {
+		logger.Error("Failed to list templates", zap.Error(err))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list templates"})
+	}
+	return c.JSON(http.StatusOK, models.TemplateListResponse{Templates: templates})
+}
+
+// CreateTemplate handles POST /admin/templates.
+// @Summary Saves a task template
+// @Description Stores the template as the next version of its name; earlier versions are kept.
+// @Tags admin-templates
+// @Accept json
+// @Produce json
+// @Param template body models.TemplateRequest true "Template definition"
+// @Success 201 {object} models.Template
+// @Failure 400 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/templates [post]
+func (h *Handler) CreateTemplate(c echo.Context) error {
+	var req models.TemplateRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid request payload"})
+	}
+	template := req.Template()
+	if err := h.checkTemplate(&template); err != nil {
+		return writeRequestError(c, err, "Failed to save template")
+	}
+	template.CreatedBy, _ = c.Get("admin").(string)
+	template.CreatedAt = time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	if err := h.store.Templates.Create(ctx, &template); err != nil {
+		logger.Error("Failed to create template", zap.Error(err), zap.String("name", template.Name))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to save template"})
+	}
+	return c.JSON(http.StatusCreated, template)
+}
+
+// GetTemplate handles GET /admin/templates/:name.
+// @Summary Retrieves a task template
+// @Tags admin-templates
+// @Produce json
+// @Param name path string true "Template name"
+// @Param version query int false "Version, the latest by default"
+// @Success 200 {object} models.Template
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/templates/{name} [get]
+func (h *Handler) GetTemplate(c echo.Context) error {
+	version, err := templateVersionParam(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	template, err := h.store.Templates.Get(ctx, c.Param("name"), version)
+	if errors.Is(err, storage.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "Template not found"})
+	}
+	if err != nil {
+		logger.Error("Failed to retrieve template", zap.Error(err), zap.String("name", c.Param("name")))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to retrieve template"})
+	}
+	return c.JSON(http.StatusOK, template)
+}
+
+// ListTemplateVersions handles GET /admin/templates/:name/versions.
+// @Summary Lists the versions of a task template
+// @Description Returns every version of the template, oldest first.
+// @Tags admin-templates
+// @Produce json
+// @Param name path string true "Template name"
+// @Success 200 {object} models.TemplateListResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/templates/{name}/versions [get]
+func (h *Handler) ListTemplateVersions(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	templates, err := h.store.Templates.Versions(ctx, c.Param("name"))
+	if errors.Is(err, storage.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "Template not found"})
+	}
+	if err != nil {
+		logger.Error("Failed to list template versions", zap.Error(err), zap.String("name", c.Param("name")))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list template versions"})
+	}
+	return c.JSON(http.StatusOK, models.TemplateListResponse{Templates: templates})
+}
+
+// DeleteTemplate handles DELETE /admin/templates/:name.
+// @Summary Deletes a task template
+// @Description Deletes every version of the template. Tasks created from it are left alone.
+// @Tags admin-templates
+// @Param name path string true "Template name"
+// @Success 204
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/templates/{name} [delete]
+func (h *Handler) DeleteTemplate(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	err := h.store.Templates.Delete(ctx, c.Param("name"))
+	if errors.Is(err, storage.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "Template not found"})
+	}
+	if err != nil {
+		logger.Error("Failed to delete template", zap.Error(err), zap.String("name", c.Param("name")))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to delete template"})
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// InstantiateTemplate handles POST /admin/templates/:name/instantiate.
+// @Summary Creates a task from a task template
+// @Description Fills in the template's variables and queues the resulting task for the agent. Parameters are validated against the schema of the task type.
+// @Tags admin-templates
+// @Accept json
+// @Produce json
+// @Param name path string true "Template name"
+// @Param request body models.TemplateInstantiateRequest true "Agent, version and variable values"
+// @Success 201 {object} models.Task
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/templates/{name}/instantiate [post]
+func (h *Handler) InstantiateTemplate(c echo.Context) error {
+	var req models.TemplateInstantiateRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid request payload"})
+	}
+	if req.AgentID == "" {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "agent_id is required"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	name := c.Param("name")
+	template, err := h.store.Templates.Get(ctx, name, req.Version)
+	if errors.Is(err, storage.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "Template not found"})
+	}
+	if err != nil {
+		logger.Error("Failed to retrieve template", zap.Error(err), zap.String("name", name))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to instantiate template"})
+	}
+	if _, err := h.jobAgents(ctx, models.JobTarget{AgentIDs: []string{req.AgentID}}); err != nil {
+		return writeRequestError(c, err, "Failed to instantiate template")
+	}
+
+	admin, _ := c.Get("admin").(string)
+	task, err := h.templateTask(template, req.Variables, req.AgentID, admin, models.AdminActor(admin), time.Now())
+	if err != nil {
+		return writeRequestError(c, err, "Failed to instantiate template")
+	}
+	if err := h.store.Tasks.Create(ctx, task); err != nil {
+		logger.Error("Failed to create task", zap.Error(err), zap.String("template", name))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to instantiate template"})
+	}
+	return c.JSON(http.StatusCreated, task)
+}
+
+// ExportTemplates handles GET /admin/templates/export.
+// @Summary Exports task templates as YAML
+// @Description Returns the latest version of the named templates, or of every template, as a YAML document that Import Templates accepts.
+// @Tags admin-templates
+// @Produce application/yaml
+// @Param name query []string false "Template names" collectionFormat(multi)
+// @Success 200 {object} models.TemplateFile
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/templates/export [get]
+func (h *Handler) ExportTemplates(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	var templates []models.Template
+	names := c.QueryParams()["name"]
+	if len(names) == 0 {
+		var err error
+		if templates, err = h.store.Templates.List(ctx); err != nil {
+			logger.Error("Failed to list templates", zap.Error(err))
+			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to export templates"})
+		}
+	}
+	for _, name := range names {
+		template, err := h.store.Templates.Get(ctx, name, 0)
+		if errors.Is(err, storage.ErrNotFound) {
+			return c.JSON(http.StatusNotFound, ErrorResponse{Error: fmt.Sprintf("Template %q not found", name)})
+		}
+		if err != nil {
+			logger.Error("Failed to retrieve template", zap.Error(err), zap.String("name", name))
+			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to export templates"})
+		}
+		templates = append(templates, *template)
+	}
+
+	file := models.TemplateFile{Templates: make([]models.TemplateRequest, 0, len(templates))}
+	for i := range templates {
+		file.Templates = append(file.Templates, templates[i].Request())
+	}
+	out, err := yaml.Marshal(file)
+	if err != nil {
+		logger.Error("Failed to encode templates", zap.Error(err))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to export templates"})
+	}
+	return c.Blob(http.StatusOK, "application/yaml", out)
+}
+
+// ImportTemplates handles POST /admin/templates/import.
+// @Summary Imports task templates from YAML
+// @Description Saves every template of a YAML document in the format of Export Templates as the next version of its name. Nothing is saved if any template is invalid.
+// @Tags admin-templates
+// @Accept application/yaml
+// @Produce json
+// @Param templates body models.TemplateFile true "YAML document"
+// @Success 201 {object} models.TemplateListResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/templates/import [post]
+func (h *Handler) ImportTemplates(c echo.Context) error {
+	body, err := io.ReadAll(io.LimitReader(c.Request().Body, MaxTemplateImportSize+1))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid request payload"})
+	}
+	if len(body) > MaxTemplateImportSize {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Template import exceeds size limit"})
+	}
+
+	var file models.TemplateFile
+	decoder := yaml.NewDecoder(bytes.NewReader(body))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid YAML", Details: err.Error()})
+	}
+	if len(file.Templates) == 0 {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "No templates to import"})
+	}
+	if len(file.Templates) > MaxTemplateImportCount {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("At most %d templates can be imported at once", MaxTemplateImportCount)})
+	}
+
+	admin, _ := c.Get("admin").(string)
+	now := time.Now()
+	templates := make([]models.Template, len(file.Templates))
+	for i := range file.Templates {
+		templates[i] = file.Templates[i].Template()
+		if err := h.checkTemplate(&templates[i]); err != nil {
+			var invalid *requestError
+			if errors.As(err, &invalid) {
+				err = &requestError{fmt.Sprintf("Template %q: %s", templates[i].Name, invalid.message)}
+			}
+			return writeRequestError(c, err, "Failed to import templates")
+		}
+		templates[i].CreatedBy = admin
+		templates[i].CreatedAt = now
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	for i := range templates {
+		if err := h.store.Templates.Create(ctx, &templates[i]); err != nil {
+			logger.Error("Failed to create template", zap.Error(err), zap.String("name", templates[i].Name))
+			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to import templates"})
+		}
+	}
+	return c.JSON(http.StatusCreated, models.TemplateListResponse{Templates: templates})
+}
+
+// checkTemplate validates a template and its task type. When every variable has a default,
+// the parameters it renders to are also checked against the task type. Problems are returned
+// as *requestError.
+func (h *Handler) checkTemplate(template *models.Template) error {
+	if err := template.Validate(); err != nil {
+		return &requestError{err.Error()}
+	}
+	if _, ok := h.taskTypes.Get(template.Task.Type); !ok {
+		return &requestError{"Invalid task type"}
+	}
+	if rendered, err := template.Render(nil); err == nil {
+		return h.validateTaskTemplate(&rendered)
+	}
+	return nil
+}
+
+// templateTask returns a queued task for the agent created from the template with the given
+// variable values. Problems with the values are returned as *requestError.
+func (h *Handler) templateTask(template *models.Template, values map[string]interface{}, agentID, createdBy, actor string, now time.Time) (*models.Task, error) {
+	rendered, err := template.Render(values)
+	if err != nil {
+		return nil, &requestError{err.Error()}
+	}
+	if err := h.validateTaskTemplate(&rendered); err != nil {
+		return nil, err
+	}
+
+	task := &models.Task{
+		AgentID:         agentID,
+		Type:            rendered.Type,
+		Parameters:      rendered.Parameters,
+		Timeout:         rendered.Timeout,
+		Retry:           rendered.Retry,
+		Priority:        rendered.Priority,
+		CreatedAt:       now,
+		CreatedBy:       createdBy,
+		TemplateName:    template.Name,
+		TemplateVersion: template.Version,
+	}
+	reason := fmt.Sprintf("template %s version %d", template.Name, template.Version)
+	if err := task.Transition(models.TaskStatusQueued, actor, reason, now); err != nil {
+		return nil, err
+	}
+	return task, nil
+}
+
+// createDefaultTasks queues the default tasks of the named role for an agent that joined it,
+// from the latest version of each template. A template that cannot be instantiated is logged
+// and skipped, so that joining the role never fails because of it.
+func (h *Handler) createDefaultTasks(ctx context.Context, agentID, roleName, createdBy string) {
+	role, err := h.store.Roles.GetByName(ctx, roleName)
+	if err != nil {
+		logger.Error("Failed to look up role", zap.Error(err), zap.String("role_name", roleName))
+		return
+	}
+
+	now := time.Now()
+	for _, name := range role.DefaultTasks {
+		template, err := h.store.Templates.Get(ctx, name, 0)
+		if err == nil {
+			var task *models.Task
+			if task, err = h.templateTask(template, nil, agentID, createdBy, models.ActorRole, now); err == nil {
+				err = h.store.Tasks.Create(ctx, task)
+			}
+		}
+		if err != nil {
+			logger.Error("Failed to create default task",
+				zap.Error(err),
+				zap.String("agent_uuid", agentID),
+				zap.String("role_name", roleName),
+				zap.String("template", name))
+		}
+	}
+}
+
+// checkDefaultTask returns a *requestError unless a template named name exists and can be
+// instantiated without variable values.
+func (h *Handler) checkDefaultTask(ctx context.Context, name string) error {
+	template, err := h.store.Templates.Get(ctx, name, 0)
+	if errors.Is(err, storage.ErrNotFound) {
+		return &requestError{fmt.Sprintf("Unknown default task template %q", name)}
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := template.Render(nil); err != nil {
+		return &requestError{fmt.Sprintf("Default task template %q: %s", name, err)}
+	}
+	return nil
+}
+
+// templateVersionParam parses the optional version query parameter, zero if it is missing.
+func templateVersionParam(c echo.Context) (int, error) {
+	raw := c.QueryParam("version")
+	if raw == "" {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(raw)
+	if err != nil || version < 1 {
+		return 0, errors.New("version must be a positive integer")
+	}
+	return version, nil
+}
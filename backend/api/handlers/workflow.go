@@ -0,0 +1,375 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+
+	"github.com/whit3rabbit/beehive/manager/internal/logger"
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
+	"github.com/whit3rabbit/beehive/manager/internal/workflow"
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+// MaxWorkflowRunAgents caps the number of agents a workflow can be started on at once.
+const MaxWorkflowRunAgents = 1000
+
+// ListWorkflows handles GET /admin/workflows.
+// @Summary Lists workflows
+// @Description Returns every workflow, oldest first.
+// @Tags admin-workflows
+// @Produce json
+// @Success 200 {object} models.WorkflowListResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/workflows [get]
+func (h *Handler) ListWorkflows(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	workflows, err := h.store.Workflows.List(ctx)
+	if err != nil {
+		logger.Error("Failed to list workflows", zap.Error(err))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list workflows"})
+	}
+	return c.JSON(http.StatusOK, models.WorkflowListResponse{Workflows: workflows})
+}
+
+// CreateWorkflow handles POST /admin/workflows.
+// @Summary Creates a workflow
+// @Description Creates a graph of task nodes. A node runs once its upstream nodes have finished and its conditions on their status or output hold.
+// @Tags admin-workflows
+// @Accept json
+// @Produce json
+// @Param workflow body models.WorkflowRequest true "Workflow definition"
+// @Success 201 {object} models.Workflow
+// @Failure 400 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/workflows [post]
+func (h *Handler) CreateWorkflow(c echo.Context) error {
+	var req models.WorkflowRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid request payload"})
+	}
+	wf, err := h.workflowFromRequest(req)
+	if err != nil {
+		return writeRequestError(c, err, "Failed to save workflow")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	now := time.Now()
+	wf.CreatedBy, _ = c.Get("admin").(string)
+	wf.CreatedAt = now
+	wf.UpdatedAt = now
+	if err := h.store.Workflows.Create(ctx, wf); err != nil {
+		logger.Error("Failed to create workflow", zap.Error(err), zap.String("name", wf.Name))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create workflow"})
+	}
+	return c.JSON(http.StatusCreated, wf)
+}
+
+// GetWorkflow handles GET /admin/workflows/:workflow_id.
+// @Summary Retrieves a workflow
+// @Tags admin-workflows
+// @Produce json
+// @Param workflow_id path string true "Workflow ID"
+// @Success 200 {object} models.Workflow
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/workflows/{workflow_id} [get]
+func (h *Handler) GetWorkflow(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	wf, err := h.workflowFromParam(ctx, c)
+	if wf == nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, wf)
+}
+
+// ReplaceWorkflow handles PUT /admin/workflows/:workflow_id.
+// @Summary Replaces a workflow
+// @Description Replaces the definition of a workflow. Runs already started keep the definition they started with.
+// @Tags admin-workflows
+// @Accept json
+// @Produce json
+// @Param workflow_id path string true "Workflow ID"
+// @Param workflow body models.WorkflowRequest true "Workflow definition"
+// @Success 200 {object} models.Workflow
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/workflows/{workflow_id} [put]
+func (h *Handler) ReplaceWorkflow(c echo.Context) error {
+	var req models.WorkflowRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid request payload"})
+	}
+	wf, err := h.workflowFromRequest(req)
+	if err != nil {
+		return writeRequestError(c, err, "Failed to save workflow")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	existing, err := h.workflowFromParam(ctx, c)
+	if existing == nil {
+		return err
+	}
+	wf.ID = existing.ID
+	wf.CreatedBy = existing.CreatedBy
+	wf.CreatedAt = existing.CreatedAt
+	wf.UpdatedAt = time.Now()
+
+	err = h.store.Workflows.Replace(ctx, wf)
+	if errors.Is(err, storage.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "Workflow not found"})
+	}
+	if err != nil {
+		logger.Error("Failed to replace workflow", zap.Error(err), zap.String("workflow_id", wf.ID.Hex()))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to update workflow"})
+	}
+	return c.JSON(http.StatusOK, wf)
+}
+
+// DeleteWorkflow handles DELETE /admin/workflows/:workflow_id.
+// @Summary Deletes a workflow
+// @Description Deletes a workflow. Its runs, including those in progress, are left alone.
+// @Tags admin-workflows
+// @Param workflow_id path string true "Workflow ID"
+// @Success 204
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/workflows/{workflow_id} [delete]
+func (h *Handler) DeleteWorkflow(c echo.Context) error {
+	objID, err := primitive.ObjectIDFromHex(c.Param("workflow_id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid workflow ID format"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	err = h.store.Workflows.Delete(ctx, objID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "Workflow not found"})
+	}
+	if err != nil {
+		logger.Error("Failed to delete workflow", zap.Error(err), zap.String("workflow_id", objID.Hex()))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to delete workflow"})
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// StartWorkflow handles POST /admin/workflows/:workflow_id/runs.
+// @Summary Starts a workflow
+// @Description Starts one run of the workflow on every agent the target selects: a list of agent UUIDs, a role, or a label selector. The nodes without dependencies are queued right away.
+// @Tags admin-workflows
+// @Accept json
+// @Produce json
+// @Param workflow_id path string true "Workflow ID"
+// @Param run body models.WorkflowRunRequest true "Agents to run the workflow on"
+// @Success 201 {object} models.WorkflowRunListResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/workflows/{workflow_id}/runs [post]
+func (h *Handler) StartWorkflow(c echo.Context) error {
+	var req models.WorkflowRunRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid request payload"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	wf, err := h.workflowFromParam(ctx, c)
+	if wf == nil {
+		return err
+	}
+	agents, err := h.jobAgents(ctx, req.Target)
+	if err != nil {
+		return writeRequestError(c, err, "Failed to start workflow")
+	}
+	if len(agents) > MaxWorkflowRunAgents {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("Target matches more than %d agents", MaxWorkflowRunAgents)})
+	}
+
+	now := time.Now()
+	admin, _ := c.Get("admin").(string)
+	resp := models.WorkflowRunListResponse{Runs: make([]models.WorkflowRun, 0, len(agents))}
+	for _, agentID := range agents {
+		run := workflow.NewRun(wf, agentID, admin, now)
+		if err := h.store.WorkflowRuns.Create(ctx, run); err != nil {
+			logger.Error("Failed to create workflow run", zap.Error(err), zap.String("workflow_id", wf.ID.Hex()))
+			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to start workflow"})
+		}
+		// A conflict means the engine already advanced the new run
+		if _, err := workflow.Advance(ctx, h.store, run, now); err != nil && !errors.Is(err, storage.ErrConflict) {
+			logger.Error("Failed to advance workflow run", zap.Error(err), zap.String("run_id", run.ID.Hex()))
+			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to start workflow"})
+		}
+		resp.Runs = append(resp.Runs, *run)
+	}
+
+	logger.Info("Started workflow", zap.String("workflow_id", wf.ID.Hex()), zap.Int("agents", len(agents)), zap.String("admin", admin))
+	return c.JSON(http.StatusCreated, resp)
+}
+
+// ListWorkflowRuns handles GET /admin/workflow-runs.
+// @Summary Lists workflow runs
+// @Description Returns the most recent workflow runs, newest first.
+// @Tags admin-workflows
+// @Produce json
+// @Param workflow_id query string false "Workflow ID"
+// @Param agent_id query string false "Agent UUID"
+// @Param status query string false "Run status"
+// @Param limit query int false "Number of runs, at most 200"
+// @Success 200 {object} models.WorkflowRunListResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/workflow-runs [get]
+func (h *Handler) ListWorkflowRuns(c echo.Context) error {
+	limit := DefaultJobPageSize
+	if value := c.QueryParam("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > MaxJobPageSize {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("limit must be between 1 and %d", MaxJobPageSize)})
+		}
+		limit = n
+	}
+	filter := storage.WorkflowRunFilter{
+		WorkflowID: c.QueryParam("workflow_id"),
+		AgentID:    c.QueryParam("agent_id"),
+		Status:     c.QueryParam("status"),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	runs, err := h.store.WorkflowRuns.List(ctx, filter, int64(limit))
+	if err != nil {
+		logger.Error("Failed to list workflow runs", zap.Error(err))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list workflow runs"})
+	}
+	return c.JSON(http.StatusOK, models.WorkflowRunListResponse{Runs: runs})
+}
+
+// GetWorkflowRun handles GET /admin/workflow-runs/:run_id.
+// @Summary Retrieves a workflow run
+// @Description Returns the run with the current status of each node and a node-and-edge graph of them.
+// @Tags admin-workflows
+// @Produce json
+// @Param run_id path string true "Workflow run ID"
+// @Success 200 {object} models.WorkflowRunResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/workflow-runs/{run_id} [get]
+func (h *Handler) GetWorkflowRun(c echo.Context) error {
+	objID, err := primitive.ObjectIDFromHex(c.Param("run_id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid workflow run ID format"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	run, err := h.store.WorkflowRuns.Get(ctx, objID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "Workflow run not found"})
+	}
+	if err != nil {
+		logger.Error("Failed to retrieve workflow run", zap.Error(err), zap.String("run_id", objID.Hex()))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to retrieve workflow run"})
+	}
+	// Show the latest task statuses even before the engine records them
+	if _, _, err := workflow.Refresh(ctx, h.store.Tasks, run); err != nil {
+		logger.Error("Failed to retrieve workflow tasks", zap.Error(err), zap.String("run_id", objID.Hex()))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to retrieve workflow run"})
+	}
+	return c.JSON(http.StatusOK, models.WorkflowRunResponse{WorkflowRun: *run, Graph: run.Graph()})
+}
+
+// CancelWorkflowRun handles POST /admin/workflow-runs/:run_id/cancel.
+// @Summary Cancels a workflow run
+// @Description Cancels the nodes of the run that have not started and the tasks of those that have: queued tasks are cancelled and dispatched or running ones move to cancel_requested.
+// @Tags admin-workflows
+// @Produce json
+// @Param run_id path string true "Workflow run ID"
+// @Success 200 {object} models.WorkflowRunResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /admin/workflow-runs/{run_id}/cancel [post]
+func (h *Handler) CancelWorkflowRun(c echo.Context) error {
+	objID, err := primitive.ObjectIDFromHex(c.Param("run_id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid workflow run ID format"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultContextTimeout)
+	defer cancel()
+
+	admin, _ := c.Get("admin").(string)
+	run, err := workflow.Cancel(ctx, h.store, objID, admin, time.Now())
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "Workflow run not found"})
+	case errors.Is(err, workflow.ErrRunStatus), errors.Is(err, storage.ErrConflict):
+		return c.JSON(http.StatusConflict, ErrorResponse{Error: "Workflow run is not running"})
+	case err != nil:
+		logger.Error("Failed to cancel workflow run", zap.Error(err), zap.String("run_id", objID.Hex()))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to cancel workflow run"})
+	}
+
+	logger.Info("Cancelled workflow run", zap.String("run_id", objID.Hex()), zap.String("admin", admin))
+	return c.JSON(http.StatusOK, models.WorkflowRunResponse{WorkflowRun: *run, Graph: run.Graph()})
+}
+
+// workflowFromRequest validates a workflow request and returns the workflow it describes.
+// Validation errors are returned as *requestError.
+func (h *Handler) workflowFromRequest(req models.WorkflowRequest) (*models.Workflow, error) {
+	wf := &models.Workflow{Name: req.Name, Description: req.Description, Nodes: req.Nodes}
+	if err := wf.Validate(); err != nil {
+		return nil, &requestError{err.Error()}
+	}
+	for i := range wf.Nodes {
+		node := &wf.Nodes[i]
+		if err := h.validateTaskTemplate(&node.Task); err != nil {
+			return nil, &requestError{fmt.Sprintf("Node %q: %s", node.ID, err.Error())}
+		}
+	}
+	return wf, nil
+}
+
+// workflowFromParam loads the workflow named by the workflow_id path parameter. If it cannot,
+// it writes the error response and returns a nil workflow with the error, if any, of writing it.
+func (h *Handler) workflowFromParam(ctx context.Context, c echo.Context) (*models.Workflow, error) {
+	objID, err := primitive.ObjectIDFromHex(c.Param("workflow_id"))
+	if err != nil {
+		return nil, c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid workflow ID format"})
+	}
+	wf, err := h.store.Workflows.Get(ctx, objID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, c.JSON(http.StatusNotFound, ErrorResponse{Error: "Workflow not found"})
+	}
+	if err != nil {
+		logger.Error("Failed to retrieve workflow", zap.Error(err), zap.String("workflow_id", objID.Hex()))
+		return nil, c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to retrieve workflow"})
+	}
+	return wf, nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"net/http"
@@ -12,8 +13,6 @@ import (
 	"time"
 
 	"github.com/labstack/echo/v4"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
 	"go.uber.org/zap"
 
 	"github.com/whit3rabbit/beehive/manager/api/admin"
@@ -22,6 +21,13 @@ import (
 	"github.com/whit3rabbit/beehive/manager/internal/config"
 	"github.com/whit3rabbit/beehive/manager/internal/logger"
 	"github.com/whit3rabbit/beehive/manager/internal/mongodb"
+	"github.com/whit3rabbit/beehive/manager/internal/reaper"
+	"github.com/whit3rabbit/beehive/manager/internal/rollout"
+	"github.com/whit3rabbit/beehive/manager/internal/scheduler"
+	"github.com/whit3rabbit/beehive/manager/internal/secrets"
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
+	"github.com/whit3rabbit/beehive/manager/internal/tasktypes"
+	"github.com/whit3rabbit/beehive/manager/internal/workflow"
 	customMiddleware "github.com/whit3rabbit/beehive/manager/middleware"
 	"github.com/whit3rabbit/beehive/manager/migrations"
 	"github.com/whit3rabbit/beehive/manager/models"
@@ -56,6 +62,11 @@ func main() {
 	// Merge configurations
 	config.MergeConfig(cfg, flags)
 
+	// Validate the merged configuration
+	if err := config.ValidateConfig(cfg); err != nil {
+		logger.Fatal("Invalid configuration", zap.Error(err))
+	}
+
 	// Initialize Logger
 	if err := logger.Initialize(cfg.Logging.Level); err != nil {
 		logger.Fatal("Failed to initialize logger", zap.Error(err))
@@ -66,16 +77,12 @@ func main() {
 	logger.Info("Starting server with configuration",
 		zap.String("host", cfg.Server.Host),
 		zap.Int("port", cfg.Server.Port),
+		zap.String("storage_backend", cfg.Storage.Backend),
 		zap.String("mongodb_database", cfg.MongoDB.Database),
 		zap.String("log_level", cfg.Logging.Level),
 		zap.Bool("tls_enabled", cfg.Server.TLS.Enabled),
 		zap.Bool("behind_reverse_proxy", cfg.Server.BehindReverseProxy))
 
-	// Connect to MongoDB
-	if err := mongodb.Connect(cfg.MongoDB.URI); err != nil {
-		logger.Fatal("Error connecting to MongoDB", zap.Error(err))
-	}
-
 	// Create root context with cancellation
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -83,22 +90,59 @@ func main() {
 	// Start cleanup routine for login attempts
 	go admin.CleanupLoginAttempts(ctx)
 
-	// Run migrations
-	db := mongodb.Client.Database(cfg.MongoDB.Database)
-	allMigrations := []migrations.Migration{
-		migrations.Migration0001,
-	}
+	// Open the storage backend
+	store := openStore(cfg)
 
-	if err := migrations.RunMigrations(db, allMigrations); err != nil {
-		logger.Fatal("Error running migrations", zap.Error(err))
+	// Ensure admin user exists
+	ensureAdminUser(store.Admins, cfg)
+
+	// Enforce task timeouts and agent liveness in the background
+	reaperDone := make(chan struct{})
+	go func() {
+		defer close(reaperDone)
+		reaper.New(store, cfg.Reaper).Run(ctx)
+	}()
+
+	// Wake polls held by this instance for tasks queued through other instances
+	if cfg.Dispatch.WatchChanges {
+		go func() {
+			if err := store.TaskChanges.Watch(ctx); err != nil {
+				logger.Error("Stopped watching task changes; held polls only wake for tasks queued through this instance", zap.Error(err))
+			}
+		}()
 	}
 
-	// Ensure admin user exists
-	ensureAdminUser(db, cfg)
+	// Create tasks from schedules in the background
+	schedulerDone := make(chan struct{})
+	go func() {
+		defer close(schedulerDone)
+		scheduler.New(store, cfg.Scheduler).Run(ctx)
+	}()
+
+	// Dispatch rolling jobs wave by wave in the background
+	rolloutDone := make(chan struct{})
+	go func() {
+		defer close(rolloutDone)
+		rollout.New(store, cfg.Rollout).Run(ctx)
+	}()
+
+	// Start the nodes of workflow runs as their upstream nodes finish
+	workflowDone := make(chan struct{})
+	go func() {
+		defer close(workflowDone)
+		workflow.New(store, cfg.Workflow).Run(ctx)
+	}()
+
+	// Key used to encrypt agent secrets at rest
+	credentialBox := newCredentialBox(cfg)
+
+	// Task types and parameter schemas accepted when creating tasks
+	taskTypes := loadTaskTypes(cfg)
 
 	// Create Echo instance and set up middleware
 	e := echo.New()
 	e.HTTPErrorHandler = handlers.CustomHTTPErrorHandler // Set Custom Error Handler
+	e.Use(configContextMiddleware(cfg))
 
 	// Initialize rate limiter
 	rateLimiter := customMiddleware.NewRateLimiter(
@@ -107,7 +151,23 @@ func main() {
 		time.Duration(cfg.Security.RateLimiting.BlockoutMinutes)*time.Minute,
 	)
 
-	setupRoutes(e, rateLimiter)
+	signatureOptions := customMiddleware.SignatureOptions{
+		ClockSkew:        time.Duration(cfg.Security.RequestSigning.ClockSkewSeconds) * time.Second,
+		RequireCanonical: cfg.Security.RequestSigning.RequireCanonical,
+	}
+
+	dispatch := storage.DispatchPolicy{
+		Weights: cfg.Dispatch.Weights,
+		Window:  cfg.Dispatch.Window,
+		Lease:   time.Duration(cfg.Dispatch.LeaseSeconds) * time.Second,
+	}
+	artifacts := handlers.ArtifactLimits{MaxFileBytes: cfg.Artifacts.MaxFileBytes, MaxTaskBytes: cfg.Artifacts.MaxTaskBytes}
+	polls := handlers.PollLimits{
+		MaxWait:    time.Duration(cfg.Dispatch.MaxPollWaitSeconds) * time.Second,
+		MaxWaiting: cfg.Dispatch.MaxWaitingPolls,
+	}
+	idempotencyTTL := time.Duration(cfg.Idempotency.TTLHours) * time.Hour
+	setupRoutes(e, store, credentialBox, taskTypes, dispatch, artifacts, polls, idempotencyTTL, rateLimiter, signatureOptions)
 
 	// Serve static files for React frontend (if available)
 	if cfg.Server.StaticDir != "" {
@@ -116,31 +176,128 @@ func main() {
 
 	// Start server
 	startServer(e, cfg)
+
+	// Stop background workers before exiting
+	cancel()
+	<-reaperDone
+	<-schedulerDone
+	<-rolloutDone
+	<-workflowDone
 }
 
-func ensureAdminUser(db *mongo.Database, cfg *config.Config) {
-	adminCollection := db.Collection("admins")
-	ctxTimeout, cancelTimeout := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancelTimeout()
+// openStore connects to the configured storage backend and returns its stores.
+// For MongoDB this also applies pending migrations.
+func openStore(cfg *config.Config) *storage.Store {
+	if cfg.Storage.Backend == storage.BackendMemory {
+		logger.Warn("Using in-memory storage; data will be lost on shutdown")
+		return storage.NewMemoryStore()
+	}
+
+	// Connect to MongoDB
+	if err := mongodb.Connect(cfg.MongoDB.URI); err != nil {
+		logger.Fatal("Error connecting to MongoDB", zap.Error(err))
+	}
 
-	passwordPolicy := models.PasswordPolicy{
+	// Run migrations
+	db := mongodb.Client.Database(cfg.MongoDB.Database)
+	allMigrations := []migrations.Migration{
+		migrations.Migration0001,
+		migrations.Migration0002,
+		migrations.Migration0003,
+		migrations.Migration0004,
+		migrations.Migration0005,
+		migrations.Migration0006,
+		migrations.Migration0007,
+		migrations.Migration0008,
+		migrations.Migration0009,
+		migrations.Migration0010,
+		migrations.Migration0011,
+		migrations.Migration0012,
+		migrations.Migration0013,
+		migrations.Migration0014,
+		migrations.Migration0015,
+		migrations.Migration0016,
+		migrations.Migration0017,
+		migrations.Migration0018,
+		migrations.Migration0019,
+	}
+
+	if err := migrations.RunMigrations(db, allMigrations); err != nil {
+		logger.Fatal("Error running migrations", zap.Error(err))
+	}
+
+	return storage.NewMongoStore(db)
+}
+
+// newCredentialBox creates the cipher used to store agent secrets.
+func newCredentialBox(cfg *config.Config) *secrets.Box {
+	keyMaterial := cfg.Auth.CredentialKey
+	if keyMaterial == "" {
+		logger.Warn("auth.credential_key is not set; deriving the agent credential key from the JWT secret")
+		keyMaterial = "agent-credentials:" + cfg.Auth.JWTSecret
+	}
+	box, err := secrets.NewBox(keyMaterial)
+	if err != nil {
+		logger.Fatal("Failed to initialize credential encryption", zap.Error(err))
+	}
+	return box
+}
+
+// loadTaskTypes returns the built-in task types plus those defined in the configured directory.
+func loadTaskTypes(cfg *config.Config) *tasktypes.Registry {
+	registry := tasktypes.Builtin()
+	loaded, err := registry.LoadDir(cfg.TaskTypes.Dir)
+	if err != nil {
+		logger.Fatal("Failed to load task types", zap.Error(err), zap.String("dir", cfg.TaskTypes.Dir))
+	}
+	if len(loaded) > 0 {
+		logger.Info("Loaded task types", zap.Strings("types", loaded), zap.String("dir", cfg.TaskTypes.Dir))
+	}
+	for name, max := range cfg.TaskTypes.MaxConcurrent {
+		if err := registry.SetMaxConcurrent(name, max); err != nil {
+			logger.Fatal("Failed to limit task type", zap.Error(err))
+		}
+	}
+	return registry
+}
+
+// passwordPolicy builds the admin password policy from the configuration.
+func passwordPolicy(cfg *config.Config) models.PasswordPolicy {
+	return models.PasswordPolicy{
 		MinLength:        cfg.Security.PasswordPolicy.MinLength,
 		RequireUppercase: cfg.Security.PasswordPolicy.RequireUppercase,
 		RequireLowercase: cfg.Security.PasswordPolicy.RequireLowercase,
 		RequireNumbers:   cfg.Security.PasswordPolicy.RequireNumbers,
 		RequireSpecial:   cfg.Security.PasswordPolicy.RequireSpecial,
 	}
+}
+
+// configContextMiddleware exposes the settings that the admin handlers read from the request context.
+func configContextMiddleware(cfg *config.Config) echo.MiddlewareFunc {
+	policy := passwordPolicy(cfg)
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set("jwt_secret", cfg.Auth.JWTSecret)
+			c.Set("token_expiration_hours", cfg.Auth.TokenExpirationHours)
+			c.Set("password_policy", policy)
+			return next(c)
+		}
+	}
+}
+
+func ensureAdminUser(admins storage.AdminStore, cfg *config.Config) {
+	ctxTimeout, cancelTimeout := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelTimeout()
 
-	var adminUser models.Admin
-	err := adminCollection.FindOne(ctxTimeout, bson.M{"username": cfg.Admin.DefaultUsername}).Decode(&adminUser)
+	_, err := admins.GetByUsername(ctxTimeout, cfg.Admin.DefaultUsername)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			hashedPassword, err := admin.GenerateHashPassword(cfg.Admin.DefaultPassword, passwordPolicy)
+		if errors.Is(err, storage.ErrNotFound) {
+			hashedPassword, err := admin.GenerateHashPassword(cfg.Admin.DefaultPassword, passwordPolicy(cfg))
 			if err != nil {
 				logger.Fatal("Failed to hash default admin password", zap.Error(err))
 			}
 
-			_, err = adminCollection.InsertOne(ctxTimeout, models.Admin{
+			err = admins.Create(ctxTimeout, &models.Admin{
 				Username:  cfg.Admin.DefaultUsername,
 				Password:  hashedPassword,
 				CreatedAt: time.Now(),
@@ -155,31 +312,99 @@ func ensureAdminUser(db *mongo.Database, cfg *config.Config) {
 	}
 }
 
-func setupRoutes(e *echo.Echo, rateLimiter customMiddleware.RateLimiter) {
+func setupRoutes(e *echo.Echo, store *storage.Store, credentialBox *secrets.Box, taskTypes *tasktypes.Registry, dispatch storage.DispatchPolicy, artifacts handlers.ArtifactLimits, polls handlers.PollLimits, idempotencyTTL time.Duration, rateLimiter customMiddleware.RateLimiter, signatureOptions customMiddleware.SignatureOptions) {
+	h := handlers.NewHandler(store, credentialBox, taskTypes, dispatch, artifacts, polls)
+
+	// Retries of requests with an Idempotency-Key header get the original response
+	idempotent := customMiddleware.IdempotencyMiddleware(store.IdempotencyKeys, credentialBox, idempotencyTTL)
+
 	// Public login route (no auth middleware)
-	e.POST("/admin/login", admin.LoginHandler)
+	e.POST("/admin/login", admin.LoginHandler(store.Admins))
 
 	// Admin routes (JWT auth)
 	adminRoutes := e.Group("/admin")
 	adminRoutes.Use(customMiddleware.AdminAuthMiddleware(rateLimiter))
 
 	// Admin protected routes
-	adminRoutes.GET("/roles", handlers.ListRoles)
-	adminRoutes.POST("/roles", handlers.CreateRole)
-	adminRoutes.GET("/roles/:role_id", handlers.GetRole)
+	adminRoutes.GET("/roles", h.ListRoles)
+	adminRoutes.POST("/roles", h.CreateRole)
+	adminRoutes.GET("/roles/:role_id", h.GetRole)
+	adminRoutes.GET("/agents", h.ListAgents)
+	adminRoutes.GET("/agents/:uuid", h.GetAgent)
+	adminRoutes.PATCH("/agents/:uuid", h.UpdateAgent)
+	adminRoutes.DELETE("/agents/:uuid", h.DecommissionAgent)
+	adminRoutes.GET("/task-types", h.ListTaskTypes)
+	adminRoutes.GET("/tasks", h.ListTasks)
+	adminRoutes.POST("/tasks/cancel", h.BulkCancelTasks)
+	adminRoutes.POST("/tasks/priority", h.BulkSetTaskPriority)
+	adminRoutes.POST("/tasks/results", h.QueryTaskResults)
+	adminRoutes.POST("/tasks/:task_id/rerun", h.RerunTask)
+	adminRoutes.GET("/tasks/:task_id/logs", h.GetTaskLog)
+	adminRoutes.GET("/tasks/:task_id/artifacts", h.ListTaskArtifacts)
+	adminRoutes.GET("/artifacts/:artifact_id/download", h.DownloadArtifact)
+	adminRoutes.GET("/artifacts/:artifact_id/preview", h.PreviewArtifact)
+	adminRoutes.GET("/jobs", h.ListJobs)
+	adminRoutes.POST("/jobs", h.CreateJob, idempotent)
+	adminRoutes.GET("/jobs/:job_id", h.GetJob)
+	adminRoutes.GET("/jobs/:job_id/results", h.GetJobResults)
+	adminRoutes.POST("/jobs/:job_id/cancel", h.CancelJob)
+	adminRoutes.POST("/jobs/:job_id/resume", h.ResumeJob)
+	adminRoutes.POST("/jobs/:job_id/abort", h.AbortJob)
+	adminRoutes.GET("/templates", h.ListTemplates)
+	adminRoutes.POST("/templates", h.CreateTemplate)
+	adminRoutes.GET("/templates/export", h.ExportTemplates)
+	adminRoutes.POST("/templates/import", h.ImportTemplates)
+	adminRoutes.GET("/templates/:name", h.GetTemplate)
+	adminRoutes.DELETE("/templates/:name", h.DeleteTemplate)
+	adminRoutes.GET("/templates/:name/versions", h.ListTemplateVersions)
+	adminRoutes.POST("/templates/:name/instantiate", h.InstantiateTemplate)
+	adminRoutes.GET("/workflows", h.ListWorkflows)
+	adminRoutes.POST("/workflows", h.CreateWorkflow)
+	adminRoutes.GET("/workflows/:workflow_id", h.GetWorkflow)
+	adminRoutes.PUT("/workflows/:workflow_id", h.ReplaceWorkflow)
+	adminRoutes.DELETE("/workflows/:workflow_id", h.DeleteWorkflow)
+	adminRoutes.POST("/workflows/:workflow_id/runs", h.StartWorkflow)
+	adminRoutes.GET("/workflow-runs", h.ListWorkflowRuns)
+	adminRoutes.GET("/workflow-runs/:run_id", h.GetWorkflowRun)
+	adminRoutes.POST("/workflow-runs/:run_id/cancel", h.CancelWorkflowRun)
+	adminRoutes.GET("/schedules", h.ListSchedules)
+	adminRoutes.POST("/schedules", h.CreateSchedule)
+	adminRoutes.GET("/schedules/:schedule_id", h.GetSchedule)
+	adminRoutes.PUT("/schedules/:schedule_id", h.ReplaceSchedule)
+	adminRoutes.DELETE("/schedules/:schedule_id", h.DeleteSchedule)
+	adminRoutes.GET("/enrollment-tokens", h.ListEnrollmentTokens)
+	adminRoutes.POST("/enrollment-tokens", h.CreateEnrollmentToken)
+	adminRoutes.DELETE("/enrollment-tokens/:token_id", h.RevokeEnrollmentToken)
+
+	// Agent request bodies are buffered for their signature check, so they are capped first
+	bodyLimit := customMiddleware.BodyLimitMiddleware(customMiddleware.DefaultMaxBodyBytes, map[string]int64{
+		"/api/task/artifacts/:task_id": artifacts.MaxUploadBytes(),
+	})
+
+	// Public enrollment route; the enrollment token is the credential
+	e.POST("/api/agent/enroll", h.EnrollAgent, bodyLimit, customMiddleware.EnrollmentIdempotencyMiddleware(store.IdempotencyKeys, credentialBox, idempotencyTTL))
 
 	// Agent routes (API key auth)
 	agentRoutes := e.Group("/api")
-	agentRoutes.Use(customMiddleware.APIAuthMiddleware)
+	agentRoutes.Use(bodyLimit)
+	// Agents that lost the response to a credential rotation replay it with their old credentials
+	signatureOptions.Replays = store.IdempotencyKeys
+	agentRoutes.Use(customMiddleware.APIAuthMiddleware(store.Agents, store.Nonces, credentialBox, signatureOptions))
 
 	// Agent endpoints
-	agentRoutes.POST("/agent/register", handlers.RegisterAgent)
-	agentRoutes.POST("/agent/heartbeat", handlers.AgentHeartbeat)
-	agentRoutes.GET("/agent/:uuid/summary", handlers.GetAgentSummary)
-	agentRoutes.GET("/agent/:agent_id/tasks", handlers.ListAgentTasks)
-	agentRoutes.POST("/task/create", handlers.CreateTask, customMiddleware.RequestValidationMiddleware)
-	agentRoutes.GET("/task/status/:task_id", handlers.GetTaskStatus)
-	agentRoutes.POST("/task/cancel/:task_id", handlers.CancelTask)
+	agentRoutes.POST("/agent/register", h.RegisterAgent, idempotent)
+	agentRoutes.POST("/agent/heartbeat", h.AgentHeartbeat)
+	agentRoutes.GET("/agent/:uuid/summary", h.GetAgentSummary)
+	agentRoutes.GET("/agent/:agent_id/tasks", h.ListAgentTasks)
+	agentRoutes.POST("/task/create", h.CreateTask, idempotent, customMiddleware.RequestValidationMiddleware)
+	agentRoutes.GET("/task/status/:task_id", h.GetTaskStatus)
+	agentRoutes.POST("/task/cancel/:task_id", h.CancelTask)
+	agentRoutes.POST("/task/cancel/:task_id/ack", h.AcknowledgeCancel)
+	agentRoutes.POST("/task/lease/:task_id", h.RenewTaskLease)
+	agentRoutes.GET("/task/poll", h.PollTask)
+	agentRoutes.POST("/task/update", h.UpdateTask)
+	agentRoutes.POST("/task/logs/:task_id", h.AppendTaskLog)
+	agentRoutes.POST("/task/artifacts/:task_id", h.UploadArtifact)
 }
 
 func startServer(e *echo.Echo, cfg *config.Config) {
@@ -85,6 +85,7 @@ func getDefaultConfig() *config.Config {
             TokenExpirationHours: 24,
             APIKey:               generateSecureString(32),
             APISecret:            generateSecureString(32),
+            CredentialKey:        generateSecureString(32),
         },
         Admin: config.AdminConfig{
             DefaultUsername: "admin",
@@ -101,7 +102,8 @@ func getDefaultConfig() *config.Config {
                 RequireNumbers   bool `yaml:"require_numbers"`
                 RequireSpecial   bool `yaml:"require_special"`
             } `yaml:"password_policy"`
-            RateLimiting config.RateLimiterConfig `yaml:"rate_limiting"`
+            RateLimiting   config.RateLimiterConfig    `yaml:"rate_limiting"`
+            RequestSigning config.RequestSigningConfig `yaml:"request_signing"`
         }{
             PasswordPolicy: struct {
                 MinLength        int  `yaml:"min_length"`
@@ -121,6 +123,9 @@ func getDefaultConfig() *config.Config {
                 WindowSeconds:   300,
                 BlockoutMinutes: 15,
             },
+            RequestSigning: config.RequestSigningConfig{
+                ClockSkewSeconds: 300,
+            },
         },
     }
 }
@@ -403,6 +408,7 @@ JWT_SECRET=%s
 TOKEN_EXPIRATION_HOURS=%d
 API_KEY=%s
 API_SECRET=%s
+CREDENTIAL_KEY=%s
 
 # Admin Configuration
 ADMIN_DEFAULT_USERNAME=%s
@@ -426,6 +432,7 @@ LOG_LEVEL=%s`,
         cfg.Auth.TokenExpirationHours,
         cfg.Auth.APIKey,
         cfg.Auth.APISecret,
+        cfg.Auth.CredentialKey,
         cfg.Admin.DefaultUsername,
         cfg.Admin.DefaultPassword,
         cfg.Logging.Level)
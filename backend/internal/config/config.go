@@ -47,6 +47,8 @@ type AuthConfig struct {
 	TokenExpirationHours int    `yaml:"token_expiration_hours"`
 	APIKey              string `yaml:"api_key"`
 	APISecret           string `yaml:"api_secret"`
+	// CredentialKey encrypts agent secrets at rest. Falls back to JWTSecret when empty.
+	CredentialKey string `yaml:"credential_key"`
 }
 
 type AdminConfig struct {
@@ -58,6 +60,102 @@ type LoggingConfig struct {
 	Level string `yaml:"level"`
 }
 
+// RequestSigningConfig controls how signed agent requests are verified.
+type RequestSigningConfig struct {
+	// ClockSkewSeconds is how far X-Timestamp may drift from the manager clock.
+	ClockSkewSeconds int `yaml:"clock_skew_seconds"`
+	// RequireCanonical rejects agents that still sign only the request body.
+	RequireCanonical bool `yaml:"require_canonical"`
+}
+
+// ReaperConfig controls the background worker that enforces task timeouts and agent liveness.
+type ReaperConfig struct {
+	IntervalSeconds          int `yaml:"interval_seconds"`
+	InactiveAfterSeconds     int `yaml:"inactive_after_seconds"`     // without a heartbeat before an agent is "inactive"
+	DisconnectedAfterSeconds int `yaml:"disconnected_after_seconds"` // without a heartbeat before an agent is "disconnected"
+	// RequeueOrphanedTasks puts the running tasks of disconnected agents back in the queue.
+	RequeueOrphanedTasks bool `yaml:"requeue_orphaned_tasks"`
+	// TaskRetentionDays is how long finished tasks are kept after their last update before they
+	// are deleted with their logs and artifacts. Jobs and workflow runs are deleted with their
+	// tasks once all of those finished this long ago. 0 keeps them forever.
+	TaskRetentionDays int `yaml:"task_retention_days"`
+	// CancelGraceSeconds is how long an agent has to acknowledge the cancellation of a task it
+	// holds before the task is marked cancelled without it.
+	CancelGraceSeconds int `yaml:"cancel_grace_seconds"`
+	// ReassignExpiredLeases hands tasks whose lease expired to another active agent with the
+	// same role, instead of back to the agent that lost them.
+	ReassignExpiredLeases bool `yaml:"reassign_expired_leases"`
+}
+
+// SchedulerConfig controls the background worker that creates tasks from schedules.
+type SchedulerConfig struct {
+	IntervalSeconds int `yaml:"interval_seconds"`
+	// MisfireGraceSeconds is how late an occurrence may fire before it counts as missed.
+	MisfireGraceSeconds int `yaml:"misfire_grace_seconds"`
+}
+
+// RolloutConfig controls the background worker that advances rolling jobs wave by wave.
+type RolloutConfig struct {
+	IntervalSeconds int `yaml:"interval_seconds"`
+}
+
+// WorkflowConfig controls the background worker that starts the nodes of workflow runs.
+type WorkflowConfig struct {
+	IntervalSeconds int `yaml:"interval_seconds"`
+}
+
+// TaskTypesConfig controls where task types beyond the built-in ones are loaded from.
+type TaskTypesConfig struct {
+	// Dir holds one JSON file per task type. Files replace built-in types with the same name.
+	Dir string `yaml:"dir"`
+	// MaxConcurrent caps how many tasks of a type one agent holds at once, overriding the
+	// max_concurrent of the type's definition.
+	MaxConcurrent map[string]int `yaml:"max_concurrent"`
+}
+
+// DispatchConfig controls how the queued tasks of an agent are shared out between the jobs and
+// submitters that queued them.
+type DispatchConfig struct {
+	// Window is how many of an agent's most recent claims fair shares are computed over.
+	Window int `yaml:"window"`
+	// Weights gives some queues, such as "submitter:alice" or "job:<id>", a larger share. Queues
+	// that are not listed have weight 1.
+	Weights map[string]int `yaml:"weights"`
+	// LeaseSeconds is how long an agent holds a claimed task without renewing its lease, by a
+	// heartbeat or a renew call, before the reaper takes the task back. Zero, the default when
+	// it is not set, disables leases: claimed tasks stay with their agent until they finish or
+	// time out.
+	LeaseSeconds int `yaml:"lease_seconds"`
+	// MaxPollWaitSeconds caps how long a poll with a wait parameter is held until a task is
+	// queued for the agent.
+	MaxPollWaitSeconds int `yaml:"max_poll_wait_seconds"`
+	// MaxWaitingPolls caps how many polls are held at once; further polls answer at once.
+	MaxWaitingPolls int `yaml:"max_waiting_polls"`
+	// WatchChanges follows the MongoDB change stream of the tasks collection, so that held
+	// polls also wake up for tasks queued through other manager instances. It needs a replica
+	// set.
+	WatchChanges bool `yaml:"watch_changes"`
+}
+
+// ArtifactsConfig caps the files agents attach to their tasks.
+type ArtifactsConfig struct {
+	// MaxFileBytes caps the size of one artifact.
+	MaxFileBytes int64 `yaml:"max_file_bytes"`
+	// MaxTaskBytes caps the combined size of the artifacts of one task.
+	MaxTaskBytes int64 `yaml:"max_task_bytes"`
+}
+
+// IdempotencyConfig controls how long responses to requests with an Idempotency-Key header
+// are kept for retries.
+type IdempotencyConfig struct {
+	TTLHours int `yaml:"ttl_hours"`
+}
+
+// StorageConfig selects the persistence backend.
+type StorageConfig struct {
+	Backend string `yaml:"backend"` // "mongo" or "memory"
+}
+
 // Config holds all configuration settings
 type Config struct {
 	Server   ServerConfig `yaml:"server"`
@@ -69,12 +167,22 @@ type Config struct {
 			RequireNumbers   bool `yaml:"require_numbers"`
 			RequireSpecial   bool `yaml:"require_special"`
 		} `yaml:"password_policy"`
-		RateLimiting RateLimiterConfig `yaml:"rate_limiting"`
+		RateLimiting   RateLimiterConfig    `yaml:"rate_limiting"`
+		RequestSigning RequestSigningConfig `yaml:"request_signing"`
 	} `yaml:"security"`
-	MongoDB MongoDBConfig `yaml:"mongodb"`
-	Auth    AuthConfig    `yaml:"auth"`
-	Admin   AdminConfig   `yaml:"admin"`
-	Logging LoggingConfig `yaml:"logging"`
+	Storage     StorageConfig     `yaml:"storage"`
+	Reaper      ReaperConfig      `yaml:"reaper"`
+	Scheduler   SchedulerConfig   `yaml:"scheduler"`
+	Rollout     RolloutConfig     `yaml:"rollout"`
+	Workflow    WorkflowConfig    `yaml:"workflow"`
+	TaskTypes   TaskTypesConfig   `yaml:"task_types"`
+	Dispatch    DispatchConfig    `yaml:"dispatch"`
+	Artifacts   ArtifactsConfig   `yaml:"artifacts"`
+	Idempotency IdempotencyConfig `yaml:"idempotency"`
+	MongoDB     MongoDBConfig     `yaml:"mongodb"`
+	Auth        AuthConfig        `yaml:"auth"`
+	Admin       AdminConfig       `yaml:"admin"`
+	Logging     LoggingConfig     `yaml:"logging"`
 }
 
 // CLIFlags holds all command line arguments
@@ -83,6 +191,7 @@ type CLIFlags struct {
 	ServerHost         string
 	ServerPort         int
 	BehindReverseProxy bool // Added flag
+	Storage            string
 	MongoURI           string
 	MongoDatabase      string
 	LogLevel           string
@@ -116,12 +225,15 @@ func LoadConfig(filename string) (*Config, error) {
 	// Set defaults for any missing values
 	setConfigDefaults(config)
 
-	// Validate configuration
+	return config, nil
+}
+
+// ValidateConfig checks the final configuration, after command line flags have been merged.
+func ValidateConfig(config *Config) error {
 	if err := validateConfig(config); err != nil {
-		return nil, fmt.Errorf("invalid configuration: %w", err)
+		return fmt.Errorf("invalid configuration: %w", err)
 	}
-
-	return config, nil
+	return nil
 }
 
 // ParseFlags parses command line arguments
@@ -136,6 +248,9 @@ func ParseFlags() *CLIFlags {
 	flag.IntVar(&flags.ServerPort, "port", 0, "Server port")
 	flag.BoolVar(&flags.BehindReverseProxy, "behind-reverse-proxy", false, "Is the server behind a reverse proxy?") // Added flag
 
+	// Storage settings
+	flag.StringVar(&flags.Storage, "storage", "", "Storage backend (mongo, memory)")
+
 	// MongoDB settings
 	flag.StringVar(&flags.MongoURI, "mongo-uri", "", "MongoDB URI")
 	flag.StringVar(&flags.MongoDatabase, "mongo-db", "", "MongoDB database name")
@@ -169,6 +284,9 @@ func MergeConfig(config *Config, flags *CLIFlags) {
 	if flags.BehindReverseProxy { // Check for flag, no need to check if it's empty
 		config.Server.BehindReverseProxy = flags.BehindReverseProxy
 	}
+	if flags.Storage != "" {
+		config.Storage.Backend = flags.Storage
+	}
 	if flags.MongoURI != "" {
 		config.MongoDB.URI = flags.MongoURI
 	}
@@ -212,6 +330,54 @@ func setConfigDefaults(config *Config) {
 	// Default BehindReverseProxy to false if not explicitly set.
 	//  No explicit default needed; Go's zero value for bool is false.
 
+	if config.Storage.Backend == "" {
+		config.Storage.Backend = "mongo"
+	}
+	if config.Reaper.IntervalSeconds == 0 {
+		config.Reaper.IntervalSeconds = 30
+	}
+	if config.Reaper.InactiveAfterSeconds == 0 {
+		config.Reaper.InactiveAfterSeconds = 120 // 2 minutes
+	}
+	if config.Reaper.DisconnectedAfterSeconds == 0 {
+		config.Reaper.DisconnectedAfterSeconds = 900 // 15 minutes
+	}
+	if config.Reaper.CancelGraceSeconds == 0 {
+		config.Reaper.CancelGraceSeconds = 300 // 5 minutes
+	}
+	if config.Scheduler.IntervalSeconds == 0 {
+		config.Scheduler.IntervalSeconds = 15
+	}
+	if config.Scheduler.MisfireGraceSeconds == 0 {
+		config.Scheduler.MisfireGraceSeconds = 300 // 5 minutes
+	}
+	if config.Rollout.IntervalSeconds == 0 {
+		config.Rollout.IntervalSeconds = 10
+	}
+	if config.Workflow.IntervalSeconds == 0 {
+		config.Workflow.IntervalSeconds = 5
+	}
+	if config.TaskTypes.Dir == "" {
+		config.TaskTypes.Dir = "config/task_types"
+	}
+	if config.Dispatch.Window == 0 {
+		config.Dispatch.Window = 20
+	}
+	if config.Dispatch.MaxPollWaitSeconds == 0 {
+		config.Dispatch.MaxPollWaitSeconds = 30
+	}
+	if config.Dispatch.MaxWaitingPolls == 0 {
+		config.Dispatch.MaxWaitingPolls = 1000
+	}
+	if config.Artifacts.MaxFileBytes == 0 {
+		config.Artifacts.MaxFileBytes = 32 << 20 // 32MB
+	}
+	if config.Artifacts.MaxTaskBytes == 0 {
+		config.Artifacts.MaxTaskBytes = 256 << 20 // 256MB
+	}
+	if config.Idempotency.TTLHours == 0 {
+		config.Idempotency.TTLHours = 24
+	}
 	if config.Auth.TokenExpirationHours == 0 {
 		config.Auth.TokenExpirationHours = 24
 	}
@@ -230,18 +396,84 @@ func setConfigDefaults(config *Config) {
 	if config.Security.RateLimiting.BlockoutMinutes == 0 {
 		config.Security.RateLimiting.BlockoutMinutes = 15
 	}
+	if config.Security.RequestSigning.ClockSkewSeconds == 0 {
+		config.Security.RequestSigning.ClockSkewSeconds = 300 // 5 minutes
+	}
 }
 
 // validateConfig checks if the configuration is valid
 func validateConfig(config *Config) error {
 	var errors []string
 
-	// Validate MongoDB configuration
-	if config.MongoDB.URI == "" {
-		errors = append(errors, "MongoDB URI is required")
+	// Validate storage configuration; MongoDB settings are only needed for the mongo backend
+	switch config.Storage.Backend {
+	case "mongo":
+		if config.MongoDB.URI == "" {
+			errors = append(errors, "MongoDB URI is required")
+		}
+		if config.MongoDB.Database == "" {
+			errors = append(errors, "MongoDB database name is required")
+		}
+	case "memory":
+	default:
+		errors = append(errors, fmt.Sprintf("Unsupported storage backend: %s", config.Storage.Backend))
+	}
+
+	// Validate reaper configuration
+	if config.Reaper.IntervalSeconds < 1 {
+		errors = append(errors, "Reaper interval must be at least 1 second")
+	}
+	if config.Reaper.InactiveAfterSeconds < 1 {
+		errors = append(errors, "Reaper inactive threshold must be at least 1 second")
+	}
+	if config.Reaper.DisconnectedAfterSeconds <= config.Reaper.InactiveAfterSeconds {
+		errors = append(errors, "Reaper disconnected threshold must be greater than the inactive threshold")
+	}
+	if config.Reaper.TaskRetentionDays < 0 {
+		errors = append(errors, "Reaper task retention must not be negative")
+	}
+	if config.Reaper.CancelGraceSeconds < 1 {
+		errors = append(errors, "Reaper cancellation grace period must be at least 1 second")
+	}
+
+	// Validate scheduler configuration
+	if config.Scheduler.IntervalSeconds < 1 {
+		errors = append(errors, "Scheduler interval must be at least 1 second")
+	}
+	if config.Scheduler.MisfireGraceSeconds < 1 {
+		errors = append(errors, "Scheduler misfire grace must be at least 1 second")
+	}
+	if config.Rollout.IntervalSeconds < 1 {
+		errors = append(errors, "Rollout interval must be at least 1 second")
+	}
+	if config.Workflow.IntervalSeconds < 1 {
+		errors = append(errors, "Workflow interval must be at least 1 second")
+	}
+	if config.Dispatch.Window < 1 {
+		errors = append(errors, "Dispatch window must be at least 1 claim")
+	}
+	if config.Dispatch.LeaseSeconds < 0 {
+		errors = append(errors, "Task lease must not be negative")
 	}
-	if config.MongoDB.Database == "" {
-		errors = append(errors, "MongoDB database name is required")
+	if config.Dispatch.MaxPollWaitSeconds < 1 {
+		errors = append(errors, "Maximum poll wait must be at least 1 second")
+	}
+	if config.Dispatch.MaxWaitingPolls < 1 {
+		errors = append(errors, "Maximum waiting polls must be at least 1")
+	}
+	for queue, weight := range config.Dispatch.Weights {
+		if weight < 1 {
+			errors = append(errors, fmt.Sprintf("Dispatch weight of %q must be at least 1", queue))
+		}
+	}
+	if config.Artifacts.MaxFileBytes < 1 {
+		errors = append(errors, "Artifact size limit must be at least 1 byte")
+	}
+	if config.Artifacts.MaxTaskBytes < config.Artifacts.MaxFileBytes {
+		errors = append(errors, "Per-task artifact quota must be at least the artifact size limit")
+	}
+	if config.Idempotency.TTLHours < 1 {
+		errors = append(errors, "Idempotency key TTL must be at least 1 hour")
 	}
 
 	// Validate TLS configuration if enabled *and* not behind a reverse proxy
@@ -281,6 +513,11 @@ func validateConfig(config *Config) error {
 		errors = append(errors, "Rate limiting blockout period must be at least 1 minute")
 	}
 
+	// Validate request signing
+	if config.Security.RequestSigning.ClockSkewSeconds < 1 {
+		errors = append(errors, "Request signing clock skew must be at least 1 second")
+	}
+
 	if len(errors) > 0 {
 		return fmt.Errorf("configuration validation errors:\n- %s", strings.Join(errors, "\n- "))
 	}
@@ -0,0 +1,414 @@
+// Package reaper runs the background worker that enforces task timeouts, leases and
+// cancellation grace periods, tracks agent liveness and deletes finished tasks, jobs and
+// workflow runs past their retention.
+package reaper
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+
+	"github.com/whit3rabbit/beehive/manager/internal/config"
+	"github.com/whit3rabbit/beehive/manager/internal/logger"
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+// Agent statuses managed by the reaper. Heartbeats move agents back to StatusActive.
+const (
+	StatusActive       = "active"
+	StatusInactive     = "inactive"
+	StatusDisconnected = "disconnected"
+)
+
+// sweepTimeout bounds a single pass so a slow backend cannot stall the worker.
+const sweepTimeout = 30 * time.Second
+
+// retentionBatch is how many expired tasks are deleted at a time.
+const retentionBatch = 500
+
+// leaseBatch is how many tasks whose lease expired are queued again at a time.
+const leaseBatch = 100
+
+// Reaper periodically times out overdue tasks, queues again tasks whose lease expired, cancels
+// tasks whose agent did not acknowledge their cancellation in time, marks agents that stopped
+// sending heartbeats and deletes expired tasks, jobs and workflow runs.
+type Reaper struct {
+	store                *storage.Store
+	interval             time.Duration
+	inactiveAfter        time.Duration
+	disconnectedAfter    time.Duration
+	requeueOrphanedTasks bool
+	reassignExpired      bool          // hand tasks with an expired lease to another agent of the role
+	retention            time.Duration // zero keeps finished tasks, jobs and workflow runs forever
+	cancelGrace          time.Duration // how long agents have to acknowledge a cancellation
+}
+
+// Result summarizes one sweep.
+type Result struct {
+	TimedOutTasks      int64
+	CancelledTasks     int64
+	InactiveAgents     int
+	DisconnectedAgents int
+	RequeuedTasks      int64
+	ExpiredLeases      int64
+	DeletedTasks       int64
+	DeletedJobs        int64
+	DeletedRuns        int64
+}
+
+// New creates a Reaper from the reaper section of the configuration.
+func New(store *storage.Store, cfg config.ReaperConfig) *Reaper {
+	return &Reaper{
+		store:                store,
+		interval:             time.Duration(cfg.IntervalSeconds) * time.Second,
+		inactiveAfter:        time.Duration(cfg.InactiveAfterSeconds) * time.Second,
+		disconnectedAfter:    time.Duration(cfg.DisconnectedAfterSeconds) * time.Second,
+		requeueOrphanedTasks: cfg.RequeueOrphanedTasks,
+		reassignExpired:      cfg.ReassignExpiredLeases,
+		retention:            time.Duration(cfg.TaskRetentionDays) * 24 * time.Hour,
+		cancelGrace:          time.Duration(cfg.CancelGraceSeconds) * time.Second,
+	}
+}
+
+// Run sweeps every interval until ctx is cancelled. Errors are logged and the next sweep is
+// attempted as usual.
+func (r *Reaper) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Info("Stopping reaper")
+			return
+		case now := <-ticker.C:
+			sweepCtx, cancel := context.WithTimeout(ctx, sweepTimeout)
+			result, err := r.Sweep(sweepCtx, now)
+			cancel()
+			if err != nil {
+				logger.Error("Reaper sweep failed", zap.Error(err))
+			}
+			if result != (Result{}) {
+				logger.Info("Reaper sweep completed",
+					zap.Int64("timed_out_tasks", result.TimedOutTasks),
+					zap.Int64("cancelled_tasks", result.CancelledTasks),
+					zap.Int("inactive_agents", result.InactiveAgents),
+					zap.Int("disconnected_agents", result.DisconnectedAgents),
+					zap.Int64("requeued_tasks", result.RequeuedTasks),
+					zap.Int64("expired_leases", result.ExpiredLeases),
+					zap.Int64("deleted_tasks", result.DeletedTasks),
+					zap.Int64("deleted_jobs", result.DeletedJobs),
+					zap.Int64("deleted_workflow_runs", result.DeletedRuns))
+			}
+		}
+	}
+}
+
+// Sweep performs a single pass as of now. It stops at the first error and returns what it
+// changed up to that point.
+func (r *Reaper) Sweep(ctx context.Context, now time.Time) (Result, error) {
+	var result Result
+
+	timedOut, err := r.store.Tasks.TimeoutOverdue(ctx, now)
+	if err != nil {
+		return result, err
+	}
+	result.TimedOutTasks = timedOut
+
+	if r.cancelGrace > 0 {
+		cancelled, err := r.store.Tasks.CancelOverdue(ctx, now.Add(-r.cancelGrace), now)
+		if err != nil {
+			return result, err
+		}
+		result.CancelledTasks = cancelled
+	}
+
+	// Disconnect first so agents silent for long enough skip the inactive state in one sweep
+	disconnected, err := r.store.Agents.MarkStale(ctx, []string{StatusActive, StatusInactive}, StatusDisconnected, now.Add(-r.disconnectedAfter))
+	if err != nil {
+		return result, err
+	}
+	result.DisconnectedAgents = len(disconnected)
+
+	inactive, err := r.store.Agents.MarkStale(ctx, []string{StatusActive}, StatusInactive, now.Add(-r.inactiveAfter))
+	if err != nil {
+		return result, err
+	}
+	result.InactiveAgents = len(inactive)
+
+	// After marking agents, so that tasks are not reassigned to agents that just went silent
+	expired, err := r.requeueExpired(ctx, now)
+	result.ExpiredLeases = expired
+	if err != nil {
+		return result, err
+	}
+
+	if r.requeueOrphanedTasks {
+		for _, uuid := range disconnected {
+			requeued, err := r.store.Tasks.RequeueRunning(ctx, uuid, now)
+			if err != nil {
+				return result, err
+			}
+			if requeued > 0 {
+				logger.Warn("Requeued tasks of disconnected agent", zap.String("agent_uuid", uuid), zap.Int64("tasks", requeued))
+			}
+			result.RequeuedTasks += requeued
+		}
+	}
+
+	if r.retention > 0 {
+		before := now.Add(-r.retention)
+		deleted, err := r.deleteExpired(ctx, before)
+		result.DeletedTasks = deleted
+		if err != nil {
+			return result, err
+		}
+		jobs, deleted, err := r.deleteExpiredJobs(ctx, before)
+		result.DeletedJobs = jobs
+		result.DeletedTasks += deleted
+		if err != nil {
+			return result, err
+		}
+		runs, deleted, err := r.deleteExpiredRuns(ctx, before)
+		result.DeletedRuns = runs
+		result.DeletedTasks += deleted
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// requeueExpired queues the tasks whose lease expired again, for the agent that lost them or,
+// with reassignExpired, for another agent of its role. It returns how many tasks it requeued.
+// Tasks of jobs and workflow runs always go back to their agent, which they were created for.
+func (r *Reaper) requeueExpired(ctx context.Context, now time.Time) (int64, error) {
+	var requeued int64
+	for {
+		tasks, err := r.store.Tasks.ExpiredLeases(ctx, now, leaseBatch)
+		if err != nil || len(tasks) == 0 {
+			return requeued, err
+		}
+		for i := range tasks {
+			task := &tasks[i]
+			agentID := task.AgentID
+			if r.reassignExpired && task.JobID == "" && task.WorkflowRunID == "" {
+				if agentID, err = r.reassignTo(ctx, task); err != nil {
+					return requeued, err
+				}
+			}
+			err := r.store.Tasks.RequeueExpired(ctx, task.ID, agentID, now)
+			if errors.Is(err, storage.ErrDuplicate) && agentID != task.AgentID {
+				// The other agent already has a task for the same schedule occurrence
+				agentID = task.AgentID
+				err = r.store.Tasks.RequeueExpired(ctx, task.ID, agentID, now)
+			}
+			switch {
+			case err == nil:
+				requeued++
+				logger.Warn("Requeued task with expired lease",
+					zap.String("task_id", task.ID.Hex()),
+					zap.String("lost_by", task.AgentID),
+					zap.String("agent_uuid", agentID))
+			case errors.Is(err, storage.ErrConflict), errors.Is(err, storage.ErrNotFound):
+				// Renewed, finished or deleted since it was listed
+			default:
+				return requeued, err
+			}
+		}
+		if len(tasks) < leaseBatch {
+			return requeued, nil
+		}
+	}
+}
+
+// reassignTo picks the active agent with the same role as the agent of task, other than that
+// agent, that holds the fewest tasks. It returns the task's own agent if there is none.
+func (r *Reaper) reassignTo(ctx context.Context, task *models.Task) (string, error) {
+	agent, err := r.store.Agents.GetByUUID(ctx, task.AgentID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return task.AgentID, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if agent.Role == "" {
+		return task.AgentID, nil
+	}
+	candidates, err := storage.MatchingAgents(ctx, r.store.Agents, storage.AgentFilter{Role: agent.Role, Status: StatusActive})
+	if err != nil {
+		return "", err
+	}
+
+	best, fewest := task.AgentID, -1
+	for _, candidate := range candidates {
+		if candidate.UUID == task.AgentID {
+			continue
+		}
+		held, err := r.store.Tasks.CountHeld(ctx, candidate.UUID)
+		if err != nil {
+			return "", err
+		}
+		var count int
+		for _, n := range held {
+			count += n
+		}
+		if fewest < 0 || count < fewest {
+			best, fewest = candidate.UUID, count
+		}
+	}
+	return best, nil
+}
+
+// deleteExpired deletes the finished tasks last updated before before, with their logs and
+// artifacts, and returns how many tasks it deleted. Tasks of jobs and workflow runs are left
+// to deleteExpiredJobs and deleteExpiredRuns.
+func (r *Reaper) deleteExpired(ctx context.Context, before time.Time) (int64, error) {
+	var deleted int64
+	for {
+		ids, err := r.store.Tasks.FinishedBefore(ctx, before, retentionBatch)
+		if err != nil || len(ids) == 0 {
+			return deleted, err
+		}
+		n, err := r.deleteTasks(ctx, ids)
+		deleted += n
+		if err != nil || len(ids) < retentionBatch {
+			return deleted, err
+		}
+	}
+}
+
+// deleteExpiredJobs deletes the jobs created before before whose tasks all finished before
+// before, with their tasks, and returns how many jobs and tasks it deleted. Jobs whose rollout
+// is running or halted are kept, as they may still start waves.
+func (r *Reaper) deleteExpiredJobs(ctx context.Context, before time.Time) (int64, int64, error) {
+	var jobs, tasks int64
+	var after primitive.ObjectID
+	for {
+		batch, err := r.store.Jobs.CreatedBefore(ctx, before, after, retentionBatch)
+		if err != nil {
+			return jobs, tasks, err
+		}
+		for i := range batch {
+			job := &batch[i]
+			after = job.ID
+			if job.Rollout != nil && (job.Rollout.Status == models.RolloutRunning || job.Rollout.Status == models.RolloutHalted) {
+				continue
+			}
+			deleted, ok, err := r.deleteSettledTasks(ctx, storage.TaskFilter{JobID: job.ID.Hex()}, before)
+			tasks += deleted
+			if err != nil {
+				return jobs, tasks, err
+			}
+			if !ok {
+				continue
+			}
+			if err := r.store.Jobs.Delete(ctx, job.ID); err != nil && !errors.Is(err, storage.ErrNotFound) {
+				return jobs, tasks, err
+			}
+			jobs++
+		}
+		if len(batch) < retentionBatch {
+			return jobs, tasks, nil
+		}
+	}
+}
+
+// deleteExpiredRuns deletes the workflow runs that finished before before and whose tasks all
+// finished before before, with their tasks, and returns how many runs and tasks it deleted.
+func (r *Reaper) deleteExpiredRuns(ctx context.Context, before time.Time) (int64, int64, error) {
+	var runs, tasks int64
+	var after primitive.ObjectID
+	for {
+		batch, err := r.store.WorkflowRuns.FinishedBefore(ctx, before, after, retentionBatch)
+		if err != nil {
+			return runs, tasks, err
+		}
+		for i := range batch {
+			run := &batch[i]
+			after = run.ID
+			deleted, ok, err := r.deleteSettledTasks(ctx, storage.TaskFilter{WorkflowRunID: run.ID.Hex()}, before)
+			tasks += deleted
+			if err != nil {
+				return runs, tasks, err
+			}
+			if !ok {
+				continue
+			}
+			if err := r.store.WorkflowRuns.Delete(ctx, run.ID); err != nil && !errors.Is(err, storage.ErrNotFound) {
+				return runs, tasks, err
+			}
+			runs++
+		}
+		if len(batch) < retentionBatch {
+			return runs, tasks, nil
+		}
+	}
+}
+
+// deleteSettledTasks deletes the tasks matching filter, with their logs and artifacts, provided
+// they all finished before before. It returns how many it deleted and whether it deleted them
+// all. The parent is deleted after its tasks, so a pass that fails halfway finds it again.
+func (r *Reaper) deleteSettledTasks(ctx context.Context, filter storage.TaskFilter, before time.Time) (int64, bool, error) {
+	counts, err := r.store.Tasks.CountByStatus(ctx, filter)
+	if err != nil {
+		return 0, false, err
+	}
+	for status, n := range counts {
+		if n > 0 && !isFinishedStatus(status) {
+			return 0, false, nil
+		}
+	}
+	recent := filter
+	recent.UpdatedAfter = before
+	counts, err = r.store.Tasks.CountByStatus(ctx, recent)
+	if err != nil || len(counts) > 0 {
+		return 0, false, err
+	}
+
+	var deleted int64
+	for {
+		page, err := r.store.Tasks.List(ctx, storage.TaskQuery{Filter: filter, Limit: retentionBatch})
+		if err != nil {
+			return deleted, false, err
+		}
+		if len(page.Tasks) == 0 {
+			return deleted, true, nil
+		}
+		ids := make([]primitive.ObjectID, len(page.Tasks))
+		for i := range page.Tasks {
+			ids[i] = page.Tasks[i].ID
+		}
+		n, err := r.deleteTasks(ctx, ids)
+		deleted += n
+		if err != nil {
+			return deleted, false, err
+		}
+	}
+}
+
+// deleteTasks deletes the tasks with their logs and artifacts and returns how many tasks it
+// deleted. The tasks go last, so a pass that fails halfway finds them again next time.
+func (r *Reaper) deleteTasks(ctx context.Context, ids []primitive.ObjectID) (int64, error) {
+	if _, err := r.store.Artifacts.DeleteByTasks(ctx, ids); err != nil {
+		return 0, err
+	}
+	if _, err := r.store.TaskLogs.DeleteByTasks(ctx, ids); err != nil {
+		return 0, err
+	}
+	return r.store.Tasks.Delete(ctx, ids)
+}
+
+// isFinishedStatus reports whether status is one of models.FinishedTaskStatuses.
+func isFinishedStatus(status string) bool {
+	for _, finished := range models.FinishedTaskStatuses {
+		if status == finished {
+			return true
+		}
+	}
+	return false
+}
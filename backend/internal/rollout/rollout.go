@@ -0,0 +1,315 @@
+// Package rollout runs the background worker that dispatches rolling jobs wave by wave.
+//
+// A rolling job starts with its first wave. Once every task of the running wave has finished,
+// the worker either starts the next wave or, if too many of its tasks did not complete, halts
+// the rollout until an administrator resumes or aborts it. Every change is made with a
+// compare-and-swap on the rollout's status and wave, so several managers can share the work.
+package rollout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+
+	"github.com/whit3rabbit/beehive/manager/internal/config"
+	"github.com/whit3rabbit/beehive/manager/internal/logger"
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+// stepTimeout bounds a single pass so a slow backend cannot stall the worker.
+const stepTimeout = 30 * time.Second
+
+// abortAttempts is how often Abort re-reads a rollout the worker changed under it.
+const abortAttempts = 3
+
+var (
+	// ErrNoRollout is returned for jobs that were not created with a rollout policy.
+	ErrNoRollout = errors.New("job has no rollout")
+	// ErrRolloutStatus is returned when the rollout is not in a status the operation applies to.
+	ErrRolloutStatus = errors.New("rollout status does not allow this")
+)
+
+// Controller periodically advances running rollouts.
+type Controller struct {
+	store    *storage.Store
+	interval time.Duration
+}
+
+// Result summarizes one pass.
+type Result struct {
+	WavesStarted int
+	Halted       int
+	Completed    int
+}
+
+// New creates a Controller from the rollout section of the configuration.
+func New(store *storage.Store, cfg config.RolloutConfig) *Controller {
+	return &Controller{
+		store:    store,
+		interval: time.Duration(cfg.IntervalSeconds) * time.Second,
+	}
+}
+
+// Run steps every interval until ctx is cancelled. Errors are logged and the next step is
+// attempted as usual.
+func (c *Controller) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Info("Stopping rollout controller")
+			return
+		case now := <-ticker.C:
+			stepCtx, cancel := context.WithTimeout(ctx, stepTimeout)
+			result, err := c.Step(stepCtx, now)
+			cancel()
+			if err != nil {
+				logger.Error("Rollout step failed", zap.Error(err))
+			}
+			if result != (Result{}) {
+				logger.Info("Rollout step completed",
+					zap.Int("waves_started", result.WavesStarted),
+					zap.Int("halted", result.Halted),
+					zap.Int("completed", result.Completed))
+			}
+		}
+	}
+}
+
+// Step checks the running wave of every running rollout. A rollout that fails is logged and
+// skipped, so it does not hold up the others; Step returns the errors of all of them joined.
+func (c *Controller) Step(ctx context.Context, now time.Time) (Result, error) {
+	var result Result
+
+	jobs, err := c.store.Jobs.Rollouts(ctx, models.RolloutRunning)
+	if err != nil {
+		return result, err
+	}
+	var errs []error
+	for i := range jobs {
+		if err := c.stepJob(ctx, &jobs[i], now, &result); err != nil {
+			logger.Error("Failed to step rollout", zap.Error(err), zap.String("job_id", jobs[i].ID.Hex()))
+			errs = append(errs, fmt.Errorf("job %s: %w", jobs[i].ID.Hex(), err))
+		}
+	}
+	return result, errors.Join(errs...)
+}
+
+// stepJob advances one rollout if its running wave has finished.
+func (c *Controller) stepJob(ctx context.Context, job *models.Job, now time.Time, result *Result) error {
+	rollout := job.Rollout
+	number := rollout.CurrentWave
+	wave := &rollout.Waves[number-1]
+
+	counts, err := c.store.Tasks.CountByStatus(ctx, storage.TaskFilter{JobID: job.ID.Hex(), Wave: number})
+	if err != nil {
+		return err
+	}
+	var total, finished int64
+	for status, n := range counts {
+		total += n
+		if (&models.Task{Status: status}).IsFinished() {
+			finished += n
+		}
+	}
+	if total < int64(len(wave.AgentIDs)) {
+		// The manager that started the wave stopped before creating all of its tasks
+		_, err := CreateTasks(ctx, c.store.Tasks, job, wave.AgentIDs, number, now)
+		return err
+	}
+	if finished < total {
+		return nil
+	}
+
+	wave.FinishedAt = now
+	wave.Succeeded = counts[models.TaskStatusCompleted]
+	wave.Failed = finished - wave.Succeeded
+	if total > 0 {
+		wave.FailureRate = float64(wave.Failed) / float64(total)
+	}
+
+	if wave.FailureRate > rollout.Policy.MaxFailureRate {
+		rollout.HaltReason = rollout.FailureReason(wave)
+		rollout.Record(models.RolloutHalted, models.ActorRollout, rollout.HaltReason, now)
+		err := c.store.Jobs.UpdateRollout(ctx, job.ID, models.RolloutRunning, number, rollout)
+		if errors.Is(err, storage.ErrConflict) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		logger.Warn("Halted rollout", zap.String("job_id", job.ID.Hex()), zap.String("reason", rollout.HaltReason))
+		result.Halted++
+		return nil
+	}
+
+	started, err := advance(ctx, c.store, job, models.RolloutRunning, models.ActorRollout, now)
+	if errors.Is(err, storage.ErrConflict) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if started {
+		result.WavesStarted++
+	} else {
+		result.Completed++
+	}
+	return nil
+}
+
+// advance starts the wave after the current one, or completes the rollout after its last
+// wave, and reports whether a wave was started. The stored rollout must still be in status
+// at the current wave, or ErrConflict is returned and nothing is started.
+func advance(ctx context.Context, store *storage.Store, job *models.Job, status, actor string, now time.Time) (bool, error) {
+	rollout := job.Rollout
+	from := rollout.CurrentWave
+	if from == len(rollout.Waves) {
+		rollout.Record(models.RolloutCompleted, actor, "all waves finished", now)
+		return false, store.Jobs.UpdateRollout(ctx, job.ID, status, from, rollout)
+	}
+
+	next := &rollout.Waves[from]
+	agents, err := activeAgents(ctx, store.Agents, next.AgentIDs)
+	if err != nil {
+		return false, err
+	}
+	next.AgentIDs = agents
+	next.StartedAt = now
+	rollout.CurrentWave = next.Number
+	rollout.Record(models.RolloutRunning, actor, fmt.Sprintf("wave %d started", next.Number), now)
+	if err := store.Jobs.UpdateRollout(ctx, job.ID, status, from, rollout); err != nil {
+		return false, err
+	}
+
+	if _, err := CreateTasks(ctx, store.Tasks, job, next.AgentIDs, next.Number, now); err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+// activeAgents drops the agents that were decommissioned or deleted since the rollout was planned.
+func activeAgents(ctx context.Context, agents storage.AgentStore, uuids []string) ([]string, error) {
+	active := make([]string, 0, len(uuids))
+	for _, uuid := range uuids {
+		agent, err := agents.GetByUUID(ctx, uuid)
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if agent.Status != models.AgentStatusDecommissioned {
+			active = append(active, uuid)
+		}
+	}
+	return active, nil
+}
+
+// Start plans the waves of a new job and marks its first wave started. The caller stores the
+// job and then creates the tasks of wave 1.
+func Start(job *models.Job, policy models.RolloutPolicy, agents []string, actor string, now time.Time) {
+	rollout := &models.Rollout{Policy: policy, Waves: policy.Plan(agents), CurrentWave: 1}
+	rollout.Waves[0].StartedAt = now
+	rollout.Record(models.RolloutRunning, actor, "wave 1 started", now)
+	job.Rollout = rollout
+}
+
+// CreateTasks creates the tasks of a job for agents in the given rollout wave, zero outside
+// rollouts, and returns how many it created. Tasks that already exist are skipped.
+func CreateTasks(ctx context.Context, tasks storage.TaskStore, job *models.Job, agents []string, wave int, now time.Time) (int, error) {
+	actor := models.AdminActor(job.CreatedBy)
+	reason := "job " + job.Name
+	if wave > 0 {
+		reason = fmt.Sprintf("job %s wave %d", job.Name, wave)
+	}
+
+	created := 0
+	for _, agentID := range agents {
+		task := models.Task{
+			AgentID:    agentID,
+			Type:       job.Task.Type,
+			Parameters: job.Task.Parameters,
+			Timeout:    job.Task.Timeout,
+			Retry:      job.Task.Retry,
+			Priority:   job.Task.Priority,
+			CreatedAt:  now,
+			CreatedBy:  job.CreatedBy,
+			JobID:      job.ID.Hex(),
+			Wave:       wave,
+		}
+		if err := task.Transition(models.TaskStatusQueued, actor, reason, now); err != nil {
+			return created, err
+		}
+		err := tasks.Create(ctx, &task)
+		if errors.Is(err, storage.ErrDuplicate) {
+			continue
+		}
+		if err != nil {
+			return created, err
+		}
+		created++
+	}
+	return created, nil
+}
+
+// Resume continues a halted rollout with its next wave, or completes it if the halted wave
+// was the last. It returns the updated job.
+func Resume(ctx context.Context, store *storage.Store, id primitive.ObjectID, actor string, now time.Time) (*models.Job, error) {
+	job, err := store.Jobs.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if job.Rollout == nil {
+		return nil, ErrNoRollout
+	}
+	if job.Rollout.Status != models.RolloutHalted {
+		return nil, ErrRolloutStatus
+	}
+
+	job.Rollout.HaltReason = ""
+	if _, err := advance(ctx, store, job, models.RolloutHalted, actor, now); err != nil {
+		if errors.Is(err, storage.ErrConflict) {
+			return nil, ErrRolloutStatus
+		}
+		return nil, err
+	}
+	return job, nil
+}
+
+// Abort stops a running or halted rollout from starting further waves. Tasks already
+// dispatched are left alone. It returns the updated job.
+func Abort(ctx context.Context, store *storage.Store, id primitive.ObjectID, actor, reason string, now time.Time) (*models.Job, error) {
+	for attempt := 0; ; attempt++ {
+		job, err := store.Jobs.Get(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		rollout := job.Rollout
+		if rollout == nil {
+			return nil, ErrNoRollout
+		}
+		status := rollout.Status
+		if status != models.RolloutRunning && status != models.RolloutHalted {
+			return nil, ErrRolloutStatus
+		}
+
+		rollout.Record(models.RolloutAborted, actor, reason, now)
+		err = store.Jobs.UpdateRollout(ctx, id, status, rollout.CurrentWave, rollout)
+		if errors.Is(err, storage.ErrConflict) && attempt+1 < abortAttempts {
+			// The worker moved the rollout on in the meantime
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return job, nil
+	}
+}
@@ -0,0 +1,258 @@
+// Package scheduler runs the background worker that creates tasks from schedules.
+//
+// Several managers may share one database. Each occurrence is fired at most once per agent
+// because the tasks it creates carry the schedule ID and occurrence time, which the task store
+// keeps unique, and the next run only moves forward if no other manager moved it first.
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	// Embedded so schedule timezones resolve on hosts without tzdata
+	_ "time/tzdata"
+
+	"github.com/robfig/cron/v3"
+	"go.uber.org/zap"
+
+	"github.com/whit3rabbit/beehive/manager/internal/config"
+	"github.com/whit3rabbit/beehive/manager/internal/logger"
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+// tickTimeout bounds a single pass so a slow backend cannot stall the worker.
+const tickTimeout = 30 * time.Second
+
+// Scheduler periodically fires the schedules that are due.
+type Scheduler struct {
+	store        *storage.Store
+	interval     time.Duration
+	misfireGrace time.Duration
+}
+
+// Result summarizes one tick.
+type Result struct {
+	Fired        int // occurrences that created tasks
+	Skipped      int // missed occurrences dropped by the skip misfire policy
+	TasksCreated int
+}
+
+// New creates a Scheduler from the scheduler section of the configuration.
+func New(store *storage.Store, cfg config.SchedulerConfig) *Scheduler {
+	return &Scheduler{
+		store:        store,
+		interval:     time.Duration(cfg.IntervalSeconds) * time.Second,
+		misfireGrace: time.Duration(cfg.MisfireGraceSeconds) * time.Second,
+	}
+}
+
+// Run ticks every interval until ctx is cancelled. Errors are logged and the next tick is
+// attempted as usual.
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Info("Stopping scheduler")
+			return
+		case now := <-ticker.C:
+			tickCtx, cancel := context.WithTimeout(ctx, tickTimeout)
+			result, err := s.Tick(tickCtx, now)
+			cancel()
+			if err != nil {
+				logger.Error("Scheduler tick failed", zap.Error(err))
+			}
+			if result != (Result{}) {
+				logger.Info("Scheduler tick completed",
+					zap.Int("fired", result.Fired),
+					zap.Int("skipped", result.Skipped),
+					zap.Int("tasks_created", result.TasksCreated))
+			}
+		}
+	}
+}
+
+// Tick fires every schedule due at now. A schedule that fails is logged and left due, so it
+// is tried again next tick without holding up the others; Tick returns the errors of all of
+// them joined.
+func (s *Scheduler) Tick(ctx context.Context, now time.Time) (Result, error) {
+	var result Result
+
+	due, err := s.store.Schedules.Due(ctx, now)
+	if err != nil {
+		return result, err
+	}
+	var errs []error
+	for i := range due {
+		if err := s.tick(ctx, &due[i], now, &result); err != nil {
+			logger.Error("Failed to fire schedule", zap.Error(err), zap.String("schedule_id", due[i].ID.Hex()))
+			errs = append(errs, fmt.Errorf("schedule %s: %w", due[i].ID.Hex(), err))
+		}
+	}
+	return result, errors.Join(errs...)
+}
+
+// tick fires or skips the due occurrence of one schedule and moves it to its next run.
+func (s *Scheduler) tick(ctx context.Context, schedule *models.Schedule, now time.Time, result *Result) error {
+	occurrence := schedule.NextRunAt
+	next, err := NextRun(schedule, now)
+	if err != nil {
+		// The schedule was valid when saved, so this only happens if it was edited in the database
+		logger.Error("Disabling invalid schedule", zap.Error(err), zap.String("schedule_id", schedule.ID.Hex()))
+		next = time.Time{}
+	}
+
+	firedAt := now
+	if schedule.Misfire == models.MisfireSkip && now.Sub(occurrence) > s.misfireGrace {
+		logger.Warn("Skipped missed schedule occurrence",
+			zap.String("schedule_id", schedule.ID.Hex()),
+			zap.Time("occurrence", occurrence))
+		firedAt = time.Time{}
+		result.Skipped++
+	} else {
+		created, err := s.fire(ctx, schedule, occurrence, now)
+		result.TasksCreated += created
+		if err != nil {
+			return err
+		}
+		result.Fired++
+	}
+
+	// Losing the race means another manager fired the same occurrence; its tasks were deduplicated
+	err = s.store.Schedules.Advance(ctx, schedule.ID, occurrence, next, firedAt)
+	if err != nil && !errors.Is(err, storage.ErrConflict) && !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+// fire creates the tasks of one occurrence and returns how many it created. Tasks another
+// manager already created for the occurrence are skipped.
+func (s *Scheduler) fire(ctx context.Context, schedule *models.Schedule, occurrence, now time.Time) (int, error) {
+	agents, err := s.targets(ctx, schedule.Target)
+	if err != nil {
+		return 0, err
+	}
+
+	created := 0
+	for _, agentID := range agents {
+		task := models.Task{
+			AgentID:      agentID,
+			Type:         schedule.Task.Type,
+			Parameters:   schedule.Task.Parameters,
+			Timeout:      schedule.Task.Timeout,
+			Retry:        schedule.Task.Retry,
+			Priority:     schedule.Task.Priority,
+			CreatedAt:    now,
+			CreatedBy:    schedule.CreatedBy,
+			ScheduleID:   schedule.ID.Hex(),
+			ScheduledFor: occurrence,
+		}
+		if err := task.Transition(models.TaskStatusQueued, models.ActorScheduler, "schedule "+schedule.Name, now); err != nil {
+			return created, err
+		}
+		err := s.store.Tasks.Create(ctx, &task)
+		if errors.Is(err, storage.ErrDuplicate) {
+			continue
+		}
+		if err != nil {
+			return created, err
+		}
+		created++
+	}
+	return created, nil
+}
+
+// targets returns the UUIDs of the agents a schedule target selects. Decommissioned agents
+// are left out.
+func (s *Scheduler) targets(ctx context.Context, target models.ScheduleTarget) ([]string, error) {
+	if target.AgentID != "" {
+		return []string{target.AgentID}, nil
+	}
+
+	matched, err := storage.MatchingAgents(ctx, s.store.Agents, storage.AgentFilter{Role: target.Role, Labels: target.Labels})
+	if err != nil {
+		return nil, err
+	}
+	agents := make([]string, 0, len(matched))
+	for _, agent := range matched {
+		agents = append(agents, agent.UUID)
+	}
+	return agents, nil
+}
+
+// Prepare checks a schedule, fills in its defaults and sets its next run after now.
+func Prepare(schedule *models.Schedule, now time.Time) error {
+	if schedule.Name == "" {
+		return errors.New("schedule name is required")
+	}
+	if (schedule.Cron == "") == schedule.RunAt.IsZero() {
+		return errors.New("exactly one of cron and run_at is required")
+	}
+	if !schedule.RunAt.IsZero() && !schedule.RunAt.After(now) {
+		return errors.New("run_at must be in the future")
+	}
+	if schedule.Timezone == "" {
+		schedule.Timezone = "UTC"
+	}
+
+	targets := 0
+	for _, set := range []bool{schedule.Target.AgentID != "", schedule.Target.Role != "", len(schedule.Target.Labels) > 0} {
+		if set {
+			targets++
+		}
+	}
+	if targets != 1 {
+		return errors.New("target needs exactly one of agent_id, role and labels")
+	}
+
+	switch schedule.Misfire {
+	case "":
+		schedule.Misfire = models.MisfireRunOnce
+	case models.MisfireRunOnce, models.MisfireSkip:
+	default:
+		return fmt.Errorf("unknown misfire policy %q", schedule.Misfire)
+	}
+
+	if schedule.Task.Retry != nil {
+		if err := schedule.Task.Retry.Validate(); err != nil {
+			return err
+		}
+	}
+
+	next, err := NextRun(schedule, now)
+	if err != nil {
+		return err
+	}
+	if next.IsZero() {
+		return errors.New("schedule never runs")
+	}
+	schedule.NextRunAt = next
+	return nil
+}
+
+// NextRun returns the first occurrence of the schedule after the given time, or the zero time
+// if it has none.
+func NextRun(schedule *models.Schedule, after time.Time) (time.Time, error) {
+	if schedule.Cron == "" {
+		if schedule.RunAt.After(after) {
+			return schedule.RunAt, nil
+		}
+		return time.Time{}, nil
+	}
+
+	location, err := time.LoadLocation(schedule.Timezone)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unknown timezone %q", schedule.Timezone)
+	}
+	expr, err := cron.ParseStandard(schedule.Cron)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid cron expression: %w", err)
+	}
+	return expr.Next(after.In(location)).UTC(), nil
+}
@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+// Fields agents can be sorted on. They match the JSON names of models.AgentSummary.
+const (
+	AgentSortUUID      = "uuid"
+	AgentSortNickname  = "nickname"
+	AgentSortHostname  = "hostname"
+	AgentSortRole      = "role"
+	AgentSortStatus    = "status"
+	AgentSortLastSeen  = "last_seen"
+	AgentSortCreatedAt = "created_at"
+)
+
+// agentTimeSortFields are the sort fields holding timestamps rather than strings.
+var agentTimeSortFields = map[string]bool{
+	AgentSortLastSeen:  true,
+	AgentSortCreatedAt: true,
+}
+
+// ValidAgentSortField reports whether agents can be sorted on field.
+func ValidAgentSortField(field string) bool {
+	switch field {
+	case AgentSortUUID, AgentSortNickname, AgentSortHostname, AgentSortRole, AgentSortStatus, AgentSortLastSeen, AgentSortCreatedAt:
+		return true
+	}
+	return false
+}
+
+// AgentFilter selects agents. Zero values match everything.
+type AgentFilter struct {
+	Status         string
+	Role           string
+	HostnamePrefix string
+	// Nickname matches agents whose nickname contains the value, ignoring case.
+	Nickname       string
+	LastSeenAfter  time.Time
+	LastSeenBefore time.Time
+	// Labels matches agents carrying all of the given labels.
+	Labels map[string]string
+}
+
+// AgentQuery describes one page of an agent listing.
+type AgentQuery struct {
+	Filter   AgentFilter
+	SortBy   string // one of the AgentSort fields, defaults to AgentSortUUID
+	SortDesc bool
+	// Cursor is the NextCursor of the previous page, empty for the first page.
+	Cursor string
+	Limit  int
+}
+
+// AgentPage is one page of an agent listing.
+type AgentPage struct {
+	Agents []models.Agent
+	// Total counts all agents matching the filter, across every page.
+	Total int64
+	// NextCursor continues the listing after this page; empty on the last page.
+	NextCursor string
+}
+
+// agentScanPageSize is the page size MatchingAgents reads agents with.
+const agentScanPageSize = 200
+
+// MatchingAgents returns every agent matching filter, leaving out decommissioned agents.
+func MatchingAgents(ctx context.Context, agents AgentStore, filter AgentFilter) ([]models.Agent, error) {
+	query := AgentQuery{Filter: filter, Limit: agentScanPageSize}
+	var matched []models.Agent
+	for {
+		page, err := agents.List(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		for _, agent := range page.Agents {
+			if agent.Status != models.AgentStatusDecommissioned {
+				matched = append(matched, agent)
+			}
+		}
+		if page.NextCursor == "" {
+			return matched, nil
+		}
+		query.Cursor = page.NextCursor
+	}
+}
+
+// agentSortValue returns the value of the sort field of agent. Timestamps are returned as
+// time.Time and everything else as a string.
+func agentSortValue(agent *models.Agent, field string) interface{} {
+	switch field {
+	case AgentSortNickname:
+		return agent.Nickname
+	case AgentSortHostname:
+		return agent.Hostname
+	case AgentSortRole:
+		return agent.Role
+	case AgentSortStatus:
+		return agent.Status
+	case AgentSortLastSeen:
+		return agent.LastSeen
+	case AgentSortCreatedAt:
+		return agent.CreatedAt
+	default:
+		return agent.UUID
+	}
+}
+
+// compareSortValues orders two values returned by agentSortValue for the same field.
+func compareSortValues(a, b interface{}) int {
+	if at, ok := a.(time.Time); ok {
+		return at.Compare(b.(time.Time))
+	}
+	return strings.Compare(a.(string), b.(string))
+}
+
+// normalize applies the query defaults.
+func (q AgentQuery) normalize() AgentQuery {
+	if q.SortBy == "" {
+		q.SortBy = AgentSortUUID
+	}
+	return q
+}
+
+// encodeAgentCursor returns the cursor continuing q after agent.
+func encodeAgentCursor(q AgentQuery, agent *models.Agent) string {
+	cursor := pageCursor{SortBy: q.SortBy, SortDesc: q.SortDesc, ID: agent.UUID}
+	switch v := agentSortValue(agent, q.SortBy).(type) {
+	case time.Time:
+		cursor.Value = formatCursorTime(v)
+	case string:
+		cursor.Value = v
+	}
+	return cursor.encode()
+}
+
+// decodeAgentCursor parses the cursor of q and returns the sort value and UUID it points at.
+func decodeAgentCursor(q AgentQuery) (interface{}, string, error) {
+	cursor, err := decodeCursor(q.Cursor, q.SortBy, q.SortDesc)
+	if err != nil {
+		return nil, "", err
+	}
+	if !agentTimeSortFields[cursor.SortBy] {
+		return cursor.Value, cursor.ID, nil
+	}
+	value, err := parseCursorTime(cursor.Value)
+	if err != nil {
+		return nil, "", err
+	}
+	return value, cursor.ID, nil
+}
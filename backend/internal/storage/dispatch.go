@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+// DefaultDispatchWindow is the number of recent claims fair shares are computed over when a
+// DispatchPolicy does not set one.
+const DefaultDispatchWindow = 20
+
+// DispatchPolicy decides which queued task of an agent ClaimNext hands out. Tasks of higher
+// priority always go first. Among tasks of the same priority, each fair-share queue (see
+// models.Task.DispatchQueue) gets a share of the agent's claims in proportion to its weight,
+// and within a queue the oldest task goes first.
+type DispatchPolicy struct {
+	// Weights maps a queue, such as "submitter:alice" or "job:<id>", to its weight. Queues that
+	// are not listed have weight 1.
+	Weights map[string]int
+	// Window is how many of the agent's most recent claims the shares are computed over.
+	Window int
+	// Limits is the capacity of the agent the task is claimed for. Tasks are only handed out
+	// while the agent has a free slot for them.
+	Limits ConcurrencyLimits
+	// Lease is how long the agent holds a claimed task unless it renews the lease. Zero claims
+	// tasks without a lease, so they stay with the agent until they finish or time out.
+	Lease time.Duration
+}
+
+// ConcurrencyLimits caps how many tasks an agent holds at once, counting the tasks dispatched
+// to it, running on it or being cancelled. Zero values mean no limit.
+type ConcurrencyLimits struct {
+	// Max caps the tasks the agent holds in all.
+	Max int
+	// PerType caps the tasks of each task type the agent holds.
+	PerType map[string]int
+}
+
+// IsZero reports whether the limits allow an agent any number of tasks.
+func (l ConcurrencyLimits) IsZero() bool {
+	if l.Max > 0 {
+		return false
+	}
+	for _, max := range l.PerType {
+		if max > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// full reports whether an agent holding the tasks counted per type in held has no slot left,
+// and otherwise returns the task types it has no slot left for.
+func (l ConcurrencyLimits) full(held map[string]int) (bool, []string) {
+	total := 0
+	for _, n := range held {
+		total += n
+	}
+	if l.Max > 0 && total >= l.Max {
+		return true, nil
+	}
+	var types []string
+	for taskType, max := range l.PerType {
+		if max > 0 && held[taskType] >= max {
+			types = append(types, taskType)
+		}
+	}
+	return false, types
+}
+
+func (p DispatchPolicy) weight(queue string) int {
+	if w := p.Weights[queue]; w > 0 {
+		return w
+	}
+	return 1
+}
+
+// leaseUntil returns when the lease on a task claimed at now expires, zero without leases.
+func (p DispatchPolicy) leaseUntil(now time.Time) time.Time {
+	if p.Lease <= 0 {
+		return time.Time{}
+	}
+	return now.Add(p.Lease)
+}
+
+func (p DispatchPolicy) window() int {
+	if p.Window > 0 {
+		return p.Window
+	}
+	return DefaultDispatchWindow
+}
+
+// queueHead describes the queued tasks of one fair-share queue at the highest priority.
+type queueHead struct {
+	Queue  string    `bson:"queue"`
+	Oldest time.Time `bson:"oldest"`
+}
+
+// pickQueue returns the queue the next task is claimed from: the one whose recent claims are
+// the smallest multiple of its weight, the one with the oldest task on a tie. recent counts
+// the agent's recent claims per queue. heads must not be empty.
+func (p DispatchPolicy) pickQueue(heads []queueHead, recent map[string]int) string {
+	best := heads[0]
+	for _, head := range heads[1:] {
+		// Compare recent[head]/weight(head) with recent[best]/weight(best) without dividing
+		a := recent[head.Queue] * p.weight(best.Queue)
+		b := recent[best.Queue] * p.weight(head.Queue)
+		if a < b || (a == b && head.Oldest.Before(best.Oldest)) {
+			best = head
+		}
+	}
+	return best.Queue
+}
+
+// dispatchBefore reports whether task a is handed out before task b when nothing else decides:
+// higher priority first, then oldest first.
+func dispatchBefore(a, b *models.Task) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	return a.CreatedAt.Before(b.CreatedAt)
+}
@@ -0,0 +1,1892 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+// NewMemoryStore returns a Store that keeps everything in process memory.
+// It is intended for tests and local development; nothing is persisted.
+func NewMemoryStore() *Store {
+	notifier := NewTaskNotifier()
+	return &Store{
+		Agents: &memoryAgentStore{agents: make(map[string]models.Agent)},
+		Tasks:  &notifyingTaskStore{TaskStore: &memoryTaskStore{tasks: make(map[primitive.ObjectID]models.Task)}, notifier: notifier},
+		Roles:  &memoryRoleStore{roles: make(map[primitive.ObjectID]models.Role)},
+		Admins: &memoryAdminStore{admins: make(map[string]models.Admin)},
+		Logs:   &memoryLogStore{},
+
+		EnrollmentTokens: &memoryEnrollmentTokenStore{tokens: make(map[primitive.ObjectID]models.EnrollmentToken)},
+		Nonces:           &memoryNonceStore{nonces: make(map[string]time.Time)},
+		Schedules:        &memoryScheduleStore{schedules: make(map[primitive.ObjectID]models.Schedule)},
+		Jobs:             &memoryJobStore{jobs: make(map[primitive.ObjectID]models.Job)},
+		Workflows:        &memoryWorkflowStore{workflows: make(map[primitive.ObjectID]models.Workflow)},
+		WorkflowRuns:     &memoryWorkflowRunStore{runs: make(map[primitive.ObjectID]models.WorkflowRun)},
+		Templates:        &memoryTemplateStore{templates: make(map[string][]models.Template)},
+		TaskLogs:         &memoryTaskLogStore{chunks: make(map[taskAttempt][]models.TaskLogChunk)},
+		Artifacts:        &memoryArtifactStore{artifacts: make(map[primitive.ObjectID]memoryArtifact)},
+		IdempotencyKeys:  &memoryIdempotencyStore{records: make(map[string]models.IdempotencyRecord)},
+		TaskChanges:      notifier,
+	}
+}
+
+type memoryAgentStore struct {
+	mu     sync.RWMutex
+	agents map[string]models.Agent // keyed by UUID
+}
+
+// cloneLabels copies a label map so stored and returned values do not alias.
+func cloneLabels(labels map[string]string) map[string]string {
+	if labels == nil {
+		return nil
+	}
+	copied := make(map[string]string, len(labels))
+	for k, v := range labels {
+		copied[k] = v
+	}
+	return copied
+}
+
+func cloneAgent(agent models.Agent) models.Agent {
+	agent.Labels = cloneLabels(agent.Labels)
+	return agent
+}
+
+// credentialsTaken reports whether another agent already uses the key ID or API key of agent.
+// Callers must hold the lock.
+func (s *memoryAgentStore) credentialsTaken(agent *models.Agent) bool {
+	for uuid, other := range s.agents {
+		if uuid == agent.UUID {
+			continue
+		}
+		if agent.KeyID != "" && other.KeyID == agent.KeyID {
+			return true
+		}
+		if agent.APIKey != "" && other.APIKey == agent.APIKey {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memoryAgentStore) Create(_ context.Context, agent *models.Agent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.agents[agent.UUID]; exists {
+		return ErrDuplicate
+	}
+	if s.credentialsTaken(agent) {
+		return ErrDuplicate
+	}
+	if agent.ID.IsZero() {
+		agent.ID = primitive.NewObjectID()
+	}
+	s.agents[agent.UUID] = cloneAgent(*agent)
+	return nil
+}
+
+func (s *memoryAgentStore) Upsert(_ context.Context, agent *models.Agent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.credentialsTaken(agent) {
+		return ErrDuplicate
+	}
+
+	if existing, ok := s.agents[agent.UUID]; ok {
+		agent.ID = existing.ID
+	} else if agent.ID.IsZero() {
+		agent.ID = primitive.NewObjectID()
+	}
+	s.agents[agent.UUID] = cloneAgent(*agent)
+	return nil
+}
+
+func (s *memoryAgentStore) GetByUUID(_ context.Context, uuid string) (*models.Agent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	agent, ok := s.agents[uuid]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	agent = cloneAgent(agent)
+	return &agent, nil
+}
+
+func (s *memoryAgentStore) GetByKeyID(_ context.Context, keyID string) (*models.Agent, error) {
+	return s.find(func(agent *models.Agent) bool { return keyID != "" && agent.KeyID == keyID })
+}
+
+func (s *memoryAgentStore) GetByPreviousKeyID(_ context.Context, keyID string) (*models.Agent, error) {
+	return s.find(func(agent *models.Agent) bool { return keyID != "" && agent.PreviousKeyID == keyID })
+}
+
+func (s *memoryAgentStore) DropPreviousCredentials(_ context.Context, uuid, keyID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	agent, ok := s.agents[uuid]
+	if !ok || agent.KeyID != keyID {
+		return ErrNotFound
+	}
+	agent.PreviousKeyID = ""
+	agent.PreviousAPISecret = ""
+	s.agents[uuid] = agent
+	return nil
+}
+
+func (s *memoryAgentStore) GetByAPIKey(_ context.Context, apiKey string) (*models.Agent, error) {
+	return s.find(func(agent *models.Agent) bool { return apiKey != "" && agent.APIKey == apiKey })
+}
+
+func (s *memoryAgentStore) find(match func(*models.Agent) bool) (*models.Agent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, agent := range s.agents {
+		if match(&agent) {
+			agent = cloneAgent(agent)
+			return &agent, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memoryAgentStore) Heartbeat(_ context.Context, uuid string, seen time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	agent, ok := s.agents[uuid]
+	if !ok {
+		return nil
+	}
+	if agent.Status == models.AgentStatusDecommissioned {
+		return ErrConflict
+	}
+	agent.Status = "active"
+	agent.LastSeen = seen
+	s.agents[uuid] = agent
+	return nil
+}
+
+func (s *memoryAgentStore) MarkStale(_ context.Context, from []string, status string, lastSeenBefore time.Time) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changed := []string{}
+	for uuid, agent := range s.agents {
+		if !containsString(from, agent.Status) || !agent.LastSeen.Before(lastSeenBefore) {
+			continue
+		}
+		agent.Status = status
+		s.agents[uuid] = agent
+		changed = append(changed, uuid)
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+func (s *memoryAgentStore) List(_ context.Context, query AgentQuery) (*AgentPage, error) {
+	query = query.normalize()
+
+	var afterValue interface{}
+	var afterUUID string
+	if query.Cursor != "" {
+		var err error
+		if afterValue, afterUUID, err = decodeAgentCursor(query); err != nil {
+			return nil, err
+		}
+	}
+
+	s.mu.RLock()
+	matched := make([]models.Agent, 0, len(s.agents))
+	for _, agent := range s.agents {
+		if agentMatches(&agent, query.Filter) {
+			matched = append(matched, cloneAgent(agent))
+		}
+	}
+	s.mu.RUnlock()
+
+	// compare orders agents by the sort field, then by UUID to keep the order total
+	compare := func(a *models.Agent, value interface{}, uuid string) int {
+		c := compareSortValues(agentSortValue(a, query.SortBy), value)
+		if c == 0 {
+			c = strings.Compare(a.UUID, uuid)
+		}
+		if query.SortDesc {
+			c = -c
+		}
+		return c
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return compare(&matched[i], agentSortValue(&matched[j], query.SortBy), matched[j].UUID) < 0
+	})
+
+	page := &AgentPage{Agents: []models.Agent{}, Total: int64(len(matched))}
+	for i := range matched {
+		if afterUUID != "" && compare(&matched[i], afterValue, afterUUID) <= 0 {
+			continue
+		}
+		if query.Limit > 0 && len(page.Agents) == query.Limit {
+			page.NextCursor = encodeAgentCursor(query, &page.Agents[len(page.Agents)-1])
+			break
+		}
+		page.Agents = append(page.Agents, matched[i])
+	}
+	return page, nil
+}
+
+// agentMatches reports whether agent passes every condition of filter.
+func agentMatches(agent *models.Agent, filter AgentFilter) bool {
+	if filter.Status != "" && agent.Status != filter.Status {
+		return false
+	}
+	if filter.Role != "" && agent.Role != filter.Role {
+		return false
+	}
+	if !strings.HasPrefix(agent.Hostname, filter.HostnamePrefix) {
+		return false
+	}
+	if !strings.Contains(strings.ToLower(agent.Nickname), strings.ToLower(filter.Nickname)) {
+		return false
+	}
+	if !filter.LastSeenAfter.IsZero() && !agent.LastSeen.After(filter.LastSeenAfter) {
+		return false
+	}
+	if !filter.LastSeenBefore.IsZero() && !agent.LastSeen.Before(filter.LastSeenBefore) {
+		return false
+	}
+	for k, v := range filter.Labels {
+		if value, ok := agent.Labels[k]; !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *memoryAgentStore) Update(_ context.Context, uuid string, update AgentUpdate) (*models.Agent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	agent, ok := s.agents[uuid]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if update.Nickname != nil {
+		agent.Nickname = *update.Nickname
+	}
+	if update.Role != nil {
+		agent.Role = *update.Role
+	}
+	if update.MaxConcurrent != nil {
+		agent.MaxConcurrent = *update.MaxConcurrent
+	}
+	s.agents[uuid] = agent
+
+	agent = cloneAgent(agent)
+	return &agent, nil
+}
+
+func (s *memoryAgentStore) Decommission(_ context.Context, uuid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	agent, ok := s.agents[uuid]
+	if !ok {
+		return ErrNotFound
+	}
+	agent.Status = models.AgentStatusDecommissioned
+	agent.KeyID = ""
+	agent.APIKey = ""
+	agent.APISecret = ""
+	agent.PreviousKeyID = ""
+	agent.PreviousAPISecret = ""
+	s.agents[uuid] = agent
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+type memoryTaskStore struct {
+	mu    sync.RWMutex
+	tasks map[primitive.ObjectID]models.Task
+}
+
+// cloneTask copies the reference fields of a task so callers cannot mutate stored state.
+func cloneTask(task models.Task) models.Task {
+	if task.Parameters != nil {
+		params := make(map[string]interface{}, len(task.Parameters))
+		for k, v := range task.Parameters {
+			params[k] = v
+		}
+		task.Parameters = params
+	}
+	if task.Output != nil {
+		output := *task.Output
+		output.Screenshots = append([]string(nil), task.Output.Screenshots...)
+		task.Output = &output
+	}
+	task.Events = append([]models.TaskEvent(nil), task.Events...)
+	task.Attempts = append([]models.TaskAttempt(nil), task.Attempts...)
+	if task.Retry != nil {
+		retry := *task.Retry
+		retry.RetryOn = append([]string(nil), task.Retry.RetryOn...)
+		task.Retry = &retry
+	}
+	return task
+}
+
+func (s *memoryTaskStore) Create(_ context.Context, task *models.Task) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if task.ID.IsZero() {
+		task.ID = primitive.NewObjectID()
+	}
+	if _, exists := s.tasks[task.ID]; exists {
+		return ErrDuplicate
+	}
+	if s.clashes(task) {
+		return ErrDuplicate
+	}
+	task.SearchText = TaskSearchText(task.Parameters)
+	task.Queue = task.DispatchQueue()
+	s.tasks[task.ID] = cloneTask(*task)
+	return nil
+}
+
+// clashes reports whether another task holds the same schedule occurrence or job wave for the
+// agent of task, which the unique indexes of the MongoDB store rule out. Callers hold s.mu.
+func (s *memoryTaskStore) clashes(task *models.Task) bool {
+	for id, other := range s.tasks {
+		if id == task.ID || other.AgentID != task.AgentID {
+			continue
+		}
+		if task.ScheduleID != "" && other.ScheduleID == task.ScheduleID && other.ScheduledFor.Equal(task.ScheduledFor) {
+			return true
+		}
+		if task.JobID != "" && other.JobID == task.JobID && other.Wave == task.Wave {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memoryTaskStore) Get(_ context.Context, id primitive.ObjectID) (*models.Task, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	task, ok := s.tasks[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	task = cloneTask(task)
+	return &task, nil
+}
+
+func (s *memoryTaskStore) ListByAgent(_ context.Context, agentID string) ([]models.Task, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tasks := []models.Task{}
+	for _, task := range s.tasks {
+		if task.AgentID == agentID {
+			tasks = append(tasks, cloneTask(task))
+		}
+	}
+	sort.Slice(tasks, func(i, j int) bool { return dispatchBefore(&tasks[i], &tasks[j]) })
+	return tasks, nil
+}
+
+func (s *memoryTaskStore) ClaimNext(_ context.Context, agentID string, policy DispatchPolicy, now time.Time) (*models.Task, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	full, fullTypes := policy.Limits.full(s.countHeld(agentID))
+	if full {
+		return nil, ErrNotFound
+	}
+
+	var eligible, started []models.Task
+	for _, task := range s.tasks {
+		if task.AgentID != agentID {
+			continue
+		}
+		if !task.StartedAt.IsZero() {
+			started = append(started, task)
+		}
+		if task.Status == models.TaskStatusQueued && !task.NextRetryAt.After(now) && !containsString(fullTypes, task.Type) {
+			eligible = append(eligible, task)
+		}
+	}
+	if len(eligible) == 0 {
+		return nil, ErrNotFound
+	}
+
+	sort.Slice(started, func(i, j int) bool { return started[i].StartedAt.After(started[j].StartedAt) })
+	if window := policy.window(); len(started) > window {
+		started = started[:window]
+	}
+	recent := make(map[string]int, len(started))
+	for _, task := range started {
+		recent[task.Queue]++
+	}
+
+	// eligible is in dispatch order, so the first task of each queue at the top priority is its head
+	sort.Slice(eligible, func(i, j int) bool { return dispatchBefore(&eligible[i], &eligible[j]) })
+	var heads []queueHead
+	seen := map[string]bool{}
+	for _, task := range eligible {
+		if task.Priority == eligible[0].Priority && !seen[task.Queue] {
+			seen[task.Queue] = true
+			heads = append(heads, queueHead{Queue: task.Queue, Oldest: task.CreatedAt})
+		}
+	}
+	queue := policy.pickQueue(heads, recent)
+
+	var next *models.Task
+	for i := range eligible {
+		if eligible[i].Queue == queue {
+			next = &eligible[i]
+			break
+		}
+	}
+
+	if err := next.Transition(models.TaskStatusDispatched, models.AgentActor(agentID), "", now); err != nil {
+		return nil, err
+	}
+	next.StartedAt = now
+	next.LeaseExpiresAt = policy.leaseUntil(now)
+	next.Attempt++
+	next.NextRetryAt = time.Time{}
+	s.tasks[next.ID] = *next
+
+	claimed := cloneTask(*next)
+	return &claimed, nil
+}
+
+// update applies change to the stored task with the given ID, owned by agentID unless it is empty,
+// then retries the task if the change failed it. The change is discarded if it fails.
+// Callers must not hold the lock.
+func (s *memoryTaskStore) update(id primitive.ObjectID, agentID string, change func(*models.Task) error) (*models.Task, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	task, ok := s.tasks[id]
+	if !ok || (agentID != "" && task.AgentID != agentID) {
+		return nil, ErrNotFound
+	}
+	task = cloneTask(task)
+	if err := change(&task); err != nil {
+		return nil, transitionConflict(err)
+	}
+	task.ScheduleRetry(task.UpdatedAt)
+	s.tasks[id] = task
+
+	updated := cloneTask(task)
+	return &updated, nil
+}
+
+func (s *memoryTaskStore) Start(_ context.Context, id primitive.ObjectID, agentID string, now time.Time) error {
+	_, err := s.update(id, agentID, func(task *models.Task) error {
+		return task.Transition(models.TaskStatusRunning, models.AgentActor(agentID), "", now)
+	})
+	return err
+}
+
+func (s *memoryTaskStore) Finish(_ context.Context, id primitive.ObjectID, agentID, status string, output *models.Output, now time.Time) error {
+	_, err := s.update(id, agentID, func(task *models.Task) error {
+		task.Output = output
+		return task.Transition(status, models.AgentActor(agentID), "", now)
+	})
+	return err
+}
+
+func (s *memoryTaskStore) Transition(_ context.Context, id primitive.ObjectID, status string, event models.TaskEvent) (*models.Task, error) {
+	return s.update(id, "", func(task *models.Task) error {
+		return task.Transition(status, event.Actor, event.Reason, event.Timestamp)
+	})
+}
+
+func (s *memoryTaskStore) TimeoutOverdue(_ context.Context, now time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var changed int64
+	for id, task := range s.tasks {
+		if task.Timeout <= 0 || task.StartedAt.IsZero() {
+			continue
+		}
+		if !task.StartedAt.Add(time.Duration(task.Timeout) * time.Second).Before(now) {
+			continue
+		}
+		task = cloneTask(task)
+		if task.Transition(models.TaskStatusTimeout, models.ActorReaper, timeoutReason(task.Timeout), now) != nil {
+			continue
+		}
+		task.ScheduleRetry(now)
+		s.tasks[id] = task
+		changed++
+	}
+	return changed, nil
+}
+
+func (s *memoryTaskStore) RequeueRunning(_ context.Context, agentID string, now time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var changed int64
+	for id, task := range s.tasks {
+		if task.AgentID != agentID || (task.Status != models.TaskStatusDispatched && task.Status != models.TaskStatusRunning) {
+			continue
+		}
+		task = cloneTask(task)
+		if task.Transition(models.TaskStatusQueued, models.ActorReaper, requeueReason, now) != nil {
+			continue
+		}
+		task.StartedAt = time.Time{}
+		s.tasks[id] = task
+		changed++
+	}
+	return changed, nil
+}
+
+func (s *memoryTaskStore) RenewLease(_ context.Context, id primitive.ObjectID, agentID string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	task, ok := s.tasks[id]
+	if !ok || task.AgentID != agentID || !models.IsHeldStatus(task.Status) {
+		return ErrNotFound
+	}
+	task.LeaseExpiresAt = until
+	s.tasks[id] = task
+	return nil
+}
+
+func (s *memoryTaskStore) ReserveArtifactBytes(_ context.Context, id primitive.ObjectID, size, limit int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	task, ok := s.tasks[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if task.ArtifactBytes+size > limit {
+		return ErrConflict
+	}
+	task.ArtifactBytes += size
+	s.tasks[id] = task
+	return nil
+}
+
+func (s *memoryTaskStore) RenewLeases(_ context.Context, agentID string, until time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var changed int64
+	for id, task := range s.tasks {
+		if task.AgentID != agentID || !models.IsHeldStatus(task.Status) {
+			continue
+		}
+		task.LeaseExpiresAt = until
+		s.tasks[id] = task
+		changed++
+	}
+	return changed, nil
+}
+
+// leaseExpired reports whether task is dispatched or running on a lease that expired before now.
+func leaseExpired(task *models.Task, now time.Time) bool {
+	if task.Status != models.TaskStatusDispatched && task.Status != models.TaskStatusRunning {
+		return false
+	}
+	return !task.LeaseExpiresAt.IsZero() && task.LeaseExpiresAt.Before(now)
+}
+
+func (s *memoryTaskStore) ExpiredLeases(_ context.Context, now time.Time, limit int) ([]models.Task, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var expired []models.Task
+	for _, task := range s.tasks {
+		if leaseExpired(&task, now) {
+			expired = append(expired, cloneTask(task))
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool { return expired[i].LeaseExpiresAt.Before(expired[j].LeaseExpiresAt) })
+	if limit > 0 && len(expired) > limit {
+		expired = expired[:limit]
+	}
+	return expired, nil
+}
+
+func (s *memoryTaskStore) RequeueExpired(_ context.Context, id primitive.ObjectID, agentID string, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	task, ok := s.tasks[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if !leaseExpired(&task, now) {
+		return ErrConflict
+	}
+	task = cloneTask(task)
+	if err := task.Transition(models.TaskStatusQueued, models.ActorReaper, leaseExpiredReason, now); err != nil {
+		return transitionConflict(err)
+	}
+	task.AgentID = agentID
+	if s.clashes(&task) {
+		return ErrDuplicate
+	}
+	task.StartedAt = time.Time{}
+	task.LeaseExpiresAt = time.Time{}
+	s.tasks[id] = task
+	return nil
+}
+
+func (s *memoryTaskStore) CancelRequested(_ context.Context, agentID string) ([]primitive.ObjectID, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var requested []models.Task
+	for _, task := range s.tasks {
+		if task.AgentID == agentID && task.Status == models.TaskStatusCancelRequested {
+			requested = append(requested, task)
+		}
+	}
+	sort.Slice(requested, func(i, j int) bool { return requested[i].UpdatedAt.Before(requested[j].UpdatedAt) })
+	ids := make([]primitive.ObjectID, len(requested))
+	for i, task := range requested {
+		ids[i] = task.ID
+	}
+	return ids, nil
+}
+
+func (s *memoryTaskStore) CancelOverdue(_ context.Context, before, now time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var changed int64
+	for id, task := range s.tasks {
+		if task.Status != models.TaskStatusCancelRequested || !task.UpdatedAt.Before(before) {
+			continue
+		}
+		task = cloneTask(task)
+		if task.Transition(models.TaskStatusCancelled, models.ActorReaper, cancelGraceReason, now) != nil {
+			continue
+		}
+		s.tasks[id] = task
+		changed++
+	}
+	return changed, nil
+}
+
+func (s *memoryTaskStore) List(_ context.Context, query TaskQuery) (*TaskPage, error) {
+	query = query.normalize()
+
+	var afterValue time.Time
+	var afterID primitive.ObjectID
+	if query.Cursor != "" {
+		var err error
+		if afterValue, afterID, err = decodeTaskCursor(query); err != nil {
+			return nil, err
+		}
+	}
+
+	s.mu.RLock()
+	matched := make([]models.Task, 0)
+	for _, task := range s.tasks {
+		if taskMatches(&task, query.Filter) {
+			matched = append(matched, cloneTask(task))
+		}
+	}
+	s.mu.RUnlock()
+
+	// compare orders tasks by the sort field, then by ID to keep the order total
+	compare := func(t *models.Task, value time.Time, id primitive.ObjectID) int {
+		c := taskSortValue(t, query.SortBy).Compare(value)
+		if c == 0 {
+			c = strings.Compare(t.ID.Hex(), id.Hex())
+		}
+		if query.SortDesc {
+			c = -c
+		}
+		return c
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return compare(&matched[i], taskSortValue(&matched[j], query.SortBy), matched[j].ID) < 0
+	})
+
+	page := &TaskPage{Tasks: []models.Task{}, Total: int64(len(matched))}
+	for i := range matched {
+		if !afterID.IsZero() && compare(&matched[i], afterValue, afterID) <= 0 {
+			continue
+		}
+		if query.Limit > 0 && len(page.Tasks) == query.Limit {
+			page.NextCursor = encodeTaskCursor(query, &page.Tasks[len(page.Tasks)-1])
+			break
+		}
+		page.Tasks = append(page.Tasks, matched[i])
+	}
+	return page, nil
+}
+
+func (s *memoryTaskStore) CancelMatching(_ context.Context, filter TaskFilter, actor string, now time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var changed int64
+	for id, task := range s.tasks {
+		target, ok := models.CancelTarget(task.Status)
+		if !ok || !taskMatches(&task, filter) {
+			continue
+		}
+		task = cloneTask(task)
+		if task.Transition(target, actor, "bulk cancel", now) != nil {
+			continue
+		}
+		s.tasks[id] = task
+		changed++
+	}
+	return changed, nil
+}
+
+func (s *memoryTaskStore) CountHeld(_ context.Context, agentID string) (map[string]int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.countHeld(agentID), nil
+}
+
+// countHeld counts the tasks the agent holds per type. Callers must hold the lock.
+func (s *memoryTaskStore) countHeld(agentID string) map[string]int {
+	held := map[string]int{}
+	for _, task := range s.tasks {
+		if task.AgentID == agentID && models.IsHeldStatus(task.Status) {
+			held[task.Type]++
+		}
+	}
+	return held
+}
+
+func (s *memoryTaskStore) SetPriority(_ context.Context, filter TaskFilter, priority int, now time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var changed int64
+	for id, task := range s.tasks {
+		if task.Status != models.TaskStatusQueued || !taskMatches(&task, filter) {
+			continue
+		}
+		task.Priority = priority
+		task.UpdatedAt = now
+		s.tasks[id] = task
+		changed++
+	}
+	return changed, nil
+}
+
+func (s *memoryTaskStore) CountByStatus(_ context.Context, filter TaskFilter) (map[string]int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	counts := make(map[string]int64)
+	for _, task := range s.tasks {
+		if taskMatches(&task, filter) {
+			counts[task.Status]++
+		}
+	}
+	return counts, nil
+}
+
+func (s *memoryTaskStore) QueryResults(_ context.Context, query ResultQuery) ([]models.Task, error) {
+	tasks := s.matchResults(query)
+	sort.Slice(tasks, func(i, j int) bool {
+		if !tasks[i].UpdatedAt.Equal(tasks[j].UpdatedAt) {
+			return tasks[i].UpdatedAt.After(tasks[j].UpdatedAt)
+		}
+		return tasks[i].ID.Hex() > tasks[j].ID.Hex()
+	})
+	if query.Limit > 0 && len(tasks) > query.Limit {
+		tasks = tasks[:query.Limit]
+	}
+	return tasks, nil
+}
+
+func (s *memoryTaskStore) AggregateResults(_ context.Context, query ResultQuery) ([]ResultGroup, error) {
+	return aggregateResults(s.matchResults(query), query), nil
+}
+
+// matchResults returns the tasks matching the filter and conditions of query.
+func (s *memoryTaskStore) matchResults(query ResultQuery) []models.Task {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var tasks []models.Task
+	for _, task := range s.tasks {
+		if taskMatches(&task, query.Filter) && resultMatches(&task, query.Where) {
+			tasks = append(tasks, task)
+		}
+	}
+	return tasks
+}
+
+func (s *memoryTaskStore) FinishedBefore(_ context.Context, before time.Time, limit int) ([]primitive.ObjectID, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var expired []models.Task
+	for _, task := range s.tasks {
+		if task.IsFinished() && task.UpdatedAt.Before(before) && task.JobID == "" && task.WorkflowRunID == "" {
+			expired = append(expired, task)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool { return expired[i].UpdatedAt.Before(expired[j].UpdatedAt) })
+	if limit > 0 && len(expired) > limit {
+		expired = expired[:limit]
+	}
+	ids := make([]primitive.ObjectID, len(expired))
+	for i, task := range expired {
+		ids[i] = task.ID
+	}
+	return ids, nil
+}
+
+func (s *memoryTaskStore) Delete(_ context.Context, ids []primitive.ObjectID) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var deleted int64
+	for _, id := range ids {
+		if _, ok := s.tasks[id]; ok {
+			delete(s.tasks, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+type memoryRoleStore struct {
+	mu    sync.RWMutex
+	roles map[primitive.ObjectID]models.Role
+}
+
+func (s *memoryRoleStore) List(_ context.Context) ([]models.Role, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	roles := make([]models.Role, 0, len(s.roles))
+	for _, role := range s.roles {
+		roles = append(roles, role)
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].CreatedAt.Before(roles[j].CreatedAt) })
+	return roles, nil
+}
+
+func (s *memoryRoleStore) Create(_ context.Context, role *models.Role) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if role.ID.IsZero() {
+		role.ID = primitive.NewObjectID()
+	}
+	if _, exists := s.roles[role.ID]; exists {
+		return ErrDuplicate
+	}
+	s.roles[role.ID] = *role
+	return nil
+}
+
+func (s *memoryRoleStore) Get(_ context.Context, id primitive.ObjectID) (*models.Role, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	role, ok := s.roles[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &role, nil
+}
+
+func (s *memoryRoleStore) GetByName(_ context.Context, name string) (*models.Role, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, role := range s.roles {
+		if role.Name == name {
+			return &role, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+type memoryAdminStore struct {
+	mu     sync.RWMutex
+	admins map[string]models.Admin // keyed by username
+}
+
+func (s *memoryAdminStore) GetByUsername(_ context.Context, username string) (*models.Admin, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	admin, ok := s.admins[username]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &admin, nil
+}
+
+func (s *memoryAdminStore) Create(_ context.Context, admin *models.Admin) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.admins[admin.Username]; exists {
+		return ErrDuplicate
+	}
+	if admin.ID.IsZero() {
+		admin.ID = primitive.NewObjectID()
+	}
+	s.admins[admin.Username] = *admin
+	return nil
+}
+
+type memoryLogStore struct {
+	mu      sync.RWMutex
+	entries []models.LogEntry
+}
+
+func (s *memoryLogStore) Create(_ context.Context, entry *models.LogEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry.ID.IsZero() {
+		entry.ID = primitive.NewObjectID()
+	}
+	s.entries = append(s.entries, *entry)
+	return nil
+}
+
+func (s *memoryLogStore) List(_ context.Context, agentID string, limit int64) ([]models.LogEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var entries []models.LogEntry
+	for _, entry := range s.entries {
+		if agentID == "" || entry.AgentID == agentID {
+			entries = append(entries, entry)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Timestamp.After(entries[j].Timestamp) })
+	if limit > 0 && int64(len(entries)) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
+
+type memoryEnrollmentTokenStore struct {
+	mu     sync.RWMutex
+	tokens map[primitive.ObjectID]models.EnrollmentToken
+}
+
+func cloneEnrollmentToken(token models.EnrollmentToken) models.EnrollmentToken {
+	token.Labels = cloneLabels(token.Labels)
+	token.Usages = append([]models.EnrollmentUsage(nil), token.Usages...)
+	return token
+}
+
+func (s *memoryEnrollmentTokenStore) Create(_ context.Context, token *models.EnrollmentToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, other := range s.tokens {
+		if other.TokenHash == token.TokenHash {
+			return ErrDuplicate
+		}
+	}
+	if token.ID.IsZero() {
+		token.ID = primitive.NewObjectID()
+	}
+	s.tokens[token.ID] = cloneEnrollmentToken(*token)
+	return nil
+}
+
+func (s *memoryEnrollmentTokenStore) List(_ context.Context) ([]models.EnrollmentToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tokens := make([]models.EnrollmentToken, 0, len(s.tokens))
+	for _, token := range s.tokens {
+		tokens = append(tokens, cloneEnrollmentToken(token))
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt.After(tokens[j].CreatedAt) })
+	return tokens, nil
+}
+
+func (s *memoryEnrollmentTokenStore) Revoke(_ context.Context, id primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.tokens[id]
+	if !ok {
+		return ErrNotFound
+	}
+	token.Revoked = true
+	s.tokens[id] = token
+	return nil
+}
+
+func (s *memoryEnrollmentTokenStore) Consume(_ context.Context, tokenHash string, usage models.EnrollmentUsage) (*models.EnrollmentToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, token := range s.tokens {
+		if token.TokenHash != tokenHash {
+			continue
+		}
+		if !token.Usable(usage.UsedAt) {
+			return nil, ErrNotFound
+		}
+		token.Uses++
+		token.Usages = append(token.Usages, usage)
+		s.tokens[id] = cloneEnrollmentToken(token)
+
+		consumed := cloneEnrollmentToken(token)
+		return &consumed, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memoryEnrollmentTokenStore) Release(_ context.Context, id primitive.ObjectID, agentUUID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.tokens[id]
+	if !ok {
+		return ErrNotFound
+	}
+	for i, usage := range token.Usages {
+		if usage.AgentUUID != agentUUID {
+			continue
+		}
+		token = cloneEnrollmentToken(token)
+		token.Uses--
+		token.Usages = append(token.Usages[:i], token.Usages[i+1:]...)
+		s.tokens[id] = token
+		return nil
+	}
+	return ErrNotFound
+}
+
+type memoryNonceStore struct {
+	mu     sync.Mutex
+	nonces map[string]time.Time // keyed by agent ID and nonce, valued by expiry
+}
+
+func (s *memoryNonceStore) Remember(_ context.Context, agentID, nonce string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	key := agentID + "\x00" + nonce
+	if expiry, ok := s.nonces[key]; ok && expiry.After(now) {
+		return ErrDuplicate
+	}
+	s.nonces[key] = expiresAt
+
+	// Expired nonces can no longer pass the timestamp check, so drop them
+	for k, expiry := range s.nonces {
+		if !expiry.After(now) {
+			delete(s.nonces, k)
+		}
+	}
+	return nil
+}
+
+type memoryIdempotencyStore struct {
+	mu      sync.Mutex
+	records map[string]models.IdempotencyRecord // keyed by caller and key
+}
+
+func (s *memoryIdempotencyStore) Reserve(_ context.Context, record *models.IdempotencyRecord) (*models.IdempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for k, existing := range s.records {
+		if !existing.ExpiresAt.After(record.CreatedAt) {
+			delete(s.records, k)
+		}
+	}
+	k := record.Caller + "\x00" + record.Key
+	if existing, ok := s.records[k]; ok {
+		return &existing, ErrDuplicate
+	}
+	s.records[k] = *record
+	return nil, nil
+}
+
+func (s *memoryIdempotencyStore) Complete(_ context.Context, caller, key string, statusCode int, contentType, body string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k := caller + "\x00" + key
+	record, ok := s.records[k]
+	if !ok {
+		return ErrNotFound
+	}
+	record.StatusCode = statusCode
+	record.ContentType = contentType
+	record.Body = body
+	s.records[k] = record
+	return nil
+}
+
+func (s *memoryIdempotencyStore) Release(_ context.Context, caller, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.records, caller+"\x00"+key)
+	return nil
+}
+
+func (s *memoryIdempotencyStore) Get(_ context.Context, caller, key string, now time.Time) (*models.IdempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, ok := s.records[caller+"\x00"+key]
+	if !ok || !record.ExpiresAt.After(now) {
+		return nil, ErrNotFound
+	}
+	return &record, nil
+}
+
+type memoryScheduleStore struct {
+	mu        sync.RWMutex
+	schedules map[primitive.ObjectID]models.Schedule
+}
+
+// cloneTaskTemplate copies the parameters and retry policy of a task template.
+func cloneTaskTemplate(template models.TaskTemplate) models.TaskTemplate {
+	if template.Parameters != nil {
+		params := make(map[string]interface{}, len(template.Parameters))
+		for k, v := range template.Parameters {
+			params[k] = v
+		}
+		template.Parameters = params
+	}
+	if template.Retry != nil {
+		retry := *template.Retry
+		retry.RetryOn = append([]string(nil), template.Retry.RetryOn...)
+		template.Retry = &retry
+	}
+	return template
+}
+
+// cloneSchedule copies the maps of a schedule so stored and returned values do not alias.
+func cloneSchedule(schedule models.Schedule) models.Schedule {
+	schedule.Task = cloneTaskTemplate(schedule.Task)
+	schedule.Target.Labels = cloneLabels(schedule.Target.Labels)
+	return schedule
+}
+
+func (s *memoryScheduleStore) Create(_ context.Context, schedule *models.Schedule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if schedule.ID.IsZero() {
+		schedule.ID = primitive.NewObjectID()
+	}
+	if _, exists := s.schedules[schedule.ID]; exists {
+		return ErrDuplicate
+	}
+	s.schedules[schedule.ID] = cloneSchedule(*schedule)
+	return nil
+}
+
+func (s *memoryScheduleStore) Get(_ context.Context, id primitive.ObjectID) (*models.Schedule, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	schedule, ok := s.schedules[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	schedule = cloneSchedule(schedule)
+	return &schedule, nil
+}
+
+func (s *memoryScheduleStore) List(_ context.Context) ([]models.Schedule, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	schedules := make([]models.Schedule, 0, len(s.schedules))
+	for _, schedule := range s.schedules {
+		schedules = append(schedules, cloneSchedule(schedule))
+	}
+	sort.Slice(schedules, func(i, j int) bool { return schedules[i].CreatedAt.Before(schedules[j].CreatedAt) })
+	return schedules, nil
+}
+
+func (s *memoryScheduleStore) Replace(_ context.Context, schedule *models.Schedule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.schedules[schedule.ID]; !ok {
+		return ErrNotFound
+	}
+	s.schedules[schedule.ID] = cloneSchedule(*schedule)
+	return nil
+}
+
+func (s *memoryScheduleStore) Delete(_ context.Context, id primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.schedules[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.schedules, id)
+	return nil
+}
+
+func (s *memoryScheduleStore) Due(_ context.Context, now time.Time) ([]models.Schedule, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	due := []models.Schedule{}
+	for _, schedule := range s.schedules {
+		if schedule.Enabled && !schedule.NextRunAt.IsZero() && !schedule.NextRunAt.After(now) {
+			due = append(due, cloneSchedule(schedule))
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].NextRunAt.Before(due[j].NextRunAt) })
+	return due, nil
+}
+
+func (s *memoryScheduleStore) Advance(_ context.Context, id primitive.ObjectID, from, next, firedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	schedule, ok := s.schedules[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if !schedule.NextRunAt.Equal(from) {
+		return ErrConflict
+	}
+	schedule.NextRunAt = next
+	if !firedAt.IsZero() {
+		schedule.LastRunAt = firedAt
+	}
+	s.schedules[id] = schedule
+	return nil
+}
+
+type memoryJobStore struct {
+	mu   sync.RWMutex
+	jobs map[primitive.ObjectID]models.Job
+}
+
+// cloneJob copies the maps and slices of a job so stored and returned values do not alias.
+func cloneJob(job models.Job) models.Job {
+	job.Task = cloneTaskTemplate(job.Task)
+	job.Target.AgentIDs = append([]string(nil), job.Target.AgentIDs...)
+	job.Target.Labels = cloneLabels(job.Target.Labels)
+	if job.Rollout != nil {
+		rollout := cloneRollout(*job.Rollout)
+		job.Rollout = &rollout
+	}
+	return job
+}
+
+// cloneRollout copies the waves and events of a rollout.
+func cloneRollout(rollout models.Rollout) models.Rollout {
+	waves := make([]models.RolloutWave, len(rollout.Waves))
+	for i, wave := range rollout.Waves {
+		wave.AgentIDs = append([]string(nil), wave.AgentIDs...)
+		waves[i] = wave
+	}
+	rollout.Waves = waves
+	rollout.Events = append([]models.RolloutEvent(nil), rollout.Events...)
+	return rollout
+}
+
+func (s *memoryJobStore) Create(_ context.Context, job *models.Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if job.ID.IsZero() {
+		job.ID = primitive.NewObjectID()
+	}
+	if _, exists := s.jobs[job.ID]; exists {
+		return ErrDuplicate
+	}
+	for _, other := range s.jobs {
+		if job.IdempotencyKey != "" && other.IdempotencyKey == job.IdempotencyKey && other.CreatedBy == job.CreatedBy {
+			return ErrDuplicate
+		}
+	}
+	s.jobs[job.ID] = cloneJob(*job)
+	return nil
+}
+
+func (s *memoryJobStore) GetByIdempotencyKey(_ context.Context, createdBy, key string) (*models.Job, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, job := range s.jobs {
+		if key != "" && job.IdempotencyKey == key && job.CreatedBy == createdBy {
+			job = cloneJob(job)
+			return &job, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memoryJobStore) Get(_ context.Context, id primitive.ObjectID) (*models.Job, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	job = cloneJob(job)
+	return &job, nil
+}
+
+func (s *memoryJobStore) List(_ context.Context, limit int64) ([]models.Job, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	jobs := make([]models.Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, cloneJob(job))
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		if !jobs[i].CreatedAt.Equal(jobs[j].CreatedAt) {
+			return jobs[i].CreatedAt.After(jobs[j].CreatedAt)
+		}
+		return jobs[i].ID.Hex() > jobs[j].ID.Hex()
+	})
+	if limit > 0 && int64(len(jobs)) > limit {
+		jobs = jobs[:limit]
+	}
+	return jobs, nil
+}
+
+func (s *memoryJobStore) MarkCancelled(_ context.Context, id primitive.ObjectID, by string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if !job.CancelledAt.IsZero() {
+		return ErrConflict
+	}
+	job.CancelledBy = by
+	job.CancelledAt = at
+	s.jobs[id] = job
+	return nil
+}
+
+func (s *memoryJobStore) Rollouts(_ context.Context, status string) ([]models.Job, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	jobs := []models.Job{}
+	for _, job := range s.jobs {
+		if job.Rollout != nil && job.Rollout.Status == status {
+			jobs = append(jobs, cloneJob(job))
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].CreatedAt.Before(jobs[j].CreatedAt) })
+	return jobs, nil
+}
+
+func (s *memoryJobStore) UpdateRollout(_ context.Context, id primitive.ObjectID, status string, wave int, rollout *models.Rollout) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if job.Rollout == nil || job.Rollout.Status != status || job.Rollout.CurrentWave != wave {
+		return ErrConflict
+	}
+	updated := cloneRollout(*rollout)
+	job.Rollout = &updated
+	s.jobs[id] = job
+	return nil
+}
+
+func (s *memoryJobStore) CreatedBefore(_ context.Context, before time.Time, after primitive.ObjectID, limit int) ([]models.Job, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	jobs := []models.Job{}
+	for id, job := range s.jobs {
+		if job.CreatedAt.Before(before) && bytes.Compare(id[:], after[:]) > 0 {
+			jobs = append(jobs, cloneJob(job))
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return bytes.Compare(jobs[i].ID[:], jobs[j].ID[:]) < 0 })
+	if limit > 0 && len(jobs) > limit {
+		jobs = jobs[:limit]
+	}
+	return jobs, nil
+}
+
+func (s *memoryJobStore) Delete(_ context.Context, id primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.jobs[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.jobs, id)
+	return nil
+}
+
+type memoryWorkflowStore struct {
+	mu        sync.RWMutex
+	workflows map[primitive.ObjectID]models.Workflow
+}
+
+// cloneWorkflowNodes copies the task templates, dependencies and conditions of workflow nodes.
+func cloneWorkflowNodes(nodes []models.WorkflowNode) []models.WorkflowNode {
+	if nodes == nil {
+		return nil
+	}
+	copied := make([]models.WorkflowNode, len(nodes))
+	for i, node := range nodes {
+		node.Task = cloneTaskTemplate(node.Task)
+		node.DependsOn = append([]string(nil), node.DependsOn...)
+		when := append([]models.WorkflowCondition(nil), node.When...)
+		for j := range when {
+			when[j].Status = append([]string(nil), when[j].Status...)
+		}
+		node.When = when
+		copied[i] = node
+	}
+	return copied
+}
+
+func cloneWorkflow(workflow models.Workflow) models.Workflow {
+	workflow.Nodes = cloneWorkflowNodes(workflow.Nodes)
+	return workflow
+}
+
+func (s *memoryWorkflowStore) Create(_ context.Context, workflow *models.Workflow) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if workflow.ID.IsZero() {
+		workflow.ID = primitive.NewObjectID()
+	}
+	if _, exists := s.workflows[workflow.ID]; exists {
+		return ErrDuplicate
+	}
+	s.workflows[workflow.ID] = cloneWorkflow(*workflow)
+	return nil
+}
+
+func (s *memoryWorkflowStore) Get(_ context.Context, id primitive.ObjectID) (*models.Workflow, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	workflow, ok := s.workflows[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	workflow = cloneWorkflow(workflow)
+	return &workflow, nil
+}
+
+func (s *memoryWorkflowStore) List(_ context.Context) ([]models.Workflow, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	workflows := make([]models.Workflow, 0, len(s.workflows))
+	for _, workflow := range s.workflows {
+		workflows = append(workflows, cloneWorkflow(workflow))
+	}
+	sort.Slice(workflows, func(i, j int) bool { return workflows[i].CreatedAt.Before(workflows[j].CreatedAt) })
+	return workflows, nil
+}
+
+func (s *memoryWorkflowStore) Replace(_ context.Context, workflow *models.Workflow) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.workflows[workflow.ID]; !ok {
+		return ErrNotFound
+	}
+	s.workflows[workflow.ID] = cloneWorkflow(*workflow)
+	return nil
+}
+
+func (s *memoryWorkflowStore) Delete(_ context.Context, id primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.workflows[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.workflows, id)
+	return nil
+}
+
+type memoryWorkflowRunStore struct {
+	mu   sync.RWMutex
+	runs map[primitive.ObjectID]models.WorkflowRun
+}
+
+func cloneWorkflowRun(run models.WorkflowRun) models.WorkflowRun {
+	run.Definition = cloneWorkflowNodes(run.Definition)
+	run.Nodes = append([]models.WorkflowNodeState(nil), run.Nodes...)
+	return run
+}
+
+func (s *memoryWorkflowRunStore) Create(_ context.Context, run *models.WorkflowRun) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if run.ID.IsZero() {
+		run.ID = primitive.NewObjectID()
+	}
+	if _, exists := s.runs[run.ID]; exists {
+		return ErrDuplicate
+	}
+	s.runs[run.ID] = cloneWorkflowRun(*run)
+	return nil
+}
+
+func (s *memoryWorkflowRunStore) Get(_ context.Context, id primitive.ObjectID) (*models.WorkflowRun, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	run, ok := s.runs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	run = cloneWorkflowRun(run)
+	return &run, nil
+}
+
+func (s *memoryWorkflowRunStore) List(_ context.Context, filter WorkflowRunFilter, limit int64) ([]models.WorkflowRun, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	runs := []models.WorkflowRun{}
+	for _, run := range s.runs {
+		switch {
+		case filter.WorkflowID != "" && run.WorkflowID != filter.WorkflowID,
+			filter.AgentID != "" && run.AgentID != filter.AgentID,
+			filter.Status != "" && run.Status != filter.Status:
+			continue
+		}
+		runs = append(runs, cloneWorkflowRun(run))
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		if !runs[i].CreatedAt.Equal(runs[j].CreatedAt) {
+			return runs[i].CreatedAt.After(runs[j].CreatedAt)
+		}
+		return runs[i].ID.Hex() > runs[j].ID.Hex()
+	})
+	if limit > 0 && int64(len(runs)) > limit {
+		runs = runs[:limit]
+	}
+	return runs, nil
+}
+
+func (s *memoryWorkflowRunStore) Running(_ context.Context) ([]models.WorkflowRun, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	runs := []models.WorkflowRun{}
+	for _, run := range s.runs {
+		if run.Status == models.WorkflowRunning {
+			runs = append(runs, cloneWorkflowRun(run))
+		}
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].CreatedAt.Before(runs[j].CreatedAt) })
+	return runs, nil
+}
+
+func (s *memoryWorkflowRunStore) Update(_ context.Context, run *models.WorkflowRun) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.runs[run.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	if stored.Revision != run.Revision {
+		return ErrConflict
+	}
+	run.Revision++
+	s.runs[run.ID] = cloneWorkflowRun(*run)
+	return nil
+}
+
+func (s *memoryWorkflowRunStore) FinishedBefore(_ context.Context, before time.Time, after primitive.ObjectID, limit int) ([]models.WorkflowRun, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	runs := []models.WorkflowRun{}
+	for id, run := range s.runs {
+		if run.Status != models.WorkflowRunning && !run.FinishedAt.IsZero() && run.FinishedAt.Before(before) && bytes.Compare(id[:], after[:]) > 0 {
+			runs = append(runs, cloneWorkflowRun(run))
+		}
+	}
+	sort.Slice(runs, func(i, j int) bool { return bytes.Compare(runs[i].ID[:], runs[j].ID[:]) < 0 })
+	if limit > 0 && len(runs) > limit {
+		runs = runs[:limit]
+	}
+	return runs, nil
+}
+
+func (s *memoryWorkflowRunStore) Delete(_ context.Context, id primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.runs[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.runs, id)
+	return nil
+}
+
+type memoryTemplateStore struct {
+	mu        sync.RWMutex
+	templates map[string][]models.Template // versions by name, oldest first
+}
+
+// cloneTemplate copies the task template and variables of a template.
+func cloneTemplate(template models.Template) models.Template {
+	template.Task = cloneTaskTemplate(template.Task)
+	template.Variables = append([]models.TemplateVariable(nil), template.Variables...)
+	return template
+}
+
+func (s *memoryTemplateStore) Create(_ context.Context, template *models.Template) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	template.ID = primitive.NewObjectID()
+	template.Version = len(s.templates[template.Name]) + 1
+	s.templates[template.Name] = append(s.templates[template.Name], cloneTemplate(*template))
+	return nil
+}
+
+func (s *memoryTemplateStore) Get(_ context.Context, name string, version int) (*models.Template, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	versions := s.templates[name]
+	if version == 0 {
+		version = len(versions)
+	}
+	if version < 1 || version > len(versions) {
+		return nil, ErrNotFound
+	}
+	template := cloneTemplate(versions[version-1])
+	return &template, nil
+}
+
+func (s *memoryTemplateStore) List(_ context.Context) ([]models.Template, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	templates := make([]models.Template, 0, len(s.templates))
+	for _, versions := range s.templates {
+		templates = append(templates, cloneTemplate(versions[len(versions)-1]))
+	}
+	sort.Slice(templates, func(i, j int) bool { return templates[i].Name < templates[j].Name })
+	return templates, nil
+}
+
+func (s *memoryTemplateStore) Versions(_ context.Context, name string) ([]models.Template, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	versions := s.templates[name]
+	if len(versions) == 0 {
+		return nil, ErrNotFound
+	}
+	templates := make([]models.Template, len(versions))
+	for i, template := range versions {
+		templates[i] = cloneTemplate(template)
+	}
+	return templates, nil
+}
+
+func (s *memoryTemplateStore) Delete(_ context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.templates[name]) == 0 {
+		return ErrNotFound
+	}
+	delete(s.templates, name)
+	return nil
+}
+
+// taskAttempt identifies the log of one attempt of a task.
+type taskAttempt struct {
+	taskID  primitive.ObjectID
+	attempt int
+}
+
+type memoryTaskLogStore struct {
+	mu     sync.RWMutex
+	chunks map[taskAttempt][]models.TaskLogChunk // in sequence order
+}
+
+func (s *memoryTaskLogStore) Append(_ context.Context, chunk *models.TaskLogChunk) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := taskAttempt{chunk.TaskID, chunk.Attempt}
+	chunks := s.chunks[key]
+	i := sort.Search(len(chunks), func(i int) bool { return chunks[i].Sequence >= chunk.Sequence })
+	if i < len(chunks) && chunks[i].Sequence == chunk.Sequence {
+		return ErrDuplicate
+	}
+	chunk.ID = primitive.NewObjectID()
+	chunks = append(chunks, models.TaskLogChunk{})
+	copy(chunks[i+1:], chunks[i:])
+	chunks[i] = *chunk
+	s.chunks[key] = chunks
+	return nil
+}
+
+func (s *memoryTaskLogStore) List(_ context.Context, taskID primitive.ObjectID, attempt int, from int64, limit int) ([]models.TaskLogChunk, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	chunks := s.chunks[taskAttempt{taskID, attempt}]
+	i := sort.Search(len(chunks), func(i int) bool { return chunks[i].Sequence >= from })
+	page := append([]models.TaskLogChunk{}, chunks[i:]...)
+	if limit > 0 && len(page) > limit {
+		page = page[:limit]
+	}
+	return page, nil
+}
+
+func (s *memoryTaskLogStore) DeleteByTasks(_ context.Context, taskIDs []primitive.ObjectID) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := make(map[primitive.ObjectID]bool, len(taskIDs))
+	for _, id := range taskIDs {
+		ids[id] = true
+	}
+	var deleted int64
+	for key, chunks := range s.chunks {
+		if ids[key.taskID] {
+			deleted += int64(len(chunks))
+			delete(s.chunks, key)
+		}
+	}
+	return deleted, nil
+}
+
+// memoryArtifact is a stored artifact with its content.
+type memoryArtifact struct {
+	models.Artifact
+	content []byte
+}
+
+type memoryArtifactStore struct {
+	mu        sync.RWMutex
+	artifacts map[primitive.ObjectID]memoryArtifact
+}
+
+func (s *memoryArtifactStore) Create(_ context.Context, artifact *models.Artifact, content io.Reader) error {
+	// Read before locking so a slow upload does not hold up other requests
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	artifact.ID = primitive.NewObjectID()
+	artifact.Size = int64(len(data))
+	s.artifacts[artifact.ID] = memoryArtifact{Artifact: *artifact, content: data}
+	return nil
+}
+
+func (s *memoryArtifactStore) List(_ context.Context, taskID primitive.ObjectID) ([]models.Artifact, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	artifacts := []models.Artifact{}
+	for _, stored := range s.artifacts {
+		if stored.TaskID == taskID {
+			artifacts = append(artifacts, stored.Artifact)
+		}
+	}
+	sort.Slice(artifacts, func(i, j int) bool {
+		if !artifacts[i].CreatedAt.Equal(artifacts[j].CreatedAt) {
+			return artifacts[i].CreatedAt.Before(artifacts[j].CreatedAt)
+		}
+		return artifacts[i].ID.Hex() < artifacts[j].ID.Hex()
+	})
+	return artifacts, nil
+}
+
+func (s *memoryArtifactStore) Open(_ context.Context, id primitive.ObjectID) (*models.Artifact, io.ReadCloser, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stored, ok := s.artifacts[id]
+	if !ok {
+		return nil, nil, ErrNotFound
+	}
+	artifact := stored.Artifact
+	// Stored content is never modified, so readers can share it
+	return &artifact, io.NopCloser(bytes.NewReader(stored.content)), nil
+}
+
+func (s *memoryArtifactStore) DeleteByTasks(_ context.Context, taskIDs []primitive.ObjectID) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := make(map[primitive.ObjectID]bool, len(taskIDs))
+	for _, id := range taskIDs {
+		ids[id] = true
+	}
+	var deleted int64
+	for id, stored := range s.artifacts {
+		if ids[stored.TaskID] {
+			delete(s.artifacts, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
@@ -0,0 +1,1991 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+// NewMongoStore returns a Store backed by the collections of the given database.
+func NewMongoStore(db *mongo.Database) *Store {
+	notifier := NewTaskNotifier()
+	notifier.watch = watchMongoTasks(db.Collection("tasks"))
+	tasks := &mongoTaskStore{collection: db.Collection("tasks"), locks: db.Collection("dispatch_locks")}
+	return &Store{
+		Agents: &mongoAgentStore{collection: db.Collection("agents")},
+		Tasks:  &notifyingTaskStore{TaskStore: tasks, notifier: notifier},
+		Roles:  &mongoRoleStore{collection: db.Collection("roles")},
+		Admins: &mongoAdminStore{collection: db.Collection("admins")},
+		Logs:   &mongoLogStore{collection: db.Collection("logs")},
+
+		EnrollmentTokens: &mongoEnrollmentTokenStore{collection: db.Collection("enrollment_tokens")},
+		Nonces:           &mongoNonceStore{collection: db.Collection("request_nonces")},
+		Schedules:        &mongoScheduleStore{collection: db.Collection("schedules")},
+		Jobs:             &mongoJobStore{collection: db.Collection("jobs")},
+		Workflows:        &mongoWorkflowStore{collection: db.Collection("workflows")},
+		WorkflowRuns:     &mongoWorkflowRunStore{collection: db.Collection("workflow_runs")},
+		Templates:        &mongoTemplateStore{collection: db.Collection("task_templates")},
+		TaskLogs:         &mongoTaskLogStore{collection: db.Collection("task_logs")},
+		Artifacts:        &mongoArtifactStore{db: db},
+		IdempotencyKeys:  &mongoIdempotencyStore{collection: db.Collection("idempotency_keys")},
+		TaskChanges:      notifier,
+	}
+}
+
+// mongoError maps driver errors onto the storage sentinel errors.
+func mongoError(err error) error {
+	switch {
+	case err == mongo.ErrNoDocuments:
+		return ErrNotFound
+	case mongo.IsDuplicateKeyError(err):
+		return ErrDuplicate
+	default:
+		return err
+	}
+}
+
+type mongoAgentStore struct {
+	collection *mongo.Collection
+}
+
+func (s *mongoAgentStore) Create(ctx context.Context, agent *models.Agent) error {
+	if agent.ID.IsZero() {
+		agent.ID = primitive.NewObjectID()
+	}
+	_, err := s.collection.InsertOne(ctx, agent)
+	return mongoError(err)
+}
+
+func (s *mongoAgentStore) Upsert(ctx context.Context, agent *models.Agent) error {
+	update := bson.M{"$set": agent}
+	// $set skips empty credentials, which are omitted from the document, so drop them explicitly
+	unset := bson.M{}
+	for field, value := range map[string]string{
+		"key_id":              agent.KeyID,
+		"api_key":             agent.APIKey,
+		"previous_key_id":     agent.PreviousKeyID,
+		"previous_api_secret": agent.PreviousAPISecret,
+	} {
+		if value == "" {
+			unset[field] = ""
+		}
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	opts := options.Update().SetUpsert(true)
+	_, err := s.collection.UpdateOne(ctx, bson.M{"uuid": agent.UUID}, update, opts)
+	return mongoError(err)
+}
+
+func (s *mongoAgentStore) GetByUUID(ctx context.Context, uuid string) (*models.Agent, error) {
+	return s.findOne(ctx, bson.M{"uuid": uuid})
+}
+
+func (s *mongoAgentStore) GetByKeyID(ctx context.Context, keyID string) (*models.Agent, error) {
+	return s.findOne(ctx, bson.M{"key_id": keyID})
+}
+
+func (s *mongoAgentStore) GetByPreviousKeyID(ctx context.Context, keyID string) (*models.Agent, error) {
+	return s.findOne(ctx, bson.M{"previous_key_id": keyID})
+}
+
+func (s *mongoAgentStore) DropPreviousCredentials(ctx context.Context, uuid, keyID string) error {
+	update := bson.M{"$unset": bson.M{"previous_key_id": "", "previous_api_secret": ""}}
+	res, err := s.collection.UpdateOne(ctx, bson.M{"uuid": uuid, "key_id": keyID}, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *mongoAgentStore) GetByAPIKey(ctx context.Context, apiKey string) (*models.Agent, error) {
+	return s.findOne(ctx, bson.M{"api_key": apiKey})
+}
+
+func (s *mongoAgentStore) findOne(ctx context.Context, filter bson.M) (*models.Agent, error) {
+	var agent models.Agent
+	if err := s.collection.FindOne(ctx, filter).Decode(&agent); err != nil {
+		return nil, mongoError(err)
+	}
+	return &agent, nil
+}
+
+func (s *mongoAgentStore) Heartbeat(ctx context.Context, uuid string, seen time.Time) error {
+	update := bson.M{
+		"$set": bson.M{
+			"status":    "active",
+			"last_seen": seen,
+		},
+	}
+	filter := bson.M{"uuid": uuid, "status": bson.M{"$ne": models.AgentStatusDecommissioned}}
+	res, err := s.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return mongoError(err)
+	}
+	if res.MatchedCount == 0 {
+		decommissioned, err := s.collection.CountDocuments(ctx, bson.M{"uuid": uuid, "status": models.AgentStatusDecommissioned})
+		if err != nil {
+			return err
+		}
+		if decommissioned > 0 {
+			return ErrConflict
+		}
+	}
+	return nil
+}
+
+func (s *mongoAgentStore) MarkStale(ctx context.Context, from []string, status string, lastSeenBefore time.Time) ([]string, error) {
+	filter := bson.M{
+		"status":    bson.M{"$in": from},
+		"last_seen": bson.M{"$lt": lastSeenBefore},
+	}
+	update := bson.M{"$set": bson.M{"status": status}}
+	opts := options.FindOneAndUpdate().SetProjection(bson.M{"uuid": 1})
+
+	// Transition one agent at a time so the returned UUIDs are exactly the agents that changed,
+	// even if some of them send a heartbeat meanwhile.
+	changed := []string{}
+	for {
+		var agent models.Agent
+		err := s.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&agent)
+		if err == mongo.ErrNoDocuments {
+			return changed, nil
+		}
+		if err != nil {
+			return changed, err
+		}
+		changed = append(changed, agent.UUID)
+	}
+}
+
+func (s *mongoAgentStore) List(ctx context.Context, query AgentQuery) (*AgentPage, error) {
+	query = query.normalize()
+	filter := agentFilterDocument(query.Filter)
+
+	total, err := s.collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	direction, after := 1, "$gt"
+	if query.SortDesc {
+		direction, after = -1, "$lt"
+	}
+	if query.Cursor != "" {
+		value, uuid, err := decodeAgentCursor(query)
+		if err != nil {
+			return nil, err
+		}
+		// Keyset pagination: continue after the last (sort value, uuid) of the previous page
+		position := bson.M{"uuid": bson.M{after: uuid}}
+		if query.SortBy != AgentSortUUID {
+			position = bson.M{"$or": bson.A{
+				bson.M{query.SortBy: bson.M{after: value}},
+				bson.M{query.SortBy: value, "uuid": bson.M{after: uuid}},
+			}}
+		}
+		filter = bson.M{"$and": bson.A{filter, position}}
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: query.SortBy, Value: direction}, {Key: "uuid", Value: direction}})
+	if query.Limit > 0 {
+		// Fetch one extra agent to learn whether another page follows
+		opts.SetLimit(int64(query.Limit) + 1)
+	}
+
+	cursor, err := s.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	page := &AgentPage{Agents: []models.Agent{}, Total: total}
+	if err := cursor.All(ctx, &page.Agents); err != nil {
+		return nil, err
+	}
+	if query.Limit > 0 && len(page.Agents) > query.Limit {
+		page.Agents = page.Agents[:query.Limit]
+		page.NextCursor = encodeAgentCursor(query, &page.Agents[query.Limit-1])
+	}
+	return page, nil
+}
+
+// agentFilterDocument translates an AgentFilter into a MongoDB filter.
+func agentFilterDocument(f AgentFilter) bson.M {
+	filter := bson.M{}
+	if f.Status != "" {
+		filter["status"] = f.Status
+	}
+	if f.Role != "" {
+		filter["role"] = f.Role
+	}
+	if f.HostnamePrefix != "" {
+		filter["hostname"] = bson.M{"$regex": "^" + regexp.QuoteMeta(f.HostnamePrefix)}
+	}
+	if f.Nickname != "" {
+		filter["nickname"] = bson.M{"$regex": regexp.QuoteMeta(f.Nickname), "$options": "i"}
+	}
+	if r := timeRange(f.LastSeenAfter, f.LastSeenBefore); len(r) > 0 {
+		filter["last_seen"] = r
+	}
+	for k, v := range f.Labels {
+		filter["labels."+k] = v
+	}
+	return filter
+}
+
+func (s *mongoAgentStore) Update(ctx context.Context, uuid string, update AgentUpdate) (*models.Agent, error) {
+	set := bson.M{}
+	if update.Nickname != nil {
+		set["nickname"] = *update.Nickname
+	}
+	if update.Role != nil {
+		set["role"] = *update.Role
+	}
+	if update.MaxConcurrent != nil {
+		set["max_concurrent"] = *update.MaxConcurrent
+	}
+	if len(set) == 0 {
+		return s.GetByUUID(ctx, uuid)
+	}
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var agent models.Agent
+	if err := s.collection.FindOneAndUpdate(ctx, bson.M{"uuid": uuid}, bson.M{"$set": set}, opts).Decode(&agent); err != nil {
+		return nil, mongoError(err)
+	}
+	return &agent, nil
+}
+
+func (s *mongoAgentStore) Decommission(ctx context.Context, uuid string) error {
+	update := bson.M{
+		"$set":   bson.M{"status": models.AgentStatusDecommissioned, "api_secret": ""},
+		"$unset": bson.M{"key_id": "", "api_key": "", "previous_key_id": "", "previous_api_secret": ""},
+	}
+	res, err := s.collection.UpdateOne(ctx, bson.M{"uuid": uuid}, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type mongoTaskStore struct {
+	collection *mongo.Collection
+	// locks serializes the claims for agents with concurrency limits.
+	locks *mongo.Collection
+}
+
+func (s *mongoTaskStore) Create(ctx context.Context, task *models.Task) error {
+	if task.ID.IsZero() {
+		task.ID = primitive.NewObjectID()
+	}
+	task.SearchText = TaskSearchText(task.Parameters)
+	task.Queue = task.DispatchQueue()
+	_, err := s.collection.InsertOne(ctx, task)
+	return mongoError(err)
+}
+
+func (s *mongoTaskStore) Get(ctx context.Context, id primitive.ObjectID) (*models.Task, error) {
+	var task models.Task
+	if err := s.collection.FindOne(ctx, bson.M{"_id": id}).Decode(&task); err != nil {
+		return nil, mongoError(err)
+	}
+	return &task, nil
+}
+
+func (s *mongoTaskStore) ListByAgent(ctx context.Context, agentID string) ([]models.Task, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "priority", Value: -1}, {Key: "created_at", Value: 1}})
+	cursor, err := s.collection.Find(ctx, bson.M{"agent_id": agentID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var tasks []models.Task
+	if err := cursor.All(ctx, &tasks); err != nil {
+		return nil, err
+	}
+	return tasks, nil
+}
+
+// claimAttempts bounds how often ClaimNext picks a queue again when another poll of the same
+// agent claims the task it picked first.
+const claimAttempts = 3
+
+func (s *mongoTaskStore) ClaimNext(ctx context.Context, agentID string, policy DispatchPolicy, now time.Time) (*models.Task, error) {
+	eligible := bson.M{
+		"agent_id":      agentID,
+		"status":        models.TaskStatusQueued,
+		"next_retry_at": bson.M{"$not": bson.M{"$gt": now}}, // also matches tasks that were never retried
+	}
+	event := models.TaskEvent{Actor: models.AgentActor(agentID), Timestamp: now}
+	claim := bson.M{
+		"started_at":       literal(now),
+		"attempt":          bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$attempt", 0}}, 1}},
+		"next_retry_at":    nil,
+		"lease_expires_at": nil,
+	}
+	if until := policy.leaseUntil(now); !until.IsZero() {
+		claim["lease_expires_at"] = literal(until)
+	}
+	update := transitionUpdate(models.TaskStatusDispatched, event, claim)
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "priority", Value: -1}, {Key: "created_at", Value: 1}}).
+		SetReturnDocument(options.After)
+
+	if !policy.Limits.IsZero() {
+		// Counting the tasks the agent holds and claiming one must not interleave with another claim
+		token, locked, err := s.lockClaims(ctx, agentID, now)
+		if err != nil {
+			return nil, err
+		}
+		if !locked {
+			return nil, ErrNotFound
+		}
+		defer s.locks.DeleteOne(ctx, bson.M{"_id": agentID, "token": token})
+
+		held, err := s.CountHeld(ctx, agentID)
+		if err != nil {
+			return nil, err
+		}
+		full, fullTypes := policy.Limits.full(held)
+		if full {
+			return nil, ErrNotFound
+		}
+		if len(fullTypes) > 0 {
+			eligible["type"] = bson.M{"$nin": fullTypes}
+		}
+	}
+
+	for attempt := 0; attempt < claimAttempts; attempt++ {
+		priority, heads, err := s.queueHeads(ctx, eligible)
+		if err != nil {
+			return nil, err
+		}
+		if len(heads) == 0 {
+			return nil, ErrNotFound
+		}
+		recent, err := s.recentClaims(ctx, agentID, policy.window())
+		if err != nil {
+			return nil, err
+		}
+		filter := bson.M{"$and": bson.A{eligible, bson.M{"priority": priority, "queue": policy.pickQueue(heads, recent)}}}
+
+		var task models.Task
+		err = s.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&task)
+		if err == nil {
+			return &task, nil
+		}
+		if err = mongoError(err); err != ErrNotFound {
+			return nil, err
+		}
+	}
+
+	// Polls keep racing for the same queue: hand out the next task in plain priority order
+	var task models.Task
+	if err := s.collection.FindOneAndUpdate(ctx, eligible, update, opts).Decode(&task); err != nil {
+		return nil, mongoError(err)
+	}
+	return &task, nil
+}
+
+// claimLockLease is how long the claim lock of an agent keeps other claims for it out when the
+// manager holding it stops before releasing it.
+const claimLockLease = 30 * time.Second
+
+// lockClaims takes the claim lock of the agent and returns the token that releases it, or false
+// if another claim holds it.
+func (s *mongoTaskStore) lockClaims(ctx context.Context, agentID string, now time.Time) (primitive.ObjectID, bool, error) {
+	if _, err := s.locks.DeleteOne(ctx, bson.M{"_id": agentID, "expires_at": bson.M{"$lte": now}}); err != nil {
+		return primitive.NilObjectID, false, err
+	}
+	token := primitive.NewObjectID()
+	_, err := s.locks.InsertOne(ctx, bson.M{"_id": agentID, "token": token, "expires_at": now.Add(claimLockLease)})
+	if mongo.IsDuplicateKeyError(err) {
+		return primitive.NilObjectID, false, nil
+	}
+	if err != nil {
+		return primitive.NilObjectID, false, err
+	}
+	return token, true, nil
+}
+
+// queueHeads returns the highest priority among the tasks matching eligible, and the oldest
+// task of each queue at that priority. heads is empty when no task matches.
+func (s *mongoTaskStore) queueHeads(ctx context.Context, eligible bson.M) (int, []queueHead, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: eligible}},
+		{{Key: "$group", Value: bson.M{
+			"_id":    bson.M{"priority": "$priority", "queue": "$queue"},
+			"oldest": bson.M{"$min": "$created_at"},
+		}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   "$_id.priority",
+			"heads": bson.M{"$push": bson.M{"queue": "$_id.queue", "oldest": "$oldest"}},
+		}}},
+		{{Key: "$sort", Value: bson.M{"_id": -1}}},
+		{{Key: "$limit", Value: 1}},
+	}
+	cursor, err := s.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var groups []struct {
+		Priority int         `bson:"_id"`
+		Heads    []queueHead `bson:"heads"`
+	}
+	if err := cursor.All(ctx, &groups); err != nil {
+		return 0, nil, err
+	}
+	if len(groups) == 0 {
+		return 0, nil, nil
+	}
+	return groups[0].Priority, groups[0].Heads, nil
+}
+
+// recentClaims counts the last window tasks claimed by the agent per queue.
+func (s *mongoTaskStore) recentClaims(ctx context.Context, agentID string, window int) (map[string]int, error) {
+	opts := options.Find().
+		SetSort(bson.D{{Key: "started_at", Value: -1}}).
+		SetLimit(int64(window)).
+		SetProjection(bson.M{"queue": 1})
+	cursor, err := s.collection.Find(ctx, bson.M{"agent_id": agentID, "started_at": bson.M{"$exists": true}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var claimed []struct {
+		Queue string `bson:"queue"`
+	}
+	if err := cursor.All(ctx, &claimed); err != nil {
+		return nil, err
+	}
+	recent := make(map[string]int, len(claimed))
+	for _, task := range claimed {
+		recent[task.Queue]++
+	}
+	return recent, nil
+}
+
+func (s *mongoTaskStore) Start(ctx context.Context, id primitive.ObjectID, agentID string, now time.Time) error {
+	event := models.TaskEvent{Actor: models.AgentActor(agentID), Timestamp: now}
+	_, err := s.transition(ctx, bson.M{"_id": id, "agent_id": agentID}, models.TaskStatusRunning, event, nil)
+	return err
+}
+
+func (s *mongoTaskStore) Finish(ctx context.Context, id primitive.ObjectID, agentID, status string, output *models.Output, now time.Time) error {
+	event := models.TaskEvent{Actor: models.AgentActor(agentID), Timestamp: now}
+	_, err := s.transition(ctx, bson.M{"_id": id, "agent_id": agentID}, status, event, bson.M{"output": literal(output)})
+	return err
+}
+
+func (s *mongoTaskStore) Transition(ctx context.Context, id primitive.ObjectID, status string, event models.TaskEvent) (*models.Task, error) {
+	return s.transition(ctx, bson.M{"_id": id}, status, event, nil)
+}
+
+// transition moves the task matching filter to status if the state machine allows it, also
+// setting the fields in set, and then retries the task if its retry policy asks for it. When
+// nothing changes it tells a missing task (ErrNotFound) from one whose status forbids the
+// change (ErrConflict).
+func (s *mongoTaskStore) transition(ctx context.Context, filter bson.M, status string, event models.TaskEvent, set bson.M) (*models.Task, error) {
+	guarded := bson.M{"status": bson.M{"$in": models.TaskStatusesFrom(status)}}
+	for k, v := range filter {
+		guarded[k] = v
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var task models.Task
+	err := s.collection.FindOneAndUpdate(ctx, guarded, transitionUpdate(status, event, set), opts).Decode(&task)
+	if err == nil {
+		return &task, s.scheduleRetry(ctx, &task, event.Timestamp)
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+
+	if err := s.collection.FindOne(ctx, filter).Decode(&task); err != nil {
+		return nil, mongoError(err)
+	}
+	return nil, transitionConflict(&models.TransitionError{From: task.Status, To: status})
+}
+
+// scheduleRetry queues task again if it just failed or timed out and its retry policy allows
+// another attempt, updating task to match. The update only applies if nothing changed the task
+// since it was read.
+func (s *mongoTaskStore) scheduleRetry(ctx context.Context, task *models.Task, now time.Time) error {
+	filter := bson.M{"_id": task.ID, "status": task.Status, "attempt": task.Attempt}
+	if !task.ScheduleRetry(now) {
+		return nil
+	}
+	_, err := s.collection.UpdateOne(ctx, filter, bson.M{
+		"$set": bson.M{
+			"status":        task.Status,
+			"updated_at":    task.UpdatedAt,
+			"next_retry_at": task.NextRetryAt,
+		},
+		"$unset": bson.M{"started_at": ""},
+		"$push":  bson.M{"events": task.Events[len(task.Events)-1]},
+	})
+	return err
+}
+
+// transitionUpdate builds the pipeline update moving a task to status. It runs as a pipeline so
+// the event can record each document's previous status, which makes it usable with UpdateMany.
+func transitionUpdate(status string, event models.TaskEvent, set bson.M) mongo.Pipeline {
+	return transitionPipeline(status, event.Actor, literal(event.Reason), event.Timestamp, set)
+}
+
+// transitionPipeline is transitionUpdate with the reason given as an aggregation expression.
+// The values in set are aggregation expressions too; nil values remove the field. Leaving a
+// held status appends the attempt, with the output being set if there is one.
+func transitionPipeline(status, actor string, reason interface{}, now time.Time, set bson.M) mongo.Pipeline {
+	fields := bson.M{
+		"status":     status,
+		"updated_at": now,
+		"events": appendExpr("$events", bson.M{
+			"from":      "$status",
+			"to":        status,
+			"actor":     literal(actor),
+			"reason":    reason,
+			"timestamp": now,
+		}),
+	}
+
+	if !models.IsHeldStatus(status) {
+		output, ok := set["output"]
+		if !ok {
+			output = "$output"
+		}
+		attempt := bson.M{
+			"number":      bson.M{"$ifNull": bson.A{"$attempt", 0}},
+			"agent_id":    "$agent_id",
+			"status":      status,
+			"started_at":  "$started_at",
+			"finished_at": now,
+			"output":      output,
+			"reason":      reason,
+		}
+		fields["attempts"] = bson.M{"$cond": bson.A{
+			bson.M{"$in": bson.A{"$status", models.HeldTaskStatuses}},
+			appendExpr("$attempts", attempt),
+			"$attempts",
+		}}
+	}
+
+	for k, v := range set {
+		if v == nil {
+			fields[k] = "$$REMOVE"
+			continue
+		}
+		fields[k] = v
+	}
+	return mongo.Pipeline{{{Key: "$set", Value: fields}}}
+}
+
+// appendExpr is an aggregation expression appending item to the array field, which may be missing.
+func appendExpr(field string, item bson.M) bson.M {
+	return bson.M{"$concatArrays": bson.A{
+		bson.M{"$ifNull": bson.A{field, bson.A{}}},
+		bson.A{item},
+	}}
+}
+
+// literal wraps v so aggregation pipelines do not read strings starting with "$" as field paths.
+func literal(v interface{}) bson.M {
+	return bson.M{"$literal": v}
+}
+
+func (s *mongoTaskStore) TimeoutOverdue(ctx context.Context, now time.Time) (int64, error) {
+	filter := bson.M{
+		"status":     bson.M{"$in": models.TaskStatusesFrom(models.TaskStatusTimeout)},
+		"timeout":    bson.M{"$gt": 0},
+		"started_at": bson.M{"$type": "date"}, // a missing start would compare lower than any date
+		"$expr": bson.M{
+			"$lt": bson.A{
+				bson.M{"$add": bson.A{"$started_at", bson.M{"$multiply": bson.A{"$timeout", 1000}}}},
+				now,
+			},
+		},
+	}
+
+	// Matches timeoutReason, which depends on each task's timeout
+	reason := bson.M{"$concat": bson.A{"exceeded timeout of ", bson.M{"$toString": "$timeout"}, "s"}}
+	update := transitionPipeline(models.TaskStatusTimeout, models.ActorReaper, reason, now, nil)
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	// One task at a time, so each can be retried under its own policy
+	var changed int64
+	for {
+		var task models.Task
+		err := s.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&task)
+		if err == mongo.ErrNoDocuments {
+			return changed, nil
+		}
+		if err != nil {
+			return changed, err
+		}
+		changed++
+		if err := s.scheduleRetry(ctx, &task, now); err != nil {
+			return changed, err
+		}
+	}
+}
+
+func (s *mongoTaskStore) RequeueRunning(ctx context.Context, agentID string, now time.Time) (int64, error) {
+	filter := bson.M{
+		"agent_id": agentID,
+		"status":   bson.M{"$in": bson.A{models.TaskStatusDispatched, models.TaskStatusRunning}},
+	}
+	event := models.TaskEvent{Actor: models.ActorReaper, Reason: requeueReason, Timestamp: now}
+	res, err := s.collection.UpdateMany(ctx, filter, transitionUpdate(models.TaskStatusQueued, event, bson.M{"started_at": nil}))
+	if err != nil {
+		return 0, err
+	}
+	return res.ModifiedCount, nil
+}
+
+func (s *mongoTaskStore) RenewLease(ctx context.Context, id primitive.ObjectID, agentID string, until time.Time) error {
+	filter := bson.M{"_id": id, "agent_id": agentID, "status": bson.M{"$in": models.HeldTaskStatuses}}
+	res, err := s.collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"lease_expires_at": until}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *mongoTaskStore) ReserveArtifactBytes(ctx context.Context, id primitive.ObjectID, size, limit int64) error {
+	if size > limit {
+		return ErrConflict
+	}
+	// $not also matches tasks without a counter, which have nothing reserved yet
+	filter := bson.M{"_id": id, "artifact_bytes": bson.M{"$not": bson.M{"$gt": limit - size}}}
+	res, err := s.collection.UpdateOne(ctx, filter, bson.M{"$inc": bson.M{"artifact_bytes": size}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount > 0 {
+		return nil
+	}
+	if err := s.collection.FindOne(ctx, bson.M{"_id": id}).Err(); err != nil {
+		return mongoError(err)
+	}
+	return ErrConflict
+}
+
+func (s *mongoTaskStore) RenewLeases(ctx context.Context, agentID string, until time.Time) (int64, error) {
+	filter := bson.M{"agent_id": agentID, "status": bson.M{"$in": models.HeldTaskStatuses}}
+	res, err := s.collection.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"lease_expires_at": until}})
+	if err != nil {
+		return 0, err
+	}
+	return res.ModifiedCount, nil
+}
+
+// expiredLeaseFilter matches the dispatched and running tasks whose lease expired before now.
+func expiredLeaseFilter(now time.Time) bson.M {
+	return bson.M{
+		"status":           bson.M{"$in": bson.A{models.TaskStatusDispatched, models.TaskStatusRunning}},
+		"lease_expires_at": bson.M{"$lt": now},
+	}
+}
+
+func (s *mongoTaskStore) ExpiredLeases(ctx context.Context, now time.Time, limit int) ([]models.Task, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "lease_expires_at", Value: 1}})
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
+	}
+	cursor, err := s.collection.Find(ctx, expiredLeaseFilter(now), opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var tasks []models.Task
+	if err := cursor.All(ctx, &tasks); err != nil {
+		return nil, err
+	}
+	return tasks, nil
+}
+
+func (s *mongoTaskStore) RequeueExpired(ctx context.Context, id primitive.ObjectID, agentID string, now time.Time) error {
+	filter := expiredLeaseFilter(now)
+	filter["_id"] = id
+	event := models.TaskEvent{Actor: models.ActorReaper, Reason: leaseExpiredReason, Timestamp: now}
+	update := transitionUpdate(models.TaskStatusQueued, event, bson.M{
+		"agent_id":         literal(agentID),
+		"started_at":       nil,
+		"lease_expires_at": nil,
+	})
+	res, err := s.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return mongoError(err)
+	}
+	if res.MatchedCount > 0 {
+		return nil
+	}
+	if err := s.collection.FindOne(ctx, bson.M{"_id": id}).Err(); err != nil {
+		return mongoError(err)
+	}
+	return ErrConflict
+}
+
+func (s *mongoTaskStore) CancelRequested(ctx context.Context, agentID string) ([]primitive.ObjectID, error) {
+	filter := bson.M{"agent_id": agentID, "status": models.TaskStatusCancelRequested}
+	opts := options.Find().SetSort(bson.D{{Key: "updated_at", Value: 1}}).SetProjection(bson.M{"_id": 1})
+	cursor, err := s.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var tasks []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &tasks); err != nil {
+		return nil, err
+	}
+	ids := make([]primitive.ObjectID, len(tasks))
+	for i, task := range tasks {
+		ids[i] = task.ID
+	}
+	return ids, nil
+}
+
+func (s *mongoTaskStore) CancelOverdue(ctx context.Context, before, now time.Time) (int64, error) {
+	// Nothing updates a task waiting for its agent to stop it, so updated_at is when it was cancelled
+	filter := bson.M{
+		"status":     models.TaskStatusCancelRequested,
+		"updated_at": bson.M{"$lt": before},
+	}
+	event := models.TaskEvent{Actor: models.ActorReaper, Reason: cancelGraceReason, Timestamp: now}
+	res, err := s.collection.UpdateMany(ctx, filter, transitionUpdate(models.TaskStatusCancelled, event, nil))
+	if err != nil {
+		return 0, err
+	}
+	return res.ModifiedCount, nil
+}
+
+func (s *mongoTaskStore) List(ctx context.Context, query TaskQuery) (*TaskPage, error) {
+	query = query.normalize()
+	filter := taskFilterDocument(query.Filter)
+
+	total, err := s.collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	direction, after := 1, "$gt"
+	if query.SortDesc {
+		direction, after = -1, "$lt"
+	}
+	if query.Cursor != "" {
+		value, id, err := decodeTaskCursor(query)
+		if err != nil {
+			return nil, err
+		}
+		// Keyset pagination: continue after the last (sort value, _id) of the previous page
+		position := bson.M{"$or": bson.A{
+			bson.M{query.SortBy: bson.M{after: value}},
+			bson.M{query.SortBy: value, "_id": bson.M{after: id}},
+		}}
+		filter = bson.M{"$and": bson.A{filter, position}}
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: query.SortBy, Value: direction}, {Key: "_id", Value: direction}})
+	if query.Limit > 0 {
+		// Fetch one extra task to learn whether another page follows
+		opts.SetLimit(int64(query.Limit) + 1)
+	}
+
+	cursor, err := s.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	page := &TaskPage{Tasks: []models.Task{}, Total: total}
+	if err := cursor.All(ctx, &page.Tasks); err != nil {
+		return nil, err
+	}
+	if query.Limit > 0 && len(page.Tasks) > query.Limit {
+		page.Tasks = page.Tasks[:query.Limit]
+		page.NextCursor = encodeTaskCursor(query, &page.Tasks[query.Limit-1])
+	}
+	return page, nil
+}
+
+func (s *mongoTaskStore) CancelMatching(ctx context.Context, filter TaskFilter, actor string, now time.Time) (int64, error) {
+	event := models.TaskEvent{Actor: actor, Reason: "bulk cancel", Timestamp: now}
+
+	// Queued tasks are cancelled outright; tasks held by an agent must be stopped by it first
+	var changed int64
+	for from, to := range map[string]string{
+		models.TaskStatusQueued:     models.TaskStatusCancelled,
+		models.TaskStatusDispatched: models.TaskStatusCancelRequested,
+		models.TaskStatusRunning:    models.TaskStatusCancelRequested,
+	} {
+		match := bson.M{"$and": bson.A{taskFilterDocument(filter), bson.M{"status": from}}}
+		res, err := s.collection.UpdateMany(ctx, match, transitionUpdate(to, event, nil))
+		if err != nil {
+			return changed, err
+		}
+		changed += res.ModifiedCount
+	}
+	return changed, nil
+}
+
+func (s *mongoTaskStore) CountHeld(ctx context.Context, agentID string) (map[string]int, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"agent_id": agentID, "status": bson.M{"$in": models.HeldTaskStatuses}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$type", "count": bson.M{"$sum": 1}}}},
+	}
+	cursor, err := s.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var groups []struct {
+		Type  string `bson:"_id"`
+		Count int    `bson:"count"`
+	}
+	if err := cursor.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+	held := make(map[string]int, len(groups))
+	for _, group := range groups {
+		held[group.Type] = group.Count
+	}
+	return held, nil
+}
+
+func (s *mongoTaskStore) SetPriority(ctx context.Context, filter TaskFilter, priority int, now time.Time) (int64, error) {
+	match := bson.M{"$and": bson.A{taskFilterDocument(filter), bson.M{"status": models.TaskStatusQueued}}}
+	res, err := s.collection.UpdateMany(ctx, match, bson.M{"$set": bson.M{"priority": priority, "updated_at": now}})
+	if err != nil {
+		return 0, err
+	}
+	return res.ModifiedCount, nil
+}
+
+func (s *mongoTaskStore) CountByStatus(ctx context.Context, filter TaskFilter) (map[string]int64, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: taskFilterDocument(filter)}},
+		{{Key: "$group", Value: bson.M{"_id": "$status", "count": bson.M{"$sum": 1}}}},
+	}
+	cursor, err := s.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var groups []struct {
+		Status string `bson:"_id"`
+		Count  int64  `bson:"count"`
+	}
+	if err := cursor.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int64, len(groups))
+	for _, group := range groups {
+		counts[group.Status] = group.Count
+	}
+	return counts, nil
+}
+
+func (s *mongoTaskStore) QueryResults(ctx context.Context, query ResultQuery) ([]models.Task, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "updated_at", Value: -1}, {Key: "_id", Value: -1}})
+	if query.Limit > 0 {
+		opts.SetLimit(int64(query.Limit))
+	}
+	cursor, err := s.collection.Find(ctx, resultFilterDocument(query), opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	tasks := []models.Task{}
+	if err := cursor.All(ctx, &tasks); err != nil {
+		return nil, err
+	}
+	return tasks, nil
+}
+
+func (s *mongoTaskStore) AggregateResults(ctx context.Context, query ResultQuery) ([]ResultGroup, error) {
+	key := interface{}(nil)
+	switch {
+	case strings.HasPrefix(query.GroupBy, resultGroupPrefix):
+		key = "$output.results." + strings.TrimPrefix(query.GroupBy, resultGroupPrefix) + ".value"
+	case query.GroupBy != "":
+		key = "$" + query.GroupBy
+	}
+	group := bson.M{"_id": key, "count": bson.M{"$sum": 1}}
+	for i, agg := range query.Aggregates {
+		// Only numbers are aggregated; $min and $max would otherwise compare across types
+		value := "$output.results." + agg.Field + ".value"
+		numeric := bson.M{"$cond": bson.A{bson.M{"$isNumber": value}, value, nil}}
+		group[fmt.Sprintf("a%d", i)] = bson.M{"$" + agg.Op: numeric}
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: resultFilterDocument(query)}},
+		{{Key: "$group", Value: group}},
+		{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}}},
+	}
+	if query.Limit > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: query.Limit}})
+	}
+	cursor, err := s.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var docs []bson.M
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	groups := make([]ResultGroup, len(docs))
+	for i, doc := range docs {
+		count, _ := models.NumberValue(doc["count"])
+		groups[i] = ResultGroup{Key: doc["_id"], Count: int64(count)}
+		for j, agg := range query.Aggregates {
+			if n, ok := models.NumberValue(doc[fmt.Sprintf("a%d", j)]); ok {
+				if groups[i].Values == nil {
+					groups[i].Values = map[string]float64{}
+				}
+				groups[i].Values[agg.Name()] = n
+			}
+		}
+	}
+	return groups, nil
+}
+
+// resultFilterDocument translates the filter and conditions of a ResultQuery into a MongoDB
+// filter.
+func resultFilterDocument(query ResultQuery) bson.M {
+	conditions := bson.A{taskFilterDocument(query.Filter)}
+	for _, cond := range query.Where {
+		path := "output.results." + cond.Field
+		if cond.Op == ResultOpExists {
+			conditions = append(conditions, bson.M{path: bson.M{"$exists": cond.Value}})
+			continue
+		}
+		conditions = append(conditions, bson.M{path + ".value": bson.M{"$" + cond.Op: cond.Value}})
+	}
+	return bson.M{"$and": conditions}
+}
+
+func (s *mongoTaskStore) FinishedBefore(ctx context.Context, before time.Time, limit int) ([]primitive.ObjectID, error) {
+	filter := bson.M{
+		"status":          bson.M{"$in": models.FinishedTaskStatuses},
+		"updated_at":      bson.M{"$lt": before},
+		"job_id":          bson.M{"$in": bson.A{nil, ""}},
+		"workflow_run_id": bson.M{"$in": bson.A{nil, ""}},
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "updated_at", Value: 1}}).SetProjection(bson.M{"_id": 1})
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
+	}
+	cursor, err := s.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var tasks []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &tasks); err != nil {
+		return nil, err
+	}
+	ids := make([]primitive.ObjectID, len(tasks))
+	for i, task := range tasks {
+		ids[i] = task.ID
+	}
+	return ids, nil
+}
+
+func (s *mongoTaskStore) Delete(ctx context.Context, ids []primitive.ObjectID) (int64, error) {
+	res, err := s.collection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+// taskFilterDocument translates a TaskFilter into a MongoDB filter.
+func taskFilterDocument(f TaskFilter) bson.M {
+	filter := bson.M{}
+	if f.AgentID != "" {
+		filter["agent_id"] = f.AgentID
+	}
+	if f.JobID != "" {
+		filter["job_id"] = f.JobID
+	}
+	if f.Wave != 0 {
+		filter["wave"] = f.Wave
+	}
+	if f.WorkflowRunID != "" {
+		filter["workflow_run_id"] = f.WorkflowRunID
+	}
+	if f.Type != "" {
+		filter["type"] = f.Type
+	}
+	if f.Status != "" {
+		filter["status"] = f.Status
+	}
+	if f.CreatedBy != "" {
+		filter["created_by"] = f.CreatedBy
+	}
+	if r := timeRange(f.CreatedAfter, f.CreatedBefore); len(r) > 0 {
+		filter["created_at"] = r
+	}
+	if r := timeRange(f.UpdatedAfter, f.UpdatedBefore); len(r) > 0 {
+		filter["updated_at"] = r
+	}
+	if f.Text != "" {
+		filter["search_text"] = bson.M{"$regex": regexp.QuoteMeta(strings.ToLower(f.Text))}
+	}
+	return filter
+}
+
+// timeRange builds an exclusive range condition; zero bounds are left open.
+func timeRange(after, before time.Time) bson.M {
+	r := bson.M{}
+	if !after.IsZero() {
+		r["$gt"] = after
+	}
+	if !before.IsZero() {
+		r["$lt"] = before
+	}
+	return r
+}
+
+type mongoRoleStore struct {
+	collection *mongo.Collection
+}
+
+func (s *mongoRoleStore) List(ctx context.Context) ([]models.Role, error) {
+	cursor, err := s.collection.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var roles []models.Role
+	if err := cursor.All(ctx, &roles); err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+func (s *mongoRoleStore) Create(ctx context.Context, role *models.Role) error {
+	if role.ID.IsZero() {
+		role.ID = primitive.NewObjectID()
+	}
+	_, err := s.collection.InsertOne(ctx, role)
+	return mongoError(err)
+}
+
+func (s *mongoRoleStore) Get(ctx context.Context, id primitive.ObjectID) (*models.Role, error) {
+	var role models.Role
+	if err := s.collection.FindOne(ctx, bson.M{"_id": id}).Decode(&role); err != nil {
+		return nil, mongoError(err)
+	}
+	return &role, nil
+}
+
+func (s *mongoRoleStore) GetByName(ctx context.Context, name string) (*models.Role, error) {
+	var role models.Role
+	if err := s.collection.FindOne(ctx, bson.M{"name": name}).Decode(&role); err != nil {
+		return nil, mongoError(err)
+	}
+	return &role, nil
+}
+
+type mongoAdminStore struct {
+	collection *mongo.Collection
+}
+
+func (s *mongoAdminStore) GetByUsername(ctx context.Context, username string) (*models.Admin, error) {
+	var admin models.Admin
+	if err := s.collection.FindOne(ctx, bson.M{"username": username}).Decode(&admin); err != nil {
+		return nil, mongoError(err)
+	}
+	return &admin, nil
+}
+
+func (s *mongoAdminStore) Create(ctx context.Context, admin *models.Admin) error {
+	if admin.ID.IsZero() {
+		admin.ID = primitive.NewObjectID()
+	}
+	_, err := s.collection.InsertOne(ctx, admin)
+	return mongoError(err)
+}
+
+type mongoLogStore struct {
+	collection *mongo.Collection
+}
+
+func (s *mongoLogStore) Create(ctx context.Context, entry *models.LogEntry) error {
+	if entry.ID.IsZero() {
+		entry.ID = primitive.NewObjectID()
+	}
+	_, err := s.collection.InsertOne(ctx, entry)
+	return mongoError(err)
+}
+
+func (s *mongoLogStore) List(ctx context.Context, agentID string, limit int64) ([]models.LogEntry, error) {
+	filter := bson.M{}
+	if agentID != "" {
+		filter["agent_id"] = agentID
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: -1}})
+	if limit > 0 {
+		opts.SetLimit(limit)
+	}
+
+	cursor, err := s.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var entries []models.LogEntry
+	if err := cursor.All(ctx, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+type mongoEnrollmentTokenStore struct {
+	collection *mongo.Collection
+}
+
+func (s *mongoEnrollmentTokenStore) Create(ctx context.Context, token *models.EnrollmentToken) error {
+	if token.ID.IsZero() {
+		token.ID = primitive.NewObjectID()
+	}
+	_, err := s.collection.InsertOne(ctx, token)
+	return mongoError(err)
+}
+
+func (s *mongoEnrollmentTokenStore) List(ctx context.Context) ([]models.EnrollmentToken, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+	cursor, err := s.collection.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var tokens []models.EnrollmentToken
+	if err := cursor.All(ctx, &tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (s *mongoEnrollmentTokenStore) Revoke(ctx context.Context, id primitive.ObjectID) error {
+	res, err := s.collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"revoked": true}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *mongoEnrollmentTokenStore) Consume(ctx context.Context, tokenHash string, usage models.EnrollmentUsage) (*models.EnrollmentToken, error) {
+	filter := bson.M{
+		"token_hash": tokenHash,
+		"revoked":    false,
+		"expires_at": bson.M{"$gt": usage.UsedAt},
+		"$expr":      bson.M{"$lt": bson.A{"$uses", "$max_uses"}},
+	}
+	update := bson.M{
+		"$inc":  bson.M{"uses": 1},
+		"$push": bson.M{"usages": usage},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var token models.EnrollmentToken
+	if err := s.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&token); err != nil {
+		return nil, mongoError(err)
+	}
+	return &token, nil
+}
+
+func (s *mongoEnrollmentTokenStore) Release(ctx context.Context, id primitive.ObjectID, agentUUID string) error {
+	filter := bson.M{"_id": id, "usages.agent_uuid": agentUUID}
+	update := bson.M{
+		"$inc":  bson.M{"uses": -1},
+		"$pull": bson.M{"usages": bson.M{"agent_uuid": agentUUID}},
+	}
+	res, err := s.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// mongoNonceStore relies on the unique (agent_id, nonce) index to detect reuse across manager
+// instances and on a TTL index on expires_at to discard old nonces.
+type mongoNonceStore struct {
+	collection *mongo.Collection
+}
+
+func (s *mongoNonceStore) Remember(ctx context.Context, agentID, nonce string, expiresAt time.Time) error {
+	_, err := s.collection.InsertOne(ctx, bson.M{
+		"agent_id":   agentID,
+		"nonce":      nonce,
+		"expires_at": expiresAt,
+	})
+	return mongoError(err)
+}
+
+type mongoIdempotencyStore struct {
+	collection *mongo.Collection
+}
+
+func (s *mongoIdempotencyStore) Reserve(ctx context.Context, record *models.IdempotencyRecord) (*models.IdempotencyRecord, error) {
+	filter := bson.M{"caller": record.Caller, "key": record.Key}
+
+	// The TTL monitor only runs once a minute, so an expired record may still be there
+	expired := bson.M{"caller": record.Caller, "key": record.Key, "expires_at": bson.M{"$lte": record.CreatedAt}}
+	if _, err := s.collection.DeleteOne(ctx, expired); err != nil {
+		return nil, err
+	}
+	_, err := s.collection.InsertOne(ctx, record)
+	if !mongo.IsDuplicateKeyError(err) {
+		return nil, err
+	}
+
+	var existing models.IdempotencyRecord
+	if err := s.collection.FindOne(ctx, filter).Decode(&existing); err != nil {
+		return nil, mongoError(err)
+	}
+	return &existing, ErrDuplicate
+}
+
+func (s *mongoIdempotencyStore) Complete(ctx context.Context, caller, key string, statusCode int, contentType, body string) error {
+	res, err := s.collection.UpdateOne(ctx, bson.M{"caller": caller, "key": key}, bson.M{"$set": bson.M{
+		"status_code":  statusCode,
+		"content_type": contentType,
+		"body":         body,
+	}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *mongoIdempotencyStore) Release(ctx context.Context, caller, key string) error {
+	_, err := s.collection.DeleteOne(ctx, bson.M{"caller": caller, "key": key})
+	return err
+}
+
+func (s *mongoIdempotencyStore) Get(ctx context.Context, caller, key string, now time.Time) (*models.IdempotencyRecord, error) {
+	filter := bson.M{"caller": caller, "key": key, "expires_at": bson.M{"$gt": now}}
+	var record models.IdempotencyRecord
+	if err := s.collection.FindOne(ctx, filter).Decode(&record); err != nil {
+		return nil, mongoError(err)
+	}
+	return &record, nil
+}
+
+type mongoScheduleStore struct {
+	collection *mongo.Collection
+}
+
+func (s *mongoScheduleStore) Create(ctx context.Context, schedule *models.Schedule) error {
+	if schedule.ID.IsZero() {
+		schedule.ID = primitive.NewObjectID()
+	}
+	_, err := s.collection.InsertOne(ctx, schedule)
+	return mongoError(err)
+}
+
+func (s *mongoScheduleStore) Get(ctx context.Context, id primitive.ObjectID) (*models.Schedule, error) {
+	var schedule models.Schedule
+	if err := s.collection.FindOne(ctx, bson.M{"_id": id}).Decode(&schedule); err != nil {
+		return nil, mongoError(err)
+	}
+	return &schedule, nil
+}
+
+func (s *mongoScheduleStore) List(ctx context.Context) ([]models.Schedule, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}})
+	cursor, err := s.collection.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	schedules := []models.Schedule{}
+	if err := cursor.All(ctx, &schedules); err != nil {
+		return nil, err
+	}
+	return schedules, nil
+}
+
+func (s *mongoScheduleStore) Replace(ctx context.Context, schedule *models.Schedule) error {
+	res, err := s.collection.ReplaceOne(ctx, bson.M{"_id": schedule.ID}, schedule)
+	if err != nil {
+		return mongoError(err)
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *mongoScheduleStore) Delete(ctx context.Context, id primitive.ObjectID) error {
+	res, err := s.collection.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *mongoScheduleStore) Due(ctx context.Context, now time.Time) ([]models.Schedule, error) {
+	filter := bson.M{"enabled": true, "next_run_at": bson.M{"$lte": now}}
+	opts := options.Find().SetSort(bson.D{{Key: "next_run_at", Value: 1}})
+	cursor, err := s.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	due := []models.Schedule{}
+	if err := cursor.All(ctx, &due); err != nil {
+		return nil, err
+	}
+	return due, nil
+}
+
+func (s *mongoScheduleStore) Advance(ctx context.Context, id primitive.ObjectID, from, next, firedAt time.Time) error {
+	set := bson.M{}
+	update := bson.M{}
+	if next.IsZero() {
+		update["$unset"] = bson.M{"next_run_at": ""}
+	} else {
+		set["next_run_at"] = next
+	}
+	if !firedAt.IsZero() {
+		set["last_run_at"] = firedAt
+	}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+
+	res, err := s.collection.UpdateOne(ctx, bson.M{"_id": id, "next_run_at": from}, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount > 0 {
+		return nil
+	}
+	if err := s.collection.FindOne(ctx, bson.M{"_id": id}).Err(); err != nil {
+		return mongoError(err)
+	}
+	return ErrConflict
+}
+
+type mongoJobStore struct {
+	collection *mongo.Collection
+}
+
+func (s *mongoJobStore) Create(ctx context.Context, job *models.Job) error {
+	if job.ID.IsZero() {
+		job.ID = primitive.NewObjectID()
+	}
+	_, err := s.collection.InsertOne(ctx, job)
+	return mongoError(err)
+}
+
+func (s *mongoJobStore) Get(ctx context.Context, id primitive.ObjectID) (*models.Job, error) {
+	var job models.Job
+	if err := s.collection.FindOne(ctx, bson.M{"_id": id}).Decode(&job); err != nil {
+		return nil, mongoError(err)
+	}
+	return &job, nil
+}
+
+func (s *mongoJobStore) GetByIdempotencyKey(ctx context.Context, createdBy, key string) (*models.Job, error) {
+	var job models.Job
+	filter := bson.M{"created_by": createdBy, "idempotency_key": key}
+	if err := s.collection.FindOne(ctx, filter).Decode(&job); err != nil {
+		return nil, mongoError(err)
+	}
+	return &job, nil
+}
+
+func (s *mongoJobStore) List(ctx context.Context, limit int64) ([]models.Job, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}).SetLimit(limit)
+	cursor, err := s.collection.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	jobs := []models.Job{}
+	if err := cursor.All(ctx, &jobs); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+func (s *mongoJobStore) MarkCancelled(ctx context.Context, id primitive.ObjectID, by string, at time.Time) error {
+	filter := bson.M{"_id": id, "cancelled_at": bson.M{"$exists": false}}
+	res, err := s.collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"cancelled_by": by, "cancelled_at": at}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount > 0 {
+		return nil
+	}
+	if err := s.collection.FindOne(ctx, bson.M{"_id": id}).Err(); err != nil {
+		return mongoError(err)
+	}
+	return ErrConflict
+}
+
+func (s *mongoJobStore) Rollouts(ctx context.Context, status string) ([]models.Job, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}})
+	cursor, err := s.collection.Find(ctx, bson.M{"rollout.status": status}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	jobs := []models.Job{}
+	if err := cursor.All(ctx, &jobs); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+func (s *mongoJobStore) UpdateRollout(ctx context.Context, id primitive.ObjectID, status string, wave int, rollout *models.Rollout) error {
+	filter := bson.M{"_id": id, "rollout.status": status, "rollout.current_wave": wave}
+	res, err := s.collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"rollout": rollout}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount > 0 {
+		return nil
+	}
+	if err := s.collection.FindOne(ctx, bson.M{"_id": id}).Err(); err != nil {
+		return mongoError(err)
+	}
+	return ErrConflict
+}
+
+func (s *mongoJobStore) CreatedBefore(ctx context.Context, before time.Time, after primitive.ObjectID, limit int) ([]models.Job, error) {
+	filter := bson.M{"created_at": bson.M{"$lt": before}, "_id": bson.M{"$gt": after}}
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
+	}
+	cursor, err := s.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	jobs := []models.Job{}
+	if err := cursor.All(ctx, &jobs); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+func (s *mongoJobStore) Delete(ctx context.Context, id primitive.ObjectID) error {
+	res, err := s.collection.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type mongoWorkflowStore struct {
+	collection *mongo.Collection
+}
+
+func (s *mongoWorkflowStore) Create(ctx context.Context, workflow *models.Workflow) error {
+	if workflow.ID.IsZero() {
+		workflow.ID = primitive.NewObjectID()
+	}
+	_, err := s.collection.InsertOne(ctx, workflow)
+	return mongoError(err)
+}
+
+func (s *mongoWorkflowStore) Get(ctx context.Context, id primitive.ObjectID) (*models.Workflow, error) {
+	var workflow models.Workflow
+	if err := s.collection.FindOne(ctx, bson.M{"_id": id}).Decode(&workflow); err != nil {
+		return nil, mongoError(err)
+	}
+	return &workflow, nil
+}
+
+func (s *mongoWorkflowStore) List(ctx context.Context) ([]models.Workflow, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}})
+	cursor, err := s.collection.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	workflows := []models.Workflow{}
+	if err := cursor.All(ctx, &workflows); err != nil {
+		return nil, err
+	}
+	return workflows, nil
+}
+
+func (s *mongoWorkflowStore) Replace(ctx context.Context, workflow *models.Workflow) error {
+	res, err := s.collection.ReplaceOne(ctx, bson.M{"_id": workflow.ID}, workflow)
+	if err != nil {
+		return mongoError(err)
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *mongoWorkflowStore) Delete(ctx context.Context, id primitive.ObjectID) error {
+	res, err := s.collection.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type mongoWorkflowRunStore struct {
+	collection *mongo.Collection
+}
+
+func (s *mongoWorkflowRunStore) Create(ctx context.Context, run *models.WorkflowRun) error {
+	if run.ID.IsZero() {
+		run.ID = primitive.NewObjectID()
+	}
+	_, err := s.collection.InsertOne(ctx, run)
+	return mongoError(err)
+}
+
+func (s *mongoWorkflowRunStore) Get(ctx context.Context, id primitive.ObjectID) (*models.WorkflowRun, error) {
+	var run models.WorkflowRun
+	if err := s.collection.FindOne(ctx, bson.M{"_id": id}).Decode(&run); err != nil {
+		return nil, mongoError(err)
+	}
+	return &run, nil
+}
+
+func (s *mongoWorkflowRunStore) List(ctx context.Context, filter WorkflowRunFilter, limit int64) ([]models.WorkflowRun, error) {
+	match := bson.M{}
+	if filter.WorkflowID != "" {
+		match["workflow_id"] = filter.WorkflowID
+	}
+	if filter.AgentID != "" {
+		match["agent_id"] = filter.AgentID
+	}
+	if filter.Status != "" {
+		match["status"] = filter.Status
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}).SetLimit(limit)
+	return s.find(ctx, match, opts)
+}
+
+func (s *mongoWorkflowRunStore) Running(ctx context.Context) ([]models.WorkflowRun, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}})
+	return s.find(ctx, bson.M{"status": models.WorkflowRunning}, opts)
+}
+
+func (s *mongoWorkflowRunStore) find(ctx context.Context, filter bson.M, opts *options.FindOptions) ([]models.WorkflowRun, error) {
+	cursor, err := s.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	runs := []models.WorkflowRun{}
+	if err := cursor.All(ctx, &runs); err != nil {
+		return nil, err
+	}
+	return runs, nil
+}
+
+func (s *mongoWorkflowRunStore) Update(ctx context.Context, run *models.WorkflowRun) error {
+	updated := *run
+	updated.Revision++
+	res, err := s.collection.ReplaceOne(ctx, bson.M{"_id": run.ID, "revision": run.Revision}, &updated)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount > 0 {
+		run.Revision = updated.Revision
+		return nil
+	}
+	if err := s.collection.FindOne(ctx, bson.M{"_id": run.ID}).Err(); err != nil {
+		return mongoError(err)
+	}
+	return ErrConflict
+}
+
+func (s *mongoWorkflowRunStore) FinishedBefore(ctx context.Context, before time.Time, after primitive.ObjectID, limit int) ([]models.WorkflowRun, error) {
+	filter := bson.M{
+		"status":      bson.M{"$ne": models.WorkflowRunning},
+		"finished_at": bson.M{"$lt": before},
+		"_id":         bson.M{"$gt": after},
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
+	}
+	return s.find(ctx, filter, opts)
+}
+
+func (s *mongoWorkflowRunStore) Delete(ctx context.Context, id primitive.ObjectID) error {
+	res, err := s.collection.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// templateCreateAttempts is how often Create picks the next version of a template when another
+// manager stored the same version first.
+const templateCreateAttempts = 5
+
+type mongoTemplateStore struct {
+	collection *mongo.Collection
+}
+
+func (s *mongoTemplateStore) Create(ctx context.Context, template *models.Template) error {
+	for attempt := 0; ; attempt++ {
+		latest, err := s.Get(ctx, template.Name, 0)
+		switch {
+		case err == nil:
+			template.Version = latest.Version + 1
+		case err == ErrNotFound:
+			template.Version = 1
+		default:
+			return err
+		}
+		template.ID = primitive.NewObjectID()
+
+		// The unique index on name and version rejects a version stored concurrently
+		_, err = s.collection.InsertOne(ctx, template)
+		err = mongoError(err)
+		if err != ErrDuplicate || attempt+1 == templateCreateAttempts {
+			return err
+		}
+	}
+}
+
+func (s *mongoTemplateStore) Get(ctx context.Context, name string, version int) (*models.Template, error) {
+	filter := bson.M{"name": name}
+	if version > 0 {
+		filter["version"] = version
+	}
+	opts := options.FindOne().SetSort(bson.D{{Key: "version", Value: -1}})
+
+	var template models.Template
+	if err := s.collection.FindOne(ctx, filter, opts).Decode(&template); err != nil {
+		return nil, mongoError(err)
+	}
+	return &template, nil
+}
+
+func (s *mongoTemplateStore) List(ctx context.Context) ([]models.Template, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$sort", Value: bson.D{{Key: "name", Value: 1}, {Key: "version", Value: -1}}}},
+		{{Key: "$group", Value: bson.D{{Key: "_id", Value: "$name"}, {Key: "latest", Value: bson.M{"$first": "$$ROOT"}}}}},
+		{{Key: "$replaceWith", Value: "$latest"}},
+		{{Key: "$sort", Value: bson.D{{Key: "name", Value: 1}}}},
+	}
+	cursor, err := s.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	templates := []models.Template{}
+	if err := cursor.All(ctx, &templates); err != nil {
+		return nil, err
+	}
+	return templates, nil
+}
+
+func (s *mongoTemplateStore) Versions(ctx context.Context, name string) ([]models.Template, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "version", Value: 1}})
+	cursor, err := s.collection.Find(ctx, bson.M{"name": name}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	templates := []models.Template{}
+	if err := cursor.All(ctx, &templates); err != nil {
+		return nil, err
+	}
+	if len(templates) == 0 {
+		return nil, ErrNotFound
+	}
+	return templates, nil
+}
+
+func (s *mongoTemplateStore) Delete(ctx context.Context, name string) error {
+	res, err := s.collection.DeleteMany(ctx, bson.M{"name": name})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type mongoTaskLogStore struct {
+	collection *mongo.Collection
+}
+
+func (s *mongoTaskLogStore) Append(ctx context.Context, chunk *models.TaskLogChunk) error {
+	chunk.ID = primitive.NewObjectID()
+	_, err := s.collection.InsertOne(ctx, chunk)
+	return mongoError(err)
+}
+
+func (s *mongoTaskLogStore) List(ctx context.Context, taskID primitive.ObjectID, attempt int, from int64, limit int) ([]models.TaskLogChunk, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "sequence", Value: 1}})
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
+	}
+	cursor, err := s.collection.Find(ctx, bson.M{"task_id": taskID, "attempt": attempt, "sequence": bson.M{"$gte": from}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	chunks := []models.TaskLogChunk{}
+	if err := cursor.All(ctx, &chunks); err != nil {
+		return nil, err
+	}
+	return chunks, nil
+}
+
+func (s *mongoTaskLogStore) DeleteByTasks(ctx context.Context, taskIDs []primitive.ObjectID) (int64, error) {
+	res, err := s.collection.DeleteMany(ctx, bson.M{"task_id": bson.M{"$in": taskIDs}})
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+// artifactBucket is the GridFS bucket artifacts are stored in, as the collections
+// "artifacts.files" and "artifacts.chunks".
+const artifactBucket = "artifacts"
+
+// artifactFile is the GridFS files document of an artifact. The fields of models.Artifact that
+// GridFS does not track itself are kept in its metadata.
+type artifactFile struct {
+	ID       primitive.ObjectID `bson:"_id"`
+	Length   int64              `bson:"length"`
+	Filename string             `bson:"filename"`
+	Metadata artifactMetadata   `bson:"metadata"`
+}
+
+type artifactMetadata struct {
+	TaskID      primitive.ObjectID `bson:"task_id"`
+	AgentID     string             `bson:"agent_id"`
+	Attempt     int                `bson:"attempt"`
+	ContentType string             `bson:"content_type"`
+	SHA256      string             `bson:"sha256"`
+	CreatedAt   time.Time          `bson:"created_at"`
+}
+
+func (f *artifactFile) artifact() models.Artifact {
+	return models.Artifact{
+		ID:          f.ID,
+		TaskID:      f.Metadata.TaskID,
+		AgentID:     f.Metadata.AgentID,
+		Attempt:     f.Metadata.Attempt,
+		Name:        f.Filename,
+		ContentType: f.Metadata.ContentType,
+		Size:        f.Length,
+		SHA256:      f.Metadata.SHA256,
+		CreatedAt:   f.Metadata.CreatedAt,
+	}
+}
+
+type mongoArtifactStore struct {
+	db *mongo.Database
+}
+
+// bucket returns the artifact bucket with the deadline of ctx, if any, applied to its reads and
+// writes. GridFS streams do not take a context, and a bucket's deadlines are shared by all its
+// users, so each call gets its own bucket.
+func (s *mongoArtifactStore) bucket(ctx context.Context) (*gridfs.Bucket, error) {
+	bucket, err := gridfs.NewBucket(s.db, options.GridFSBucket().SetName(artifactBucket))
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		bucket.SetReadDeadline(deadline)
+		bucket.SetWriteDeadline(deadline)
+	}
+	return bucket, nil
+}
+
+func (s *mongoArtifactStore) Create(ctx context.Context, artifact *models.Artifact, content io.Reader) error {
+	bucket, err := s.bucket(ctx)
+	if err != nil {
+		return err
+	}
+	id := primitive.NewObjectID()
+	metadata := artifactMetadata{
+		TaskID:      artifact.TaskID,
+		AgentID:     artifact.AgentID,
+		Attempt:     artifact.Attempt,
+		ContentType: artifact.ContentType,
+		SHA256:      artifact.SHA256,
+		CreatedAt:   artifact.CreatedAt,
+	}
+	upload, err := bucket.OpenUploadStreamWithID(id, artifact.Name, options.GridFSUpload().SetMetadata(metadata))
+	if err != nil {
+		return err
+	}
+	size, err := io.Copy(upload, content)
+	if err != nil {
+		// Remove the chunks written so far
+		upload.Abort()
+		return err
+	}
+	if err := upload.Close(); err != nil {
+		return err
+	}
+	artifact.ID = id
+	artifact.Size = size
+	return nil
+}
+
+func (s *mongoArtifactStore) List(ctx context.Context, taskID primitive.ObjectID) ([]models.Artifact, error) {
+	bucket, err := s.bucket(ctx)
+	if err != nil {
+		return nil, err
+	}
+	opts := options.GridFSFind().SetSort(bson.D{{Key: "uploadDate", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := bucket.FindContext(ctx, bson.M{"metadata.task_id": taskID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var files []artifactFile
+	if err := cursor.All(ctx, &files); err != nil {
+		return nil, err
+	}
+	artifacts := make([]models.Artifact, len(files))
+	for i := range files {
+		artifacts[i] = files[i].artifact()
+	}
+	return artifacts, nil
+}
+
+func (s *mongoArtifactStore) Open(ctx context.Context, id primitive.ObjectID) (*models.Artifact, io.ReadCloser, error) {
+	bucket, err := s.bucket(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	var file artifactFile
+	if err := bucket.GetFilesCollection().FindOne(ctx, bson.M{"_id": id}).Decode(&file); err != nil {
+		return nil, nil, mongoError(err)
+	}
+	download, err := bucket.OpenDownloadStream(id)
+	if err == gridfs.ErrFileNotFound {
+		return nil, nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	artifact := file.artifact()
+	return &artifact, download, nil
+}
+
+func (s *mongoArtifactStore) DeleteByTasks(ctx context.Context, taskIDs []primitive.ObjectID) (int64, error) {
+	files := s.db.Collection(artifactBucket + ".files")
+	opts := options.Find().SetProjection(bson.M{"_id": 1})
+	cursor, err := files.Find(ctx, bson.M{"metadata.task_id": bson.M{"$in": taskIDs}}, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var found []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &found); err != nil {
+		return 0, err
+	}
+	if len(found) == 0 {
+		return 0, nil
+	}
+	ids := make([]primitive.ObjectID, len(found))
+	for i, file := range found {
+		ids[i] = file.ID
+	}
+
+	// Remove the chunks first, so an interrupted pass leaves the files listed for the next one
+	chunks := s.db.Collection(artifactBucket + ".chunks")
+	if _, err := chunks.DeleteMany(ctx, bson.M{"files_id": bson.M{"$in": ids}}); err != nil {
+		return 0, err
+	}
+	res, err := files.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
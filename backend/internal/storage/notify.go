@@ -0,0 +1,263 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+
+	"github.com/whit3rabbit/beehive/manager/internal/logger"
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+// TaskNotifier wakes agents waiting in a long poll when tasks they may be able to claim change:
+// a task is queued for them, one of their tasks finishes and frees a slot, or one is cancelled.
+// Writes through the store notify it in-process; Watch also picks up the writes of other
+// manager instances sharing the database.
+type TaskNotifier struct {
+	mu      sync.Mutex
+	waiters map[string]map[chan struct{}]struct{} // keyed by agent UUID
+	watch   func(ctx context.Context, n *TaskNotifier) error
+}
+
+// NewTaskNotifier creates a TaskNotifier without waiters.
+func NewTaskNotifier() *TaskNotifier {
+	return &TaskNotifier{waiters: make(map[string]map[chan struct{}]struct{})}
+}
+
+// Subscribe returns a channel that receives when the tasks of the agent change, and a function
+// that ends the subscription. Changes while the receiver is busy are coalesced into one.
+func (n *TaskNotifier) Subscribe(agentID string) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	n.mu.Lock()
+	if n.waiters[agentID] == nil {
+		n.waiters[agentID] = make(map[chan struct{}]struct{})
+	}
+	n.waiters[agentID][ch] = struct{}{}
+	n.mu.Unlock()
+
+	return ch, func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		delete(n.waiters[agentID], ch)
+		if len(n.waiters[agentID]) == 0 {
+			delete(n.waiters, agentID)
+		}
+	}
+}
+
+// Notify wakes the waiters of the agent.
+func (n *TaskNotifier) Notify(agentID string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for ch := range n.waiters[agentID] {
+		wake(ch)
+	}
+}
+
+// NotifyAll wakes every waiter, after changes to tasks of agents that are not known.
+func (n *TaskNotifier) NotifyAll() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, waiters := range n.waiters {
+		for ch := range waiters {
+			wake(ch)
+		}
+	}
+}
+
+func wake(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// Watch notifies waiters of the task changes made by other manager instances until ctx is
+// done. It returns at once for stores that are not shared, and with an error if the database
+// cannot report changes, as a standalone MongoDB server cannot. Other failures are logged and
+// watching resumes after a delay.
+func (n *TaskNotifier) Watch(ctx context.Context) error {
+	if n.watch == nil {
+		return nil
+	}
+	return n.watch(ctx, n)
+}
+
+// Delays before following the change stream of the tasks collection again after it failed,
+// doubling from watchRetryMin up to watchRetryMax.
+const (
+	watchRetryMin = time.Second
+	watchRetryMax = time.Minute
+)
+
+// MongoDB error codes of change streams that cannot be opened or resumed.
+const (
+	codeChangeStreamUnsupported = 40573 // standalone servers have no change streams
+	codeInvalidResumeToken      = 260
+	codeChangeStreamHistoryLost = 286
+)
+
+// watchMongoTasks follows the change stream of the tasks collection, resuming it after the last
+// change seen whenever it fails. Only changes that can make a task claimable or free a slot are
+// followed, so lease renewals wake nobody.
+func watchMongoTasks(collection *mongo.Collection) func(ctx context.Context, n *TaskNotifier) error {
+	return func(ctx context.Context, n *TaskNotifier) error {
+		var resumeToken bson.Raw
+		delay := watchRetryMin
+		for {
+			started := time.Now()
+			err := followMongoTasks(ctx, collection, n, &resumeToken)
+			if ctx.Err() != nil {
+				return nil
+			}
+			var serverErr mongo.ServerError
+			if errors.As(err, &serverErr) {
+				if serverErr.HasErrorCode(codeChangeStreamUnsupported) {
+					return err
+				}
+				if serverErr.HasErrorCode(codeInvalidResumeToken) || serverErr.HasErrorCode(codeChangeStreamHistoryLost) {
+					resumeToken = nil
+				}
+			}
+			if time.Since(started) > watchRetryMax {
+				delay = watchRetryMin
+			}
+			logger.Warn("Task change stream failed; watching again", zap.Error(err), zap.Duration("retry_in", delay))
+			// Changes may be missed while the stream is down, so every held poll checks again
+			n.NotifyAll()
+
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(delay):
+			}
+			if delay *= 2; delay > watchRetryMax {
+				delay = watchRetryMax
+			}
+		}
+	}
+}
+
+// followMongoTasks opens the change stream of the tasks collection after resumeToken, if set,
+// and notifies the agents of the changed tasks until the stream fails or ctx is done. It keeps
+// resumeToken at the last change seen.
+func followMongoTasks(ctx context.Context, collection *mongo.Collection, n *TaskNotifier, resumeToken *bson.Raw) error {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"$or": bson.A{
+			bson.M{"operationType": bson.M{"$in": bson.A{"insert", "replace"}}},
+			bson.M{"updateDescription.updatedFields.status": bson.M{"$exists": true}},
+			bson.M{"updateDescription.updatedFields.agent_id": bson.M{"$exists": true}},
+		}}}},
+		{{Key: "$project", Value: bson.M{"fullDocument.agent_id": 1}}},
+	}
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup).SetMaxAwaitTime(10 * time.Second)
+	if *resumeToken != nil {
+		opts.SetResumeAfter(*resumeToken)
+	}
+	stream, err := collection.Watch(ctx, pipeline, opts)
+	if err != nil {
+		return err
+	}
+	defer stream.Close(context.Background())
+
+	for stream.Next(ctx) {
+		*resumeToken = stream.ResumeToken()
+		var event struct {
+			FullDocument *struct {
+				AgentID string `bson:"agent_id"`
+			} `bson:"fullDocument"`
+		}
+		if err := stream.Decode(&event); err != nil {
+			logger.Warn("Skipping task change that cannot be decoded", zap.Error(err))
+			continue
+		}
+		// The task may have been deleted before it was looked up
+		if event.FullDocument != nil {
+			n.Notify(event.FullDocument.AgentID)
+		}
+	}
+	if token := stream.ResumeToken(); token != nil {
+		*resumeToken = token
+	}
+	if err := stream.Err(); err != nil {
+		return err
+	}
+	return errors.New("change stream closed")
+}
+
+// notifyingTaskStore notifies the waiters of an agent after writes that may let it claim a task.
+type notifyingTaskStore struct {
+	TaskStore
+	notifier *TaskNotifier
+}
+
+func (s *notifyingTaskStore) Create(ctx context.Context, task *models.Task) error {
+	err := s.TaskStore.Create(ctx, task)
+	if err == nil {
+		s.notifier.Notify(task.AgentID)
+	}
+	return err
+}
+
+func (s *notifyingTaskStore) Finish(ctx context.Context, id primitive.ObjectID, agentID, status string, output *models.Output, now time.Time) error {
+	err := s.TaskStore.Finish(ctx, id, agentID, status, output, now)
+	if err == nil {
+		s.notifier.Notify(agentID)
+	}
+	return err
+}
+
+func (s *notifyingTaskStore) Transition(ctx context.Context, id primitive.ObjectID, status string, event models.TaskEvent) (*models.Task, error) {
+	task, err := s.TaskStore.Transition(ctx, id, status, event)
+	if err == nil {
+		s.notifier.Notify(task.AgentID)
+	}
+	return task, err
+}
+
+func (s *notifyingTaskStore) RequeueRunning(ctx context.Context, agentID string, now time.Time) (int64, error) {
+	n, err := s.TaskStore.RequeueRunning(ctx, agentID, now)
+	if n > 0 {
+		s.notifier.Notify(agentID)
+	}
+	return n, err
+}
+
+func (s *notifyingTaskStore) RequeueExpired(ctx context.Context, id primitive.ObjectID, agentID string, now time.Time) error {
+	err := s.TaskStore.RequeueExpired(ctx, id, agentID, now)
+	if err == nil {
+		s.notifier.Notify(agentID)
+	}
+	return err
+}
+
+func (s *notifyingTaskStore) TimeoutOverdue(ctx context.Context, now time.Time) (int64, error) {
+	n, err := s.TaskStore.TimeoutOverdue(ctx, now)
+	if n > 0 {
+		s.notifier.NotifyAll()
+	}
+	return n, err
+}
+
+func (s *notifyingTaskStore) CancelOverdue(ctx context.Context, before, now time.Time) (int64, error) {
+	n, err := s.TaskStore.CancelOverdue(ctx, before, now)
+	if n > 0 {
+		s.notifier.NotifyAll()
+	}
+	return n, err
+}
+
+func (s *notifyingTaskStore) CancelMatching(ctx context.Context, filter TaskFilter, actor string, now time.Time) (int64, error) {
+	n, err := s.TaskStore.CancelMatching(ctx, filter, actor, now)
+	if n > 0 {
+		s.notifier.NotifyAll()
+	}
+	return n, err
+}
@@ -0,0 +1,300 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+// Operators of a ResultCondition.
+const (
+	ResultOpEq     = "eq"
+	ResultOpNe     = "ne"
+	ResultOpGt     = "gt"
+	ResultOpGte    = "gte"
+	ResultOpLt     = "lt"
+	ResultOpLte    = "lte"
+	ResultOpExists = "exists"
+)
+
+// Operators of a ResultAggregate.
+const (
+	AggregateSum = "sum"
+	AggregateAvg = "avg"
+	AggregateMin = "min"
+	AggregateMax = "max"
+)
+
+// Task fields results can be grouped by, besides "results.<name>".
+var resultGroupFields = []string{"agent_id", "type", "status", "job_id"}
+
+// resultGroupPrefix introduces a result name in ResultQuery.GroupBy.
+const resultGroupPrefix = "results."
+
+// ResultCondition compares the result Field of a task with Value. Numbers compare with numbers
+// and strings with strings; other comparisons only hold for ResultOpNe. For ResultOpExists,
+// Value is a bool telling whether the result must be present.
+type ResultCondition struct {
+	Field string
+	Op    string
+	Value interface{}
+}
+
+// ResultAggregate computes Op over the numeric values of the result Field.
+type ResultAggregate struct {
+	Field string
+	Op    string
+}
+
+// Name is the key the aggregate is reported under in ResultGroup.Values.
+func (a ResultAggregate) Name() string {
+	return a.Op + "_" + a.Field
+}
+
+// ResultQuery selects tasks by their fields and results. Result names must be valid as
+// models.ValidResultName describes, which ValidateResultQuery checks.
+type ResultQuery struct {
+	Filter TaskFilter
+	Where  []ResultCondition
+	// GroupBy is one of the task fields "agent_id", "type", "status" and "job_id", or
+	// "results.<name>"; empty puts every task in one group.
+	GroupBy    string
+	Aggregates []ResultAggregate
+	Limit      int
+}
+
+// ResultGroup is one group of tasks aggregated by AggregateResults.
+type ResultGroup struct {
+	// Key is the value the tasks share in the GroupBy field, nil for tasks without it.
+	Key   interface{}
+	Count int64
+	// Values holds the aggregates by name. Aggregates over no numeric values are left out.
+	Values map[string]float64
+}
+
+// ValidateResultQuery checks the result names, operators and grouping of q.
+func ValidateResultQuery(q ResultQuery) error {
+	for _, cond := range q.Where {
+		if !models.ValidResultName(cond.Field) {
+			return fmt.Errorf("invalid result name %q", cond.Field)
+		}
+		switch cond.Op {
+		case ResultOpEq, ResultOpNe:
+		case ResultOpGt, ResultOpGte, ResultOpLt, ResultOpLte:
+			if _, ok := models.NumberValue(cond.Value); !ok {
+				if _, ok := cond.Value.(string); !ok {
+					return fmt.Errorf("%s compares with a number or a string", cond.Op)
+				}
+			}
+		case ResultOpExists:
+			if _, ok := cond.Value.(bool); !ok {
+				return fmt.Errorf("%s takes a boolean", cond.Op)
+			}
+		default:
+			return fmt.Errorf("invalid operator %q", cond.Op)
+		}
+	}
+	seen := map[string]bool{}
+	for _, agg := range q.Aggregates {
+		if !models.ValidResultName(agg.Field) {
+			return fmt.Errorf("invalid result name %q", agg.Field)
+		}
+		if seen[agg.Name()] {
+			return fmt.Errorf("duplicate aggregate %s", agg.Name())
+		}
+		seen[agg.Name()] = true
+		switch agg.Op {
+		case AggregateSum, AggregateAvg, AggregateMin, AggregateMax:
+		default:
+			return fmt.Errorf("invalid aggregate %q", agg.Op)
+		}
+	}
+	if q.GroupBy != "" && !containsString(resultGroupFields, q.GroupBy) {
+		name, ok := strings.CutPrefix(q.GroupBy, resultGroupPrefix)
+		if !ok || !models.ValidResultName(name) {
+			return fmt.Errorf("invalid group_by %q", q.GroupBy)
+		}
+	}
+	return nil
+}
+
+// taskResult returns the value of the named result of task.
+func taskResult(task *models.Task, name string) (interface{}, bool) {
+	if task.Output == nil {
+		return nil, false
+	}
+	result, ok := task.Output.Results[name]
+	return result.Value, ok
+}
+
+// resultMatches reports whether task passes every condition on its results.
+func resultMatches(task *models.Task, where []ResultCondition) bool {
+	for _, cond := range where {
+		value, ok := taskResult(task, cond.Field)
+		if cond.Op == ResultOpExists {
+			if ok != cond.Value.(bool) {
+				return false
+			}
+			continue
+		}
+		if !ok {
+			if cond.Op != ResultOpNe {
+				return false
+			}
+			continue
+		}
+		cmp, comparable := compareValues(value, cond.Value)
+		var holds bool
+		switch cond.Op {
+		case ResultOpEq:
+			holds = comparable && cmp == 0
+		case ResultOpNe:
+			holds = !comparable || cmp != 0
+		case ResultOpGt:
+			holds = comparable && cmp > 0
+		case ResultOpGte:
+			holds = comparable && cmp >= 0
+		case ResultOpLt:
+			holds = comparable && cmp < 0
+		case ResultOpLte:
+			holds = comparable && cmp <= 0
+		}
+		if !holds {
+			return false
+		}
+	}
+	return true
+}
+
+// compareValues compares two numbers, strings or booleans, and reports whether they are of the
+// same kind. Booleans are only ever equal or not, compared as 0 or 1.
+func compareValues(a, b interface{}) (int, bool) {
+	if x, ok := models.NumberValue(a); ok {
+		y, ok := models.NumberValue(b)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	}
+	if x, ok := a.(string); ok {
+		y, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(x, y), true
+	}
+	if x, ok := a.(bool); ok {
+		y, ok := b.(bool)
+		if !ok {
+			return 0, false
+		}
+		if x == y {
+			return 0, true
+		}
+		return 1, true
+	}
+	return 0, false
+}
+
+// resultGroupKey returns the value of the GroupBy field of task.
+func resultGroupKey(task *models.Task, groupBy string) interface{} {
+	switch groupBy {
+	case "":
+		return nil
+	case "agent_id":
+		return task.AgentID
+	case "type":
+		return task.Type
+	case "status":
+		return task.Status
+	case "job_id":
+		if task.JobID == "" {
+			return nil // MongoDB groups tasks without the field under null
+		}
+		return task.JobID
+	}
+	value, _ := taskResult(task, strings.TrimPrefix(groupBy, resultGroupPrefix))
+	return value
+}
+
+// aggregateResults groups tasks as q describes, largest group first.
+func aggregateResults(tasks []models.Task, q ResultQuery) []ResultGroup {
+	type accumulator struct {
+		group  ResultGroup
+		counts map[string]int // numeric values seen per aggregate
+	}
+	byKey := map[interface{}]*accumulator{}
+	var order []*accumulator
+	for i := range tasks {
+		key := resultGroupKey(&tasks[i], q.GroupBy)
+		if n, ok := models.NumberValue(key); ok {
+			key = n // group 1 and 1.0 together, as MongoDB does
+		}
+		acc, ok := byKey[key]
+		if !ok {
+			acc = &accumulator{group: ResultGroup{Key: key, Values: map[string]float64{}}, counts: map[string]int{}}
+			byKey[key] = acc
+			order = append(order, acc)
+		}
+		acc.group.Count++
+		for _, agg := range q.Aggregates {
+			value, _ := taskResult(&tasks[i], agg.Field)
+			n, ok := models.NumberValue(value)
+			if !ok {
+				continue
+			}
+			name := agg.Name()
+			current, seen := acc.group.Values[name], acc.counts[name] > 0
+			switch agg.Op {
+			case AggregateSum, AggregateAvg:
+				current += n
+			case AggregateMin:
+				if !seen || n < current {
+					current = n
+				}
+			case AggregateMax:
+				if !seen || n > current {
+					current = n
+				}
+			}
+			acc.group.Values[name] = current
+			acc.counts[name]++
+		}
+	}
+
+	groups := make([]ResultGroup, len(order))
+	for i, acc := range order {
+		for _, agg := range q.Aggregates {
+			name := agg.Name()
+			switch {
+			case agg.Op == AggregateSum:
+				// A sum over nothing is 0, as MongoDB reports it
+				acc.group.Values[name] += 0
+			case agg.Op == AggregateAvg && acc.counts[name] > 0:
+				acc.group.Values[name] /= float64(acc.counts[name])
+			}
+		}
+		if len(acc.group.Values) == 0 {
+			acc.group.Values = nil
+		}
+		groups[i] = acc.group
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		if groups[i].Count != groups[j].Count {
+			return groups[i].Count > groups[j].Count
+		}
+		return fmt.Sprint(groups[i].Key) < fmt.Sprint(groups[j].Key)
+	})
+	if q.Limit > 0 && len(groups) > q.Limit {
+		groups = groups[:q.Limit]
+	}
+	return groups
+}
@@ -0,0 +1,353 @@
+// Package storage defines the persistence interfaces used by the manager and
+// provides MongoDB and in-memory implementations of them.
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+var (
+	// ErrNotFound is returned when the requested document does not exist.
+	ErrNotFound = errors.New("storage: not found")
+	// ErrConflict is returned when a document exists but is not in a state that allows the operation.
+	ErrConflict = errors.New("storage: conflicting state")
+	// ErrDuplicate is returned when an insert violates a uniqueness constraint.
+	ErrDuplicate = errors.New("storage: duplicate key")
+)
+
+// Backend names accepted by the --storage flag.
+const (
+	BackendMongo  = "mongo"
+	BackendMemory = "memory"
+)
+
+// AgentStore persists registered agents.
+type AgentStore interface {
+	// Create inserts a new agent and returns ErrDuplicate if the UUID is already registered.
+	Create(ctx context.Context, agent *models.Agent) error
+	// Upsert inserts the agent or replaces the fields of the agent with the same UUID.
+	Upsert(ctx context.Context, agent *models.Agent) error
+	GetByUUID(ctx context.Context, uuid string) (*models.Agent, error)
+	GetByKeyID(ctx context.Context, keyID string) (*models.Agent, error)
+	// GetByPreviousKeyID looks up an agent by the key ID its last credential rotation replaced.
+	GetByPreviousKeyID(ctx context.Context, keyID string) (*models.Agent, error)
+	// DropPreviousCredentials forgets the credentials the last rotation of the agent replaced,
+	// provided its current key ID is still keyID.
+	DropPreviousCredentials(ctx context.Context, uuid, keyID string) error
+	// GetByAPIKey looks up a legacy agent by the SHA256 hash of its API key.
+	GetByAPIKey(ctx context.Context, apiKey string) (*models.Agent, error)
+	// Heartbeat marks the agent active and records when it was last seen.
+	// Unknown UUIDs are ignored; decommissioned agents are left as they are and ErrConflict
+	// is returned.
+	Heartbeat(ctx context.Context, uuid string, seen time.Time) error
+	// MarkStale moves agents in one of the from statuses that were last seen before lastSeenBefore
+	// to status, and returns the UUIDs of the agents it changed.
+	MarkStale(ctx context.Context, from []string, status string, lastSeenBefore time.Time) ([]string, error)
+	// List returns one page of the agents matching the query.
+	// It returns ErrInvalidCursor if the query cursor cannot be used.
+	List(ctx context.Context, query AgentQuery) (*AgentPage, error)
+	// Update applies the non-nil fields of update to the agent and returns the result.
+	Update(ctx context.Context, uuid string, update AgentUpdate) (*models.Agent, error)
+	// Decommission marks the agent decommissioned and removes its credentials, so it can no
+	// longer authenticate.
+	Decommission(ctx context.Context, uuid string) error
+}
+
+// AgentUpdate holds the agent fields an administrator may change. Nil fields are left as is.
+type AgentUpdate struct {
+	Nickname      *string
+	Role          *string
+	MaxConcurrent *int
+}
+
+// TaskStore persists tasks and their lifecycle. Every status change goes through the state
+// machine in models: the methods only apply to tasks whose current status allows the change,
+// and append a models.TaskEvent to the task. Methods acting on a single task return ErrConflict
+// wrapping a *models.TransitionError when its status does not allow the change.
+type TaskStore interface {
+	// Create inserts the task, assigning a new ID if it has none and setting its dispatch queue.
+	// It returns ErrDuplicate if a task was already created for the same schedule occurrence and
+	// agent, or for the same job, rollout wave and agent.
+	Create(ctx context.Context, task *models.Task) error
+	Get(ctx context.Context, id primitive.ObjectID) (*models.Task, error)
+	// ListByAgent returns the tasks of the agent, highest priority first and then oldest first.
+	ListByAgent(ctx context.Context, agentID string) ([]models.Task, error)
+	// ClaimNext atomically moves the queued task of the agent that policy picks to "dispatched",
+	// provided the agent has a free slot for it under policy.Limits. It returns ErrNotFound when
+	// the agent has no queued work it has room for, or while another claim for the agent holding
+	// limits is in progress.
+	ClaimNext(ctx context.Context, agentID string, policy DispatchPolicy, now time.Time) (*models.Task, error)
+	// Start moves a dispatched task owned by the agent to "running".
+	// It returns ErrNotFound if the agent does not own the task.
+	Start(ctx context.Context, id primitive.ObjectID, agentID string, now time.Time) error
+	// Finish records the output of a task owned by the agent and moves it to status.
+	// It returns ErrNotFound if the agent does not own the task.
+	Finish(ctx context.Context, id primitive.ObjectID, agentID, status string, output *models.Output, now time.Time) error
+	// Transition moves the task to status, recording the actor, reason and timestamp of event.
+	Transition(ctx context.Context, id primitive.ObjectID, status string, event models.TaskEvent) (*models.Task, error)
+	// TimeoutOverdue moves tasks held by an agent whose timeout has elapsed at now to "timeout"
+	// and returns how many it changed. Tasks without a timeout are left alone.
+	TimeoutOverdue(ctx context.Context, now time.Time) (int64, error)
+	// RequeueRunning moves the dispatched and running tasks of the agent back to "queued" so
+	// they are handed out again on its next poll, and returns how many it changed.
+	RequeueRunning(ctx context.Context, agentID string, now time.Time) (int64, error)
+	// RenewLease extends the lease on a task the agent holds until the given time. It returns
+	// ErrNotFound if the agent does not hold the task.
+	RenewLease(ctx context.Context, id primitive.ObjectID, agentID string, until time.Time) error
+	// RenewLeases extends the leases on every task the agent holds until the given time, and
+	// returns how many it changed.
+	RenewLeases(ctx context.Context, agentID string, until time.Time) (int64, error)
+	// ExpiredLeases returns up to limit dispatched or running tasks whose lease expired before
+	// now, the longest expired first.
+	ExpiredLeases(ctx context.Context, now time.Time, limit int) ([]models.Task, error)
+	// RequeueExpired moves a task whose lease expired before now back to "queued" for agentID,
+	// which may be another agent than the one that lost it, and records the lost attempt. It
+	// returns ErrConflict if the task was renewed or changed status in the meantime, and
+	// ErrDuplicate if agentID already has the task's job wave or schedule occurrence.
+	RequeueExpired(ctx context.Context, id primitive.ObjectID, agentID string, now time.Time) error
+	// CancelRequested returns the IDs of the tasks of the agent waiting for it to stop them,
+	// in "cancel_requested", oldest request first.
+	CancelRequested(ctx context.Context, agentID string) ([]primitive.ObjectID, error)
+	// CancelOverdue moves the tasks in "cancel_requested" since before, whose agent never
+	// acknowledged the cancellation, to "cancelled" and returns how many it changed.
+	CancelOverdue(ctx context.Context, before, now time.Time) (int64, error)
+	// List returns one page of the tasks matching the query.
+	// It returns ErrInvalidCursor if the query cursor cannot be used.
+	List(ctx context.Context, query TaskQuery) (*TaskPage, error)
+	// CancelMatching cancels the tasks matching filter as models.CancelTarget describes and
+	// returns how many it changed. Finished tasks are left alone.
+	CancelMatching(ctx context.Context, filter TaskFilter, actor string, now time.Time) (int64, error)
+	// CountHeld counts the tasks the agent holds per task type: those dispatched to it, running
+	// on it or being cancelled.
+	CountHeld(ctx context.Context, agentID string) (map[string]int, error)
+	// SetPriority sets the priority of the queued tasks matching filter and returns how many
+	// it changed.
+	SetPriority(ctx context.Context, filter TaskFilter, priority int, now time.Time) (int64, error)
+	// CountByStatus returns the number of tasks matching filter in each status that has any.
+	CountByStatus(ctx context.Context, filter TaskFilter) (map[string]int64, error)
+	// QueryResults returns up to limit tasks matching the filter and conditions of query, most
+	// recently updated first.
+	QueryResults(ctx context.Context, query ResultQuery) ([]models.Task, error)
+	// AggregateResults groups the tasks matching the filter and conditions of query and computes
+	// its aggregates per group. It returns up to limit groups, largest first.
+	AggregateResults(ctx context.Context, query ResultQuery) ([]ResultGroup, error)
+	// ReserveArtifactBytes adds size to the ArtifactBytes of the task, provided the total stays
+	// within limit, and returns ErrConflict otherwise. A negative size releases a reservation.
+	ReserveArtifactBytes(ctx context.Context, id primitive.ObjectID, size, limit int64) error
+	// FinishedBefore returns the IDs of up to limit finished tasks last updated before before,
+	// least recently updated first. Tasks of jobs and workflow runs are left out, as their
+	// parents read their results; they are deleted with their parents.
+	FinishedBefore(ctx context.Context, before time.Time, limit int) ([]primitive.ObjectID, error)
+	// Delete removes the tasks and returns how many it removed. Their logs and artifacts are
+	// left to the caller.
+	Delete(ctx context.Context, ids []primitive.ObjectID) (int64, error)
+}
+
+// JobStore persists fan-out jobs. Their tasks live in the TaskStore.
+type JobStore interface {
+	// Create inserts the job, assigning a new ID if it has none. It returns ErrDuplicate if its
+	// creator already has a job with the same IdempotencyKey.
+	Create(ctx context.Context, job *models.Job) error
+	Get(ctx context.Context, id primitive.ObjectID) (*models.Job, error)
+	// GetByIdempotencyKey returns the job the administrator created with the idempotency key.
+	GetByIdempotencyKey(ctx context.Context, createdBy, key string) (*models.Job, error)
+	// List returns up to limit jobs, newest first.
+	List(ctx context.Context, limit int64) ([]models.Job, error)
+	// MarkCancelled records who cancelled the job and when. It returns ErrConflict if the job
+	// was already cancelled.
+	MarkCancelled(ctx context.Context, id primitive.ObjectID, by string, at time.Time) error
+	// Rollouts returns the jobs whose rollout is in status, oldest first.
+	Rollouts(ctx context.Context, status string) ([]models.Job, error)
+	// UpdateRollout replaces the rollout state of the job. It returns ErrConflict unless the
+	// stored rollout is still in status at wave, so that concurrent updates cannot both apply.
+	UpdateRollout(ctx context.Context, id primitive.ObjectID, status string, wave int, rollout *models.Rollout) error
+	// CreatedBefore returns up to limit jobs created before before with an ID above after, in
+	// ID order, so that callers can page through them.
+	CreatedBefore(ctx context.Context, before time.Time, after primitive.ObjectID, limit int) ([]models.Job, error)
+	// Delete removes the job. Its tasks are left to the caller.
+	Delete(ctx context.Context, id primitive.ObjectID) error
+}
+
+// WorkflowStore persists workflow definitions.
+type WorkflowStore interface {
+	// Create inserts the workflow, assigning a new ID if it has none.
+	Create(ctx context.Context, workflow *models.Workflow) error
+	Get(ctx context.Context, id primitive.ObjectID) (*models.Workflow, error)
+	// List returns all workflows, oldest first.
+	List(ctx context.Context) ([]models.Workflow, error)
+	// Replace overwrites the stored workflow with the same ID.
+	Replace(ctx context.Context, workflow *models.Workflow) error
+	Delete(ctx context.Context, id primitive.ObjectID) error
+}
+
+// WorkflowRunFilter selects workflow runs. Zero values match everything.
+type WorkflowRunFilter struct {
+	WorkflowID string
+	AgentID    string
+	Status     string
+}
+
+// WorkflowRunStore persists workflow runs. Their tasks live in the TaskStore.
+type WorkflowRunStore interface {
+	// Create inserts the run, assigning a new ID if it has none.
+	Create(ctx context.Context, run *models.WorkflowRun) error
+	Get(ctx context.Context, id primitive.ObjectID) (*models.WorkflowRun, error)
+	// List returns up to limit runs matching filter, newest first.
+	List(ctx context.Context, filter WorkflowRunFilter, limit int64) ([]models.WorkflowRun, error)
+	// Running returns the runs in progress, oldest first.
+	Running(ctx context.Context) ([]models.WorkflowRun, error)
+	// Update replaces the stored run and increments its revision. It returns ErrConflict if the
+	// stored revision is no longer run.Revision, so that concurrent updates cannot both apply.
+	Update(ctx context.Context, run *models.WorkflowRun) error
+	// FinishedBefore returns up to limit runs no longer running that finished before before
+	// with an ID above after, in ID order, so that callers can page through them.
+	FinishedBefore(ctx context.Context, before time.Time, after primitive.ObjectID, limit int) ([]models.WorkflowRun, error)
+	// Delete removes the run. Its tasks are left to the caller.
+	Delete(ctx context.Context, id primitive.ObjectID) error
+}
+
+// ScheduleStore persists task schedules.
+type ScheduleStore interface {
+	// Create inserts the schedule, assigning a new ID if it has none.
+	Create(ctx context.Context, schedule *models.Schedule) error
+	Get(ctx context.Context, id primitive.ObjectID) (*models.Schedule, error)
+	// List returns all schedules, oldest first.
+	List(ctx context.Context) ([]models.Schedule, error)
+	// Replace overwrites the stored schedule with the same ID.
+	Replace(ctx context.Context, schedule *models.Schedule) error
+	Delete(ctx context.Context, id primitive.ObjectID) error
+	// Due returns the enabled schedules whose next run is at or before now.
+	Due(ctx context.Context, now time.Time) ([]models.Schedule, error)
+	// Advance moves the next run of the schedule from from to next, unsetting it if next is
+	// zero, and records firedAt as its last run unless firedAt is zero. It returns ErrConflict
+	// if the next run is no longer from, because another manager advanced the schedule first
+	// or it was edited.
+	Advance(ctx context.Context, id primitive.ObjectID, from, next, firedAt time.Time) error
+}
+
+// TemplateStore persists versioned task templates. Stored versions are never changed.
+type TemplateStore interface {
+	// Create stores the template as the next version of its name, setting its ID and Version.
+	Create(ctx context.Context, template *models.Template) error
+	// Get returns the given version of the named template, or its latest version if version
+	// is zero.
+	Get(ctx context.Context, name string, version int) (*models.Template, error)
+	// List returns the latest version of every template, by name.
+	List(ctx context.Context) ([]models.Template, error)
+	// Versions returns every version of the named template, oldest first. It returns
+	// ErrNotFound if there are none.
+	Versions(ctx context.Context, name string) ([]models.Template, error)
+	// Delete removes every version of the named template.
+	Delete(ctx context.Context, name string) error
+}
+
+// TaskLogStore persists the log chunks agents stream for their tasks.
+type TaskLogStore interface {
+	// Append stores the chunk, assigning it an ID. It returns ErrDuplicate if the attempt of the
+	// task already has a chunk with the same sequence number.
+	Append(ctx context.Context, chunk *models.TaskLogChunk) error
+	// List returns up to limit chunks of the attempt of the task with a sequence number of at
+	// least from, in sequence order.
+	List(ctx context.Context, taskID primitive.ObjectID, attempt int, from int64, limit int) ([]models.TaskLogChunk, error)
+	// DeleteByTasks removes the chunks of every attempt of the tasks and returns how many it
+	// removed.
+	DeleteByTasks(ctx context.Context, taskIDs []primitive.ObjectID) (int64, error)
+}
+
+// ArtifactStore persists the files agents attach to their tasks.
+type ArtifactStore interface {
+	// Create stores the artifact with the content read from content, assigning it an ID and
+	// setting its Size to the number of bytes read.
+	Create(ctx context.Context, artifact *models.Artifact, content io.Reader) error
+	// List returns the artifacts of the task, oldest first.
+	List(ctx context.Context, taskID primitive.ObjectID) ([]models.Artifact, error)
+	// Open returns the artifact and its content, which the caller must close.
+	Open(ctx context.Context, id primitive.ObjectID) (*models.Artifact, io.ReadCloser, error)
+	// DeleteByTasks removes the artifacts of the tasks and returns how many it removed.
+	DeleteByTasks(ctx context.Context, taskIDs []primitive.ObjectID) (int64, error)
+}
+
+// RoleStore persists agent roles.
+type RoleStore interface {
+	List(ctx context.Context) ([]models.Role, error)
+	Create(ctx context.Context, role *models.Role) error
+	Get(ctx context.Context, id primitive.ObjectID) (*models.Role, error)
+	GetByName(ctx context.Context, name string) (*models.Role, error)
+}
+
+// AdminStore persists administrator accounts.
+type AdminStore interface {
+	GetByUsername(ctx context.Context, username string) (*models.Admin, error)
+	Create(ctx context.Context, admin *models.Admin) error
+}
+
+// LogStore persists API and task audit entries.
+type LogStore interface {
+	Create(ctx context.Context, entry *models.LogEntry) error
+	// List returns the entries for an agent, newest first. An empty agentID lists all entries.
+	List(ctx context.Context, agentID string, limit int64) ([]models.LogEntry, error)
+}
+
+// EnrollmentTokenStore persists agent enrollment tokens.
+type EnrollmentTokenStore interface {
+	Create(ctx context.Context, token *models.EnrollmentToken) error
+	List(ctx context.Context) ([]models.EnrollmentToken, error)
+	Revoke(ctx context.Context, id primitive.ObjectID) error
+	// Consume atomically records one use of the token with the given hash.
+	// It returns ErrNotFound if the token is unknown, revoked, expired or used up.
+	Consume(ctx context.Context, tokenHash string, usage models.EnrollmentUsage) (*models.EnrollmentToken, error)
+	// Release gives back the use recorded for the agent, when its enrollment failed after Consume.
+	// It returns ErrNotFound if the token recorded no use for the agent.
+	Release(ctx context.Context, id primitive.ObjectID, agentUUID string) error
+}
+
+// NonceStore remembers request nonces so signed requests cannot be replayed.
+type NonceStore interface {
+	// Remember records the nonce for the agent until expiresAt.
+	// It returns ErrDuplicate if the agent already used the nonce and it has not expired.
+	Remember(ctx context.Context, agentID, nonce string, expiresAt time.Time) error
+}
+
+// IdempotencyStore remembers requests sent with an idempotency key, and the responses to them.
+type IdempotencyStore interface {
+	// Reserve records the request of record, which has no response yet. If the caller already
+	// used the key and that record had not expired at record.CreatedAt, it returns the existing
+	// record and ErrDuplicate instead.
+	Reserve(ctx context.Context, record *models.IdempotencyRecord) (*models.IdempotencyRecord, error)
+	// Complete stores the response to the request reserved under the key of the caller.
+	Complete(ctx context.Context, caller, key string, statusCode int, contentType, body string) error
+	// Release forgets the request reserved under the key of the caller, so it can be retried.
+	Release(ctx context.Context, caller, key string) error
+	// Get returns the record of the key of the caller. It returns ErrNotFound if there is none
+	// or it had expired at now.
+	Get(ctx context.Context, caller, key string, now time.Time) (*models.IdempotencyRecord, error)
+}
+
+// Store bundles the stores of one backend.
+type Store struct {
+	Agents           AgentStore
+	Tasks            TaskStore
+	Roles            RoleStore
+	Admins           AdminStore
+	Logs             LogStore
+	EnrollmentTokens EnrollmentTokenStore
+	Nonces           NonceStore
+	Schedules        ScheduleStore
+	Jobs             JobStore
+	Workflows        WorkflowStore
+	WorkflowRuns     WorkflowRunStore
+	Templates        TemplateStore
+	TaskLogs         TaskLogStore
+	Artifacts        ArtifactStore
+	IdempotencyKeys  IdempotencyStore
+
+	// TaskChanges wakes agents waiting for a task when writes through Tasks concern them.
+	TaskChanges *TaskNotifier
+}
@@ -0,0 +1,185 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+// Fields tasks can be sorted on.
+const (
+	TaskSortCreatedAt = "created_at"
+	TaskSortUpdatedAt = "updated_at"
+)
+
+// requeueReason is recorded on tasks put back in the queue because their agent disconnected.
+const requeueReason = "agent disconnected"
+
+// leaseExpiredReason is recorded on tasks taken back from an agent that stopped renewing its lease.
+const leaseExpiredReason = "lease expired"
+
+// cancelGraceReason is recorded on tasks cancelled without their agent acknowledging it.
+const cancelGraceReason = "cancellation not acknowledged by the agent"
+
+// timeoutReason is recorded on tasks that exceeded their timeout.
+func timeoutReason(timeout int) string {
+	return fmt.Sprintf("exceeded timeout of %ds", timeout)
+}
+
+// transitionConflict wraps state machine errors in ErrConflict and passes other errors through.
+func transitionConflict(err error) error {
+	if errors.Is(err, models.ErrIllegalTransition) {
+		return fmt.Errorf("%w: %w", ErrConflict, err)
+	}
+	return err
+}
+
+// TaskFilter selects tasks. Zero values match everything.
+type TaskFilter struct {
+	AgentID       string
+	JobID         string
+	Wave          int // rollout wave within the job
+	WorkflowRunID string
+	Type          string
+	Status        string
+	CreatedBy     string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	UpdatedAfter  time.Time
+	UpdatedBefore time.Time
+	// Text matches tasks whose parameter keys or values contain it, ignoring case.
+	Text string
+}
+
+// IsEmpty reports whether the filter matches every task.
+func (f TaskFilter) IsEmpty() bool {
+	return f == TaskFilter{}
+}
+
+// TaskQuery describes one page of a task listing.
+type TaskQuery struct {
+	Filter   TaskFilter
+	SortBy   string // TaskSortCreatedAt (default) or TaskSortUpdatedAt
+	SortDesc bool
+	// Cursor is the NextCursor of the previous page, empty for the first page.
+	Cursor string
+	Limit  int
+}
+
+// TaskPage is one page of a task listing.
+type TaskPage struct {
+	Tasks []models.Task
+	// Total counts all tasks matching the filter, across every page.
+	Total int64
+	// NextCursor continues the listing after this page; empty on the last page.
+	NextCursor string
+}
+
+// ValidTaskSortField reports whether tasks can be sorted on field.
+func ValidTaskSortField(field string) bool {
+	return field == TaskSortCreatedAt || field == TaskSortUpdatedAt
+}
+
+// TaskSearchText flattens task parameters into the lower-cased text matched by TaskFilter.Text.
+// Keys and values are listed one per line, with nested keys in dotted form.
+func TaskSearchText(parameters map[string]interface{}) string {
+	var lines []string
+	var walk func(prefix string, value interface{})
+	walk = func(prefix string, value interface{}) {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			keys := make([]string, 0, len(v))
+			for k := range v {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				walk(prefix+k+".", v[k])
+			}
+		case primitive.M:
+			walk(prefix, map[string]interface{}(v))
+		case primitive.D:
+			walk(prefix, map[string]interface{}(v.Map()))
+		case []interface{}:
+			for _, item := range v {
+				walk(prefix, item)
+			}
+		case primitive.A:
+			walk(prefix, []interface{}(v))
+		case nil:
+			lines = append(lines, strings.TrimSuffix(prefix, "."))
+		default:
+			lines = append(lines, strings.TrimSuffix(prefix, ".")+"="+fmt.Sprint(v))
+		}
+	}
+	walk("", parameters)
+	return strings.ToLower(strings.Join(lines, "\n"))
+}
+
+// taskSortValue returns the value of the sort field of task.
+func taskSortValue(task *models.Task, field string) time.Time {
+	if field == TaskSortUpdatedAt {
+		return task.UpdatedAt
+	}
+	return task.CreatedAt
+}
+
+// taskMatches reports whether task passes every condition of filter.
+func taskMatches(task *models.Task, filter TaskFilter) bool {
+	switch {
+	case filter.AgentID != "" && task.AgentID != filter.AgentID,
+		filter.JobID != "" && task.JobID != filter.JobID,
+		filter.Wave != 0 && task.Wave != filter.Wave,
+		filter.WorkflowRunID != "" && task.WorkflowRunID != filter.WorkflowRunID,
+		filter.Type != "" && task.Type != filter.Type,
+		filter.Status != "" && task.Status != filter.Status,
+		filter.CreatedBy != "" && task.CreatedBy != filter.CreatedBy,
+		!filter.CreatedAfter.IsZero() && !task.CreatedAt.After(filter.CreatedAfter),
+		!filter.CreatedBefore.IsZero() && !task.CreatedAt.Before(filter.CreatedBefore),
+		!filter.UpdatedAfter.IsZero() && !task.UpdatedAt.After(filter.UpdatedAfter),
+		!filter.UpdatedBefore.IsZero() && !task.UpdatedAt.Before(filter.UpdatedBefore):
+		return false
+	}
+	return strings.Contains(task.SearchText, strings.ToLower(filter.Text))
+}
+
+// normalize applies the query defaults.
+func (q TaskQuery) normalize() TaskQuery {
+	if q.SortBy == "" {
+		q.SortBy = TaskSortCreatedAt
+	}
+	return q
+}
+
+// encodeTaskCursor returns the cursor continuing q after task.
+func encodeTaskCursor(q TaskQuery, task *models.Task) string {
+	return pageCursor{
+		SortBy:   q.SortBy,
+		SortDesc: q.SortDesc,
+		Value:    formatCursorTime(taskSortValue(task, q.SortBy)),
+		ID:       task.ID.Hex(),
+	}.encode()
+}
+
+// decodeTaskCursor parses the cursor of q and returns the sort value and task ID it points at.
+func decodeTaskCursor(q TaskQuery) (time.Time, primitive.ObjectID, error) {
+	cursor, err := decodeCursor(q.Cursor, q.SortBy, q.SortDesc)
+	if err != nil {
+		return time.Time{}, primitive.NilObjectID, err
+	}
+	value, err := parseCursorTime(cursor.Value)
+	if err != nil {
+		return time.Time{}, primitive.NilObjectID, err
+	}
+	id, err := primitive.ObjectIDFromHex(cursor.ID)
+	if err != nil {
+		return time.Time{}, primitive.NilObjectID, ErrInvalidCursor
+	}
+	return value, id, nil
+}
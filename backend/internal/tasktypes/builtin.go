@@ -0,0 +1,92 @@
+package tasktypes
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Builtin returns a registry holding the task types agents support out of the box.
+func Builtin() *Registry {
+	r := NewRegistry()
+	for _, t := range builtinTypes {
+		if err := r.Register(t); err != nil {
+			panic(err) // the built-in schemas are constants
+		}
+	}
+	return r
+}
+
+var builtinTypes = []TaskType{
+	{
+		Name:        "command_shell",
+		Description: "Runs a command in the agent's shell.",
+		Schema: json.RawMessage(`{
+			"type": "object",
+			"properties": {
+				"command": {"type": "string", "minLength": 1, "title": "Command"},
+				"working_dir": {"type": "string", "title": "Working directory"}
+			},
+			"required": ["command"],
+			"additionalProperties": false
+		}`),
+		Normalize: trimStrings("command", "working_dir"),
+	},
+	{
+		Name:        "file_operation",
+		Description: "Reads, writes or deletes a file on the agent host.",
+		Schema: json.RawMessage(`{
+			"type": "object",
+			"properties": {
+				"operation": {"type": "string", "enum": ["read", "write", "delete"], "title": "Operation"},
+				"path": {"type": "string", "minLength": 1, "title": "Path"},
+				"content": {"type": "string", "title": "Content"}
+			},
+			"required": ["operation", "path"],
+			"additionalProperties": false,
+			"if": {"properties": {"operation": {"const": "write"}}},
+			"then": {"required": ["content"]}
+		}`),
+		Normalize: func(params map[string]interface{}) (map[string]interface{}, error) {
+			params, _ = trimStrings("operation", "path")(params)
+			if op, ok := params["operation"].(string); ok {
+				params["operation"] = strings.ToLower(op)
+			}
+			return params, nil
+		},
+	},
+	{
+		Name:        "ui_automation",
+		Description: "Runs a desktop UI automation script.",
+		Schema:      scriptSchema,
+	},
+	{
+		Name:        "browser_automation",
+		Description: "Runs a browser automation script.",
+		Schema:      scriptSchema,
+	},
+}
+
+var scriptSchema = json.RawMessage(`{
+	"type": "object",
+	"properties": {
+		"script": {"type": "string", "minLength": 1, "title": "Automation script"}
+	},
+	"required": ["script"],
+	"additionalProperties": false
+}`)
+
+// trimStrings returns a NormalizeFunc that trims surrounding whitespace from the given keys.
+func trimStrings(keys ...string) NormalizeFunc {
+	return func(params map[string]interface{}) (map[string]interface{}, error) {
+		normalized := make(map[string]interface{}, len(params))
+		for k, v := range params {
+			normalized[k] = v
+		}
+		for _, k := range keys {
+			if s, ok := normalized[k].(string); ok {
+				normalized[k] = strings.TrimSpace(s)
+			}
+		}
+		return normalized, nil
+	}
+}
@@ -0,0 +1,276 @@
+// Package tasktypes keeps the registry of task types the manager accepts. Each type declares a
+// JSON Schema for its parameters, and may normalize parameters before they are validated and
+// declare a JSON Schema for the results its tasks report.
+package tasktypes
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+// ErrUnknownType is returned for task types that are not registered.
+var ErrUnknownType = errors.New("unknown task type")
+
+// NormalizeFunc rewrites task parameters into their canonical form before validation,
+// for example by trimming strings or filling in defaults.
+type NormalizeFunc func(params map[string]interface{}) (map[string]interface{}, error)
+
+// TaskType describes one kind of task.
+type TaskType struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Schema      json.RawMessage `json:"schema"`
+	// ResultSchema is optional; it describes the results of tasks of the type, by name, as an
+	// object of plain values.
+	ResultSchema json.RawMessage `json:"result_schema,omitempty"`
+	// MaxConcurrent caps how many tasks of the type one agent holds at once; 0 means no limit.
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+	// Normalize is optional; types loaded from files have none.
+	Normalize NormalizeFunc `json:"-"`
+
+	compiled       *jsonschema.Schema
+	compiledResult *jsonschema.Schema
+}
+
+// ValidationError lists why parameters, or results, do not match the schema of their task type.
+type ValidationError struct {
+	Type     string
+	Problems []string
+	// Results is set when the results of a task were validated.
+	Results bool
+}
+
+func (e *ValidationError) Error() string {
+	what := "parameters"
+	if e.Results {
+		what = "results"
+	}
+	return fmt.Sprintf("invalid %s for %s: %s", what, e.Type, strings.Join(e.Problems, "; "))
+}
+
+// Registry holds the registered task types. It is safe for concurrent use.
+type Registry struct {
+	mu    sync.RWMutex
+	types map[string]*TaskType
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{types: make(map[string]*TaskType)}
+}
+
+// Register compiles the schema of t and adds it, replacing any type with the same name.
+func (r *Registry) Register(t TaskType) error {
+	if t.Name == "" {
+		return errors.New("task type has no name")
+	}
+	if len(t.Schema) == 0 {
+		return fmt.Errorf("task type %s has no schema", t.Name)
+	}
+	if t.MaxConcurrent < 0 {
+		return fmt.Errorf("task type %s: max_concurrent must not be negative", t.Name)
+	}
+
+	var err error
+	if t.compiled, err = compileSchema(t.Name+".json", t.Schema); err != nil {
+		return fmt.Errorf("task type %s: %w", t.Name, err)
+	}
+	if len(t.ResultSchema) > 0 {
+		if t.compiledResult, err = compileSchema(t.Name+".result.json", t.ResultSchema); err != nil {
+			return fmt.Errorf("task type %s: result %w", t.Name, err)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.types[t.Name] = &t
+	return nil
+}
+
+// compileSchema compiles a JSON Schema, naming it url.
+func compileSchema(url string, schema json.RawMessage) (*jsonschema.Schema, error) {
+	doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(schema))
+	if err != nil {
+		return nil, fmt.Errorf("parsing schema: %w", err)
+	}
+	compiler := jsonschema.NewCompiler()
+	if err := compiler.AddResource(url, doc); err != nil {
+		return nil, err
+	}
+	compiled, err := compiler.Compile(url)
+	if err != nil {
+		return nil, fmt.Errorf("compiling schema: %w", err)
+	}
+	return compiled, nil
+}
+
+// Get returns the task type with the given name.
+func (r *Registry) Get(name string) (TaskType, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	t, ok := r.types[name]
+	if !ok {
+		return TaskType{}, false
+	}
+	return *t, true
+}
+
+// SetMaxConcurrent changes the concurrency limit of a registered type.
+func (r *Registry) SetMaxConcurrent(name string, max int) error {
+	if max < 0 {
+		return fmt.Errorf("task type %s: max_concurrent must not be negative", name)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, ok := r.types[name]
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrUnknownType, name)
+	}
+	copied := *t
+	copied.MaxConcurrent = max
+	r.types[name] = &copied
+	return nil
+}
+
+// Limits returns the concurrency limit of every type that has one.
+func (r *Registry) Limits() map[string]int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	limits := map[string]int{}
+	for name, t := range r.types {
+		if t.MaxConcurrent > 0 {
+			limits[name] = t.MaxConcurrent
+		}
+	}
+	return limits
+}
+
+// List returns the registered task types sorted by name.
+func (r *Registry) List() []TaskType {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	types := make([]TaskType, 0, len(r.types))
+	for _, t := range r.types {
+		types = append(types, *t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i].Name < types[j].Name })
+	return types
+}
+
+// Validate normalizes params for the named type and checks them against its schema.
+// It returns the normalized parameters, ErrUnknownType, or a *ValidationError.
+func (r *Registry) Validate(name string, params map[string]interface{}) (map[string]interface{}, error) {
+	t, ok := r.Get(name)
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownType, name)
+	}
+	if params == nil {
+		params = map[string]interface{}{}
+	}
+
+	if t.Normalize != nil {
+		normalized, err := t.Normalize(params)
+		if err != nil {
+			return nil, &ValidationError{Type: name, Problems: []string{err.Error()}}
+		}
+		params = normalized
+	}
+
+	if err := validate(t.compiled, params, name, false); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+// ValidateResults checks the plain values of the results of a task of the named type against
+// the type's result schema. Types without a result schema, and unknown types, accept any results.
+// It returns a *ValidationError if the results do not match.
+func (r *Registry) ValidateResults(name string, values map[string]interface{}) error {
+	t, ok := r.Get(name)
+	if !ok || t.compiledResult == nil {
+		return nil
+	}
+	if values == nil {
+		values = map[string]interface{}{}
+	}
+	return validate(t.compiledResult, values, name, true)
+}
+
+// validate checks value against schema, returning a *ValidationError for the named type if it
+// does not match.
+func validate(schema *jsonschema.Schema, value map[string]interface{}, name string, results bool) error {
+	// Round-trip through JSON so the validator sees the same value types as a decoded request
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return &ValidationError{Type: name, Problems: []string{err.Error()}, Results: results}
+	}
+	instance, err := jsonschema.UnmarshalJSON(bytes.NewReader(raw))
+	if err != nil {
+		return &ValidationError{Type: name, Problems: []string{err.Error()}, Results: results}
+	}
+
+	var invalid *jsonschema.ValidationError
+	if err := schema.Validate(instance); errors.As(err, &invalid) {
+		root := "parameters"
+		if results {
+			root = "results"
+		}
+		return &ValidationError{Type: name, Problems: problems(invalid, root), Results: results}
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// problems flattens a schema validation error into one line per failed keyword, locating each
+// under root.
+func problems(err *jsonschema.ValidationError, root string) []string {
+	var lines []string
+	for _, unit := range err.BasicOutput().Errors {
+		if unit.Error == nil {
+			continue
+		}
+		location := root + strings.ReplaceAll(unit.InstanceLocation, "/", ".")
+		lines = append(lines, location+": "+unit.Error.String())
+	}
+	if len(lines) == 0 {
+		lines = append(lines, err.Error())
+	}
+	return lines
+}
+
+// LoadDir registers every *.json file in dir as a task type, replacing built-in types with the
+// same name. A missing directory is not an error. Each file holds one TaskType object.
+func (r *Registry) LoadDir(dir string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	var loaded []string
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return loaded, err
+		}
+		var t TaskType
+		if err := json.Unmarshal(data, &t); err != nil {
+			return loaded, fmt.Errorf("%s: %w", path, err)
+		}
+		if err := r.Register(t); err != nil {
+			return loaded, fmt.Errorf("%s: %w", path, err)
+		}
+		loaded = append(loaded, t.Name)
+	}
+	return loaded, nil
+}
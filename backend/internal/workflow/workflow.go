@@ -0,0 +1,362 @@
+// Package workflow runs the background worker that executes workflow runs.
+//
+// A node of a run creates its task on the run's agent once all of its upstream nodes have
+// finished and its conditions hold; otherwise it is skipped, which in turn decides the nodes
+// downstream of it. The ID of each new task is stored on the run, with a compare-and-swap on
+// the run's revision, before the task is created. Several managers can therefore share the
+// work, and a manager that stops halfway leaves nothing the next pass cannot repair.
+package workflow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+
+	"github.com/whit3rabbit/beehive/manager/internal/config"
+	"github.com/whit3rabbit/beehive/manager/internal/logger"
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+// stepTimeout bounds a single pass so a slow backend cannot stall the worker.
+const stepTimeout = 30 * time.Second
+
+// cancelAttempts is how often Cancel re-reads a run the worker changed under it.
+const cancelAttempts = 3
+
+// ErrRunStatus is returned when cancelling a run that is no longer running.
+var ErrRunStatus = errors.New("workflow run is not running")
+
+// Engine periodically advances running workflow runs.
+type Engine struct {
+	store    *storage.Store
+	interval time.Duration
+}
+
+// Result summarizes what one or more advances did.
+type Result struct {
+	NodesStarted int
+	NodesSkipped int
+	RunsFinished int
+}
+
+func (r *Result) add(other Result) {
+	r.NodesStarted += other.NodesStarted
+	r.NodesSkipped += other.NodesSkipped
+	r.RunsFinished += other.RunsFinished
+}
+
+// New creates an Engine from the workflow section of the configuration.
+func New(store *storage.Store, cfg config.WorkflowConfig) *Engine {
+	return &Engine{
+		store:    store,
+		interval: time.Duration(cfg.IntervalSeconds) * time.Second,
+	}
+}
+
+// Run steps every interval until ctx is cancelled. Errors are logged and the next step is
+// attempted as usual.
+func (e *Engine) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Info("Stopping workflow engine")
+			return
+		case now := <-ticker.C:
+			stepCtx, cancel := context.WithTimeout(ctx, stepTimeout)
+			result, err := e.Step(stepCtx, now)
+			cancel()
+			if err != nil {
+				logger.Error("Workflow step failed", zap.Error(err))
+			}
+			if result != (Result{}) {
+				logger.Info("Workflow step completed",
+					zap.Int("nodes_started", result.NodesStarted),
+					zap.Int("nodes_skipped", result.NodesSkipped),
+					zap.Int("runs_finished", result.RunsFinished))
+			}
+		}
+	}
+}
+
+// Step advances every running run. It stops at the first error and returns what it did up to
+// that point.
+func (e *Engine) Step(ctx context.Context, now time.Time) (Result, error) {
+	var result Result
+
+	runs, err := e.store.WorkflowRuns.Running(ctx)
+	if err != nil {
+		return result, err
+	}
+	for i := range runs {
+		advanced, err := Advance(ctx, e.store, &runs[i], now)
+		if errors.Is(err, storage.ErrConflict) {
+			// Another manager advanced the run first
+			continue
+		}
+		result.add(advanced)
+		if err != nil {
+			return result, fmt.Errorf("workflow run %s: %w", runs[i].ID.Hex(), err)
+		}
+	}
+	return result, nil
+}
+
+// NewRun returns a run of the workflow on the agent with every node pending. The caller stores
+// it and then advances it to start the nodes without dependencies.
+func NewRun(workflow *models.Workflow, agentID, createdBy string, now time.Time) *models.WorkflowRun {
+	run := &models.WorkflowRun{
+		WorkflowID:   workflow.ID.Hex(),
+		WorkflowName: workflow.Name,
+		AgentID:      agentID,
+		Status:       models.WorkflowRunning,
+		Definition:   workflow.Nodes,
+		Nodes:        make([]models.WorkflowNodeState, len(workflow.Nodes)),
+		CreatedBy:    createdBy,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	for i, node := range workflow.Nodes {
+		run.Nodes[i] = models.WorkflowNodeState{ID: node.ID, Status: models.WorkflowNodePending}
+	}
+	return run
+}
+
+// Advance brings the node states of the run up to date with their tasks, starts or skips the
+// nodes whose upstream nodes have all finished, and finishes the run once every node has. It
+// returns storage.ErrConflict, and starts nothing, if the stored run changed since it was read.
+func Advance(ctx context.Context, store *storage.Store, run *models.WorkflowRun, now time.Time) (Result, error) {
+	var result Result
+
+	tasks, changed, err := Refresh(ctx, store.Tasks, run)
+	if err != nil {
+		return result, err
+	}
+
+	// Nodes whose task a previous pass stored on the run but did not create
+	var create []int
+	for i, state := range run.Nodes {
+		if state.TaskID != "" && tasks[state.ID] == nil && !models.WorkflowNodeFinished(state.Status) {
+			create = append(create, i)
+		}
+	}
+
+	started, skipped := plan(run, tasks, now)
+	result.NodesStarted, result.NodesSkipped = len(started), skipped
+	if finish(run, now) {
+		result.RunsFinished = 1
+	}
+	if changed || len(started) > 0 || skipped > 0 || result.RunsFinished > 0 {
+		run.UpdatedAt = now
+		if err := store.WorkflowRuns.Update(ctx, run); err != nil {
+			return Result{}, err
+		}
+	}
+
+	for _, i := range append(create, started...) {
+		if err := createTask(ctx, store.Tasks, run, i, now); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// Refresh copies the status of each node's task onto the node and returns the tasks by node
+// ID. It reports whether any node changed; nothing is stored.
+func Refresh(ctx context.Context, tasks storage.TaskStore, run *models.WorkflowRun) (map[string]*models.Task, bool, error) {
+	page, err := tasks.List(ctx, storage.TaskQuery{
+		Filter: storage.TaskFilter{WorkflowRunID: run.ID.Hex()},
+		Limit:  models.MaxWorkflowNodes,
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	byNode := make(map[string]*models.Task, len(page.Tasks))
+	for i := range page.Tasks {
+		byNode[page.Tasks[i].WorkflowNode] = &page.Tasks[i]
+	}
+	changed := false
+	for i := range run.Nodes {
+		state := &run.Nodes[i]
+		task := byNode[state.ID]
+		if task == nil || task.ID.Hex() != state.TaskID || task.Status == state.Status {
+			continue
+		}
+		state.Status = task.Status
+		if task.IsFinished() {
+			state.FinishedAt = task.UpdatedAt
+		}
+		changed = true
+	}
+	return byNode, changed, nil
+}
+
+// plan starts or skips every pending node whose upstream nodes have all finished, repeating
+// until skips stop deciding further nodes. It returns the indexes of the started nodes and
+// how many were skipped.
+func plan(run *models.WorkflowRun, tasks map[string]*models.Task, now time.Time) ([]int, int) {
+	status := make(map[string]string, len(run.Nodes))
+	for _, state := range run.Nodes {
+		status[state.ID] = state.Status
+	}
+
+	var started []int
+	skipped := 0
+	for progressed := true; progressed; {
+		progressed = false
+		for i, node := range run.Definition {
+			state := &run.Nodes[i]
+			if state.Status != models.WorkflowNodePending || !upstreamFinished(node, status) {
+				continue
+			}
+			if reason := blocked(node, status, tasks); reason != "" {
+				state.Status = models.WorkflowNodeSkipped
+				state.Reason = reason
+				state.FinishedAt = now
+				skipped++
+			} else {
+				state.Status = models.TaskStatusQueued
+				state.TaskID = primitive.NewObjectID().Hex()
+				state.StartedAt = now
+				started = append(started, i)
+			}
+			status[state.ID] = state.Status
+			progressed = true
+		}
+	}
+	return started, skipped
+}
+
+func upstreamFinished(node models.WorkflowNode, status map[string]string) bool {
+	for _, dep := range node.DependsOn {
+		if !models.WorkflowNodeFinished(status[dep]) {
+			return false
+		}
+	}
+	return true
+}
+
+// blocked returns why a node whose upstream nodes have finished must be skipped, or "" if it runs.
+func blocked(node models.WorkflowNode, status map[string]string, tasks map[string]*models.Task) string {
+	if len(node.When) == 0 {
+		for _, dep := range node.DependsOn {
+			if status[dep] != models.TaskStatusCompleted {
+				return fmt.Sprintf("upstream node %s %s", dep, status[dep])
+			}
+		}
+		return ""
+	}
+	for i := range node.When {
+		cond := &node.When[i]
+		var output *models.Output
+		if task := tasks[cond.Node]; task != nil {
+			output = task.Output
+		}
+		if !cond.Matches(status[cond.Node], output) {
+			return "condition on node " + cond.Node + " not met"
+		}
+	}
+	return ""
+}
+
+// finish completes or fails the run once every node has finished, and reports whether it did.
+func finish(run *models.WorkflowRun, now time.Time) bool {
+	status := models.WorkflowCompleted
+	for _, state := range run.Nodes {
+		if !models.WorkflowNodeFinished(state.Status) {
+			return false
+		}
+		if state.Status != models.TaskStatusCompleted && state.Status != models.WorkflowNodeSkipped {
+			status = models.WorkflowFailed
+		}
+	}
+	run.Status = status
+	run.FinishedAt = now
+	return true
+}
+
+// createTask creates the task of the run's node at index i with the ID stored on the node.
+// A task that already exists is left alone.
+func createTask(ctx context.Context, tasks storage.TaskStore, run *models.WorkflowRun, i int, now time.Time) error {
+	node, state := run.Definition[i], run.Nodes[i]
+	id, err := primitive.ObjectIDFromHex(state.TaskID)
+	if err != nil {
+		return err
+	}
+
+	task := models.Task{
+		ID:            id,
+		AgentID:       run.AgentID,
+		Type:          node.Task.Type,
+		Parameters:    node.Task.Parameters,
+		Timeout:       node.Task.Timeout,
+		Retry:         node.Task.Retry,
+		Priority:      node.Task.Priority,
+		CreatedAt:     now,
+		CreatedBy:     run.CreatedBy,
+		WorkflowRunID: run.ID.Hex(),
+		WorkflowNode:  node.ID,
+	}
+	reason := fmt.Sprintf("workflow %s node %s", run.WorkflowName, node.ID)
+	if err := task.Transition(models.TaskStatusQueued, models.ActorWorkflow, reason, now); err != nil {
+		return err
+	}
+	if err := tasks.Create(ctx, &task); err != nil && !errors.Is(err, storage.ErrDuplicate) {
+		return err
+	}
+	return nil
+}
+
+// Cancel stops a running run on behalf of the admin: its pending nodes are cancelled and so
+// are the tasks of its started nodes, as models.CancelTarget describes. It returns the
+// updated run.
+func Cancel(ctx context.Context, store *storage.Store, id primitive.ObjectID, admin string, now time.Time) (*models.WorkflowRun, error) {
+	var run *models.WorkflowRun
+	for attempt := 0; ; attempt++ {
+		var err error
+		if run, err = store.WorkflowRuns.Get(ctx, id); err != nil {
+			return nil, err
+		}
+		if run.Status != models.WorkflowRunning {
+			return nil, ErrRunStatus
+		}
+
+		for i := range run.Nodes {
+			state := &run.Nodes[i]
+			if state.Status == models.WorkflowNodePending {
+				state.Status = models.TaskStatusCancelled
+				state.Reason = "run cancelled"
+				state.FinishedAt = now
+			}
+		}
+		run.Status = models.WorkflowCancelled
+		run.CancelledBy = admin
+		run.FinishedAt = now
+		run.UpdatedAt = now
+		err = store.WorkflowRuns.Update(ctx, run)
+		if errors.Is(err, storage.ErrConflict) && attempt+1 < cancelAttempts {
+			// The worker advanced the run in the meantime
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+
+	if _, err := store.Tasks.CancelMatching(ctx, storage.TaskFilter{WorkflowRunID: id.Hex()}, models.AdminActor(admin), now); err != nil {
+		return nil, err
+	}
+	if _, _, err := Refresh(ctx, store.Tasks, run); err != nil {
+		return nil, err
+	}
+	return run, nil
+}
@@ -1,21 +1,28 @@
 package middleware
 
 import (
+	"bytes"
 	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"io"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/labstack/echo/v4"
-	"go.mongodb.org/mongo-driver/bson"
+	"go.uber.org/zap"
 
 	"github.com/whit3rabbit/beehive/manager/api/admin"
-	"github.com/whit3rabbit/beehive/manager/internal/mongodb"
+	"github.com/whit3rabbit/beehive/manager/internal/logger"
+	"github.com/whit3rabbit/beehive/manager/internal/secrets"
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
 	"github.com/whit3rabbit/beehive/manager/models"
 )
 
@@ -119,71 +126,254 @@ func AdminAuthMiddleware(rateLimiter RateLimiter) echo.MiddlewareFunc {
 	}
 }
 
+// Headers used by signed agent requests.
+const (
+	SignatureVersionHeader = "X-Signature-Version"
+	TimestampHeader        = "X-Timestamp"
+	NonceHeader            = "X-Nonce"
+)
+
+// Signature versions understood by APIAuthMiddleware.
+const (
+	// SignatureVersionBody signs only the raw request body. It is kept for older agents.
+	SignatureVersionBody = "1"
+	// SignatureVersionCanonical signs the canonical request built by CanonicalRequest.
+	SignatureVersionCanonical = "2"
+)
+
+// maxNonceLength bounds the X-Nonce header so it cannot be used to bloat the nonce store.
+const maxNonceLength = 128
+
+// SignatureOptions configures how APIAuthMiddleware verifies request signatures.
+type SignatureOptions struct {
+	// ClockSkew is how far X-Timestamp may drift from the manager clock.
+	ClockSkew time.Duration
+	// RequireCanonical rejects requests signed with SignatureVersionBody.
+	RequireCanonical bool
+	// Replays, if set, lets an agent sign with the credentials its last rotation replaced, to
+	// retry a request whose response is recorded under its Idempotency-Key. This is how an agent
+	// that lost the response to POST /agent/register gets its new credentials.
+	Replays storage.IdempotencyStore
+}
+
 // APIAuthMiddleware validates the X-API-Key and X-Signature headers.
-// It checks that the API key exists in the database and that the signature,
-// computed as an HMAC-SHA256 of the request body using the API key as secret, is valid.
-func APIAuthMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
-	return func(c echo.Context) error {
-		apiKey := c.Request().Header.Get("X-API-Key")
-		signature := c.Request().Header.Get("X-Signature")
+// X-API-Key carries the key ID issued at registration and X-Signature the hex encoded
+// HMAC-SHA256 keyed with the agent's shared secret, which the manager decrypts from storage.
+//
+// Agents sending X-Signature-Version: 2 sign the canonical request built by CanonicalRequest,
+// which covers the method, path, query, body, X-Timestamp and X-Nonce. The timestamp must be
+// within opts.ClockSkew of the manager clock and each nonce is accepted once per agent.
+// Requests without the header are treated as version 1 and sign only the raw body; they are
+// rejected when opts.RequireCanonical is set. Every response advertises the newest version
+// in SignatureVersionHeader so agents can migrate.
+//
+// Agents whose credentials were just rotated may sign with the previous ones, but only to
+// replay a recorded response; see SignatureOptions.Replays. Their first request signed with
+// the new credentials drops the previous ones.
+//
+// Agents registered before shared secrets were introduced only have a raw API key, which they
+// send in the clear and so cannot sign with. They are rejected and must enroll again.
+func APIAuthMiddleware(agents storage.AgentStore, nonces storage.NonceStore, box *secrets.Box, opts SignatureOptions) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Response().Header().Set(SignatureVersionHeader, SignatureVersionCanonical)
 
-		if apiKey == "" || signature == "" {
-			return c.JSON(http.StatusUnauthorized, echo.Map{
-				"error": "Missing API key or signature",
-			})
-		}
+			req := c.Request()
+			apiKey := req.Header.Get("X-API-Key")
+			signature := req.Header.Get("X-Signature")
 
-		// Get MongoDB database name from context
-		dbName := c.Get("mongodb_database").(string)
-		collection := mongodb.Client.Database(dbName).Collection("agents")
+			if apiKey == "" || signature == "" {
+				return c.JSON(http.StatusUnauthorized, echo.Map{
+					"error": "Missing API key or signature",
+				})
+			}
 
-		// Find agent by API key
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
+			version := req.Header.Get(SignatureVersionHeader)
+			if version == "" {
+				version = SignatureVersionBody
+			}
 
-		var agent models.Agent
-		err := collection.FindOne(ctx, bson.M{"api_key": apiKey}).Decode(&agent)
-		if err != nil {
-			return c.JSON(http.StatusUnauthorized, echo.Map{
-				"error": "Invalid API key",
-			})
-		}
+			var timestamp time.Time
+			timestampHeader := req.Header.Get(TimestampHeader)
+			nonce := req.Header.Get(NonceHeader)
+			switch version {
+			case SignatureVersionBody:
+				if opts.RequireCanonical {
+					return c.JSON(http.StatusUnauthorized, echo.Map{
+						"error": "Canonical request signature required",
+					})
+				}
+			case SignatureVersionCanonical:
+				if timestampHeader == "" || nonce == "" {
+					return c.JSON(http.StatusUnauthorized, echo.Map{
+						"error": "Missing timestamp or nonce",
+					})
+				}
+				if len(nonce) > maxNonceLength {
+					return c.JSON(http.StatusUnauthorized, echo.Map{
+						"error": "Invalid nonce",
+					})
+				}
+				seconds, err := strconv.ParseInt(timestampHeader, 10, 64)
+				if err != nil {
+					return c.JSON(http.StatusUnauthorized, echo.Map{
+						"error": "Invalid timestamp",
+					})
+				}
+				timestamp = time.Unix(seconds, 0)
+				if skew := time.Since(timestamp); skew > opts.ClockSkew || skew < -opts.ClockSkew {
+					return c.JSON(http.StatusUnauthorized, echo.Map{
+						"error": "Request timestamp outside allowed window",
+					})
+				}
+			default:
+				return c.JSON(http.StatusUnauthorized, echo.Map{
+					"error": "Unsupported signature version",
+				})
+			}
 
-		// Store agent info in context for downstream handlers
-		c.Set("agent_id", agent.ID.Hex())
-		c.Set("agent_uuid", agent.UUID)
+			// Find agent by key ID
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
 
-		// Read and validate request body
-		var body struct{}
-		if err := c.Bind(&body); err != nil {
-			return c.JSON(http.StatusBadRequest, echo.Map{
-				"error": "Invalid request body",
-			})
-		}
+			agent, signingKey, previous, err := resolveAgentCredentials(ctx, agents, box, apiKey, opts.Replays != nil)
+			if err != nil {
+				return c.JSON(http.StatusUnauthorized, echo.Map{
+					"error": "Invalid API key",
+				})
+			}
 
-		// Get the request body as a byte slice
-		bodyBytes, err := io.ReadAll(c.Request().Body)
-		if err != nil {
-			return c.JSON(http.StatusInternalServerError, echo.Map{
-				"error": "Unable to read request body",
-			})
+			// Get the request body as a byte slice
+			bodyBytes, err := io.ReadAll(req.Body)
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				return c.JSON(http.StatusRequestEntityTooLarge, echo.Map{
+					"error": "Request body too large",
+				})
+			}
+			if err != nil {
+				return c.JSON(http.StatusInternalServerError, echo.Map{
+					"error": "Unable to read request body",
+				})
+			}
+			req.Body.Close()
+
+			// Restore the request body for downstream handlers
+			req.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+
+			// Compute and verify HMAC signature
+			payload := bodyBytes
+			if version == SignatureVersionCanonical {
+				payload = []byte(CanonicalRequest(req.Method, req.URL.EscapedPath(), req.URL.RawQuery, bodyBytes, timestampHeader, nonce))
+			}
+			if !hmac.Equal([]byte(signature), []byte(ComputeSignature(signingKey, payload))) {
+				return c.JSON(http.StatusUnauthorized, echo.Map{
+					"error": "Invalid signature",
+				})
+			}
+
+			// Only record nonces of authentic requests, so forged requests cannot burn them.
+			// Once the timestamp leaves the skew window the request is rejected anyway.
+			if version == SignatureVersionCanonical {
+				err := nonces.Remember(ctx, agent.UUID, nonce, timestamp.Add(opts.ClockSkew))
+				if errors.Is(err, storage.ErrDuplicate) {
+					return c.JSON(http.StatusUnauthorized, echo.Map{
+						"error": "Nonce already used",
+					})
+				}
+				if err != nil {
+					return c.JSON(http.StatusInternalServerError, echo.Map{
+						"error": "Unable to verify request nonce",
+					})
+				}
+			}
+
+			if previous {
+				return replayWithPreviousCredentials(c, opts.Replays, box, agent, bodyBytes)
+			}
+			if agent.PreviousKeyID != "" {
+				// The agent has its new credentials, so the ones they replaced are no longer needed
+				err := agents.DropPreviousCredentials(ctx, agent.UUID, agent.KeyID)
+				if err != nil && !errors.Is(err, storage.ErrNotFound) {
+					logger.Error("Failed to drop previous agent credentials", zap.Error(err), zap.String("agent_uuid", agent.UUID))
+				}
+			}
+
+			// Store agent info in context for downstream handlers
+			c.Set("agent_id", agent.ID.Hex())
+			c.Set("agent_uuid", agent.UUID)
+
+			return next(c)
 		}
-		defer c.Request().Body.Close()
+	}
+}
+
+// CanonicalRequest builds the string signed by SignatureVersionCanonical requests: the method,
+// the escaped path, the query sorted by key and value, the hex SHA256 of the body, the
+// timestamp and the nonce, separated by newlines.
+func CanonicalRequest(method, path, rawQuery string, body []byte, timestamp, nonce string) string {
+	bodyHash := sha256.Sum256(body)
+	return strings.Join([]string{
+		strings.ToUpper(method),
+		path,
+		canonicalQuery(rawQuery),
+		hex.EncodeToString(bodyHash[:]),
+		timestamp,
+		nonce,
+	}, "\n")
+}
 
-		// Restore the request body for downstream handlers
-		c.Request().Body = io.NopCloser(strings.NewReader(string(bodyBytes)))
+// canonicalQuery re-encodes the query with its keys and the values of each key sorted.
+func canonicalQuery(rawQuery string) string {
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		// Sign malformed queries verbatim rather than guessing at their meaning
+		return rawQuery
+	}
+	for _, v := range values {
+		sort.Strings(v)
+	}
+	return values.Encode()
+}
 
-		// Compute and verify HMAC signature
-		mac := hmac.New(sha256.New, []byte(agent.APISecret))
-		mac.Write(bodyBytes)
-		expectedMAC := hex.EncodeToString(mac.Sum(nil))
+// ComputeSignature returns the hex encoded HMAC-SHA256 of payload keyed with key.
+func ComputeSignature(key string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
 
-		if !hmac.Equal([]byte(signature), []byte(expectedMAC)) {
-			return c.JSON(http.StatusUnauthorized, echo.Map{
-				"error": "Invalid signature",
-			})
+// resolveAgentCredentials finds the agent identified by the X-API-Key value and returns the key
+// its requests must be signed with. With allowPrevious, the key IDs replaced by the last
+// rotation of an agent are looked up too, and reported as previous.
+func resolveAgentCredentials(ctx context.Context, agents storage.AgentStore, box *secrets.Box, apiKey string, allowPrevious bool) (*models.Agent, string, bool, error) {
+	agent, err := agents.GetByKeyID(ctx, apiKey)
+	if err == nil {
+		if agent.CredentialVersion != models.CredentialVersionSharedSecret {
+			return nil, "", false, storage.ErrNotFound
+		}
+		secret, err := box.Decrypt(agent.APISecret)
+		if err != nil {
+			return nil, "", false, err
 		}
+		return agent, secret, false, nil
+	}
+	if !errors.Is(err, storage.ErrNotFound) {
+		return nil, "", false, err
+	}
 
-		return next(c)
+	if allowPrevious {
+		agent, err := agents.GetByPreviousKeyID(ctx, apiKey)
+		if err == nil {
+			secret, err := box.Decrypt(agent.PreviousAPISecret)
+			if err != nil {
+				return nil, "", false, err
+			}
+			return agent, secret, true, nil
+		}
+		if !errors.Is(err, storage.ErrNotFound) {
+			return nil, "", false, err
+		}
 	}
-}
\ No newline at end of file
+	return nil, "", false, storage.ErrNotFound
+}
@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// DefaultMaxBodyBytes caps the request bodies of routes without a limit of their own. It leaves
+// room for a task update carrying the largest task output once encoded as JSON.
+const DefaultMaxBodyBytes = 8 << 20 // 8MB
+
+// BodyLimitMiddleware rejects request bodies larger than max, or than the limit given in
+// routes for the route path, with 413. It must run before middleware that reads the body,
+// such as the signature check of APIAuthMiddleware, so that oversized bodies are refused
+// before they are held in memory.
+func BodyLimitMiddleware(max int64, routes map[string]int64) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			limit := max
+			if routeLimit, ok := routes[c.Path()]; ok {
+				limit = routeLimit
+			}
+			req := c.Request()
+			if req.ContentLength > limit {
+				return c.JSON(http.StatusRequestEntityTooLarge, echo.Map{
+					"error": "Request body too large",
+				})
+			}
+			// Bodies sent without a length stop being read at the limit
+			req.Body = http.MaxBytesReader(c.Response().Writer, req.Body, limit)
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+
+	"github.com/whit3rabbit/beehive/manager/internal/logger"
+	"github.com/whit3rabbit/beehive/manager/internal/secrets"
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+// Headers of idempotent requests.
+const (
+	IdempotencyKeyHeader     = "Idempotency-Key"
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength  = 255
+	idempotencyStoreTimeout  = 5 * time.Second
+)
+
+// IdempotencyMiddleware lets callers retry a request safely by sending it with an
+// Idempotency-Key header. The first request with a key is handled as usual and its response
+// is kept for ttl; a retry with the same key, method, path and body gets that response again
+// instead of being handled twice. Reusing a key for a different request, or while the first
+// one is still being handled, is rejected with 409. Responses are encrypted with box, since
+// they may carry agent credentials, and server errors are not kept so the request can be retried.
+// The key is set as "idempotency_key" in the context of the handler.
+// It must run after the admin or agent authentication middleware, which identifies the caller.
+func IdempotencyMiddleware(store storage.IdempotencyStore, box *secrets.Box, ttl time.Duration) echo.MiddlewareFunc {
+	return idempotency(store, box, ttl, func(c echo.Context, _ []byte) string {
+		return idempotencyCaller(c)
+	})
+}
+
+// EnrollmentIdempotencyMiddleware is IdempotencyMiddleware for the public enrollment route,
+// whose requests are not authenticated. Keys are scoped to the enrollment token in the body
+// instead of a caller, so a retry with the same token and key gets the original credentials
+// without using the token again.
+func EnrollmentIdempotencyMiddleware(store storage.IdempotencyStore, box *secrets.Box, ttl time.Duration) echo.MiddlewareFunc {
+	return idempotency(store, box, ttl, func(_ echo.Context, body []byte) string {
+		var req struct {
+			Token string `json:"token"`
+		}
+		if err := json.Unmarshal(body, &req); err != nil || req.Token == "" {
+			return ""
+		}
+		return "enrollment:" + secrets.Hash(req.Token)
+	})
+}
+
+// idempotency implements the idempotency middleware for requests whose caller, the scope of
+// their keys, is returned by callerOf; requests without a caller are handled as usual.
+func idempotency(store storage.IdempotencyStore, box *secrets.Box, ttl time.Duration, callerOf func(c echo.Context, body []byte) string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			key := c.Request().Header.Get(IdempotencyKeyHeader)
+			if key == "" {
+				return next(c)
+			}
+			if len(key) > maxIdempotencyKeyLength {
+				return c.JSON(http.StatusBadRequest, echo.Map{
+					"error": "Idempotency key is too long",
+				})
+			}
+			req := c.Request()
+			bodyBytes, err := io.ReadAll(req.Body)
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				return c.JSON(http.StatusRequestEntityTooLarge, echo.Map{
+					"error": "Request body too large",
+				})
+			}
+			if err != nil {
+				return c.JSON(http.StatusInternalServerError, echo.Map{
+					"error": "Unable to read request body",
+				})
+			}
+			req.Body.Close()
+			req.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+
+			caller := callerOf(c, bodyBytes)
+			if caller == "" {
+				return next(c)
+			}
+
+			now := time.Now()
+			record := &models.IdempotencyRecord{
+				Caller:      caller,
+				Key:         key,
+				RequestHash: requestHash(req, bodyBytes),
+				CreatedAt:   now,
+				ExpiresAt:   now.Add(ttl),
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), idempotencyStoreTimeout)
+			defer cancel()
+
+			existing, err := store.Reserve(ctx, record)
+			if errors.Is(err, storage.ErrDuplicate) {
+				return replayResponse(c, box, record, existing)
+			}
+			if err != nil {
+				logger.Error("Failed to reserve idempotency key", zap.Error(err), zap.String("caller", caller))
+				return c.JSON(http.StatusInternalServerError, echo.Map{
+					"error": "Unable to check idempotency key",
+				})
+			}
+
+			// Handlers that write in several steps use the key to resume a request that failed halfway
+			c.Set("idempotency_key", key)
+			recorder := &recordingWriter{ResponseWriter: c.Response().Writer}
+			c.Response().Writer = recorder
+			err = next(c)
+			c.Response().Writer = recorder.ResponseWriter
+
+			// The handler may have used up most of the time left on ctx
+			ctx, cancel = context.WithTimeout(context.Background(), idempotencyStoreTimeout)
+			defer cancel()
+
+			status := c.Response().Status
+			if err != nil || !c.Response().Committed || status >= http.StatusInternalServerError {
+				if releaseErr := store.Release(ctx, caller, key); releaseErr != nil {
+					logger.Error("Failed to release idempotency key", zap.Error(releaseErr), zap.String("caller", caller))
+				}
+				return err
+			}
+
+			body, err := box.Encrypt(recorder.body.String())
+			if err == nil {
+				err = store.Complete(ctx, caller, key, status, c.Response().Header().Get(echo.HeaderContentType), body)
+			}
+			if err != nil {
+				// The response was sent; a retry will be rejected as in progress until the key expires
+				logger.Error("Failed to store idempotent response", zap.Error(err), zap.String("caller", caller))
+			}
+			return nil
+		}
+	}
+}
+
+// requestHash identifies the method, path and body of a request.
+func requestHash(req *http.Request, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(req.Method + " " + req.URL.Path + "\n"))
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// replayWithPreviousCredentials answers a request the agent signed with the credentials its
+// last rotation replaced. Only a retry of a request whose response is recorded under its
+// Idempotency-Key gets an answer, that response; anything else is rejected like an unknown key.
+func replayWithPreviousCredentials(c echo.Context, store storage.IdempotencyStore, box *secrets.Box, agent *models.Agent, body []byte) error {
+	key := c.Request().Header.Get(IdempotencyKeyHeader)
+	if key == "" {
+		return c.JSON(http.StatusUnauthorized, echo.Map{
+			"error": "Invalid API key",
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), idempotencyStoreTimeout)
+	defer cancel()
+
+	existing, err := store.Get(ctx, models.AgentActor(agent.UUID), key, time.Now())
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		logger.Error("Failed to look up idempotency key", zap.Error(err), zap.String("agent_uuid", agent.UUID))
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Unable to check idempotency key",
+		})
+	}
+	record := &models.IdempotencyRecord{RequestHash: requestHash(c.Request(), body)}
+	if err != nil || existing.StatusCode == 0 || existing.RequestHash != record.RequestHash {
+		return c.JSON(http.StatusUnauthorized, echo.Map{
+			"error": "Invalid API key",
+		})
+	}
+	return replayResponse(c, box, record, existing)
+}
+
+// idempotencyCaller returns who sent the request, or "" if it was not authenticated.
+func idempotencyCaller(c echo.Context) string {
+	if username, ok := c.Get("admin").(string); ok && username != "" {
+		return models.AdminActor(username)
+	}
+	if uuid, ok := c.Get("agent_uuid").(string); ok && uuid != "" {
+		return models.AgentActor(uuid)
+	}
+	return ""
+}
+
+// replayResponse answers a request whose key was already used, as existing recorded it.
+func replayResponse(c echo.Context, box *secrets.Box, record, existing *models.IdempotencyRecord) error {
+	if existing.RequestHash != record.RequestHash {
+		return c.JSON(http.StatusConflict, echo.Map{
+			"error": "Idempotency key was already used for a different request",
+		})
+	}
+	if existing.StatusCode == 0 {
+		return c.JSON(http.StatusConflict, echo.Map{
+			"error": "A request with this idempotency key is still being processed",
+		})
+	}
+	body, err := box.Decrypt(existing.Body)
+	if err != nil {
+		logger.Error("Failed to decrypt idempotent response", zap.Error(err), zap.String("caller", existing.Caller))
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Unable to replay response",
+		})
+	}
+	c.Response().Header().Set(IdempotentReplayedHeader, "true")
+	return c.Blob(existing.StatusCode, existing.ContentType, []byte(body))
+}
+
+// recordingWriter keeps a copy of the response body it writes.
+type recordingWriter struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,43 @@
+package migrations
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Migration 0002: Agent enrollment tokens
+var Migration0002 = Migration{
+	Version:     2,
+	Description: "Create enrollment_tokens collection",
+	Up: func(db *mongo.Database) error {
+		err := createCollection(db, "enrollment_tokens", nil)
+		if err != nil {
+			return err
+		}
+
+		// Tokens are looked up by the hash of their raw value
+		err = createIndex(db, "enrollment_tokens", bson.M{"token_hash": 1}, options.Index().SetUnique(true))
+		if err != nil {
+			return err
+		}
+
+		log.Println("Migration 0002 Up executed successfully")
+		return nil
+	},
+	Down: func(db *mongo.Database) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if err := db.Collection("enrollment_tokens").Drop(ctx); err != nil {
+			return err
+		}
+
+		log.Println("Migration 0002 Down executed successfully")
+		return nil
+	},
+}
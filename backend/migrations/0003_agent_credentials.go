@@ -0,0 +1,67 @@
+package migrations
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Migration 0003: Shared-secret agent credentials.
+// Agents are now looked up by key_id, and api_key is only present on legacy agents,
+// so both unique indexes must ignore documents without the field.
+var Migration0003 = Migration{
+	Version:     3,
+	Description: "Index agent key IDs and make legacy API keys optional",
+	Up: func(db *mongo.Database) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if _, err := db.Collection("agents").Indexes().DropOne(ctx, "api_key_1"); err != nil {
+			return err
+		}
+
+		// Legacy documents stored an empty api_key on failed registrations; drop it so the partial index ignores them
+		_, err := db.Collection("agents").UpdateMany(ctx, bson.M{"api_key": ""}, bson.M{"$unset": bson.M{"api_key": ""}})
+		if err != nil {
+			return err
+		}
+
+		err = createIndex(db, "agents", bson.M{"api_key": 1}, options.Index().
+			SetUnique(true).
+			SetPartialFilterExpression(bson.M{"api_key": bson.M{"$type": "string"}}))
+		if err != nil {
+			return err
+		}
+
+		err = createIndex(db, "agents", bson.M{"key_id": 1}, options.Index().
+			SetUnique(true).
+			SetPartialFilterExpression(bson.M{"key_id": bson.M{"$type": "string"}}))
+		if err != nil {
+			return err
+		}
+
+		log.Println("Migration 0003 Up executed successfully")
+		return nil
+	},
+	Down: func(db *mongo.Database) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if _, err := db.Collection("agents").Indexes().DropOne(ctx, "key_id_1"); err != nil {
+			return err
+		}
+		if _, err := db.Collection("agents").Indexes().DropOne(ctx, "api_key_1"); err != nil {
+			return err
+		}
+		if err := createIndex(db, "agents", bson.M{"api_key": 1}, options.Index().SetUnique(true)); err != nil {
+			return err
+		}
+
+		log.Println("Migration 0003 Down executed successfully")
+		return nil
+	},
+}
@@ -0,0 +1,49 @@
+package migrations
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Migration 0004: Request nonces for replay protection
+var Migration0004 = Migration{
+	Version:     4,
+	Description: "Create request_nonces collection",
+	Up: func(db *mongo.Database) error {
+		err := createCollection(db, "request_nonces", nil)
+		if err != nil {
+			return err
+		}
+
+		// A nonce may only be used once per agent, across all manager instances
+		err = createIndex(db, "request_nonces", bson.D{{Key: "agent_id", Value: 1}, {Key: "nonce", Value: 1}}, options.Index().SetUnique(true))
+		if err != nil {
+			return err
+		}
+
+		// Nonces are only needed while their timestamp is inside the clock skew window
+		err = createIndex(db, "request_nonces", bson.M{"expires_at": 1}, options.Index().SetExpireAfterSeconds(0))
+		if err != nil {
+			return err
+		}
+
+		log.Println("Migration 0004 Up executed successfully")
+		return nil
+	},
+	Down: func(db *mongo.Database) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if err := db.Collection("request_nonces").Drop(ctx); err != nil {
+			return err
+		}
+
+		log.Println("Migration 0004 Down executed successfully")
+		return nil
+	},
+}
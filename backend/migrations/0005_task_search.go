@@ -0,0 +1,79 @@
+package migrations
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
+)
+
+// Migration 0005: Admin task listing.
+// Backfills the search_text used for free-text search and indexes the sort fields.
+var Migration0005 = Migration{
+	Version:     5,
+	Description: "Backfill task search text and index task listing fields",
+	Up: func(db *mongo.Database) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer cancel()
+
+		tasks := db.Collection("tasks")
+		cursor, err := tasks.Find(ctx, bson.M{"search_text": bson.M{"$exists": false}})
+		if err != nil {
+			return err
+		}
+		defer cursor.Close(ctx)
+
+		for cursor.Next(ctx) {
+			var task struct {
+				ID         primitive.ObjectID     `bson:"_id"`
+				Parameters map[string]interface{} `bson:"parameters"`
+			}
+			if err := cursor.Decode(&task); err != nil {
+				return err
+			}
+			update := bson.M{"$set": bson.M{"search_text": storage.TaskSearchText(task.Parameters)}}
+			if _, err := tasks.UpdateByID(ctx, task.ID, update); err != nil {
+				return err
+			}
+		}
+		if err := cursor.Err(); err != nil {
+			return err
+		}
+
+		for _, field := range []string{"created_at", "updated_at"} {
+			err = createIndex(db, "tasks", bson.D{{Key: field, Value: -1}, {Key: "_id", Value: -1}}, nil)
+			if err != nil {
+				return err
+			}
+		}
+		err = createIndex(db, "tasks", bson.M{"status": 1}, nil)
+		if err != nil {
+			return err
+		}
+
+		log.Println("Migration 0005 Up executed successfully")
+		return nil
+	},
+	Down: func(db *mongo.Database) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		tasks := db.Collection("tasks")
+		for _, name := range []string{"created_at_-1__id_-1", "updated_at_-1__id_-1", "status_1"} {
+			if _, err := tasks.Indexes().DropOne(ctx, name); err != nil {
+				return err
+			}
+		}
+		if _, err := tasks.UpdateMany(ctx, bson.M{}, bson.M{"$unset": bson.M{"search_text": ""}}); err != nil {
+			return err
+		}
+
+		log.Println("Migration 0005 Down executed successfully")
+		return nil
+	},
+}
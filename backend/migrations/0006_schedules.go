@@ -0,0 +1,56 @@
+package migrations
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Migration 0006: Scheduled and recurring tasks
+var Migration0006 = Migration{
+	Version:     6,
+	Description: "Create schedules collection",
+	Up: func(db *mongo.Database) error {
+		err := createCollection(db, "schedules", nil)
+		if err != nil {
+			return err
+		}
+
+		// The scheduler looks up enabled schedules by their next run
+		err = createIndex(db, "schedules", bson.D{{Key: "enabled", Value: 1}, {Key: "next_run_at", Value: 1}}, nil)
+		if err != nil {
+			return err
+		}
+
+		// Each schedule occurrence creates at most one task per agent, even when several managers fire it
+		occurrence := bson.D{{Key: "schedule_id", Value: 1}, {Key: "scheduled_for", Value: 1}, {Key: "agent_id", Value: 1}}
+		opts := options.Index().
+			SetUnique(true).
+			SetPartialFilterExpression(bson.M{"schedule_id": bson.M{"$exists": true}})
+		err = createIndex(db, "tasks", occurrence, opts)
+		if err != nil {
+			return err
+		}
+
+		log.Println("Migration 0006 Up executed successfully")
+		return nil
+	},
+	Down: func(db *mongo.Database) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if _, err := db.Collection("tasks").Indexes().DropOne(ctx, "schedule_id_1_scheduled_for_1_agent_id_1"); err != nil {
+			return err
+		}
+		if err := db.Collection("schedules").Drop(ctx); err != nil {
+			return err
+		}
+
+		log.Println("Migration 0006 Down executed successfully")
+		return nil
+	},
+}
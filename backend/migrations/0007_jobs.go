@@ -0,0 +1,53 @@
+package migrations
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Migration 0007: Fan-out jobs
+var Migration0007 = Migration{
+	Version:     7,
+	Description: "Create jobs collection",
+	Up: func(db *mongo.Database) error {
+		err := createCollection(db, "jobs", nil)
+		if err != nil {
+			return err
+		}
+
+		// Jobs are listed newest first
+		err = createIndex(db, "jobs", bson.D{{Key: "created_at", Value: -1}}, nil)
+		if err != nil {
+			return err
+		}
+
+		// Job progress counts the tasks of a job by status
+		opts := options.Index().SetPartialFilterExpression(bson.M{"job_id": bson.M{"$exists": true}})
+		err = createIndex(db, "tasks", bson.D{{Key: "job_id", Value: 1}, {Key: "status", Value: 1}}, opts)
+		if err != nil {
+			return err
+		}
+
+		log.Println("Migration 0007 Up executed successfully")
+		return nil
+	},
+	Down: func(db *mongo.Database) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if _, err := db.Collection("tasks").Indexes().DropOne(ctx, "job_id_1_status_1"); err != nil {
+			return err
+		}
+		if err := db.Collection("jobs").Drop(ctx); err != nil {
+			return err
+		}
+
+		log.Println("Migration 0007 Down executed successfully")
+		return nil
+	},
+}
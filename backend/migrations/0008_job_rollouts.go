@@ -0,0 +1,52 @@
+package migrations
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Migration 0008: Rolling jobs
+var Migration0008 = Migration{
+	Version:     8,
+	Description: "Index job rollouts",
+	Up: func(db *mongo.Database) error {
+		// The rollout controller looks up rolling jobs by status
+		opts := options.Index().SetPartialFilterExpression(bson.M{"rollout": bson.M{"$exists": true}})
+		err := createIndex(db, "jobs", bson.D{{Key: "rollout.status", Value: 1}}, opts)
+		if err != nil {
+			return err
+		}
+
+		// A job creates at most one task per agent in each wave, even when several managers start it
+		wave := bson.D{{Key: "job_id", Value: 1}, {Key: "wave", Value: 1}, {Key: "agent_id", Value: 1}}
+		opts = options.Index().
+			SetUnique(true).
+			SetPartialFilterExpression(bson.M{"job_id": bson.M{"$exists": true}})
+		err = createIndex(db, "tasks", wave, opts)
+		if err != nil {
+			return err
+		}
+
+		log.Println("Migration 0008 Up executed successfully")
+		return nil
+	},
+	Down: func(db *mongo.Database) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if _, err := db.Collection("tasks").Indexes().DropOne(ctx, "job_id_1_wave_1_agent_id_1"); err != nil {
+			return err
+		}
+		if _, err := db.Collection("jobs").Indexes().DropOne(ctx, "rollout.status_1"); err != nil {
+			return err
+		}
+
+		log.Println("Migration 0008 Down executed successfully")
+		return nil
+	},
+}
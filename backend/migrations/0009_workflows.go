@@ -0,0 +1,60 @@
+package migrations
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Migration 0009: Workflows
+var Migration0009 = Migration{
+	Version:     9,
+	Description: "Create workflows and workflow_runs collections",
+	Up: func(db *mongo.Database) error {
+		for _, name := range []string{"workflows", "workflow_runs"} {
+			if err := createCollection(db, name, nil); err != nil {
+				return err
+			}
+		}
+
+		// The workflow engine looks up running runs; listings filter by workflow, newest first
+		err := createIndex(db, "workflow_runs", bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: 1}}, nil)
+		if err != nil {
+			return err
+		}
+		err = createIndex(db, "workflow_runs", bson.D{{Key: "workflow_id", Value: 1}, {Key: "created_at", Value: -1}}, nil)
+		if err != nil {
+			return err
+		}
+
+		// The engine reads the tasks of a run to follow its nodes
+		opts := options.Index().SetPartialFilterExpression(bson.M{"workflow_run_id": bson.M{"$exists": true}})
+		err = createIndex(db, "tasks", bson.D{{Key: "workflow_run_id", Value: 1}}, opts)
+		if err != nil {
+			return err
+		}
+
+		log.Println("Migration 0009 Up executed successfully")
+		return nil
+	},
+	Down: func(db *mongo.Database) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if _, err := db.Collection("tasks").Indexes().DropOne(ctx, "workflow_run_id_1"); err != nil {
+			return err
+		}
+		for _, name := range []string{"workflow_runs", "workflows"} {
+			if err := db.Collection(name).Drop(ctx); err != nil {
+				return err
+			}
+		}
+
+		log.Println("Migration 0009 Down executed successfully")
+		return nil
+	},
+}
@@ -0,0 +1,44 @@
+package migrations
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Migration 0010: Task templates
+var Migration0010 = Migration{
+	Version:     10,
+	Description: "Create task_templates collection",
+	Up: func(db *mongo.Database) error {
+		err := createCollection(db, "task_templates", nil)
+		if err != nil {
+			return err
+		}
+
+		// Every version of a template is stored once, even when several managers save it
+		version := bson.D{{Key: "name", Value: 1}, {Key: "version", Value: -1}}
+		err = createIndex(db, "task_templates", version, options.Index().SetUnique(true))
+		if err != nil {
+			return err
+		}
+
+		log.Println("Migration 0010 Up executed successfully")
+		return nil
+	},
+	Down: func(db *mongo.Database) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if err := db.Collection("task_templates").Drop(ctx); err != nil {
+			return err
+		}
+
+		log.Println("Migration 0010 Down executed successfully")
+		return nil
+	},
+}
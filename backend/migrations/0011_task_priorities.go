@@ -0,0 +1,67 @@
+package migrations
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Migration 0011: Task priorities and fair-share dispatch queues
+var Migration0011 = Migration{
+	Version:     11,
+	Description: "Backfill task priorities and dispatch queues",
+	Up: func(db *mongo.Database) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		defer cancel()
+
+		tasks := db.Collection("tasks")
+		if _, err := tasks.UpdateMany(ctx, bson.M{"priority": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"priority": 0}}); err != nil {
+			return err
+		}
+
+		// Tasks of a job share its queue; any other task is queued under its submitter
+		queue := bson.M{"$cond": bson.A{
+			bson.M{"$gt": bson.A{bson.M{"$ifNull": bson.A{"$job_id", ""}}, ""}},
+			bson.M{"$concat": bson.A{"job:", "$job_id"}},
+			bson.M{"$concat": bson.A{"submitter:", bson.M{"$ifNull": bson.A{"$created_by", ""}}}},
+		}}
+		_, err := tasks.UpdateMany(ctx, bson.M{"queue": bson.M{"$exists": false}}, bson.A{bson.M{"$set": bson.M{"queue": queue}}})
+		if err != nil {
+			return err
+		}
+
+		// Polls pick the highest priority queued task and weigh queues by the agent's recent claims
+		dispatch := bson.D{
+			{Key: "agent_id", Value: 1},
+			{Key: "status", Value: 1},
+			{Key: "priority", Value: -1},
+			{Key: "created_at", Value: 1},
+		}
+		if err := createIndex(db, "tasks", dispatch, nil); err != nil {
+			return err
+		}
+		if err := createIndex(db, "tasks", bson.D{{Key: "agent_id", Value: 1}, {Key: "started_at", Value: -1}}, nil); err != nil {
+			return err
+		}
+
+		log.Println("Migration 0011 Up executed successfully")
+		return nil
+	},
+	Down: func(db *mongo.Database) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		tasks := db.Collection("tasks")
+		for _, name := range []string{"agent_id_1_status_1_priority_-1_created_at_1", "agent_id_1_started_at_-1"} {
+			if _, err := tasks.Indexes().DropOne(ctx, name); err != nil {
+				return err
+			}
+		}
+
+		log.Println("Migration 0011 Down executed successfully")
+		return nil
+	},
+}
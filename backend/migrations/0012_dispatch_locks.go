@@ -0,0 +1,52 @@
+package migrations
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Migration 0012: Concurrency limits
+var Migration0012 = Migration{
+	Version:     12,
+	Description: "Create dispatch_locks collection",
+	Up: func(db *mongo.Database) error {
+		err := createCollection(db, "dispatch_locks", nil)
+		if err != nil {
+			return err
+		}
+
+		// Claims check their own lease; the TTL index only clears locks nobody asks for again
+		err = createIndex(db, "dispatch_locks", bson.M{"expires_at": 1}, options.Index().SetExpireAfterSeconds(0))
+		if err != nil {
+			return err
+		}
+
+		// Claims for limited agents count the tasks each agent holds per type
+		err = createIndex(db, "tasks", bson.D{{Key: "agent_id", Value: 1}, {Key: "status", Value: 1}, {Key: "type", Value: 1}}, nil)
+		if err != nil {
+			return err
+		}
+
+		log.Println("Migration 0012 Up executed successfully")
+		return nil
+	},
+	Down: func(db *mongo.Database) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if _, err := db.Collection("tasks").Indexes().DropOne(ctx, "agent_id_1_status_1_type_1"); err != nil {
+			return err
+		}
+		if err := db.Collection("dispatch_locks").Drop(ctx); err != nil {
+			return err
+		}
+
+		log.Println("Migration 0012 Down executed successfully")
+		return nil
+	},
+}
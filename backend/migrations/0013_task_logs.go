@@ -0,0 +1,44 @@
+package migrations
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Migration 0013: Streamed task logs
+var Migration0013 = Migration{
+	Version:     13,
+	Description: "Create task_logs collection",
+	Up: func(db *mongo.Database) error {
+		err := createCollection(db, "task_logs", nil)
+		if err != nil {
+			return err
+		}
+
+		// Agents resend chunks they are unsure about; each sequence number of an attempt is stored once
+		sequence := bson.D{{Key: "task_id", Value: 1}, {Key: "attempt", Value: 1}, {Key: "sequence", Value: 1}}
+		err = createIndex(db, "task_logs", sequence, options.Index().SetUnique(true))
+		if err != nil {
+			return err
+		}
+
+		log.Println("Migration 0013 Up executed successfully")
+		return nil
+	},
+	Down: func(db *mongo.Database) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if err := db.Collection("task_logs").Drop(ctx); err != nil {
+			return err
+		}
+
+		log.Println("Migration 0013 Down executed successfully")
+		return nil
+	},
+}
@@ -0,0 +1,49 @@
+package migrations
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Migration 0014: Task artifacts and retention
+var Migration0014 = Migration{
+	Version:     14,
+	Description: "Create artifacts GridFS bucket indexes",
+	Up: func(db *mongo.Database) error {
+		// The driver indexes the bucket itself on the first upload; artifacts are listed per task
+		taskFiles := bson.D{{Key: "metadata.task_id", Value: 1}, {Key: "uploadDate", Value: 1}}
+		err := createIndex(db, "artifacts.files", taskFiles, nil)
+		if err != nil {
+			return err
+		}
+
+		// The reaper looks for finished tasks that are past their retention
+		err = createIndex(db, "tasks", bson.D{{Key: "status", Value: 1}, {Key: "updated_at", Value: 1}}, nil)
+		if err != nil {
+			return err
+		}
+
+		log.Println("Migration 0014 Up executed successfully")
+		return nil
+	},
+	Down: func(db *mongo.Database) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if _, err := db.Collection("tasks").Indexes().DropOne(ctx, "status_1_updated_at_1"); err != nil {
+			return err
+		}
+		for _, name := range []string{"artifacts.files", "artifacts.chunks"} {
+			if err := db.Collection(name).Drop(ctx); err != nil {
+				return err
+			}
+		}
+
+		log.Println("Migration 0014 Down executed successfully")
+		return nil
+	},
+}
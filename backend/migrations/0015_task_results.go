@@ -0,0 +1,37 @@
+package migrations
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Migration 0015: Typed task results
+var Migration0015 = Migration{
+	Version:     15,
+	Description: "Index typed task results",
+	Up: func(db *mongo.Database) error {
+		// Result names are chosen by task types and agents, so every result is indexed
+		err := createIndex(db, "tasks", bson.D{{Key: "output.results.$**", Value: 1}}, nil)
+		if err != nil {
+			return err
+		}
+
+		log.Println("Migration 0015 Up executed successfully")
+		return nil
+	},
+	Down: func(db *mongo.Database) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if _, err := db.Collection("tasks").Indexes().DropOne(ctx, "output.results.$**_1"); err != nil {
+			return err
+		}
+
+		log.Println("Migration 0015 Down executed successfully")
+		return nil
+	},
+}
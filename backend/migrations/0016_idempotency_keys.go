@@ -0,0 +1,49 @@
+package migrations
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Migration 0016: Idempotency keys for retried requests
+var Migration0016 = Migration{
+	Version:     16,
+	Description: "Create idempotency_keys collection",
+	Up: func(db *mongo.Database) error {
+		err := createCollection(db, "idempotency_keys", nil)
+		if err != nil {
+			return err
+		}
+
+		// A key identifies one request per caller, across all manager instances
+		err = createIndex(db, "idempotency_keys", bson.D{{Key: "caller", Value: 1}, {Key: "key", Value: 1}}, options.Index().SetUnique(true))
+		if err != nil {
+			return err
+		}
+
+		// Responses are only repeated for retries within the configured TTL
+		err = createIndex(db, "idempotency_keys", bson.M{"expires_at": 1}, options.Index().SetExpireAfterSeconds(0))
+		if err != nil {
+			return err
+		}
+
+		log.Println("Migration 0016 Up executed successfully")
+		return nil
+	},
+	Down: func(db *mongo.Database) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if err := db.Collection("idempotency_keys").Drop(ctx); err != nil {
+			return err
+		}
+
+		log.Println("Migration 0016 Down executed successfully")
+		return nil
+	},
+}
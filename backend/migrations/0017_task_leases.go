@@ -0,0 +1,37 @@
+package migrations
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Migration 0017: Task leases
+var Migration0017 = Migration{
+	Version:     17,
+	Description: "Index task leases",
+	Up: func(db *mongo.Database) error {
+		// The reaper looks for held tasks whose lease expired
+		err := createIndex(db, "tasks", bson.D{{Key: "status", Value: 1}, {Key: "lease_expires_at", Value: 1}}, nil)
+		if err != nil {
+			return err
+		}
+
+		log.Println("Migration 0017 Up executed successfully")
+		return nil
+	},
+	Down: func(db *mongo.Database) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if _, err := db.Collection("tasks").Indexes().DropOne(ctx, "status_1_lease_expires_at_1"); err != nil {
+			return err
+		}
+
+		log.Println("Migration 0017 Down executed successfully")
+		return nil
+	},
+}
@@ -0,0 +1,40 @@
+package migrations
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Migration 0018: Previous agent credentials
+// An agent may replay its last credential rotation with the key ID the rotation replaced.
+var Migration0018 = Migration{
+	Version:     18,
+	Description: "Index the key IDs replaced by agent credential rotations",
+	Up: func(db *mongo.Database) error {
+		err := createIndex(db, "agents", bson.M{"previous_key_id": 1}, options.Index().
+			SetUnique(true).
+			SetPartialFilterExpression(bson.M{"previous_key_id": bson.M{"$type": "string"}}))
+		if err != nil {
+			return err
+		}
+
+		log.Println("Migration 0018 Up executed successfully")
+		return nil
+	},
+	Down: func(db *mongo.Database) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if _, err := db.Collection("agents").Indexes().DropOne(ctx, "previous_key_id_1"); err != nil {
+			return err
+		}
+
+		log.Println("Migration 0018 Down executed successfully")
+		return nil
+	},
+}
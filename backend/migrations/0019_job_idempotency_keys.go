@@ -0,0 +1,41 @@
+package migrations
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Migration 0019: Job idempotency keys
+// A job created with an Idempotency-Key is resumed, not created again, when the request is retried.
+var Migration0019 = Migration{
+	Version:     19,
+	Description: "Index the idempotency keys of jobs",
+	Up: func(db *mongo.Database) error {
+		keys := bson.D{{Key: "created_by", Value: 1}, {Key: "idempotency_key", Value: 1}}
+		err := createIndex(db, "jobs", keys, options.Index().
+			SetUnique(true).
+			SetPartialFilterExpression(bson.M{"idempotency_key": bson.M{"$type": "string"}}))
+		if err != nil {
+			return err
+		}
+
+		log.Println("Migration 0019 Up executed successfully")
+		return nil
+	},
+	Down: func(db *mongo.Database) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if _, err := db.Collection("jobs").Indexes().DropOne(ctx, "created_by_1_idempotency_key_1"); err != nil {
+			return err
+		}
+
+		log.Println("Migration 0019 Down executed successfully")
+		return nil
+	},
+}
@@ -13,38 +13,113 @@ type Agent struct {
 	MacHash   string             `json:"mac_hash" bson:"mac_hash" validate:"required"`
 	Nickname  string             `json:"nickname" bson:"nickname"`
 	Role      string             `json:"role" bson:"role"`
-	APIKey    string             `json:"-" bson:"api_key"`           // Store API key but don't expose in JSON
-	APISecret string             `json:"-" bson:"api_secret"`        // Store API secret but don't expose in JSON
-	Status    string             `json:"status" bson:"status"`       // "active", "inactive", "disconnected"
+	Labels    map[string]string  `json:"labels,omitempty" bson:"labels,omitempty"`
+	// MaxConcurrent caps how many tasks the agent holds at once; 0 means no limit of its own.
+	MaxConcurrent int `json:"max_concurrent,omitempty" bson:"max_concurrent,omitempty"`
+	KeyID     string             `json:"-" bson:"key_id,omitempty"`     // Public identifier sent as X-API-Key
+	APIKey    string             `json:"-" bson:"api_key,omitempty"`    // Legacy: SHA256 of the raw API key
+	APISecret string             `json:"-" bson:"api_secret"`           // Encrypted HMAC secret (legacy: SHA256 hash); never exposed in JSON
+	// CredentialVersion identifies how KeyID/APIKey and APISecret are stored.
+	CredentialVersion int `json:"-" bson:"credential_version,omitempty"`
+	// PreviousKeyID and PreviousAPISecret are the credentials the last rotation replaced. They
+	// only let the agent replay that rotation, in case it lost the response, and are dropped
+	// once the agent signs with its new credentials.
+	PreviousKeyID     string `json:"-" bson:"previous_key_id,omitempty"`
+	PreviousAPISecret string `json:"-" bson:"previous_api_secret,omitempty"`
+	Status    string             `json:"status" bson:"status"`       // "active", "inactive", "disconnected", "decommissioned"
 	LastSeen  time.Time          `json:"last_seen" bson:"last_seen"`
 	CreatedAt time.Time          `json:"created_at" bson:"created_at"`
+	// EnrollmentTokenID is the token the agent enrolled with, if any.
+	EnrollmentTokenID string `json:"enrollment_token_id,omitempty" bson:"enrollment_token_id,omitempty"`
 }
 
+// AgentStatusDecommissioned marks agents retired by an administrator. They keep their history
+// but can no longer authenticate.
+const AgentStatusDecommissioned = "decommissioned"
+
+const (
+	// CredentialVersionLegacy agents authenticate with a hashed API key and sign with the raw API key.
+	CredentialVersionLegacy = 0
+	// CredentialVersionSharedSecret agents authenticate with a key ID and sign with a shared secret
+	// that the manager stores encrypted.
+	CredentialVersionSharedSecret = 1
+)
+
 type AgentSummary struct {
-    UUID     string    `json:"uuid"`
-    Nickname string    `json:"nickname"`
-    Hostname string    `json:"hostname"`
-    LastSeen time.Time `json:"last_seen"`
-    Role     string    `json:"role"`
+    UUID      string            `json:"uuid"`
+    Nickname  string            `json:"nickname"`
+    Hostname  string            `json:"hostname"`
+    LastSeen  time.Time         `json:"last_seen"`
+    Role      string            `json:"role"`
+    Status    string            `json:"status"`
+    Labels    map[string]string `json:"labels,omitempty"`
+    MaxConcurrent int           `json:"max_concurrent,omitempty"`
+    CreatedAt time.Time         `json:"created_at"`
+}
+
+// AgentDetail is an agent summary with the task slots it is using.
+type AgentDetail struct {
+    AgentSummary
+    Slots AgentSlots `json:"slots"`
+}
+
+// AgentSlots compares the tasks an agent holds (dispatched, running or being cancelled) with
+// its concurrency limits. A Max of 0 means no limit.
+type AgentSlots struct {
+    Used  int                  `json:"used"`
+    Max   int                  `json:"max"`
+    Types map[string]TypeSlots `json:"types,omitempty"`
+}
+
+// TypeSlots compares the tasks of one type an agent holds with the limit of that type.
+type TypeSlots struct {
+    Used int `json:"used"`
+    Max  int `json:"max"`
+}
+
+// AgentListResponse is one page of the admin agent inventory.
+type AgentListResponse struct {
+    Agents     []AgentSummary `json:"agents"`
+    Total      int64          `json:"total"`
+    NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+// AgentUpdateRequest holds the agent fields an administrator may edit. Omitted fields are unchanged.
+type AgentUpdateRequest struct {
+    Nickname *string `json:"nickname"`
+    Role     *string `json:"role"`
+    // MaxConcurrent sets the agent's own concurrency limit; 0 removes it.
+    MaxConcurrent *int `json:"max_concurrent"`
 }
 
+// HeartbeatRequest is sent by agents to report that they are alive. The manager records the
+// heartbeat for the authenticated agent at its own time: UUID must be that agent's, and
+// Timestamp is only kept for compatibility.
 type HeartbeatRequest struct {
     UUID      string    `json:"uuid" validate:"required"`
-    Timestamp time.Time `json:"timestamp" validate:"required"`  // Added timestamp per spec
+    Timestamp time.Time `json:"timestamp" validate:"required"`
 }
 
 type HeartbeatResponse struct {
     Status    string    `json:"status"`
     Timestamp time.Time `json:"timestamp"`
+    // CancelTasks lists the IDs of tasks the agent holds that were cancelled.
+    CancelTasks []string `json:"cancel_tasks,omitempty"`
+    // LeaseExpiresAt is when the leases of the tasks the agent holds now expire, if leases are enabled.
+    LeaseExpiresAt *time.Time `json:"lease_expires_at,omitempty"`
 }
 
 // ToSummary converts an Agent to an AgentSummary.
 func (a *Agent) ToSummary() AgentSummary {
     return AgentSummary{
-        UUID:     a.UUID,
-        Nickname: a.Nickname,
-        Hostname: a.Hostname,
-        LastSeen: a.LastSeen,
-        Role:     a.Role,
+        UUID:      a.UUID,
+        Nickname:  a.Nickname,
+        Hostname:  a.Hostname,
+        LastSeen:  a.LastSeen,
+        Role:      a.Role,
+        Status:    a.Status,
+        Labels:    a.Labels,
+        MaxConcurrent: a.MaxConcurrent,
+        CreatedAt: a.CreatedAt,
     }
 }
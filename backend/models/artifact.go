@@ -0,0 +1,30 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Artifact describes a file an agent attached to a task, such as a screenshot or a download
+// made by a browser automation task. The content is stored apart from the description and
+// read through the artifact download endpoint.
+type Artifact struct {
+	ID          primitive.ObjectID `json:"id"`
+	TaskID      primitive.ObjectID `json:"task_id"`
+	AgentID     string             `json:"agent_id"`
+	Attempt     int                `json:"attempt"`
+	Name        string             `json:"name"`
+	ContentType string             `json:"content_type"`
+	Size        int64              `json:"size"`
+	// SHA256 is the hex-encoded SHA-256 digest of the content, checked on upload.
+	SHA256    string    `json:"sha256"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ArtifactListResponse lists the artifacts of a task, oldest first.
+type ArtifactListResponse struct {
+	Artifacts []Artifact `json:"artifacts"`
+	// TotalSize is the combined size of the artifacts, counted against the per-task quota.
+	TotalSize int64 `json:"total_size"`
+}
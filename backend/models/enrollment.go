@@ -0,0 +1,57 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// EnrollmentToken lets a new machine register itself as an agent without prior credentials.
+// Only a hash of the token is stored; the raw value is shown once when the token is created.
+type EnrollmentToken struct {
+	ID          primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	TokenHash   string             `json:"-" bson:"token_hash"`
+	Description string             `json:"description,omitempty" bson:"description,omitempty"`
+	Role        string             `json:"role,omitempty" bson:"role,omitempty"`
+	Labels      map[string]string  `json:"labels,omitempty" bson:"labels,omitempty"`
+	MaxUses     int                `json:"max_uses" bson:"max_uses"`
+	Uses        int                `json:"uses" bson:"uses"`
+	Usages      []EnrollmentUsage  `json:"usages,omitempty" bson:"usages,omitempty"`
+	Revoked     bool               `json:"revoked" bson:"revoked"`
+	ExpiresAt   time.Time          `json:"expires_at" bson:"expires_at"`
+	CreatedBy   string             `json:"created_by,omitempty" bson:"created_by,omitempty"`
+	CreatedAt   time.Time          `json:"created_at" bson:"created_at"`
+}
+
+// EnrollmentUsage records one agent enrolled with a token.
+type EnrollmentUsage struct {
+	AgentUUID string    `json:"agent_uuid" bson:"agent_uuid"`
+	Hostname  string    `json:"hostname" bson:"hostname"`
+	UsedAt    time.Time `json:"used_at" bson:"used_at"`
+}
+
+type EnrollmentTokenRequest struct {
+	Description    string            `json:"description"`
+	Role           string            `json:"role"`
+	Labels         map[string]string `json:"labels"`
+	MaxUses        int               `json:"max_uses" validate:"gte=0"`
+	ExpiresInHours int               `json:"expires_in_hours" validate:"gte=0"`
+}
+
+type EnrollmentTokenResponse struct {
+	Token string `json:"token"` // raw token, only returned at creation
+	EnrollmentToken
+}
+
+type EnrollmentRequest struct {
+	Token    string `json:"token" validate:"required"`
+	UUID     string `json:"uuid" validate:"required"`
+	Hostname string `json:"hostname" validate:"required"`
+	MacHash  string `json:"mac_hash" validate:"required"`
+	Nickname string `json:"nickname"`
+}
+
+// Usable reports whether the token can still enroll an agent at the given time.
+func (t *EnrollmentToken) Usable(now time.Time) bool {
+	return !t.Revoked && now.Before(t.ExpiresAt) && t.Uses < t.MaxUses
+}
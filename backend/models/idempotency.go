@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+// IdempotencyRecord remembers a request sent with an Idempotency-Key header, and the response
+// to it, so that a retry of the request gets the same response instead of repeating it.
+type IdempotencyRecord struct {
+	// Caller is the administrator or agent that sent the request, as in task events.
+	Caller string `bson:"caller"`
+	Key    string `bson:"key"`
+	// RequestHash identifies the method, path and body of the request.
+	RequestHash string `bson:"request_hash"`
+	// StatusCode is 0 while the first request with the key is being handled.
+	StatusCode  int    `bson:"status_code"`
+	ContentType string `bson:"content_type,omitempty"`
+	// Body is the response body, encrypted because it may hold agent credentials.
+	Body      string    `bson:"body,omitempty"`
+	CreatedAt time.Time `bson:"created_at"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
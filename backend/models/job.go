@@ -0,0 +1,218 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Job runs one task template on many agents. Each target agent gets its own task carrying the
+// job's ID; the job's progress is derived from those tasks.
+type Job struct {
+	ID     primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Name   string             `json:"name" bson:"name"`
+	Task   TaskTemplate       `json:"task" bson:"task"`
+	Target JobTarget          `json:"target" bson:"target"`
+	// TaskCount is the number of agents the target resolved to when the job was created.
+	TaskCount   int       `json:"task_count" bson:"task_count"`
+	CreatedBy   string    `json:"created_by,omitempty" bson:"created_by,omitempty"`
+	CreatedAt   time.Time `json:"created_at" bson:"created_at"`
+	CancelledBy string    `json:"cancelled_by,omitempty" bson:"cancelled_by,omitempty"`
+	CancelledAt time.Time `json:"cancelled_at,omitempty" bson:"cancelled_at,omitempty"`
+	// Rollout is set on jobs that reach their agents in waves rather than all at once.
+	Rollout *Rollout `json:"rollout,omitempty" bson:"rollout,omitempty"`
+	// IdempotencyKey is the Idempotency-Key the job was created with, so that a retry after a
+	// failure resumes the job instead of creating another one.
+	IdempotencyKey string `json:"-" bson:"idempotency_key,omitempty"`
+}
+
+// JobTarget selects the agents of a job. Exactly one of AgentIDs, Role and Labels is set.
+type JobTarget struct {
+	AgentIDs []string          `json:"agent_ids,omitempty" bson:"agent_ids,omitempty"`
+	Role     string            `json:"role,omitempty" bson:"role,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty" bson:"labels,omitempty"`
+}
+
+// JobRequest is the body of POST /admin/jobs.
+type JobRequest struct {
+	Name   string       `json:"name"`
+	Task   TaskTemplate `json:"task"`
+	Target JobTarget    `json:"target"`
+	// Rollout dispatches the job in waves; without it every agent gets its task at once.
+	Rollout *RolloutPolicy `json:"rollout,omitempty"`
+}
+
+// JobProgress aggregates the tasks of a job.
+type JobProgress struct {
+	Total int64 `json:"total"`
+	// Counts holds the number of tasks in each status that has any.
+	Counts    map[string]int64 `json:"counts"`
+	Finished  int64            `json:"finished"`
+	Succeeded int64            `json:"succeeded"`
+	// SuccessRatio is Succeeded divided by Finished, zero while no task has finished.
+	SuccessRatio float64 `json:"success_ratio"`
+	// Done is set once every task has finished and, for rolling jobs, no further wave will start.
+	Done bool `json:"done"`
+	// Stragglers lists the unfinished tasks that have gone longest without an update.
+	Stragglers []JobResult `json:"stragglers"`
+}
+
+// JobResult is the outcome of a job on one agent.
+type JobResult struct {
+	TaskID    string    `json:"task_id"`
+	AgentID   string    `json:"agent_id"`
+	Status    string    `json:"status"`
+	Attempt   int       `json:"attempt"`
+	Output    *Output   `json:"output,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// JobResponse is a job with its current progress.
+type JobResponse struct {
+	Job
+	Progress JobProgress `json:"progress"`
+}
+
+// JobListResponse lists jobs, newest first.
+type JobListResponse struct {
+	Jobs []Job `json:"jobs"`
+}
+
+// JobResultsResponse is one page of the results of a job.
+type JobResultsResponse struct {
+	Results    []JobResult `json:"results"`
+	Total      int64       `json:"total"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+// JobCancelResponse reports how many tasks cancelling a job changed.
+type JobCancelResponse struct {
+	JobID     string    `json:"job_id"`
+	Cancelled int64     `json:"cancelled"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// JobResultOf returns the JobResult view of task.
+func JobResultOf(task *Task) JobResult {
+	return JobResult{
+		TaskID:    task.ID.Hex(),
+		AgentID:   task.AgentID,
+		Status:    task.Status,
+		Attempt:   task.Attempt,
+		Output:    task.Output,
+		UpdatedAt: task.UpdatedAt,
+	}
+}
+
+// Rollout statuses.
+const (
+	RolloutRunning   = "running"
+	RolloutHalted    = "halted"
+	RolloutCompleted = "completed"
+	RolloutAborted   = "aborted"
+)
+
+// ActorRollout is the actor recorded on the changes the rollout controller makes.
+const ActorRollout = "system:rollout"
+
+// RolloutPolicy describes how a job is dispatched in waves.
+type RolloutPolicy struct {
+	// BatchSize is the number of agents per wave. Exactly one of BatchSize and BatchPercent is set.
+	BatchSize int `json:"batch_size,omitempty" bson:"batch_size,omitempty"`
+	// BatchPercent sizes each wave as a percentage of the job's agents, rounded up.
+	BatchPercent int `json:"batch_percent,omitempty" bson:"batch_percent,omitempty"`
+	// MaxFailureRate halts the rollout after a wave in which a larger fraction of tasks did not
+	// complete. Zero halts on any failure.
+	MaxFailureRate float64 `json:"max_failure_rate" bson:"max_failure_rate"`
+}
+
+// Rollout is the persisted state of a job dispatched in waves.
+type Rollout struct {
+	Policy RolloutPolicy `json:"policy" bson:"policy"`
+	Status string        `json:"status" bson:"status"`
+	// CurrentWave is the number of the last wave started, counting from 1.
+	CurrentWave int           `json:"current_wave" bson:"current_wave"`
+	Waves       []RolloutWave `json:"waves" bson:"waves"`
+	HaltReason  string        `json:"halt_reason,omitempty" bson:"halt_reason,omitempty"`
+	// Events records every change of status and every wave started, oldest first.
+	Events []RolloutEvent `json:"events" bson:"events"`
+}
+
+// RolloutWave is one batch of agents of a rollout. The outcome fields are set once every
+// task of the wave has finished.
+type RolloutWave struct {
+	Number     int       `json:"number" bson:"number"`
+	AgentIDs   []string  `json:"agent_ids" bson:"agent_ids"`
+	StartedAt  time.Time `json:"started_at,omitempty" bson:"started_at,omitempty"`
+	FinishedAt time.Time `json:"finished_at,omitempty" bson:"finished_at,omitempty"`
+	Succeeded  int64     `json:"succeeded" bson:"succeeded"`
+	Failed     int64     `json:"failed" bson:"failed"`
+	// FailureRate is Failed divided by the number of tasks in the wave.
+	FailureRate float64 `json:"failure_rate" bson:"failure_rate"`
+}
+
+// RolloutEvent is an entry of the audit trail of a rollout.
+type RolloutEvent struct {
+	Status    string    `json:"status" bson:"status"` // status of the rollout after the event
+	Wave      int       `json:"wave" bson:"wave"`
+	Actor     string    `json:"actor" bson:"actor"`
+	Reason    string    `json:"reason,omitempty" bson:"reason,omitempty"`
+	Timestamp time.Time `json:"timestamp" bson:"timestamp"`
+}
+
+// Validate checks the policy.
+func (p *RolloutPolicy) Validate() error {
+	if p.BatchSize < 0 || p.BatchPercent < 0 || p.BatchPercent > 100 {
+		return errors.New("rollout batch_size must be positive and batch_percent between 1 and 100")
+	}
+	if (p.BatchSize > 0) == (p.BatchPercent > 0) {
+		return errors.New("rollout needs exactly one of batch_size and batch_percent")
+	}
+	if p.MaxFailureRate < 0 || p.MaxFailureRate > 1 {
+		return errors.New("rollout max_failure_rate must be between 0 and 1")
+	}
+	return nil
+}
+
+// Plan splits agents into waves in order.
+func (p *RolloutPolicy) Plan(agents []string) []RolloutWave {
+	size := p.BatchSize
+	if p.BatchPercent > 0 {
+		size = (len(agents)*p.BatchPercent + 99) / 100
+	}
+	if size < 1 {
+		size = 1
+	}
+
+	var waves []RolloutWave
+	for start := 0; start < len(agents); start += size {
+		end := start + size
+		if end > len(agents) {
+			end = len(agents)
+		}
+		waves = append(waves, RolloutWave{
+			Number:   len(waves) + 1,
+			AgentIDs: append([]string(nil), agents[start:end]...),
+		})
+	}
+	return waves
+}
+
+// Record appends an event and moves the rollout to status.
+func (r *Rollout) Record(status, actor, reason string, now time.Time) {
+	r.Status = status
+	r.Events = append(r.Events, RolloutEvent{
+		Status:    status,
+		Wave:      r.CurrentWave,
+		Actor:     actor,
+		Reason:    reason,
+		Timestamp: now,
+	})
+}
+
+// FailureReason describes a wave whose failure rate exceeded the policy.
+func (r *Rollout) FailureReason(wave *RolloutWave) string {
+	return fmt.Sprintf("wave %d failure rate %.0f%% exceeded %.0f%%", wave.Number, wave.FailureRate*100, r.Policy.MaxFailureRate*100)
+}
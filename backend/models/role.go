@@ -12,5 +12,7 @@ type Role struct {
 	Description  string             `json:"description,omitempty" bson:"description,omitempty"`
 	Applications []string           `json:"applications,omitempty" bson:"applications,omitempty"`
 	DefaultTasks []string           `json:"default_tasks,omitempty" bson:"default_tasks,omitempty"`
-	CreatedAt    time.Time          `json:"created_at" bson:"created_at"`
+	// MaxConcurrent caps how many tasks each agent with the role holds at once; 0 means no limit.
+	MaxConcurrent int       `json:"max_concurrent,omitempty" bson:"max_concurrent,omitempty"`
+	CreatedAt     time.Time `json:"created_at" bson:"created_at"`
 }
@@ -0,0 +1,71 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Misfire policies decide what happens to occurrences the scheduler noticed late,
+// for example because no manager was running.
+const (
+	// MisfireRunOnce fires one run for all missed occurrences, then continues on schedule.
+	MisfireRunOnce = "run_once"
+	// MisfireSkip drops occurrences noticed later than the scheduler's grace period.
+	MisfireSkip = "skip"
+)
+
+// Schedule creates tasks from a template at the times given by a cron expression, or once at RunAt.
+type Schedule struct {
+	ID   primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Name string             `json:"name" bson:"name"`
+	Task TaskTemplate       `json:"task" bson:"task"`
+	// Cron is a standard five-field cron expression or a descriptor such as "@daily".
+	// Exactly one of Cron and RunAt is set.
+	Cron     string         `json:"cron,omitempty" bson:"cron,omitempty"`
+	RunAt    time.Time      `json:"run_at,omitempty" bson:"run_at,omitempty"`
+	Timezone string         `json:"timezone" bson:"timezone"` // IANA name the cron expression is read in
+	Target   ScheduleTarget `json:"target" bson:"target"`
+	Misfire  string         `json:"misfire_policy" bson:"misfire_policy"`
+	Enabled  bool           `json:"enabled" bson:"enabled"`
+	// NextRunAt is the next occurrence to fire; zero once a one-shot schedule has fired.
+	NextRunAt time.Time `json:"next_run_at,omitempty" bson:"next_run_at,omitempty"`
+	LastRunAt time.Time `json:"last_run_at,omitempty" bson:"last_run_at,omitempty"`
+	CreatedBy string    `json:"created_by,omitempty" bson:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" bson:"updated_at"`
+}
+
+// TaskTemplate holds the fields copied into every task a schedule creates.
+type TaskTemplate struct {
+	Type       string                 `json:"type" bson:"type"`
+	Parameters map[string]interface{} `json:"parameters" bson:"parameters"`
+	Timeout    int                    `json:"timeout,omitempty" bson:"timeout,omitempty"`
+	Retry      *RetryPolicy           `json:"retry,omitempty" bson:"retry,omitempty"`
+	Priority   int                    `json:"priority,omitempty" bson:"priority,omitempty"`
+}
+
+// ScheduleTarget selects the agents a schedule creates tasks for. Exactly one of AgentID, Role
+// and Labels is set; Role and Labels are resolved each time the schedule fires.
+type ScheduleTarget struct {
+	AgentID string            `json:"agent_id,omitempty" bson:"agent_id,omitempty"`
+	Role    string            `json:"role,omitempty" bson:"role,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty" bson:"labels,omitempty"`
+}
+
+// ScheduleRequest is the body of the schedule create and replace endpoints.
+type ScheduleRequest struct {
+	Name     string         `json:"name"`
+	Task     TaskTemplate   `json:"task"`
+	Cron     string         `json:"cron"`
+	RunAt    time.Time      `json:"run_at"`
+	Timezone string         `json:"timezone"` // defaults to UTC
+	Target   ScheduleTarget `json:"target"`
+	Misfire  string         `json:"misfire_policy"` // defaults to MisfireRunOnce
+	Enabled  *bool          `json:"enabled"`        // defaults to true
+}
+
+// ScheduleListResponse lists the schedules.
+type ScheduleListResponse struct {
+	Schedules []Schedule `json:"schedules"`
+}
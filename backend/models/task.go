@@ -1,6 +1,7 @@
 package models
 
 import (
+	"encoding/json"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -9,14 +10,62 @@ import (
 type Task struct {
     ID        primitive.ObjectID     `json:"id" bson:"_id,omitempty"`
     AgentID   string                `json:"agent_id" bson:"agent_id" validate:"required"`
-    Type      string                `json:"type" bson:"type" validate:"required,oneof=command_shell file_operation ui_automation browser_automation"`
+    Type      string                `json:"type" bson:"type" validate:"required"`
     Parameters map[string]interface{} `json:"parameters" bson:"parameters" validate:"required"`
-    Status    string                `json:"status" bson:"status" validate:"required,oneof=queued running completed failed cancelled timeout"`
+    Status    string                `json:"status" bson:"status" validate:"required,oneof=queued dispatched running cancel_requested completed failed cancelled timeout"`
     Output    *Output               `json:"output,omitempty" bson:"output,omitempty"`
     CreatedAt time.Time             `json:"created_at" bson:"created_at"`
     UpdatedAt time.Time             `json:"updated_at" bson:"updated_at"`
     Timeout   int                   `json:"timeout" bson:"timeout"`
     StartedAt time.Time             `json:"started_at,omitempty" bson:"started_at,omitempty"`
+    // LeaseExpiresAt is when the agent holding the task loses it unless it renews the lease;
+    // zero for tasks claimed without a lease.
+    LeaseExpiresAt time.Time        `json:"lease_expires_at,omitempty" bson:"lease_expires_at,omitempty"`
+    CreatedBy string                `json:"created_by,omitempty" bson:"created_by,omitempty"` // admin username or agent UUID
+    RerunOf   string                `json:"rerun_of,omitempty" bson:"rerun_of,omitempty"`     // ID of the task this one re-runs
+    // SearchText is a lower-cased flattening of Parameters used for free-text search.
+    SearchText string               `json:"-" bson:"search_text,omitempty"`
+    // Events is the status history of the task, oldest first.
+    Events    []TaskEvent           `json:"events,omitempty" bson:"events,omitempty"`
+    Retry     *RetryPolicy          `json:"retry,omitempty" bson:"retry,omitempty"`
+    // Attempt is the number of the current or last attempt; it grows each time an agent claims the task.
+    Attempt   int                   `json:"attempt" bson:"attempt"`
+    Attempts  []TaskAttempt         `json:"attempts,omitempty" bson:"attempts,omitempty"`
+    // NextRetryAt holds a retried task back from agents until then.
+    NextRetryAt time.Time           `json:"next_retry_at,omitempty" bson:"next_retry_at,omitempty"`
+    // ScheduleID and ScheduledFor identify the schedule occurrence that created the task.
+    ScheduleID   string             `json:"schedule_id,omitempty" bson:"schedule_id,omitempty"`
+    ScheduledFor time.Time          `json:"scheduled_for,omitempty" bson:"scheduled_for,omitempty"`
+    // JobID is the fan-out job the task belongs to.
+    JobID        string             `json:"job_id,omitempty" bson:"job_id,omitempty"`
+    // Wave is the rollout wave of the job the task was dispatched in, zero outside rollouts.
+    Wave         int                `json:"wave,omitempty" bson:"wave,omitempty"`
+    // WorkflowRunID and WorkflowNode identify the workflow run and node that created the task.
+    WorkflowRunID string            `json:"workflow_run_id,omitempty" bson:"workflow_run_id,omitempty"`
+    WorkflowNode  string            `json:"workflow_node,omitempty" bson:"workflow_node,omitempty"`
+    // TemplateName and TemplateVersion identify the task template the task was created from.
+    TemplateName    string          `json:"template_name,omitempty" bson:"template_name,omitempty"`
+    TemplateVersion int             `json:"template_version,omitempty" bson:"template_version,omitempty"`
+    // Priority orders the queued tasks of an agent, higher first, from MinTaskPriority to MaxTaskPriority.
+    Priority  int                   `json:"priority" bson:"priority"`
+    // Queue is the fair-share queue the task is dispatched from; see Task.DispatchQueue.
+    Queue     string                `json:"queue,omitempty" bson:"queue,omitempty"`
+    // ArtifactBytes is the combined size reserved for the artifacts of the task, which the
+    // per-task artifact quota caps.
+    ArtifactBytes int64             `json:"-" bson:"artifact_bytes,omitempty"`
+}
+
+// FinishedTaskStatuses are the statuses a task no longer leaves on its own.
+var FinishedTaskStatuses = []string{TaskStatusCompleted, TaskStatusFailed, TaskStatusCancelled, TaskStatusTimeout}
+
+// IsFinished reports whether the task has reached a final status.
+func (t *Task) IsFinished() bool {
+    for _, status := range FinishedTaskStatuses {
+        if t.Status == status {
+            return true
+        }
+    }
+    return false
 }
 
 type TaskCreationResponse struct {
@@ -31,13 +80,130 @@ type TaskCancelResponse struct {
 	Timestamp time.Time `json:"timestamp"`
 }
 
+// TaskLeaseResponse tells an agent until when it holds a task after renewing its lease.
+type TaskLeaseResponse struct {
+	TaskID         string    `json:"task_id"`
+	LeaseExpiresAt time.Time `json:"lease_expires_at"`
+}
+
+// TaskCancelAckRequest is sent by an agent once it stopped a cancelled task, with any output
+// the task produced until then.
+type TaskCancelAckRequest struct {
+	Output *Output `json:"output"`
+}
+
 type AgentRegistrationResponse struct {
-	APIKey    string    `json:"api_key"`
+	KeyID     string    `json:"key_id"`
+	APIKey    string    `json:"api_key"` // Deprecated: same value as KeyID
+	APISecret string    `json:"api_secret"`
 	Status    string    `json:"status"`
 	Timestamp time.Time `json:"timestamp"`
 }
 
 type Output struct {
-	Logs  string `json:"logs,omitempty" bson:"logs,omitempty"`
-	Error string `json:"error,omitempty" bson:"error,omitempty"`
+	Logs        string   `json:"logs,omitempty" bson:"logs,omitempty"`
+	Error       string   `json:"error,omitempty" bson:"error,omitempty"`
+	Screenshots []string `json:"screenshots,omitempty" bson:"screenshots,omitempty"`
+	// Results holds typed values the task reported, such as "open_ports", by name. They can be
+	// queried and aggregated across tasks.
+	Results map[string]TaskOutput `json:"results,omitempty" bson:"results,omitempty"`
+}
+
+// AgentTask is the view of a task handed to an agent when it polls for work.
+type AgentTask struct {
+	TaskID     string                 `json:"task_id"`
+	Type       string                 `json:"type"`
+	Parameters map[string]interface{} `json:"parameters"`
+	Timeout    int                    `json:"timeout,omitempty"`
+	// LeaseExpiresAt is when the task is taken back from the agent unless it renews the lease.
+	LeaseExpiresAt *time.Time `json:"lease_expires_at,omitempty"`
+}
+
+type TaskPollResponse struct {
+	Task *AgentTask `json:"task"`
+	// CancelTasks lists the IDs of tasks the agent holds that were cancelled; the agent should
+	// stop them and acknowledge with /task/cancel/{task_id}/ack.
+	CancelTasks []string `json:"cancel_tasks,omitempty"`
+}
+
+type TaskUpdateRequest struct {
+	TaskID string  `json:"task_id" validate:"required"`
+	Status string  `json:"status" validate:"required,oneof=running success failure"`
+	Output *Output `json:"output"` // required for success and failure
+}
+
+type TaskUpdateResponse struct {
+	Status string `json:"status"`
+}
+
+// TaskListResponse is one page of the admin task listing.
+type TaskListResponse struct {
+	Tasks      []Task `json:"tasks"`
+	Total      int64  `json:"total"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// TaskBulkCancelRequest selects the tasks cancelled by POST /admin/tasks/cancel.
+// All must be set to cancel every active task when no filter is given.
+type TaskBulkCancelRequest struct {
+	AgentID       string    `json:"agent_id"`
+	JobID         string    `json:"job_id"`
+	Type          string    `json:"type"`
+	Status        string    `json:"status"`
+	CreatedBy     string    `json:"created_by"`
+	CreatedAfter  time.Time `json:"created_after"`
+	CreatedBefore time.Time `json:"created_before"`
+	UpdatedAfter  time.Time `json:"updated_after"`
+	UpdatedBefore time.Time `json:"updated_before"`
+	Query         string    `json:"q"`
+	All           bool      `json:"all"`
+}
+
+type TaskBulkCancelResponse struct {
+	Cancelled int64     `json:"cancelled"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// TaskPriorityRequest sets the priority of the queued tasks matching the filter, through
+// POST /admin/tasks/priority. All must be set to change every queued task.
+type TaskPriorityRequest struct {
+	TaskBulkCancelRequest
+	Priority *int `json:"priority"`
+}
+
+// TaskPriorityResponse reports how many tasks POST /admin/tasks/priority changed.
+type TaskPriorityResponse struct {
+	Updated   int64     `json:"updated"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// ToAgentTask converts a Task to the AgentTask view returned by /task/poll.
+func (t *Task) ToAgentTask() *AgentTask {
+	task := &AgentTask{
+		TaskID:     t.ID.Hex(),
+		Type:       t.Type,
+		Parameters: t.Parameters,
+		Timeout:    t.Timeout,
+	}
+	if !t.LeaseExpiresAt.IsZero() {
+		lease := t.LeaseExpiresAt
+		task.LeaseExpiresAt = &lease
+	}
+	return task
+}
+
+// TaskTypeInfo describes a registered task type and the JSON Schema of its parameters.
+type TaskTypeInfo struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Schema      json.RawMessage `json:"schema"`
+	// ResultSchema describes the results of tasks of the type, if the type declares it.
+	ResultSchema json.RawMessage `json:"result_schema,omitempty"`
+	// MaxConcurrent caps how many tasks of the type one agent holds at once; 0 means no limit.
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+}
+
+// TaskTypeListResponse lists the task types tasks can be created with.
+type TaskTypeListResponse struct {
+	TaskTypes []TaskTypeInfo `json:"task_types"`
 }
@@ -1,11 +1,102 @@
 package models
 
+import (
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+// Value types of TaskParameter and TaskOutput.
+const (
+	ValueTypeString  = "string"
+	ValueTypeNumber  = "number"
+	ValueTypeBoolean = "boolean"
+)
+
+// MaxTaskResults caps the number of results one task reports.
+const MaxTaskResults = 100
+
+// resultNamePattern matches the names results may have. Names become field paths in queries,
+// so dots and dollar signs are ruled out.
+var resultNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,63}$`)
+
 type TaskParameter struct {
 	Type  string      `json:"type"`  // "string", "number", "boolean"
 	Value interface{} `json:"value"` // Actual value, type depends on "Type"
 }
 
 type TaskOutput struct {
-	Type  string      `json:"type"`  // "string", "number", "boolean"
-	Value interface{} `json:"value"` // Actual value, type depends on "Type"
+	Type  string      `json:"type" bson:"type"`   // "string", "number", "boolean"
+	Value interface{} `json:"value" bson:"value"` // Actual value, type depends on "Type"
+}
+
+// Validate checks that the value of o is of its declared type.
+func (o TaskOutput) Validate() error {
+	var ok bool
+	switch o.Type {
+	case ValueTypeString:
+		_, ok = o.Value.(string)
+	case ValueTypeNumber:
+		_, ok = NumberValue(o.Value)
+	case ValueTypeBoolean:
+		_, ok = o.Value.(bool)
+	default:
+		return fmt.Errorf("unknown value type %q", o.Type)
+	}
+	if !ok {
+		return fmt.Errorf("value is not a %s", o.Type)
+	}
+	return nil
+}
+
+// NumberValue returns value as a float64 if it is a number, as decoded from JSON or BSON.
+func NumberValue(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// ValidResultName reports whether a task result may be named name.
+func ValidResultName(name string) bool {
+	return resultNamePattern.MatchString(name)
+}
+
+// ValidateResults checks the names and values of the results of a task.
+func ValidateResults(results map[string]TaskOutput) error {
+	if len(results) > MaxTaskResults {
+		return fmt.Errorf("a task reports at most %d results", MaxTaskResults)
+	}
+	names := make([]string, 0, len(results))
+	for name := range results {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !ValidResultName(name) {
+			return fmt.Errorf("invalid result name %q", name)
+		}
+		if err := results[name].Validate(); err != nil {
+			return fmt.Errorf("result %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// ResultValues returns the plain values of results, as result schemas see them.
+func ResultValues(results map[string]TaskOutput) map[string]interface{} {
+	values := make(map[string]interface{}, len(results))
+	for name, result := range results {
+		values[name] = result.Value
+	}
+	return values
 }
@@ -0,0 +1,49 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Streams a task log chunk can belong to.
+const (
+	LogStreamStdout = "stdout"
+	LogStreamStderr = "stderr"
+)
+
+// TaskLogChunk is one piece of the output an agent streams while a task runs. Each attempt of
+// a task has its own log, ordered by Sequence, which the agent numbers from 0.
+type TaskLogChunk struct {
+	ID        primitive.ObjectID `json:"-" bson:"_id,omitempty"`
+	TaskID    primitive.ObjectID `json:"task_id" bson:"task_id"`
+	AgentID   string             `json:"agent_id" bson:"agent_id"`
+	Attempt   int                `json:"attempt" bson:"attempt"`
+	Sequence  int64              `json:"sequence" bson:"sequence"`
+	Stream    string             `json:"stream" bson:"stream"`
+	Data      string             `json:"data" bson:"data"`
+	CreatedAt time.Time          `json:"created_at" bson:"created_at"`
+}
+
+// TaskLogAppendRequest is the body of the agent log append endpoint.
+type TaskLogAppendRequest struct {
+	Sequence *int64 `json:"sequence"`
+	Stream   string `json:"stream"` // defaults to "stdout"
+	Data     string `json:"data"`
+}
+
+// TaskLogAppendResponse acknowledges a log chunk. Duplicate is set when a chunk with the same
+// sequence number was already stored; the new one is then dropped.
+type TaskLogAppendResponse struct {
+	TaskID    string `json:"task_id"`
+	Sequence  int64  `json:"sequence"`
+	Duplicate bool   `json:"duplicate,omitempty"`
+}
+
+// TaskLogResponse is one page of the log of a task attempt. NextSequence is where the next
+// page starts.
+type TaskLogResponse struct {
+	Attempt      int            `json:"attempt"`
+	Chunks       []TaskLogChunk `json:"chunks"`
+	NextSequence int64          `json:"next_sequence"`
+}
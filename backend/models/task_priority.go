@@ -0,0 +1,34 @@
+package models
+
+import "fmt"
+
+// Task priorities range from MinTaskPriority to MaxTaskPriority. Tasks are created with
+// DefaultTaskPriority unless they ask for another.
+const (
+	MinTaskPriority     = -100
+	MaxTaskPriority     = 100
+	DefaultTaskPriority = 0
+)
+
+// Prefixes of the fair-share queues tasks are dispatched from.
+const (
+	QueueJobPrefix       = "job:"
+	QueueSubmitterPrefix = "submitter:"
+)
+
+// ValidatePriority returns an error if priority is out of range.
+func ValidatePriority(priority int) error {
+	if priority < MinTaskPriority || priority > MaxTaskPriority {
+		return fmt.Errorf("priority must be between %d and %d", MinTaskPriority, MaxTaskPriority)
+	}
+	return nil
+}
+
+// DispatchQueue returns the fair-share queue of the task: its job, so that every job gets its
+// own share of the agent, or else whoever created it.
+func (t *Task) DispatchQueue() string {
+	if t.JobID != "" {
+		return QueueJobPrefix + t.JobID
+	}
+	return QueueSubmitterPrefix + t.CreatedBy
+}
@@ -0,0 +1,58 @@
+package models
+
+import "time"
+
+// TaskResultCondition compares one result of a task with a value. Op is "eq", "ne", "gt",
+// "gte", "lt", "lte" or "exists"; for "exists", Value is a boolean.
+type TaskResultCondition struct {
+	Field string      `json:"field"`
+	Op    string      `json:"op"`
+	Value interface{} `json:"value"`
+}
+
+// TaskResultAggregate computes Op, one of "sum", "avg", "min" or "max", over the numeric
+// values of one result. It is reported as "<op>_<field>".
+type TaskResultAggregate struct {
+	Field string `json:"field"`
+	Op    string `json:"op"`
+}
+
+// TaskResultQueryRequest is the body of POST /admin/tasks/results. It selects tasks like a
+// bulk cancellation, narrowed down by conditions on their results, and either lists them or,
+// with group_by or aggregates, aggregates them. All is ignored.
+type TaskResultQueryRequest struct {
+	TaskBulkCancelRequest
+	Where []TaskResultCondition `json:"where"`
+	// GroupBy is "agent_id", "type", "status", "job_id" or "results.<field>"; empty puts every
+	// matching task in one group.
+	GroupBy    string                `json:"group_by"`
+	Aggregates []TaskResultAggregate `json:"aggregates"`
+	Limit      int                   `json:"limit"`
+}
+
+// TaskResultRow is one task listed by a result query.
+type TaskResultRow struct {
+	TaskID    string                `json:"task_id"`
+	AgentID   string                `json:"agent_id"`
+	Type      string                `json:"type"`
+	Status    string                `json:"status"`
+	JobID     string                `json:"job_id,omitempty"`
+	UpdatedAt time.Time             `json:"updated_at"`
+	Results   map[string]TaskOutput `json:"results"`
+}
+
+// TaskResultGroup is one group of an aggregating result query.
+type TaskResultGroup struct {
+	Key   interface{} `json:"key"`
+	Count int64       `json:"count"`
+	// Values holds each requested aggregate by "<op>_<field>"; aggregates over no numeric
+	// values are left out.
+	Values map[string]float64 `json:"values,omitempty"`
+}
+
+// TaskResultQueryResponse holds the tasks a result query listed, most recently updated first,
+// or the groups it aggregated them into, largest first.
+type TaskResultQueryResponse struct {
+	Tasks  []TaskResultRow   `json:"tasks,omitempty"`
+	Groups []TaskResultGroup `json:"groups,omitempty"`
+}
@@ -0,0 +1,121 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff strategies of a RetryPolicy.
+const (
+	BackoffFixed       = "fixed"
+	BackoffExponential = "exponential"
+)
+
+// MaxTaskAttempts caps RetryPolicy.MaxAttempts.
+const MaxTaskAttempts = 20
+
+// RetryPolicy describes how a task that fails or times out is tried again.
+type RetryPolicy struct {
+	// MaxAttempts counts the first attempt, so 3 allows two retries.
+	MaxAttempts int `json:"max_attempts" bson:"max_attempts" yaml:"max_attempts"`
+	// Backoff is BackoffFixed (default) or BackoffExponential.
+	Backoff      string `json:"backoff,omitempty" bson:"backoff,omitempty" yaml:"backoff,omitempty"`
+	DelaySeconds int    `json:"delay_seconds" bson:"delay_seconds" yaml:"delay_seconds"`
+	// MaxDelaySeconds caps exponential delays; zero means no cap.
+	MaxDelaySeconds int `json:"max_delay_seconds,omitempty" bson:"max_delay_seconds,omitempty" yaml:"max_delay_seconds,omitempty"`
+	// Jitter shortens each delay by a random fraction of up to this much, between 0 and 1.
+	Jitter float64 `json:"jitter,omitempty" bson:"jitter,omitempty" yaml:"jitter,omitempty"`
+	// RetryOn lists the statuses that are retried, failed and timeout by default.
+	RetryOn []string `json:"retry_on,omitempty" bson:"retry_on,omitempty" yaml:"retry_on,omitempty"`
+}
+
+// TaskAttempt records one execution of a task by an agent.
+type TaskAttempt struct {
+	Number     int       `json:"number" bson:"number"`
+	AgentID    string    `json:"agent_id" bson:"agent_id"`
+	Status     string    `json:"status" bson:"status"` // the status the attempt ended in
+	StartedAt  time.Time `json:"started_at" bson:"started_at"`
+	FinishedAt time.Time `json:"finished_at" bson:"finished_at"`
+	Output     *Output   `json:"output,omitempty" bson:"output,omitempty"`
+	// Reason tells why the manager ended the attempt, such as an expired lease.
+	Reason string `json:"reason,omitempty" bson:"reason,omitempty"`
+}
+
+// retryableStatuses are the statuses a RetryPolicy may retry.
+var retryableStatuses = []string{TaskStatusFailed, TaskStatusTimeout}
+
+// Validate checks the policy and fills in its defaults.
+func (p *RetryPolicy) Validate() error {
+	if p.MaxAttempts < 1 || p.MaxAttempts > MaxTaskAttempts {
+		return fmt.Errorf("retry max_attempts must be between 1 and %d", MaxTaskAttempts)
+	}
+	switch p.Backoff {
+	case "":
+		p.Backoff = BackoffFixed
+	case BackoffFixed, BackoffExponential:
+	default:
+		return fmt.Errorf("unknown retry backoff %q", p.Backoff)
+	}
+	if p.DelaySeconds < 0 || p.MaxDelaySeconds < 0 {
+		return errors.New("retry delays cannot be negative")
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return errors.New("retry jitter must be between 0 and 1")
+	}
+	if len(p.RetryOn) == 0 {
+		p.RetryOn = append([]string(nil), retryableStatuses...)
+	}
+	for _, status := range p.RetryOn {
+		if !containsStatus(retryableStatuses, status) {
+			return fmt.Errorf("status %q cannot be retried", status)
+		}
+	}
+	return nil
+}
+
+// Delay returns how long to wait before the attempt after attempt number attempt.
+func (p *RetryPolicy) Delay(attempt int) time.Duration {
+	delay := float64(p.DelaySeconds)
+	if p.Backoff == BackoffExponential && attempt > 1 {
+		delay *= math.Pow(2, float64(attempt-1))
+	}
+	if p.MaxDelaySeconds > 0 && delay > float64(p.MaxDelaySeconds) {
+		delay = float64(p.MaxDelaySeconds)
+	}
+	if p.Jitter > 0 {
+		delay *= 1 - p.Jitter*rand.Float64()
+	}
+	return time.Duration(delay * float64(time.Second))
+}
+
+// ScheduleRetry queues the task again if it just failed or timed out and its retry policy
+// allows another attempt. Tasks that were being cancelled are not retried.
+// It reports whether a retry was scheduled.
+func (t *Task) ScheduleRetry(now time.Time) bool {
+	p := t.Retry
+	if p == nil || t.Attempt >= p.MaxAttempts || !containsStatus(p.RetryOn, t.Status) {
+		return false
+	}
+	if n := len(t.Events); n > 0 && t.Events[n-1].From == TaskStatusCancelRequested {
+		return false
+	}
+	reason := fmt.Sprintf("retry %d of %d after %s", t.Attempt+1, p.MaxAttempts, t.Status)
+	if err := t.Transition(TaskStatusQueued, ActorSystem, reason, now); err != nil {
+		return false
+	}
+	t.NextRetryAt = now.Add(p.Delay(t.Attempt))
+	t.StartedAt = time.Time{}
+	return true
+}
+
+func containsStatus(statuses []string, status string) bool {
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,164 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Task statuses.
+const (
+	TaskStatusQueued          = "queued"
+	TaskStatusDispatched      = "dispatched"       // handed to the agent by /task/poll
+	TaskStatusRunning         = "running"          // the agent reported that it started
+	TaskStatusCancelRequested = "cancel_requested" // cancelled by an operator while the agent holds it
+	TaskStatusCompleted       = "completed"
+	TaskStatusFailed          = "failed"
+	TaskStatusTimeout         = "timeout"
+	TaskStatusCancelled       = "cancelled"
+)
+
+// Actors recorded in task events that are not an agent or an administrator.
+const (
+	ActorSystem    = "system"
+	ActorReaper    = "system:reaper"
+	ActorScheduler = "system:scheduler"
+)
+
+// AgentActor identifies an agent in task events.
+func AgentActor(uuid string) string { return "agent:" + uuid }
+
+// AdminActor identifies an administrator in task events.
+func AdminActor(username string) string { return "admin:" + username }
+
+// taskTransitions lists, for each status, the statuses a task may move to next.
+// Every status change goes through this table.
+var taskTransitions = map[string][]string{
+	"": {TaskStatusQueued},
+	TaskStatusQueued: {
+		TaskStatusDispatched,
+		TaskStatusCancelled,
+	},
+	TaskStatusDispatched: {
+		TaskStatusRunning,
+		TaskStatusCompleted,
+		TaskStatusFailed,
+		TaskStatusTimeout,
+		TaskStatusCancelRequested,
+		TaskStatusQueued, // requeued when the agent disconnects
+	},
+	TaskStatusRunning: {
+		TaskStatusCompleted,
+		TaskStatusFailed,
+		TaskStatusTimeout,
+		TaskStatusCancelRequested,
+		TaskStatusQueued,
+	},
+	TaskStatusCancelRequested: {
+		TaskStatusCancelled,
+		TaskStatusCompleted, // the agent finished before it saw the request
+		TaskStatusFailed,
+		TaskStatusTimeout,
+	},
+	// Failed and timed out tasks are queued again only by their retry policy
+	TaskStatusFailed:  {TaskStatusQueued},
+	TaskStatusTimeout: {TaskStatusQueued},
+}
+
+// HeldTaskStatuses are the statuses in which an agent holds the task. Leaving them ends an attempt.
+var HeldTaskStatuses = []string{TaskStatusDispatched, TaskStatusRunning, TaskStatusCancelRequested}
+
+// IsHeldStatus reports whether an agent holds tasks in status.
+func IsHeldStatus(status string) bool { return containsStatus(HeldTaskStatuses, status) }
+
+// ErrIllegalTransition is matched by every *TransitionError.
+var ErrIllegalTransition = errors.New("illegal task status transition")
+
+// TransitionError reports a status change the state machine does not allow.
+type TransitionError struct {
+	From string
+	To   string
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("task cannot move from %q to %q", e.From, e.To)
+}
+
+func (e *TransitionError) Is(target error) bool { return target == ErrIllegalTransition }
+
+// TaskEvent records one status change of a task.
+type TaskEvent struct {
+	From      string    `json:"from" bson:"from"`
+	To        string    `json:"to" bson:"to"`
+	Actor     string    `json:"actor" bson:"actor"`
+	Reason    string    `json:"reason,omitempty" bson:"reason,omitempty"`
+	Timestamp time.Time `json:"timestamp" bson:"timestamp"`
+}
+
+// CanTransition reports whether a task may move from one status to another.
+func CanTransition(from, to string) bool {
+	for _, next := range taskTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// TaskStatusesFrom returns the statuses from which a task may move to status.
+func TaskStatusesFrom(status string) []string {
+	var from []string
+	for current, next := range taskTransitions {
+		if current == "" {
+			continue
+		}
+		for _, s := range next {
+			if s == status {
+				from = append(from, current)
+			}
+		}
+	}
+	return from
+}
+
+// CancelTarget returns the status a cancellation moves a task in status to: queued tasks are
+// cancelled outright, while tasks an agent holds must be stopped by the agent first.
+func CancelTarget(status string) (string, bool) {
+	switch status {
+	case TaskStatusQueued:
+		return TaskStatusCancelled, true
+	case TaskStatusDispatched, TaskStatusRunning:
+		return TaskStatusCancelRequested, true
+	}
+	return "", false
+}
+
+// Transition moves the task to status and records the change in its events. Leaving a held
+// status also records the attempt, with the task's current output.
+// It returns a *TransitionError if the state machine does not allow the change.
+func (t *Task) Transition(status, actor, reason string, now time.Time) error {
+	if !CanTransition(t.Status, status) {
+		return &TransitionError{From: t.Status, To: status}
+	}
+	if IsHeldStatus(t.Status) && !IsHeldStatus(status) {
+		t.Attempts = append(t.Attempts, TaskAttempt{
+			Number:     t.Attempt,
+			AgentID:    t.AgentID,
+			Status:     status,
+			StartedAt:  t.StartedAt,
+			FinishedAt: now,
+			Output:     t.Output,
+			Reason:     reason,
+		})
+	}
+	t.Events = append(t.Events, TaskEvent{
+		From:      t.Status,
+		To:        status,
+		Actor:     actor,
+		Reason:    reason,
+		Timestamp: now,
+	})
+	t.Status = status
+	t.UpdatedAt = now
+	return nil
+}
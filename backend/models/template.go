@@ -0,0 +1,305 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Types a template variable can be declared with.
+const (
+	VariableString  = "string"
+	VariableInteger = "integer"
+	VariableNumber  = "number"
+	VariableBoolean = "boolean"
+)
+
+// ActorRole is the actor recorded on the default tasks created for an agent joining a role.
+const ActorRole = "system:role"
+
+var (
+	templateNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,63}$`)
+	variableNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	// placeholderPattern matches a variable reference such as "{{ port }}" in a parameter string.
+	placeholderPattern = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+)
+
+// Template is one version of a named task template. Saving a template under an existing name
+// adds a version; stored versions never change, so tasks can be traced to the exact definition
+// that created them.
+type Template struct {
+	ID          primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Name        string             `json:"name" bson:"name"`
+	Version     int                `json:"version" bson:"version"`
+	Description string             `json:"description,omitempty" bson:"description,omitempty"`
+	// Task holds the type, timeout and retry policy of the tasks created from the template, and
+	// parameter defaults that may reference variables as "{{ name }}".
+	Task      TaskTemplate       `json:"task" bson:"task"`
+	Variables []TemplateVariable `json:"variables,omitempty" bson:"variables,omitempty"`
+	CreatedBy string             `json:"created_by,omitempty" bson:"created_by,omitempty"`
+	CreatedAt time.Time          `json:"created_at" bson:"created_at"`
+}
+
+// TemplateVariable declares an input of a template. A variable without a default must be given
+// a value whenever the template is instantiated.
+type TemplateVariable struct {
+	Name        string      `json:"name" bson:"name" yaml:"name"`
+	Type        string      `json:"type" bson:"type" yaml:"type"`
+	Description string      `json:"description,omitempty" bson:"description,omitempty" yaml:"description,omitempty"`
+	Default     interface{} `json:"default,omitempty" bson:"default,omitempty" yaml:"default,omitempty"`
+}
+
+// TemplateRequest is the body of the template create endpoint and one entry of a YAML export.
+type TemplateRequest struct {
+	Name        string             `json:"name" yaml:"name"`
+	Description string             `json:"description" yaml:"description,omitempty"`
+	Task        TemplateTask       `json:"task" yaml:"task"`
+	Variables   []TemplateVariable `json:"variables" yaml:"variables,omitempty"`
+}
+
+// TemplateTask is TaskTemplate as it is written in YAML files.
+type TemplateTask struct {
+	Type       string                 `json:"type" yaml:"type"`
+	Parameters map[string]interface{} `json:"parameters" yaml:"parameters,omitempty"`
+	Timeout    int                    `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	Retry      *RetryPolicy           `json:"retry,omitempty" yaml:"retry,omitempty"`
+	Priority   int                    `json:"priority,omitempty" yaml:"priority,omitempty"`
+}
+
+// TemplateFile is the YAML document templates are exported to and imported from.
+type TemplateFile struct {
+	Templates []TemplateRequest `yaml:"templates"`
+}
+
+// TemplateListResponse lists templates.
+type TemplateListResponse struct {
+	Templates []Template `json:"templates"`
+}
+
+// TemplateInstantiateRequest is the body of the template instantiate endpoint.
+type TemplateInstantiateRequest struct {
+	AgentID   string                 `json:"agent_id"`
+	Version   int                    `json:"version"` // defaults to the latest version
+	Variables map[string]interface{} `json:"variables"`
+}
+
+// Request returns the fields of the template that are written to YAML files.
+func (t *Template) Request() TemplateRequest {
+	return TemplateRequest{
+		Name:        t.Name,
+		Description: t.Description,
+		Task: TemplateTask{
+			Type:       t.Task.Type,
+			Parameters: t.Task.Parameters,
+			Timeout:    t.Task.Timeout,
+			Retry:      t.Task.Retry,
+			Priority:   t.Task.Priority,
+		},
+		Variables: t.Variables,
+	}
+}
+
+// Template returns the template the request describes, without an ID or version.
+func (r *TemplateRequest) Template() Template {
+	return Template{
+		Name:        r.Name,
+		Description: r.Description,
+		Task: TaskTemplate{
+			Type:       r.Task.Type,
+			Parameters: r.Task.Parameters,
+			Timeout:    r.Task.Timeout,
+			Retry:      r.Task.Retry,
+			Priority:   r.Task.Priority,
+		},
+		Variables: r.Variables,
+	}
+}
+
+// Validate checks the name and variables of the template and that its parameters only
+// reference declared variables. Parameters are checked against the task type when the
+// template is instantiated, once the variables are filled in.
+func (t *Template) Validate() error {
+	if !templateNamePattern.MatchString(t.Name) {
+		return errors.New("template name must be 1 to 64 lower-case letters, digits, '.', '_' or '-'")
+	}
+	if t.Task.Type == "" {
+		return errors.New("template task type is required")
+	}
+	if t.Task.Timeout < 0 {
+		return errors.New("task timeout must not be negative")
+	}
+	if t.Task.Retry != nil {
+		if err := t.Task.Retry.Validate(); err != nil {
+			return err
+		}
+	}
+	if err := ValidatePriority(t.Task.Priority); err != nil {
+		return err
+	}
+
+	declared := make(map[string]bool, len(t.Variables))
+	for _, variable := range t.Variables {
+		if !variableNamePattern.MatchString(variable.Name) {
+			return fmt.Errorf("invalid variable name %q", variable.Name)
+		}
+		if declared[variable.Name] {
+			return fmt.Errorf("duplicate variable %q", variable.Name)
+		}
+		declared[variable.Name] = true
+		switch variable.Type {
+		case VariableString, VariableInteger, VariableNumber, VariableBoolean:
+		default:
+			return fmt.Errorf("variable %q has unknown type %q", variable.Name, variable.Type)
+		}
+		if variable.Default != nil {
+			if err := variable.check(variable.Default); err != nil {
+				return fmt.Errorf("default of %w", err)
+			}
+		}
+	}
+
+	var undeclared error
+	walkStrings(t.Task.Parameters, func(s string) {
+		for _, match := range placeholderPattern.FindAllStringSubmatch(s, -1) {
+			if !declared[match[1]] && undeclared == nil {
+				undeclared = fmt.Errorf("parameters reference undeclared variable %q", match[1])
+			}
+		}
+	})
+	return undeclared
+}
+
+// check returns an error if value does not have the type of the variable.
+func (v *TemplateVariable) check(value interface{}) error {
+	ok := false
+	switch v.Type {
+	case VariableString:
+		_, ok = value.(string)
+	case VariableBoolean:
+		_, ok = value.(bool)
+	case VariableInteger:
+		f, isNumber := toFloat(value)
+		ok = isNumber && f == math.Trunc(f)
+	case VariableNumber:
+		_, ok = toFloat(value)
+	}
+	if !ok {
+		return fmt.Errorf("variable %q must be a %s", v.Name, v.Type)
+	}
+	return nil
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch n := value.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	default:
+		return 0, false
+	}
+}
+
+// Render returns the task template with the variables filled in from values and, for variables
+// missing from values, their defaults. A parameter that is exactly one placeholder takes the
+// variable's value and type; placeholders inside longer strings are replaced by its text.
+func (t *Template) Render(values map[string]interface{}) (TaskTemplate, error) {
+	resolved := make(map[string]interface{}, len(t.Variables))
+	for _, variable := range t.Variables {
+		value, ok := values[variable.Name]
+		if !ok || value == nil {
+			value = variable.Default
+		}
+		if value == nil {
+			return TaskTemplate{}, fmt.Errorf("variable %q is required", variable.Name)
+		}
+		if err := variable.check(value); err != nil {
+			return TaskTemplate{}, err
+		}
+		resolved[variable.Name] = value
+	}
+	for name := range values {
+		if _, ok := resolved[name]; !ok {
+			return TaskTemplate{}, fmt.Errorf("unknown variable %q", name)
+		}
+	}
+
+	task := t.Task
+	task.Parameters, _ = substitute(t.Task.Parameters, resolved).(map[string]interface{})
+	if task.Retry != nil {
+		retry := *task.Retry
+		retry.RetryOn = append([]string(nil), task.Retry.RetryOn...)
+		task.Retry = &retry
+	}
+	return task, nil
+}
+
+// substitute returns a copy of value with the placeholders in its strings replaced. Documents
+// decoded from MongoDB become plain maps and slices.
+func substitute(value interface{}, vars map[string]interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		if match := placeholderPattern.FindStringSubmatch(v); match != nil && match[0] == v {
+			return vars[match[1]]
+		}
+		return placeholderPattern.ReplaceAllStringFunc(v, func(placeholder string) string {
+			name := placeholderPattern.FindStringSubmatch(placeholder)[1]
+			return fmt.Sprint(vars[name])
+		})
+	case map[string]interface{}:
+		if v == nil {
+			return v
+		}
+		copied := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			copied[key] = substitute(item, vars)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, item := range v {
+			copied[i] = substitute(item, vars)
+		}
+		return copied
+	case primitive.M:
+		return substitute(map[string]interface{}(v), vars)
+	case primitive.D:
+		return substitute(v.Map(), vars)
+	case primitive.A:
+		return substitute([]interface{}(v), vars)
+	default:
+		return value
+	}
+}
+
+// walkStrings calls fn with every string in value.
+func walkStrings(value interface{}, fn func(string)) {
+	switch v := value.(type) {
+	case string:
+		fn(v)
+	case map[string]interface{}:
+		for _, item := range v {
+			walkStrings(item, fn)
+		}
+	case []interface{}:
+		for _, item := range v {
+			walkStrings(item, fn)
+		}
+	case primitive.M:
+		walkStrings(map[string]interface{}(v), fn)
+	case primitive.D:
+		walkStrings(v.Map(), fn)
+	case primitive.A:
+		walkStrings([]interface{}(v), fn)
+	}
+}
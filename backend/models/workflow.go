@@ -0,0 +1,372 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MaxWorkflowNodes caps the number of nodes of a workflow.
+const MaxWorkflowNodes = 100
+
+// Workflow run statuses. A run completes once every node has completed or been skipped, and
+// fails once every node has finished and at least one did not complete.
+const (
+	WorkflowRunning   = "running"
+	WorkflowCompleted = "completed"
+	WorkflowFailed    = "failed"
+	WorkflowCancelled = "cancelled"
+)
+
+// Workflow node statuses besides those of tasks. A node that created a task takes the status
+// of its task.
+const (
+	// WorkflowNodePending nodes wait for their upstream nodes to finish.
+	WorkflowNodePending = "pending"
+	// WorkflowNodeSkipped nodes will not run because their conditions did not hold.
+	WorkflowNodeSkipped = "skipped"
+)
+
+// Condition operators comparing an output field with WorkflowCondition.Value.
+const (
+	ConditionEquals      = "equals"
+	ConditionNotEquals   = "not_equals"
+	ConditionContains    = "contains"
+	ConditionNotContains = "not_contains"
+	ConditionEmpty       = "empty"
+	ConditionNotEmpty    = "not_empty"
+)
+
+// ActorWorkflow is the actor recorded on the tasks and changes the workflow engine makes.
+const ActorWorkflow = "system:workflow"
+
+// Workflow is a reusable graph of task nodes. A run of the workflow creates the task of each
+// node on the run's agent once the node's upstream nodes have finished and its conditions hold.
+type Workflow struct {
+	ID          primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Name        string             `json:"name" bson:"name"`
+	Description string             `json:"description,omitempty" bson:"description,omitempty"`
+	Nodes       []WorkflowNode     `json:"nodes" bson:"nodes"`
+	CreatedBy   string             `json:"created_by,omitempty" bson:"created_by,omitempty"`
+	CreatedAt   time.Time          `json:"created_at" bson:"created_at"`
+	UpdatedAt   time.Time          `json:"updated_at" bson:"updated_at"`
+}
+
+// WorkflowNode is one task of a workflow.
+type WorkflowNode struct {
+	ID        string       `json:"id" bson:"id"`
+	Task      TaskTemplate `json:"task" bson:"task"`
+	DependsOn []string     `json:"depends_on,omitempty" bson:"depends_on,omitempty"`
+	// When lists conditions on upstream nodes that must all hold for the node to run. Without
+	// conditions a node runs only if every upstream node completed.
+	When []WorkflowCondition `json:"when,omitempty" bson:"when,omitempty"`
+}
+
+// WorkflowCondition tests the outcome of an upstream node.
+type WorkflowCondition struct {
+	Node string `json:"node" bson:"node"`
+	// Status lists the node statuses that satisfy the condition, completed by default.
+	Status []string `json:"status,omitempty" bson:"status,omitempty"`
+	// Field names an output field: "logs", "error", or "logs.<path>" for a value in logs
+	// holding a JSON object. Without a field only the status is tested.
+	Field string `json:"field,omitempty" bson:"field,omitempty"`
+	Op    string `json:"op,omitempty" bson:"op,omitempty"`
+	Value string `json:"value,omitempty" bson:"value,omitempty"`
+}
+
+// WorkflowRequest is the body of the workflow create and replace endpoints.
+type WorkflowRequest struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	Nodes       []WorkflowNode `json:"nodes"`
+}
+
+// WorkflowListResponse lists the workflows.
+type WorkflowListResponse struct {
+	Workflows []Workflow `json:"workflows"`
+}
+
+// WorkflowRun is one execution of a workflow on an agent.
+type WorkflowRun struct {
+	ID           primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	WorkflowID   string             `json:"workflow_id" bson:"workflow_id"`
+	WorkflowName string             `json:"workflow_name" bson:"workflow_name"`
+	AgentID      string             `json:"agent_id" bson:"agent_id"`
+	Status       string             `json:"status" bson:"status"`
+	// Definition is a copy of the workflow's nodes when the run was created, so later edits of
+	// the workflow do not change runs in progress.
+	Definition []WorkflowNode `json:"definition" bson:"definition"`
+	// Nodes holds the state of each node, in the order of Definition.
+	Nodes       []WorkflowNodeState `json:"nodes" bson:"nodes"`
+	CreatedBy   string              `json:"created_by,omitempty" bson:"created_by,omitempty"`
+	CreatedAt   time.Time           `json:"created_at" bson:"created_at"`
+	UpdatedAt   time.Time           `json:"updated_at" bson:"updated_at"`
+	FinishedAt  time.Time           `json:"finished_at,omitempty" bson:"finished_at,omitempty"`
+	CancelledBy string              `json:"cancelled_by,omitempty" bson:"cancelled_by,omitempty"`
+	// Revision counts the stored changes of the run; updates only apply to the revision they read.
+	Revision int `json:"-" bson:"revision"`
+}
+
+// WorkflowNodeState is the progress of one node of a run.
+type WorkflowNodeState struct {
+	ID     string `json:"id" bson:"id"`
+	Status string `json:"status" bson:"status"`
+	TaskID string `json:"task_id,omitempty" bson:"task_id,omitempty"`
+	// Reason explains why the node was skipped or cancelled.
+	Reason     string    `json:"reason,omitempty" bson:"reason,omitempty"`
+	StartedAt  time.Time `json:"started_at,omitempty" bson:"started_at,omitempty"`
+	FinishedAt time.Time `json:"finished_at,omitempty" bson:"finished_at,omitempty"`
+}
+
+// WorkflowRunRequest is the body of POST /admin/workflows/:workflow_id/runs. The workflow runs
+// once on every agent the target selects.
+type WorkflowRunRequest struct {
+	Target JobTarget `json:"target"`
+}
+
+// WorkflowRunResponse is a run with the graph of its node states.
+type WorkflowRunResponse struct {
+	WorkflowRun
+	Graph WorkflowGraph `json:"graph"`
+}
+
+// WorkflowRunListResponse lists workflow runs, newest first.
+type WorkflowRunListResponse struct {
+	Runs []WorkflowRun `json:"runs"`
+}
+
+// WorkflowGraph is the node-and-edge view of a run used to draw it.
+type WorkflowGraph struct {
+	Nodes []WorkflowGraphNode `json:"nodes"`
+	Edges []WorkflowGraphEdge `json:"edges"`
+}
+
+// WorkflowGraphNode is a node of a WorkflowGraph.
+type WorkflowGraphNode struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"` // task type
+	Status string `json:"status"`
+	TaskID string `json:"task_id,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// Level is the length of the longest path from a node without dependencies, for layered layouts.
+	Level int `json:"level"`
+}
+
+// WorkflowGraphEdge runs from an upstream node to the node depending on it.
+type WorkflowGraphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Conditional is set when the downstream node has conditions on the upstream node.
+	Conditional bool `json:"conditional,omitempty"`
+}
+
+// WorkflowNodeFinished reports whether a node in status will not change any more.
+func WorkflowNodeFinished(status string) bool {
+	return status == WorkflowNodeSkipped || (&Task{Status: status}).IsFinished()
+}
+
+// Validate checks the nodes of the workflow: IDs are unique, dependencies exist and form no
+// cycle, and conditions only refer to upstream nodes. Task templates are checked by the caller.
+func (w *Workflow) Validate() error {
+	if w.Name == "" {
+		return errors.New("workflow name is required")
+	}
+	if len(w.Nodes) == 0 {
+		return errors.New("workflow needs at least one node")
+	}
+	if len(w.Nodes) > MaxWorkflowNodes {
+		return fmt.Errorf("workflow cannot have more than %d nodes", MaxWorkflowNodes)
+	}
+
+	ids := make(map[string]bool, len(w.Nodes))
+	for _, node := range w.Nodes {
+		if node.ID == "" {
+			return errors.New("every workflow node needs an id")
+		}
+		if ids[node.ID] {
+			return fmt.Errorf("duplicate node id %q", node.ID)
+		}
+		ids[node.ID] = true
+	}
+	for i := range w.Nodes {
+		node := &w.Nodes[i]
+		upstream := make(map[string]bool, len(node.DependsOn))
+		for _, dep := range node.DependsOn {
+			if !ids[dep] {
+				return fmt.Errorf("node %q depends on unknown node %q", node.ID, dep)
+			}
+			if dep == node.ID || upstream[dep] {
+				return fmt.Errorf("node %q lists dependency %q twice or on itself", node.ID, dep)
+			}
+			upstream[dep] = true
+		}
+		for j := range node.When {
+			if err := node.When[j].validate(upstream); err != nil {
+				return fmt.Errorf("node %q: %w", node.ID, err)
+			}
+		}
+	}
+	if WorkflowLevels(w.Nodes) == nil {
+		return errors.New("workflow dependencies form a cycle")
+	}
+	return nil
+}
+
+// validate checks the condition and fills in its default status.
+func (c *WorkflowCondition) validate(upstream map[string]bool) error {
+	if !upstream[c.Node] {
+		return fmt.Errorf("condition on %q, which is not an upstream node", c.Node)
+	}
+	if len(c.Status) == 0 {
+		c.Status = []string{TaskStatusCompleted}
+	}
+	for _, status := range c.Status {
+		if !WorkflowNodeFinished(status) {
+			return fmt.Errorf("condition status %q is not a final node status", status)
+		}
+	}
+	if c.Field == "" {
+		if c.Op != "" {
+			return errors.New("condition op needs a field")
+		}
+		return nil
+	}
+	if c.Field != "logs" && c.Field != "error" && !strings.HasPrefix(c.Field, "logs.") {
+		return fmt.Errorf("unknown condition field %q", c.Field)
+	}
+	switch c.Op {
+	case ConditionEquals, ConditionNotEquals, ConditionContains, ConditionNotContains, ConditionEmpty, ConditionNotEmpty:
+		return nil
+	default:
+		return fmt.Errorf("unknown condition op %q", c.Op)
+	}
+}
+
+// WorkflowLevels returns the level of each node, the length of the longest path to it from a
+// node without dependencies. It returns nil if the dependencies form a cycle.
+func WorkflowLevels(nodes []WorkflowNode) map[string]int {
+	levels := make(map[string]int, len(nodes))
+	for len(levels) < len(nodes) {
+		progressed := false
+		for _, node := range nodes {
+			if _, done := levels[node.ID]; done {
+				continue
+			}
+			level, ready := 0, true
+			for _, dep := range node.DependsOn {
+				depLevel, ok := levels[dep]
+				if !ok {
+					ready = false
+					break
+				}
+				if depLevel+1 > level {
+					level = depLevel + 1
+				}
+			}
+			if ready {
+				levels[node.ID] = level
+				progressed = true
+			}
+		}
+		if !progressed {
+			return nil
+		}
+	}
+	return levels
+}
+
+// Matches reports whether an upstream node that finished in status with output satisfies the
+// condition.
+func (c *WorkflowCondition) Matches(status string, output *Output) bool {
+	if !containsStatus(c.Status, status) {
+		return false
+	}
+	if c.Field == "" {
+		return true
+	}
+
+	value := outputField(output, c.Field)
+	switch c.Op {
+	case ConditionEquals:
+		return value == c.Value
+	case ConditionNotEquals:
+		return value != c.Value
+	case ConditionContains:
+		return strings.Contains(value, c.Value)
+	case ConditionNotContains:
+		return !strings.Contains(value, c.Value)
+	case ConditionEmpty:
+		return value == ""
+	case ConditionNotEmpty:
+		return value != ""
+	}
+	return false
+}
+
+// outputField returns the named field of output as a string, empty if it is missing. Values
+// inside JSON logs that are not strings are returned as JSON.
+func outputField(output *Output, field string) string {
+	if output == nil {
+		return ""
+	}
+	switch field {
+	case "logs":
+		return output.Logs
+	case "error":
+		return output.Error
+	}
+
+	var value interface{}
+	if err := json.Unmarshal([]byte(output.Logs), &value); err != nil {
+		return ""
+	}
+	for _, key := range strings.Split(strings.TrimPrefix(field, "logs."), ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		if value, ok = object[key]; !ok {
+			return ""
+		}
+	}
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		encoded, _ := json.Marshal(v)
+		return string(encoded)
+	}
+}
+
+// Graph returns the node-and-edge view of the run.
+func (r *WorkflowRun) Graph() WorkflowGraph {
+	levels := WorkflowLevels(r.Definition)
+	graph := WorkflowGraph{Nodes: []WorkflowGraphNode{}, Edges: []WorkflowGraphEdge{}}
+	for i, node := range r.Definition {
+		state := r.Nodes[i]
+		graph.Nodes = append(graph.Nodes, WorkflowGraphNode{
+			ID:     node.ID,
+			Type:   node.Task.Type,
+			Status: state.Status,
+			TaskID: state.TaskID,
+			Reason: state.Reason,
+			Level:  levels[node.ID],
+		})
+		for _, dep := range node.DependsOn {
+			edge := WorkflowGraphEdge{From: dep, To: node.ID}
+			for _, cond := range node.When {
+				if cond.Node == dep {
+					edge.Conditional = true
+				}
+			}
+			graph.Edges = append(graph.Edges, edge)
+		}
+	}
+	return graph
+}
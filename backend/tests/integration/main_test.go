@@ -22,6 +22,9 @@ import (
 	"github.com/whit3rabbit/beehive/manager/api/handlers"
 	"github.com/whit3rabbit/beehive/manager/internal/config"
 	"github.com/whit3rabbit/beehive/manager/internal/mongodb"
+	"github.com/whit3rabbit/beehive/manager/internal/secrets"
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
+	"github.com/whit3rabbit/beehive/manager/internal/tasktypes"
 	customMiddleware "github.com/whit3rabbit/beehive/manager/middleware"
 	"github.com/whit3rabbit/beehive/manager/models"
 	"golang.org/x/crypto/bcrypt"
@@ -151,6 +154,40 @@ func TestAgentCRUD(t *testing.T) {
 	assert.Equal(t, mongo.ErrNoDocuments, err, "Should return no documents error")
 }
 
+func TestAgentUpsertDropsLegacyKey(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	db := mongoClient.Database(testConfig.MongoDB.Database)
+	collection := db.Collection("agents")
+	defer collection.DeleteOne(context.Background(), bson.M{"uuid": "legacy-uuid"})
+
+	// A legacy agent stores the hash of its raw API key
+	_, err := collection.InsertOne(ctx, models.Agent{
+		UUID:      "legacy-uuid",
+		Hostname:  "legacy-host",
+		APIKey:    "legacy-api-key-hash",
+		APISecret: "legacy-api-secret",
+		Status:    "active",
+		CreatedAt: time.Now(),
+	})
+	require.NoError(t, err)
+
+	// Re-issuing credentials clears APIKey before saving the agent
+	store := storage.NewMongoStore(db)
+	agent, err := store.Agents.GetByUUID(ctx, "legacy-uuid")
+	require.NoError(t, err)
+	agent.KeyID = "new-key-id"
+	agent.APIKey = ""
+	agent.APISecret = "new-api-secret"
+	require.NoError(t, store.Agents.Upsert(ctx, agent))
+
+	var raw bson.M
+	require.NoError(t, collection.FindOne(ctx, bson.M{"uuid": "legacy-uuid"}).Decode(&raw))
+	assert.NotContains(t, raw, "api_key", "Should remove the legacy API key")
+	assert.Equal(t, "new-key-id", raw["key_id"])
+}
+
 func TestRoleCRUD(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -315,18 +352,24 @@ func setupEcho() *echo.Echo {
 	return e
 }
 
+func setupHandler() *handlers.Handler {
+	box, _ := secrets.NewBox("integration-test-credential-key")
+	return handlers.NewHandler(storage.NewMongoStore(mongoClient.Database(testConfig.MongoDB.Database)), box, tasktypes.Builtin(), storage.DispatchPolicy{}, handlers.ArtifactLimits{}, handlers.PollLimits{})
+}
+
 func TestAPICreateTask(t *testing.T) {
 	e := setupEcho()
-	
+	h := setupHandler()
+
 	// Setup route
-	e.POST("/task/create", handlers.CreateTask)
+	e.POST("/task/create", h.CreateTask)
 
 	// Create test task
 	task := models.Task{
 		AgentID: "test-agent",
-		Type:    "scan",
+		Type:    "command_shell",
 		Parameters: map[string]interface{}{
-			"target": "localhost",
+			"command": "hostname",
 		},
 	}
 
@@ -342,10 +385,9 @@ func TestAPICreateTask(t *testing.T) {
 	rec := httptest.NewRecorder()
 
 	c := e.NewContext(req, rec)
-	c.Set("mongodb_database", testConfig.MongoDB.Database)
 
 	// Test handler
-	err = handlers.CreateTask(c)
+	err = h.CreateTask(c)
 	assert.NoError(t, err)
 	assert.Equal(t, http.StatusOK, rec.Code)
 
@@ -409,7 +451,8 @@ func TestTaskOutputValidation(t *testing.T) {
 
 func TestAPIListRoles(t *testing.T) {
 	e := setupEcho()
-	e.GET("/roles", handlers.ListRoles)
+	h := setupHandler()
+	e.GET("/roles", h.ListRoles)
 
 	// Create test role first
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -431,9 +474,8 @@ func TestAPIListRoles(t *testing.T) {
 	req := httptest.NewRequest(http.MethodGet, "/roles", nil)
 	rec := httptest.NewRecorder()
 	c := e.NewContext(req, rec)
-	c.Set("mongodb_database", testConfig.MongoDB.Database)
 
-	err = handlers.ListRoles(c)
+	err = h.ListRoles(c)
 	assert.NoError(t, err)
 	assert.Equal(t, http.StatusOK, rec.Code)
 
@@ -450,7 +492,8 @@ func TestAPIListRoles(t *testing.T) {
 
 func TestAPIAgentHeartbeat(t *testing.T) {
 	e := setupEcho()
-	e.POST("/agent/heartbeat", handlers.AgentHeartbeat)
+	h := setupHandler()
+	e.POST("/agent/heartbeat", h.AgentHeartbeat)
 
 	heartbeat := models.HeartbeatRequest{
 		UUID:      "test-agent",
@@ -465,9 +508,8 @@ func TestAPIAgentHeartbeat(t *testing.T) {
 	rec := httptest.NewRecorder()
 
 	c := e.NewContext(req, rec)
-	c.Set("mongodb_database", testConfig.MongoDB.Database)
 
-	err = handlers.AgentHeartbeat(c)
+	err = h.AgentHeartbeat(c)
 	assert.NoError(t, err)
 	assert.Equal(t, http.StatusOK, rec.Code)
 
@@ -0,0 +1,176 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/whit3rabbit/beehive/manager/api/handlers"
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+func seedAgents(t *testing.T, store *storage.Store) time.Time {
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Second)
+	for i := 0; i < 7; i++ {
+		agent := &models.Agent{
+			UUID:      fmt.Sprintf("agent-%d", i),
+			Hostname:  fmt.Sprintf("web-%02d", i),
+			Nickname:  fmt.Sprintf("Node %d", i),
+			Role:      "worker",
+			Status:    "active",
+			KeyID:     fmt.Sprintf("bh_key_%d", i),
+			APISecret: "encrypted-secret",
+			Labels:    map[string]string{"env": "prod"},
+			LastSeen:  now.Add(-time.Duration(i) * time.Minute),
+			CreatedAt: now,
+		}
+		if i%2 == 1 {
+			agent.Hostname = fmt.Sprintf("db-%02d", i)
+			agent.Labels = map[string]string{"env": "staging"}
+		}
+		require.NoError(t, store.Agents.Create(ctx, agent))
+	}
+	return now
+}
+
+func listAgents(t *testing.T, h *handlers.Handler, query string) (int, models.AgentListResponse) {
+	c, rec := newJSONContext(setupEcho(), http.MethodGet, "/admin/agents?"+query, nil)
+	require.NoError(t, h.ListAgents(c))
+
+	var resp models.AgentListResponse
+	if rec.Code == http.StatusOK {
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	}
+	return rec.Code, resp
+}
+
+func TestListAgentsPagination(t *testing.T) {
+	store := storage.NewMemoryStore()
+	seedAgents(t, store)
+	h := setupHandler(store)
+
+	// Walk every page, newest heartbeat first
+	var seen []string
+	cursor := ""
+	for pages := 0; pages < 10; pages++ {
+		code, resp := listAgents(t, h, "sort=last_seen&order=desc&limit=3&cursor="+cursor)
+		require.Equal(t, http.StatusOK, code)
+		assert.Equal(t, int64(7), resp.Total)
+		for _, agent := range resp.Agents {
+			seen = append(seen, agent.UUID)
+		}
+		if resp.NextCursor == "" {
+			break
+		}
+		cursor = resp.NextCursor
+	}
+	assert.Equal(t, []string{"agent-0", "agent-1", "agent-2", "agent-3", "agent-4", "agent-5", "agent-6"}, seen)
+
+	// A cursor only continues the sort order it was issued for
+	_, first := listAgents(t, h, "sort=last_seen&order=desc&limit=3")
+	code, _ := listAgents(t, h, "sort=hostname&limit=3&cursor="+first.NextCursor)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = listAgents(t, h, "cursor=not-a-cursor")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = listAgents(t, h, "sort=api_secret")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestListAgentsFilters(t *testing.T) {
+	store := storage.NewMemoryStore()
+	now := seedAgents(t, store)
+	h := setupHandler(store)
+
+	uuids := func(resp models.AgentListResponse) []string {
+		var out []string
+		for _, agent := range resp.Agents {
+			out = append(out, agent.UUID)
+		}
+		return out
+	}
+
+	_, resp := listAgents(t, h, "hostname_prefix=db-")
+	assert.Equal(t, []string{"agent-1", "agent-3", "agent-5"}, uuids(resp))
+	assert.Equal(t, int64(3), resp.Total)
+
+	_, resp = listAgents(t, h, "label=env:prod&nickname=node%204")
+	assert.Equal(t, []string{"agent-4"}, uuids(resp))
+
+	after := now.Add(-150 * time.Second).UTC().Format(time.RFC3339)
+	_, resp = listAgents(t, h, "last_seen_after="+after+"&sort=hostname")
+	assert.Equal(t, []string{"agent-1", "agent-0", "agent-2"}, uuids(resp))
+
+	code, _ := listAgents(t, h, "label=env")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = listAgents(t, h, "last_seen_before=yesterday")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestAdminAgentEditAndDecommission(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	seedAgents(t, store)
+	require.NoError(t, store.Roles.Create(ctx, &models.Role{Name: "scanner"}))
+	h := setupHandler(store)
+	e := setupEcho()
+
+	c, rec := newJSONContext(e, http.MethodGet, "/admin/agents/agent-2", nil)
+	c.SetParamNames("uuid")
+	c.SetParamValues("agent-2")
+	require.NoError(t, h.GetAgent(c))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, strings.ToLower(rec.Body.String()), "secret")
+	assert.NotContains(t, rec.Body.String(), "bh_key_2")
+
+	c, rec = newJSONContext(e, http.MethodPatch, "/admin/agents/agent-2", map[string]string{"role": "unknown"})
+	c.SetParamNames("uuid")
+	c.SetParamValues("agent-2")
+	require.NoError(t, h.UpdateAgent(c))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	c, rec = newJSONContext(e, http.MethodPatch, "/admin/agents/agent-2", map[string]string{"role": "scanner"})
+	c.SetParamNames("uuid")
+	c.SetParamValues("agent-2")
+	require.NoError(t, h.UpdateAgent(c))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var summary models.AgentSummary
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &summary))
+	assert.Equal(t, "scanner", summary.Role)
+	assert.Equal(t, "Node 2", summary.Nickname, "Omitted fields are left unchanged")
+
+	c, rec = newJSONContext(e, http.MethodDelete, "/admin/agents/agent-2", nil)
+	c.SetParamNames("uuid")
+	c.SetParamValues("agent-2")
+	require.NoError(t, h.DecommissionAgent(c))
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+
+	agent, err := store.Agents.GetByUUID(ctx, "agent-2")
+	require.NoError(t, err)
+	assert.Equal(t, models.AgentStatusDecommissioned, agent.Status)
+	_, err = store.Agents.GetByKeyID(ctx, "bh_key_2")
+	assert.ErrorIs(t, err, storage.ErrNotFound, "Decommissioned agents can no longer authenticate")
+
+	// An agent that is still running keeps sending heartbeats
+	c, rec = newJSONContext(e, http.MethodPost, "/api/agent/heartbeat", models.HeartbeatRequest{UUID: "agent-2", Timestamp: time.Now()})
+	c.Set("agent_uuid", "agent-2")
+	require.NoError(t, h.AgentHeartbeat(c))
+	assert.Equal(t, http.StatusGone, rec.Code)
+	agent, err = store.Agents.GetByUUID(ctx, "agent-2")
+	require.NoError(t, err)
+	assert.Equal(t, models.AgentStatusDecommissioned, agent.Status, "Heartbeats do not bring decommissioned agents back")
+
+	c, rec = newJSONContext(e, http.MethodDelete, "/admin/agents/missing", nil)
+	c.SetParamNames("uuid")
+	c.SetParamValues("missing")
+	require.NoError(t, h.DecommissionAgent(c))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
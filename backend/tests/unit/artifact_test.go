@@ -0,0 +1,330 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/whit3rabbit/beehive/manager/api/handlers"
+	"github.com/whit3rabbit/beehive/manager/internal/config"
+	"github.com/whit3rabbit/beehive/manager/internal/reaper"
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
+	"github.com/whit3rabbit/beehive/manager/internal/tasktypes"
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+func sha256Hex(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// uploadArtifact posts content as a multipart artifact upload with the given form fields.
+func uploadArtifact(t *testing.T, h *handlers.Handler, agentID, taskID, filename string, content []byte, fields map[string]string) (int, models.Artifact) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for name, value := range fields {
+		require.NoError(t, form.WriteField(name, value))
+	}
+	part, err := form.CreateFormFile("file", filename)
+	require.NoError(t, err)
+	part.Write(content)
+	require.NoError(t, form.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/api/task/artifacts/"+taskID, &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	rec := httptest.NewRecorder()
+	c := setupEcho().NewContext(req, rec)
+	c.SetParamNames("task_id")
+	c.SetParamValues(taskID)
+	c.Set("agent_uuid", agentID)
+	require.NoError(t, h.UploadArtifact(c))
+	var artifact models.Artifact
+	json.Unmarshal(rec.Body.Bytes(), &artifact)
+	return rec.Code, artifact
+}
+
+func TestUploadArtifact(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	h := handlers.NewHandler(store, testCredentialBox, tasktypes.Builtin(), storage.DispatchPolicy{},
+		handlers.ArtifactLimits{MaxFileBytes: 16, MaxTaskBytes: 24}, handlers.PollLimits{})
+
+	task := queueTasks(t, store, 1, time.Now(), func(task *models.Task) { task.Type = "ui_automation" })[0]
+	id := task.ID.Hex()
+	png := []byte("\x89PNG fake image")
+	fields := map[string]string{"sha256": sha256Hex(png), "content_type": "image/png"}
+
+	code, _ := uploadArtifact(t, h, "agent-1", id, "shot.png", png, fields)
+	assert.Equal(t, http.StatusConflict, code, "Queued tasks take no artifacts yet")
+
+	_, err := store.Tasks.ClaimNext(ctx, "agent-1", storage.DispatchPolicy{}, time.Now())
+	require.NoError(t, err)
+
+	code, _ = uploadArtifact(t, h, "agent-2", id, "shot.png", png, fields)
+	assert.Equal(t, http.StatusNotFound, code, "Only the task's agent may upload")
+	code, _ = uploadArtifact(t, h, "agent-1", id, "shot.png", png, map[string]string{"content_type": "image/png"})
+	assert.Equal(t, http.StatusBadRequest, code, "The digest is required")
+	code, _ = uploadArtifact(t, h, "agent-1", id, "shot.png", png, map[string]string{"sha256": sha256Hex([]byte("other"))})
+	assert.Equal(t, http.StatusBadRequest, code, "The digest must match the content")
+	large := bytes.Repeat([]byte("x"), 17)
+	code, _ = uploadArtifact(t, h, "agent-1", id, "big.bin", large, map[string]string{"sha256": sha256Hex(large)})
+	assert.Equal(t, http.StatusRequestEntityTooLarge, code)
+
+	code, artifact := uploadArtifact(t, h, "agent-1", id, "../../shots/shot.png", png, fields)
+	require.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, "shot.png", artifact.Name, "Directories are stripped from the name")
+	assert.Equal(t, "image/png", artifact.ContentType)
+	assert.Equal(t, int64(len(png)), artifact.Size)
+	assert.Equal(t, 1, artifact.Attempt)
+
+	// 15 of the 24 bytes of the task's quota are used
+	log := []byte("0123456789")
+	code, _ = uploadArtifact(t, h, "agent-1", id, "out.log", log, map[string]string{"sha256": sha256Hex(log)})
+	assert.Equal(t, http.StatusRequestEntityTooLarge, code, "Should enforce the per-task quota")
+
+	artifacts, err := store.Artifacts.List(ctx, task.ID)
+	require.NoError(t, err)
+	assert.Len(t, artifacts, 1)
+}
+
+func TestArtifactQuotaConcurrentUploads(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	h := handlers.NewHandler(store, testCredentialBox, tasktypes.Builtin(), storage.DispatchPolicy{},
+		handlers.ArtifactLimits{MaxFileBytes: 16, MaxTaskBytes: 24}, handlers.PollLimits{})
+
+	task := queueTasks(t, store, 1, time.Now(), func(task *models.Task) {})[0]
+	_, err := store.Tasks.ClaimNext(ctx, "agent-1", storage.DispatchPolicy{}, time.Now())
+	require.NoError(t, err)
+
+	// Only two of the 10-byte uploads fit in the task's quota, however they interleave
+	content := []byte("0123456789")
+	codes := make([]int, 8)
+	var wg sync.WaitGroup
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i], _ = uploadArtifact(t, h, "agent-1", task.ID.Hex(), fmt.Sprintf("out-%d.log", i), content, map[string]string{"sha256": sha256Hex(content)})
+		}(i)
+	}
+	wg.Wait()
+
+	var created int
+	for _, code := range codes {
+		if code == http.StatusCreated {
+			created++
+		} else {
+			assert.Equal(t, http.StatusRequestEntityTooLarge, code)
+		}
+	}
+	assert.Equal(t, 2, created)
+	artifacts, err := store.Artifacts.List(ctx, task.ID)
+	require.NoError(t, err)
+	assert.Len(t, artifacts, 2)
+}
+
+func TestServeArtifact(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	h := setupHandler(store)
+	e := setupEcho()
+
+	task := queueTasks(t, store, 1, time.Now(), func(task *models.Task) {})[0]
+	_, err := store.Tasks.ClaimNext(ctx, "agent-1", storage.DispatchPolicy{}, time.Now())
+	require.NoError(t, err)
+	png, page := []byte("\x89PNG fake image"), []byte("<script>alert(1)</script>")
+	code, shot := uploadArtifact(t, h, "agent-1", task.ID.Hex(), "shot.png", png, map[string]string{"sha256": sha256Hex(png), "content_type": "image/png"})
+	require.Equal(t, http.StatusCreated, code)
+	code, html := uploadArtifact(t, h, "agent-1", task.ID.Hex(), "page.html", page, map[string]string{"sha256": sha256Hex(page), "content_type": "text/html"})
+	require.Equal(t, http.StatusCreated, code)
+
+	c, rec := newJSONContext(e, http.MethodGet, "/admin/tasks/"+task.ID.Hex()+"/artifacts", nil)
+	c.SetParamNames("task_id")
+	c.SetParamValues(task.ID.Hex())
+	require.NoError(t, h.ListTaskArtifacts(c))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var list models.ArtifactListResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &list))
+	require.Len(t, list.Artifacts, 2)
+	assert.Equal(t, int64(len(png)+len(page)), list.TotalSize)
+
+	serve := func(handler echo.HandlerFunc, id string) *httptest.ResponseRecorder {
+		c, rec := newJSONContext(e, http.MethodGet, "/admin/artifacts/"+id, nil)
+		c.SetParamNames("artifact_id")
+		c.SetParamValues(id)
+		require.NoError(t, handler(c))
+		return rec
+	}
+
+	rec = serve(h.DownloadArtifact, html.ID.Hex())
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, page, rec.Body.Bytes())
+	assert.Equal(t, "text/html", rec.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename=page.html`, rec.Header().Get("Content-Disposition"))
+
+	rec = serve(h.PreviewArtifact, shot.ID.Hex())
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, png, rec.Body.Bytes())
+	assert.Equal(t, "image/png", rec.Header().Get("Content-Type"))
+	assert.Equal(t, `inline; filename=shot.png`, rec.Header().Get("Content-Disposition"))
+
+	rec = serve(h.PreviewArtifact, html.ID.Hex())
+	assert.Equal(t, http.StatusUnsupportedMediaType, rec.Code, "HTML must not be rendered in the admin's browser")
+	rec = serve(h.DownloadArtifact, task.ID.Hex())
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestArtifactRetention(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	h := setupHandler(store)
+	now := time.Now()
+
+	tasks := queueTasks(t, store, 3, now.Add(-60*24*time.Hour), func(task *models.Task) {})
+	for i, finishedAt := range []time.Time{now.Add(-45 * 24 * time.Hour), now.Add(-time.Hour)} {
+		_, err := store.Tasks.ClaimNext(ctx, "agent-1", storage.DispatchPolicy{}, finishedAt)
+		require.NoError(t, err)
+		content := []byte("artifact")
+		code, _ := uploadArtifact(t, h, "agent-1", tasks[i].ID.Hex(), "out.txt", content, map[string]string{"sha256": sha256Hex(content)})
+		require.Equal(t, http.StatusCreated, code)
+		code, _ = appendLog(t, h, "agent-1", tasks[i].ID.Hex(), map[string]interface{}{"sequence": 0, "data": "done\n"})
+		require.Equal(t, http.StatusOK, code)
+		require.NoError(t, store.Tasks.Finish(ctx, tasks[i].ID, "agent-1", "completed", &models.Output{}, finishedAt))
+	}
+
+	cfg := config.ReaperConfig{IntervalSeconds: 1, InactiveAfterSeconds: 120, DisconnectedAfterSeconds: 900}
+	result, err := reaper.New(store, cfg).Sweep(ctx, now)
+	require.NoError(t, err)
+	assert.Zero(t, result.DeletedTasks, "Finished tasks are kept forever by default")
+
+	cfg.TaskRetentionDays = 30
+	result, err = reaper.New(store, cfg).Sweep(ctx, now)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), result.DeletedTasks)
+
+	_, err = store.Tasks.Get(ctx, tasks[0].ID)
+	assert.ErrorIs(t, err, storage.ErrNotFound, "The expired task is deleted")
+	artifacts, err := store.Artifacts.List(ctx, tasks[0].ID)
+	require.NoError(t, err)
+	assert.Empty(t, artifacts, "Its artifacts go with it")
+	chunks, err := store.TaskLogs.List(ctx, tasks[0].ID, 1, 0, 0)
+	require.NoError(t, err)
+	assert.Empty(t, chunks, "Its log goes with it")
+
+	for _, task := range tasks[1:] {
+		_, err := store.Tasks.Get(ctx, task.ID)
+		assert.NoError(t, err, "Recent and unfinished tasks are kept")
+	}
+	artifacts, err = store.Artifacts.List(ctx, tasks[1].ID)
+	require.NoError(t, err)
+	assert.Len(t, artifacts, 1)
+
+	// Jobs and workflow runs read the results of their tasks however old they are
+	finishedAt := now.Add(-45 * 24 * time.Hour)
+	parents := []func(*models.Task){
+		func(task *models.Task) { task.AgentID, task.JobID = "agent-2", "job-1" },
+		func(task *models.Task) { task.AgentID, task.WorkflowRunID = "agent-2", "run-1" },
+	}
+	var children []models.Task
+	for _, parent := range parents {
+		child := queueTasks(t, store, 1, finishedAt, parent)[0]
+		_, err := store.Tasks.ClaimNext(ctx, "agent-2", storage.DispatchPolicy{}, finishedAt)
+		require.NoError(t, err)
+		require.NoError(t, store.Tasks.Finish(ctx, child.ID, "agent-2", "completed", &models.Output{}, finishedAt))
+		children = append(children, child)
+	}
+	result, err = reaper.New(store, cfg).Sweep(ctx, now)
+	require.NoError(t, err)
+	assert.Zero(t, result.DeletedTasks)
+	for _, child := range children {
+		_, err := store.Tasks.Get(ctx, child.ID)
+		assert.NoError(t, err, "Tasks of jobs and workflow runs are kept")
+	}
+}
+
+func TestJobAndRunRetention(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	now := time.Now()
+	old := now.Add(-45 * 24 * time.Hour)
+
+	// finished creates a task finished long ago on each agent, filled in by parent
+	finished := func(parent func(*models.Task), agents ...string) []models.Task {
+		var tasks []models.Task
+		for _, agent := range agents {
+			tasks = append(tasks, queueTasks(t, store, 1, old, func(task *models.Task) {
+				task.AgentID, task.Status, task.UpdatedAt = agent, "completed", old
+				parent(task)
+			})...)
+		}
+		return tasks
+	}
+	ofJob := func(job *models.Job) func(*models.Task) {
+		return func(task *models.Task) { task.JobID = job.ID.Hex() }
+	}
+	ofRun := func(run *models.WorkflowRun) func(*models.Task) {
+		return func(task *models.Task) { task.WorkflowRunID = run.ID.Hex() }
+	}
+
+	expiredJob := models.Job{Name: "expired", CreatedAt: old}
+	busyJob := models.Job{Name: "busy", CreatedAt: old}
+	haltedJob := models.Job{Name: "halted", CreatedAt: old, Rollout: &models.Rollout{Status: models.RolloutHalted}}
+	for _, job := range []*models.Job{&expiredJob, &busyJob, &haltedJob} {
+		require.NoError(t, store.Jobs.Create(ctx, job))
+	}
+	expiredJobTasks := finished(ofJob(&expiredJob), "agent-1", "agent-2")
+	finished(ofJob(&busyJob), "agent-1")
+	queueTasks(t, store, 1, old, func(task *models.Task) { task.AgentID, task.JobID = "agent-2", busyJob.ID.Hex() })
+	finished(ofJob(&haltedJob), "agent-1")
+
+	expiredRun := models.WorkflowRun{Status: models.WorkflowCompleted, CreatedAt: old, FinishedAt: old}
+	recentRun := models.WorkflowRun{Status: models.WorkflowFailed, CreatedAt: old, FinishedAt: now.Add(-time.Hour)}
+	for _, run := range []*models.WorkflowRun{&expiredRun, &recentRun} {
+		require.NoError(t, store.WorkflowRuns.Create(ctx, run))
+	}
+	expiredRunTasks := finished(ofRun(&expiredRun), "agent-1")
+	finished(ofRun(&recentRun), "agent-1")
+
+	chunk := models.TaskLogChunk{TaskID: expiredJobTasks[0].ID, AgentID: "agent-1", Data: "done\n", CreatedAt: old}
+	require.NoError(t, store.TaskLogs.Append(ctx, &chunk))
+
+	cfg := config.ReaperConfig{IntervalSeconds: 1, InactiveAfterSeconds: 120, DisconnectedAfterSeconds: 900, TaskRetentionDays: 30}
+	result, err := reaper.New(store, cfg).Sweep(ctx, now)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), result.DeletedJobs)
+	assert.Equal(t, int64(1), result.DeletedRuns)
+	assert.Equal(t, int64(3), result.DeletedTasks)
+
+	_, err = store.Jobs.Get(ctx, expiredJob.ID)
+	assert.ErrorIs(t, err, storage.ErrNotFound, "A job whose tasks all expired is deleted")
+	_, err = store.WorkflowRuns.Get(ctx, expiredRun.ID)
+	assert.ErrorIs(t, err, storage.ErrNotFound, "A run that finished long ago is deleted")
+	for _, task := range append(expiredJobTasks, expiredRunTasks...) {
+		_, err := store.Tasks.Get(ctx, task.ID)
+		assert.ErrorIs(t, err, storage.ErrNotFound, "Their tasks go with them")
+	}
+	chunks, err := store.TaskLogs.List(ctx, expiredJobTasks[0].ID, 0, 0, 0)
+	require.NoError(t, err)
+	assert.Empty(t, chunks, "So do the logs of their tasks")
+
+	for _, job := range []models.Job{busyJob, haltedJob} {
+		_, err := store.Jobs.Get(ctx, job.ID)
+		assert.NoError(t, err, "Jobs with unfinished tasks or a rollout that may resume are kept")
+	}
+	_, err = store.WorkflowRuns.Get(ctx, recentRun.ID)
+	assert.NoError(t, err, "Recently finished runs are kept")
+}
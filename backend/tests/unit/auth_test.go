@@ -0,0 +1,276 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/whit3rabbit/beehive/manager/internal/secrets"
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
+	customMiddleware "github.com/whit3rabbit/beehive/manager/middleware"
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+// testSignatureOptions accepts both signature versions with the default clock skew.
+var testSignatureOptions = customMiddleware.SignatureOptions{ClockSkew: 5 * time.Minute}
+
+// setupAgentAPI wires the enrollment route and a few authenticated agent routes.
+func setupAgentAPI(store *storage.Store) *echo.Echo {
+	return setupAgentAPIWithOptions(store, testSignatureOptions)
+}
+
+func setupAgentAPIWithOptions(store *storage.Store, opts customMiddleware.SignatureOptions) *echo.Echo {
+	e := setupEcho()
+	h := setupHandler(store)
+
+	e.POST("/api/agent/enroll", h.EnrollAgent)
+	agentRoutes := e.Group("/api")
+	agentRoutes.Use(customMiddleware.APIAuthMiddleware(store.Agents, store.Nonces, testCredentialBox, opts))
+	agentRoutes.POST("/agent/register", h.RegisterAgent)
+	agentRoutes.POST("/agent/heartbeat", h.AgentHeartbeat)
+	agentRoutes.GET("/task/poll", h.PollTask)
+	return e
+}
+
+// signedRequest performs a request signed the way an agent signs it.
+func signedRequest(e *echo.Echo, method, target, keyID, signingKey string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, bytes.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set("X-API-Key", keyID)
+	req.Header.Set("X-Signature", customMiddleware.ComputeSignature(signingKey, body))
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+// canonicalRequest builds a version 2 request signed over the canonical request string.
+func canonicalRequest(method, target, keyID, secret string, body []byte, timestamp time.Time, nonce string) *http.Request {
+	req := httptest.NewRequest(method, target, bytes.NewReader(body))
+	ts := strconv.FormatInt(timestamp.Unix(), 10)
+	canonical := customMiddleware.CanonicalRequest(method, req.URL.EscapedPath(), req.URL.RawQuery, body, ts, nonce)
+
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set("X-API-Key", keyID)
+	req.Header.Set("X-Signature", customMiddleware.ComputeSignature(secret, []byte(canonical)))
+	req.Header.Set(customMiddleware.SignatureVersionHeader, customMiddleware.SignatureVersionCanonical)
+	req.Header.Set(customMiddleware.TimestampHeader, ts)
+	req.Header.Set(customMiddleware.NonceHeader, nonce)
+	return req
+}
+
+func serve(e *echo.Echo, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func enrollTestAgent(t *testing.T, e *echo.Echo, store *storage.Store, uuid string) models.AgentRegistrationResponse {
+	require.NoError(t, store.EnrollmentTokens.Create(context.Background(), &models.EnrollmentToken{
+		TokenHash: secrets.Hash("token-" + uuid),
+		MaxUses:   1,
+		ExpiresAt: time.Now().Add(time.Hour),
+	}))
+
+	body, _ := json.Marshal(models.EnrollmentRequest{Token: "token-" + uuid, UUID: uuid, Hostname: "host", MacHash: "mac"})
+	req := httptest.NewRequest(http.MethodPost, "/api/agent/enroll", bytes.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var creds models.AgentRegistrationResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &creds))
+	require.NotEmpty(t, creds.KeyID)
+	require.NotEmpty(t, creds.APISecret)
+	return creds
+}
+
+func TestSignedRequestRoundTrip(t *testing.T) {
+	store := storage.NewMemoryStore()
+	e := setupAgentAPI(store)
+	creds := enrollTestAgent(t, e, store, "agent-1")
+
+	// The secret is stored encrypted, not in the clear
+	agent, err := store.Agents.GetByUUID(context.Background(), "agent-1")
+	require.NoError(t, err)
+	assert.NotEqual(t, creds.APISecret, agent.APISecret)
+
+	heartbeat, _ := json.Marshal(models.HeartbeatRequest{UUID: "agent-1", Timestamp: time.Now()})
+	rec := signedRequest(e, http.MethodPost, "/api/agent/heartbeat", creds.KeyID, creds.APISecret, heartbeat)
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	rec = signedRequest(e, http.MethodGet, "/api/task/poll", creds.KeyID, creds.APISecret, nil)
+	assert.Equal(t, http.StatusOK, rec.Code, "GET requests sign an empty body")
+
+	rec = signedRequest(e, http.MethodPost, "/api/agent/heartbeat", creds.KeyID, "wrong-secret", heartbeat)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	rec = signedRequest(e, http.MethodPost, "/api/agent/heartbeat", "bh_unknown", creds.APISecret, heartbeat)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestCredentialRotation(t *testing.T) {
+	store := storage.NewMemoryStore()
+	e := setupAgentAPI(store)
+	creds := enrollTestAgent(t, e, store, "agent-1")
+
+	// An agent cannot re-register someone else
+	other, _ := json.Marshal(models.Agent{UUID: "agent-2"})
+	rec := signedRequest(e, http.MethodPost, "/api/agent/register", creds.KeyID, creds.APISecret, other)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	self, _ := json.Marshal(models.Agent{UUID: "agent-1", Nickname: "renamed"})
+	rec = signedRequest(e, http.MethodPost, "/api/agent/register", creds.KeyID, creds.APISecret, self)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var rotated models.AgentRegistrationResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &rotated))
+	assert.NotEqual(t, creds.KeyID, rotated.KeyID)
+
+	heartbeat, _ := json.Marshal(models.HeartbeatRequest{UUID: "agent-1", Timestamp: time.Now()})
+	rec = signedRequest(e, http.MethodPost, "/api/agent/heartbeat", creds.KeyID, creds.APISecret, heartbeat)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "Old credentials should stop working")
+	rec = signedRequest(e, http.MethodPost, "/api/agent/heartbeat", rotated.KeyID, rotated.APISecret, heartbeat)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestLegacyCredentials(t *testing.T) {
+	store := storage.NewMemoryStore()
+	e := setupAgentAPI(store)
+
+	// Agents registered under the old scheme only know their raw API key
+	require.NoError(t, store.Agents.Create(context.Background(), &models.Agent{
+		UUID:      "legacy-agent",
+		APIKey:    secrets.Hash("legacy-key"),
+		APISecret: secrets.Hash("never-shared"),
+	}))
+
+	// The key is sent in the clear, so a signature keyed with it proves nothing
+	heartbeat, _ := json.Marshal(models.HeartbeatRequest{UUID: "legacy-agent", Timestamp: time.Now()})
+	rec := signedRequest(e, http.MethodPost, "/api/agent/heartbeat", "legacy-key", "legacy-key", heartbeat)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	rec = signedRequest(e, http.MethodPost, "/api/agent/register", "legacy-key", "legacy-key", []byte(`{}`))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestCanonicalSignature(t *testing.T) {
+	store := storage.NewMemoryStore()
+	e := setupAgentAPI(store)
+	creds := enrollTestAgent(t, e, store, "agent-1")
+	now := time.Now()
+
+	rec := serve(e, canonicalRequest(http.MethodGet, "/api/task/poll?b=2&a=1", creds.KeyID, creds.APISecret, nil, now, "nonce-1"))
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, customMiddleware.SignatureVersionCanonical, rec.Header().Get(customMiddleware.SignatureVersionHeader))
+
+	// Replaying the exact request is rejected
+	rec = serve(e, canonicalRequest(http.MethodGet, "/api/task/poll?b=2&a=1", creds.KeyID, creds.APISecret, nil, now, "nonce-1"))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// Timestamps outside the clock skew window are rejected
+	rec = serve(e, canonicalRequest(http.MethodGet, "/api/task/poll", creds.KeyID, creds.APISecret, nil, now.Add(-10*time.Minute), "nonce-2"))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	rec = serve(e, canonicalRequest(http.MethodGet, "/api/task/poll", creds.KeyID, creds.APISecret, nil, now.Add(10*time.Minute), "nonce-3"))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// The signature covers the path and query, not only the body
+	req := canonicalRequest(http.MethodGet, "/api/task/poll?a=1", creds.KeyID, creds.APISecret, nil, now, "nonce-4")
+	req.URL.RawQuery = "a=2"
+	assert.Equal(t, http.StatusUnauthorized, serve(e, req).Code)
+
+	// Unknown versions and missing nonces are rejected
+	req = canonicalRequest(http.MethodGet, "/api/task/poll", creds.KeyID, creds.APISecret, nil, now, "nonce-5")
+	req.Header.Set(customMiddleware.SignatureVersionHeader, "9")
+	assert.Equal(t, http.StatusUnauthorized, serve(e, req).Code)
+	req = canonicalRequest(http.MethodGet, "/api/task/poll", creds.KeyID, creds.APISecret, nil, now, "nonce-6")
+	req.Header.Del(customMiddleware.NonceHeader)
+	assert.Equal(t, http.StatusUnauthorized, serve(e, req).Code)
+
+	// A forged request does not burn the nonce for the real agent
+	heartbeat, _ := json.Marshal(models.HeartbeatRequest{UUID: "agent-1", Timestamp: now})
+	rec = serve(e, canonicalRequest(http.MethodPost, "/api/agent/heartbeat", creds.KeyID, "wrong-secret", heartbeat, now, "nonce-7"))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	rec = serve(e, canonicalRequest(http.MethodPost, "/api/agent/heartbeat", creds.KeyID, creds.APISecret, heartbeat, now, "nonce-7"))
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+}
+
+func TestCanonicalQueryOrder(t *testing.T) {
+	body := []byte(`{"a":1}`)
+	assert.Equal(t,
+		customMiddleware.CanonicalRequest("get", "/api/x", "b=2&a=1&a=0", body, "1", "n"),
+		customMiddleware.CanonicalRequest("GET", "/api/x", "a=0&a=1&b=2", body, "1", "n"))
+	assert.NotEqual(t,
+		customMiddleware.CanonicalRequest("GET", "/api/x", "", body, "1", "n"),
+		customMiddleware.CanonicalRequest("POST", "/api/x", "", body, "1", "n"))
+}
+
+func TestRequireCanonicalSignature(t *testing.T) {
+	store := storage.NewMemoryStore()
+	e := setupAgentAPIWithOptions(store, customMiddleware.SignatureOptions{ClockSkew: time.Minute, RequireCanonical: true})
+	creds := enrollTestAgent(t, e, store, "agent-1")
+
+	rec := signedRequest(e, http.MethodGet, "/api/task/poll", creds.KeyID, creds.APISecret, nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, customMiddleware.SignatureVersionCanonical, rec.Header().Get(customMiddleware.SignatureVersionHeader))
+
+	rec = serve(e, canonicalRequest(http.MethodGet, "/api/task/poll", creds.KeyID, creds.APISecret, nil, time.Now(), "nonce-1"))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestBodyLimit(t *testing.T) {
+	store := storage.NewMemoryStore()
+	e := setupEcho()
+	h := setupHandler(store)
+	agentRoutes := e.Group("/api")
+	agentRoutes.Use(customMiddleware.BodyLimitMiddleware(16, map[string]int64{"/api/task/artifacts/:task_id": 64}))
+	agentRoutes.Use(customMiddleware.APIAuthMiddleware(store.Agents, store.Nonces, testCredentialBox, testSignatureOptions))
+	agentRoutes.POST("/agent/heartbeat", h.AgentHeartbeat)
+	agentRoutes.POST("/task/artifacts/:task_id", h.UploadArtifact)
+	creds := enrollTestAgent(t, setupAgentAPI(store), store, "agent-1")
+
+	body := bytes.Repeat([]byte("x"), 32)
+	rec := signedRequest(e, http.MethodPost, "/api/agent/heartbeat", creds.KeyID, creds.APISecret, body)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code, "Oversized bodies are refused before authentication")
+
+	req := httptest.NewRequest(http.MethodPost, "/api/agent/heartbeat", bytes.NewReader(body))
+	req.ContentLength = -1
+	req.Header.Set("X-API-Key", creds.KeyID)
+	req.Header.Set("X-Signature", customMiddleware.ComputeSignature(creds.APISecret, body))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, serve(e, req).Code, "Bodies without a length stop at the limit")
+
+	rec = signedRequest(e, http.MethodPost, "/api/task/artifacts/"+primitive.NewObjectID().Hex(), "unknown", "secret", body)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "Routes may allow larger bodies")
+}
+
+func TestHeartbeatIdentity(t *testing.T) {
+	store := storage.NewMemoryStore()
+	e := setupAgentAPI(store)
+	creds := enrollTestAgent(t, e, store, "agent-1")
+	enrollTestAgent(t, e, store, "agent-2")
+	require.NoError(t, store.Agents.Heartbeat(context.Background(), "agent-2", time.Now().Add(-time.Hour)))
+
+	heartbeat, _ := json.Marshal(models.HeartbeatRequest{UUID: "agent-2", Timestamp: time.Now()})
+	rec := signedRequest(e, http.MethodPost, "/api/agent/heartbeat", creds.KeyID, creds.APISecret, heartbeat)
+	assert.Equal(t, http.StatusForbidden, rec.Code, "Agents cannot keep other agents alive")
+	other, err := store.Agents.GetByUUID(context.Background(), "agent-2")
+	require.NoError(t, err)
+	assert.True(t, other.LastSeen.Before(time.Now().Add(-time.Minute)))
+
+	// A clock far in the past does not make the agent look stale
+	heartbeat, _ = json.Marshal(models.HeartbeatRequest{UUID: "agent-1", Timestamp: time.Now().Add(-24 * time.Hour)})
+	rec = signedRequest(e, http.MethodPost, "/api/agent/heartbeat", creds.KeyID, creds.APISecret, heartbeat)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	agent, err := store.Agents.GetByUUID(context.Background(), "agent-1")
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), agent.LastSeen, time.Minute)
+}
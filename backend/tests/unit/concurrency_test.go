@@ -0,0 +1,101 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/whit3rabbit/beehive/manager/api/handlers"
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
+	"github.com/whit3rabbit/beehive/manager/internal/tasktypes"
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+func TestClaimConcurrencyLimits(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+
+	now := time.Now()
+	browser := func(task *models.Task) { task.Type = "browser_automation" }
+	tasks := queueTasks(t, store, 2, now.Add(-time.Hour), browser)
+	queueTasks(t, store, 2, now.Add(-time.Minute), func(task *models.Task) {})
+
+	policy := storage.DispatchPolicy{Limits: storage.ConcurrencyLimits{Max: 2, PerType: map[string]int{"browser_automation": 1}}}
+	claimed, err := store.Tasks.ClaimNext(ctx, "agent-1", policy, now)
+	require.NoError(t, err)
+	assert.Equal(t, tasks[0].ID, claimed.ID)
+
+	claimed, err = store.Tasks.ClaimNext(ctx, "agent-1", policy, now)
+	require.NoError(t, err)
+	assert.Equal(t, "command_shell", claimed.Type, "Should skip types without a free slot")
+
+	_, err = store.Tasks.ClaimNext(ctx, "agent-1", policy, now)
+	assert.ErrorIs(t, err, storage.ErrNotFound, "Should hand out nothing while every slot is taken")
+
+	held, err := store.Tasks.CountHeld(ctx, "agent-1")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"browser_automation": 1, "command_shell": 1}, held)
+
+	require.NoError(t, store.Tasks.Start(ctx, tasks[0].ID, "agent-1", now))
+	require.NoError(t, store.Tasks.Finish(ctx, tasks[0].ID, "agent-1", "completed", &models.Output{}, now))
+	claimed, err = store.Tasks.ClaimNext(ctx, "agent-1", policy, now)
+	require.NoError(t, err)
+	assert.Equal(t, tasks[1].ID, claimed.ID, "A finished task frees its slot")
+}
+
+func TestAgentConcurrencySlots(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	types := tasktypes.Builtin()
+	require.NoError(t, types.SetMaxConcurrent("browser_automation", 1))
+	h := handlers.NewHandler(store, testCredentialBox, types, storage.DispatchPolicy{}, handlers.ArtifactLimits{}, handlers.PollLimits{})
+	e := setupEcho()
+
+	require.NoError(t, store.Roles.Create(ctx, &models.Role{Name: "web", MaxConcurrent: 2}))
+	require.NoError(t, store.Agents.Create(ctx, &models.Agent{UUID: "agent-1", KeyID: "key-1", Role: "web", Status: "active", MaxConcurrent: 5}))
+	queueTasks(t, store, 3, time.Now().Add(-time.Minute), func(task *models.Task) {})
+
+	poll := func() *models.AgentTask {
+		c, rec := newJSONContext(e, http.MethodGet, "/api/task/poll", nil)
+		c.Set("agent_uuid", "agent-1")
+		require.NoError(t, h.PollTask(c))
+		require.Equal(t, http.StatusOK, rec.Code)
+		var polled models.TaskPollResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &polled))
+		return polled.Task
+	}
+	assert.NotNil(t, poll())
+	assert.NotNil(t, poll())
+	assert.Nil(t, poll(), "The role's limit is lower than the agent's")
+
+	c, rec := newJSONContext(e, http.MethodGet, "/admin/agents/agent-1", nil)
+	c.SetParamNames("uuid")
+	c.SetParamValues("agent-1")
+	require.NoError(t, h.GetAgent(c))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var detail models.AgentDetail
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &detail))
+	assert.Equal(t, 5, detail.MaxConcurrent)
+	assert.Equal(t, 2, detail.Slots.Used)
+	assert.Equal(t, 2, detail.Slots.Max)
+	assert.Equal(t, models.TypeSlots{Used: 2}, detail.Slots.Types["command_shell"])
+	assert.Equal(t, models.TypeSlots{Max: 1}, detail.Slots.Types["browser_automation"])
+
+	update := func(body map[string]interface{}) int {
+		c, rec := newJSONContext(e, http.MethodPatch, "/admin/agents/agent-1", body)
+		c.SetParamNames("uuid")
+		c.SetParamValues("agent-1")
+		require.NoError(t, h.UpdateAgent(c))
+		return rec.Code
+	}
+	assert.Equal(t, http.StatusBadRequest, update(map[string]interface{}{"max_concurrent": -1}))
+	require.Equal(t, http.StatusOK, update(map[string]interface{}{"max_concurrent": 1}))
+	agent, err := store.Agents.GetByUUID(ctx, "agent-1")
+	require.NoError(t, err)
+	assert.Equal(t, 1, agent.MaxConcurrent)
+}
@@ -0,0 +1,134 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+// queueTasks creates count queued tasks for agent-1, one second apart from start.
+func queueTasks(t *testing.T, store *storage.Store, count int, start time.Time, fill func(*models.Task)) []models.Task {
+	tasks := make([]models.Task, count)
+	for i := range tasks {
+		tasks[i] = models.Task{AgentID: "agent-1", Type: "command_shell", Status: "queued", CreatedAt: start.Add(time.Duration(i) * time.Second)}
+		fill(&tasks[i])
+		require.NoError(t, store.Tasks.Create(context.Background(), &tasks[i]))
+	}
+	return tasks
+}
+
+// claimQueues claims count tasks of agent-1 and returns the queue of each.
+func claimQueues(t *testing.T, store *storage.Store, policy storage.DispatchPolicy, count int, now time.Time) []string {
+	queues := make([]string, count)
+	for i := range queues {
+		task, err := store.Tasks.ClaimNext(context.Background(), "agent-1", policy, now.Add(time.Duration(i)*time.Second))
+		require.NoError(t, err)
+		queues[i] = task.Queue
+	}
+	return queues
+}
+
+func TestDispatchPriority(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+
+	now := time.Now()
+	low := queueTasks(t, store, 1, now.Add(-time.Hour), func(task *models.Task) { task.Priority = -5 })[0]
+	normal := queueTasks(t, store, 1, now.Add(-time.Minute), func(task *models.Task) {})[0]
+	urgent := queueTasks(t, store, 1, now, func(task *models.Task) { task.Priority = 50 })[0]
+
+	tasks, err := store.Tasks.ListByAgent(ctx, "agent-1")
+	require.NoError(t, err)
+	require.Len(t, tasks, 3)
+	assert.Equal(t, []string{urgent.ID.Hex(), normal.ID.Hex(), low.ID.Hex()},
+		[]string{tasks[0].ID.Hex(), tasks[1].ID.Hex(), tasks[2].ID.Hex()}, "Should list the highest priority first")
+
+	for _, want := range []models.Task{urgent, normal, low} {
+		claimed, err := store.Tasks.ClaimNext(ctx, "agent-1", storage.DispatchPolicy{}, now)
+		require.NoError(t, err)
+		assert.Equal(t, want.ID, claimed.ID, "Should claim the highest priority first, however new")
+	}
+}
+
+func TestDispatchFairShare(t *testing.T) {
+	store := storage.NewMemoryStore()
+
+	// alice floods the queue before bob and a job add their tasks
+	now := time.Now()
+	queueTasks(t, store, 6, now.Add(-time.Hour), func(task *models.Task) { task.CreatedBy = "alice" })
+	queueTasks(t, store, 2, now.Add(-time.Minute), func(task *models.Task) { task.CreatedBy = "bob" })
+	wave := 0
+	queueTasks(t, store, 2, now.Add(-30*time.Second), func(task *models.Task) {
+		wave++ // a job queues one task per agent and wave
+		task.CreatedBy, task.JobID, task.Wave = "carol", "job-1", wave
+	})
+
+	queues := claimQueues(t, store, storage.DispatchPolicy{}, 10, now)
+	assert.Equal(t, []string{
+		"submitter:alice", "submitter:bob", "job:job-1",
+		"submitter:alice", "submitter:bob", "job:job-1",
+		"submitter:alice", "submitter:alice", "submitter:alice", "submitter:alice",
+	}, queues, "Should take turns between submitters and jobs, oldest first on a tie")
+}
+
+func TestDispatchWeights(t *testing.T) {
+	store := storage.NewMemoryStore()
+
+	now := time.Now()
+	queueTasks(t, store, 10, now.Add(-time.Hour), func(task *models.Task) { task.CreatedBy = "alice" })
+	queueTasks(t, store, 10, now.Add(-time.Minute), func(task *models.Task) { task.CreatedBy = "bob" })
+
+	policy := storage.DispatchPolicy{Weights: map[string]int{"submitter:bob": 3}, Window: 8}
+	counts := map[string]int{}
+	for _, queue := range claimQueues(t, store, policy, 8, now) {
+		counts[queue]++
+	}
+	assert.Equal(t, map[string]int{"submitter:alice": 2, "submitter:bob": 6}, counts, "Should share claims by weight")
+}
+
+func TestBulkSetTaskPriority(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	h := setupHandler(store)
+	e := setupEcho()
+
+	now := time.Now()
+	tasks := queueTasks(t, store, 3, now.Add(-time.Minute), func(task *models.Task) { task.CreatedBy = "alice" })
+	_, err := store.Tasks.ClaimNext(ctx, "agent-1", storage.DispatchPolicy{}, now)
+	require.NoError(t, err)
+
+	bump := func(body map[string]interface{}) (int, models.TaskPriorityResponse) {
+		c, rec := newJSONContext(e, http.MethodPost, "/admin/tasks/priority", body)
+		c.Set("admin", "operator")
+		require.NoError(t, h.BulkSetTaskPriority(c))
+		var resp models.TaskPriorityResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec.Code, resp
+	}
+
+	code, _ := bump(map[string]interface{}{"all": true})
+	assert.Equal(t, http.StatusBadRequest, code, "Priority is required")
+	code, _ = bump(map[string]interface{}{"priority": 10})
+	assert.Equal(t, http.StatusBadRequest, code, "An empty filter needs an explicit all")
+	code, _ = bump(map[string]interface{}{"created_by": "alice", "priority": 101})
+	assert.Equal(t, http.StatusBadRequest, code, "Priority is bounded")
+
+	code, resp := bump(map[string]interface{}{"created_by": "alice", "priority": 10})
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, int64(2), resp.Updated, "Should only change queued tasks")
+
+	claimed, err := store.Tasks.Get(ctx, tasks[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, 0, claimed.Priority)
+	queued, err := store.Tasks.Get(ctx, tasks[2].ID)
+	require.NoError(t, err)
+	assert.Equal(t, 10, queued.Priority)
+}
@@ -0,0 +1,115 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+func TestEnrollmentTokenFlow(t *testing.T) {
+	e := setupEcho()
+	store := storage.NewMemoryStore()
+	h := setupHandler(store)
+
+	require.NoError(t, store.Roles.Create(context.Background(), &models.Role{Name: "worker"}))
+
+	// Mint a two-use token bound to the worker role
+	c, rec := newJSONContext(e, http.MethodPost, "/admin/enrollment-tokens", models.EnrollmentTokenRequest{
+		Role:    "worker",
+		Labels:  map[string]string{"site": "lab"},
+		MaxUses: 2,
+	})
+	c.Set("admin", "admin")
+	require.NoError(t, h.CreateEnrollmentToken(c))
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	var minted models.EnrollmentTokenResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &minted))
+	require.NotEmpty(t, minted.Token)
+
+	enroll := func(token, uuid string) int {
+		c, rec := newJSONContext(e, http.MethodPost, "/api/agent/enroll", models.EnrollmentRequest{
+			Token:    token,
+			UUID:     uuid,
+			Hostname: uuid + "-host",
+			MacHash:  "mac",
+		})
+		require.NoError(t, h.EnrollAgent(c))
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, enroll("not-a-token", "agent-0"))
+	assert.Equal(t, http.StatusOK, enroll(minted.Token, "agent-1"))
+	assert.Equal(t, http.StatusConflict, enroll(minted.Token, "agent-1"), "Should not re-enroll an existing agent")
+	assert.Equal(t, http.StatusOK, enroll(minted.Token, "agent-2"))
+	assert.Equal(t, http.StatusUnauthorized, enroll(minted.Token, "agent-3"), "Should reject a used-up token")
+
+	agent, err := store.Agents.GetByUUID(context.Background(), "agent-1")
+	require.NoError(t, err)
+	assert.Equal(t, "worker", agent.Role)
+	assert.Equal(t, "lab", agent.Labels["site"])
+	assert.Equal(t, minted.ID.Hex(), agent.EnrollmentTokenID)
+
+	tokens, err := store.EnrollmentTokens.List(context.Background())
+	require.NoError(t, err)
+	require.Len(t, tokens, 1)
+	assert.Equal(t, 2, tokens[0].Uses)
+	require.Len(t, tokens[0].Usages, 2)
+	assert.Equal(t, "agent-1", tokens[0].Usages[0].AgentUUID)
+}
+
+// failingAgentStore fails to create agents, as a database outage would.
+type failingAgentStore struct {
+	storage.AgentStore
+}
+
+func (failingAgentStore) Create(context.Context, *models.Agent) error {
+	return errors.New("database unavailable")
+}
+
+func TestEnrollmentReleasesTokenOnFailure(t *testing.T) {
+	ctx := context.Background()
+	e := setupEcho()
+	store := storage.NewMemoryStore()
+	h := setupHandler(store)
+
+	c, rec := newJSONContext(e, http.MethodPost, "/admin/enrollment-tokens", models.EnrollmentTokenRequest{MaxUses: 1})
+	c.Set("admin", "admin")
+	require.NoError(t, h.CreateEnrollmentToken(c))
+	require.Equal(t, http.StatusCreated, rec.Code)
+	var minted models.EnrollmentTokenResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &minted))
+
+	enroll := func() int {
+		c, rec := newJSONContext(e, http.MethodPost, "/api/agent/enroll", models.EnrollmentRequest{
+			Token:    minted.Token,
+			UUID:     "agent-1",
+			Hostname: "agent-1-host",
+			MacHash:  "mac",
+		})
+		require.NoError(t, h.EnrollAgent(c))
+		return rec.Code
+	}
+
+	agents := store.Agents
+	store.Agents = failingAgentStore{agents}
+	assert.Equal(t, http.StatusInternalServerError, enroll())
+	tokens, err := store.EnrollmentTokens.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, tokens, 1)
+	assert.Zero(t, tokens[0].Uses, "The failed enrollment gives back its use")
+	assert.Empty(t, tokens[0].Usages)
+
+	store.Agents = agents
+	assert.Equal(t, http.StatusOK, enroll(), "The single-use token still enrolls the agent")
+	assert.ErrorIs(t, store.EnrollmentTokens.Release(ctx, minted.ID, "agent-2"), storage.ErrNotFound,
+		"Only uses recorded for the agent are given back")
+}
@@ -0,0 +1,250 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/whit3rabbit/beehive/manager/api/handlers"
+	"github.com/whit3rabbit/beehive/manager/internal/secrets"
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
+	customMiddleware "github.com/whit3rabbit/beehive/manager/middleware"
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+func TestIdempotentTaskCreation(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	h := setupHandler(store)
+	e := setupEcho()
+
+	// Stands in for the agent authentication middleware
+	authenticate := func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set("agent_uuid", c.Request().Header.Get("X-Agent"))
+			return next(c)
+		}
+	}
+	idempotent := customMiddleware.IdempotencyMiddleware(store.IdempotencyKeys, testCredentialBox, time.Hour)
+	e.POST("/api/task/create", h.CreateTask, authenticate, idempotent)
+
+	create := func(agentID, key, command string) (*httptest.ResponseRecorder, models.TaskCreationResponse) {
+		body, _ := json.Marshal(handlers.TaskRequest{
+			Task: models.Task{AgentID: "agent-1", Type: "command_shell", Parameters: map[string]interface{}{"command": command}},
+		})
+		req := httptest.NewRequest(http.MethodPost, "/api/task/create", bytes.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set("X-Agent", agentID)
+		if key != "" {
+			req.Header.Set(customMiddleware.IdempotencyKeyHeader, key)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		var resp models.TaskCreationResponse
+		_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec, resp
+	}
+	countTasks := func() int {
+		tasks, err := store.Tasks.ListByAgent(ctx, "agent-1")
+		require.NoError(t, err)
+		return len(tasks)
+	}
+
+	rec, first := create("agent-0", "key-1", "uptime")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Header().Get(customMiddleware.IdempotentReplayedHeader))
+
+	rec, retried := create("agent-0", "key-1", "uptime")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, first.TaskID, retried.TaskID, "A retry returns the original response")
+	assert.Equal(t, "true", rec.Header().Get(customMiddleware.IdempotentReplayedHeader))
+	assert.Equal(t, 1, countTasks(), "A retry creates no task")
+
+	rec, _ = create("agent-0", "key-1", "reboot")
+	assert.Equal(t, http.StatusConflict, rec.Code, "A key cannot be reused for another request")
+	assert.Equal(t, 1, countTasks())
+
+	rec, other := create("agent-2", "key-1", "uptime")
+	require.Equal(t, http.StatusOK, rec.Code, "Keys are scoped to their caller")
+	assert.NotEqual(t, first.TaskID, other.TaskID)
+
+	rec, _ = create("agent-0", "", "uptime")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, 3, countTasks(), "Requests without a key are never deduplicated")
+
+	// A retry that arrives while the first request is still being handled
+	now := time.Now()
+	_, err := store.IdempotencyKeys.Reserve(ctx, &models.IdempotencyRecord{
+		Caller: models.AgentActor("agent-0"), Key: "key-2", RequestHash: "pending", CreatedAt: now, ExpiresAt: now.Add(time.Hour),
+	})
+	require.NoError(t, err)
+	rec, _ = create("agent-0", "key-2", "uptime")
+	assert.Equal(t, http.StatusConflict, rec.Code)
+
+	// Expired keys can be used again
+	_, err = store.IdempotencyKeys.Reserve(ctx, &models.IdempotencyRecord{
+		Caller: models.AgentActor("agent-0"), Key: "key-1", CreatedAt: now.Add(2 * time.Hour), ExpiresAt: now.Add(3 * time.Hour),
+	})
+	assert.NoError(t, err)
+}
+
+func TestIdempotentEnrollment(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	h := setupHandler(store)
+	e := setupEcho()
+	e.POST("/api/agent/enroll", h.EnrollAgent, customMiddleware.EnrollmentIdempotencyMiddleware(store.IdempotencyKeys, testCredentialBox, time.Hour))
+	require.NoError(t, store.EnrollmentTokens.Create(ctx, &models.EnrollmentToken{
+		TokenHash: secrets.Hash("token-1"), MaxUses: 1, ExpiresAt: time.Now().Add(time.Hour),
+	}))
+
+	enroll := func(key string) (*httptest.ResponseRecorder, models.AgentRegistrationResponse) {
+		body, _ := json.Marshal(models.EnrollmentRequest{Token: "token-1", UUID: "agent-1", Hostname: "host", MacHash: "mac"})
+		req := httptest.NewRequest(http.MethodPost, "/api/agent/enroll", bytes.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if key != "" {
+			req.Header.Set(customMiddleware.IdempotencyKeyHeader, key)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		var creds models.AgentRegistrationResponse
+		_ = json.Unmarshal(rec.Body.Bytes(), &creds)
+		return rec, creds
+	}
+
+	rec, first := enroll("key-1")
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec, retried := enroll("key-1")
+	require.Equal(t, http.StatusOK, rec.Code, "A retry after a lost response still gets the credentials")
+	assert.Equal(t, "true", rec.Header().Get(customMiddleware.IdempotentReplayedHeader))
+	assert.Equal(t, first.KeyID, retried.KeyID)
+	assert.Equal(t, first.APISecret, retried.APISecret)
+
+	tokens, err := store.EnrollmentTokens.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, tokens, 1)
+	assert.Equal(t, 1, tokens[0].Uses, "The retry does not use the token again")
+
+	rec, _ = enroll("key-2")
+	assert.Equal(t, http.StatusConflict, rec.Code, "Without the key the agent is enrolled already")
+}
+
+func TestIdempotentRegistration(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	h := setupHandler(store)
+	e := setupEcho()
+	opts := testSignatureOptions
+	opts.Replays = store.IdempotencyKeys
+	e.POST("/api/agent/enroll", h.EnrollAgent)
+	agentRoutes := e.Group("/api")
+	agentRoutes.Use(customMiddleware.APIAuthMiddleware(store.Agents, store.Nonces, testCredentialBox, opts))
+	agentRoutes.POST("/agent/register", h.RegisterAgent, customMiddleware.IdempotencyMiddleware(store.IdempotencyKeys, testCredentialBox, time.Hour))
+	agentRoutes.POST("/agent/heartbeat", h.AgentHeartbeat)
+	creds := enrollTestAgent(t, e, store, "agent-1")
+
+	register := func(keyID, secret, key, nickname string) (*httptest.ResponseRecorder, models.AgentRegistrationResponse) {
+		body, _ := json.Marshal(models.Agent{UUID: "agent-1", Nickname: nickname})
+		req := httptest.NewRequest(http.MethodPost, "/api/agent/register", bytes.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set("X-API-Key", keyID)
+		req.Header.Set("X-Signature", customMiddleware.ComputeSignature(secret, body))
+		if key != "" {
+			req.Header.Set(customMiddleware.IdempotencyKeyHeader, key)
+		}
+		rec := serve(e, req)
+		var resp models.AgentRegistrationResponse
+		_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec, resp
+	}
+
+	rec, rotated := register(creds.KeyID, creds.APISecret, "key-1", "renamed")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.NotEqual(t, creds.KeyID, rotated.KeyID)
+
+	// The agent lost the response and retries with the credentials it still has
+	rec, retried := register(creds.KeyID, creds.APISecret, "key-1", "renamed")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, "true", rec.Header().Get(customMiddleware.IdempotentReplayedHeader))
+	assert.Equal(t, rotated.KeyID, retried.KeyID)
+	assert.Equal(t, rotated.APISecret, retried.APISecret)
+
+	// The old credentials only replay that response
+	rec, _ = register(creds.KeyID, creds.APISecret, "key-2", "renamed")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "A new rotation needs the new credentials")
+	rec, _ = register(creds.KeyID, creds.APISecret, "key-1", "other")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "The retry must be the same request")
+	rec, _ = register(creds.KeyID, "wrong-secret", "key-1", "renamed")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	heartbeat, _ := json.Marshal(models.HeartbeatRequest{UUID: "agent-1", Timestamp: time.Now()})
+	rec = signedRequest(e, http.MethodPost, "/api/agent/heartbeat", creds.KeyID, creds.APISecret, heartbeat)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// Once the agent uses its new credentials the old ones are dropped
+	rec = signedRequest(e, http.MethodPost, "/api/agent/heartbeat", rotated.KeyID, rotated.APISecret, heartbeat)
+	require.Equal(t, http.StatusOK, rec.Code)
+	agent, err := store.Agents.GetByUUID(ctx, "agent-1")
+	require.NoError(t, err)
+	assert.Empty(t, agent.PreviousKeyID)
+	rec, _ = register(creds.KeyID, creds.APISecret, "key-1", "renamed")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestIdempotentJobResume(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	setupJobAgents(t, store)
+	h := setupHandler(store)
+	e := setupEcho()
+
+	authenticate := func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set("admin", "root")
+			return next(c)
+		}
+	}
+	e.POST("/admin/jobs", h.CreateJob, authenticate, customMiddleware.IdempotencyMiddleware(store.IdempotencyKeys, testCredentialBox, time.Hour))
+	create := func() (*httptest.ResponseRecorder, models.JobResponse) {
+		body, _ := json.Marshal(models.JobRequest{
+			Task:   models.TaskTemplate{Type: "command_shell", Parameters: map[string]interface{}{"command": "uptime"}},
+			Target: models.JobTarget{AgentIDs: []string{"web-1", "web-2"}},
+		})
+		req := httptest.NewRequest(http.MethodPost, "/admin/jobs", bytes.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(customMiddleware.IdempotencyKeyHeader, "key-1")
+		rec := serve(e, req)
+		var resp models.JobResponse
+		_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec, resp
+	}
+
+	// The job is stored but only some of its tasks are created
+	tasks := store.Tasks
+	store.Tasks = brokenAgentTasks{tasks, "web-2"}
+	rec, _ := create()
+	require.Equal(t, http.StatusInternalServerError, rec.Code)
+
+	store.Tasks = tasks
+	rec, resumed := create()
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	jobs, err := store.Jobs.List(ctx, 10)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1, "The retry resumes the job instead of creating another")
+	assert.Equal(t, jobs[0].ID, resumed.ID)
+	counts, err := store.Tasks.CountByStatus(ctx, storage.TaskFilter{JobID: resumed.ID.Hex()})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"queued": 2}, counts, "Each agent gets one task")
+
+	rec, replayed := create()
+	require.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, "true", rec.Header().Get(customMiddleware.IdempotentReplayedHeader))
+	assert.Equal(t, resumed.ID, replayed.ID)
+}
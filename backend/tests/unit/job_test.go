@@ -0,0 +1,175 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/whit3rabbit/beehive/manager/api/handlers"
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+// setupJobAgents stores five web agents, one of them decommissioned, and one database agent.
+func setupJobAgents(t *testing.T, store *storage.Store) {
+	ctx := context.Background()
+	require.NoError(t, store.Roles.Create(ctx, &models.Role{Name: "web"}))
+	for _, agent := range []models.Agent{
+		{UUID: "web-1", Role: "web", Status: "active", Labels: map[string]string{"zone": "a"}},
+		{UUID: "web-2", Role: "web", Status: "active", Labels: map[string]string{"zone": "a"}},
+		{UUID: "web-3", Role: "web", Status: "active", Labels: map[string]string{"zone": "b"}},
+		{UUID: "web-4", Role: "web", Status: "inactive", Labels: map[string]string{"zone": "b"}},
+		{UUID: "web-5", Role: "web", Status: "decommissioned", Labels: map[string]string{"zone": "a"}},
+		{UUID: "db-1", Role: "db", Status: "active", Labels: map[string]string{"zone": "a"}},
+	} {
+		agent := agent
+		agent.KeyID = "key-" + agent.UUID
+		require.NoError(t, store.Agents.Create(ctx, &agent))
+	}
+}
+
+func createJob(t *testing.T, h *handlers.Handler, target models.JobTarget) (int, models.JobResponse) {
+	c, rec := newJSONContext(setupEcho(), http.MethodPost, "/admin/jobs", models.JobRequest{
+		Name:   "uptime everywhere",
+		Task:   models.TaskTemplate{Type: "command_shell", Parameters: map[string]interface{}{"command": "uptime"}},
+		Target: target,
+	})
+	c.Set("admin", "root")
+	require.NoError(t, h.CreateJob(c))
+	var resp models.JobResponse
+	if rec.Code == http.StatusCreated {
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	}
+	return rec.Code, resp
+}
+
+func jobRequest(t *testing.T, handler echo.HandlerFunc, method, target, jobID string, out interface{}) int {
+	t.Helper()
+	c, rec := newJSONContext(setupEcho(), method, target, nil)
+	c.SetParamNames("job_id")
+	c.SetParamValues(jobID)
+	c.Set("admin", "root")
+	require.NoError(t, handler(c))
+	if out != nil && rec.Code == http.StatusOK {
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), out))
+	}
+	return rec.Code
+}
+
+func TestCreateJobTargets(t *testing.T) {
+	store := storage.NewMemoryStore()
+	setupJobAgents(t, store)
+	h := setupHandler(store)
+
+	tasksOf := func(jobID string) []string {
+		page, err := store.Tasks.List(context.Background(), storage.TaskQuery{Filter: storage.TaskFilter{JobID: jobID}})
+		require.NoError(t, err)
+		var agents []string
+		for _, task := range page.Tasks {
+			assert.Equal(t, "queued", task.Status)
+			assert.Equal(t, "root", task.CreatedBy)
+			agents = append(agents, task.AgentID)
+		}
+		return agents
+	}
+
+	code, job := createJob(t, h, models.JobTarget{Role: "web"})
+	require.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, 4, job.TaskCount, "Decommissioned agents are left out")
+	assert.Equal(t, models.JobProgress{
+		Total:      4,
+		Counts:     map[string]int64{"queued": 4},
+		Stragglers: job.Progress.Stragglers,
+	}, job.Progress)
+	assert.ElementsMatch(t, []string{"web-1", "web-2", "web-3", "web-4"}, tasksOf(job.ID.Hex()))
+
+	code, job = createJob(t, h, models.JobTarget{Labels: map[string]string{"zone": "a"}})
+	require.Equal(t, http.StatusCreated, code)
+	assert.ElementsMatch(t, []string{"web-1", "web-2", "db-1"}, tasksOf(job.ID.Hex()))
+
+	code, job = createJob(t, h, models.JobTarget{AgentIDs: []string{"db-1", "web-3", "db-1"}})
+	require.Equal(t, http.StatusCreated, code)
+	assert.ElementsMatch(t, []string{"db-1", "web-3"}, tasksOf(job.ID.Hex()))
+
+	for name, target := range map[string]models.JobTarget{
+		"no target":          {},
+		"two targets":        {Role: "web", AgentIDs: []string{"web-1"}},
+		"unknown agent":      {AgentIDs: []string{"web-1", "web-9"}},
+		"decommissioned":     {AgentIDs: []string{"web-5"}},
+		"unknown role":       {Role: "mail"},
+		"no matching agents": {Labels: map[string]string{"zone": "c"}},
+	} {
+		code, _ := createJob(t, h, target)
+		assert.Equal(t, http.StatusBadRequest, code, name)
+	}
+}
+
+func TestJobProgressAndCancel(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	setupJobAgents(t, store)
+	h := setupHandler(store)
+
+	code, job := createJob(t, h, models.JobTarget{Role: "web"})
+	require.Equal(t, http.StatusCreated, code)
+	jobID := job.ID.Hex()
+
+	now := time.Now()
+	claim := func(agentID string) *models.Task {
+		task, err := store.Tasks.ClaimNext(ctx, agentID, storage.DispatchPolicy{}, now)
+		require.NoError(t, err)
+		return task
+	}
+	require.NoError(t, store.Tasks.Finish(ctx, claim("web-1").ID, "web-1", "completed", &models.Output{Logs: "up 3 days"}, now))
+	require.NoError(t, store.Tasks.Finish(ctx, claim("web-2").ID, "web-2", "failed", &models.Output{Error: "denied"}, now))
+	running := claim("web-3")
+	require.NoError(t, store.Tasks.Start(ctx, running.ID, "web-3", now))
+
+	var resp models.JobResponse
+	require.Equal(t, http.StatusOK, jobRequest(t, h.GetJob, http.MethodGet, "/admin/jobs/"+jobID, jobID, &resp))
+	progress := resp.Progress
+	assert.Equal(t, int64(4), progress.Total)
+	assert.Equal(t, map[string]int64{"completed": 1, "failed": 1, "running": 1, "queued": 1}, progress.Counts)
+	assert.Equal(t, int64(2), progress.Finished)
+	assert.Equal(t, int64(1), progress.Succeeded)
+	assert.Equal(t, 0.5, progress.SuccessRatio)
+	assert.False(t, progress.Done)
+	var stragglers []string
+	for _, straggler := range progress.Stragglers {
+		stragglers = append(stragglers, straggler.AgentID)
+	}
+	assert.ElementsMatch(t, []string{"web-3", "web-4"}, stragglers)
+
+	var results models.JobResultsResponse
+	require.Equal(t, http.StatusOK, jobRequest(t, h.GetJobResults, http.MethodGet, "/admin/jobs/"+jobID+"/results?status=completed", jobID, &results))
+	require.Len(t, results.Results, 1)
+	assert.Equal(t, "web-1", results.Results[0].AgentID)
+	assert.Equal(t, "up 3 days", results.Results[0].Output.Logs)
+
+	var page models.JobResultsResponse
+	require.Equal(t, http.StatusOK, jobRequest(t, h.GetJobResults, http.MethodGet, "/admin/jobs/"+jobID+"/results?limit=3", jobID, &page))
+	assert.Len(t, page.Results, 3)
+	assert.Equal(t, int64(4), page.Total)
+	assert.NotEmpty(t, page.NextCursor)
+
+	var cancelled models.JobCancelResponse
+	require.Equal(t, http.StatusOK, jobRequest(t, h.CancelJob, http.MethodPost, "/admin/jobs/"+jobID+"/cancel", jobID, &cancelled))
+	assert.Equal(t, int64(2), cancelled.Cancelled, "Only unfinished tasks are cancelled")
+
+	counts, err := store.Tasks.CountByStatus(ctx, storage.TaskFilter{JobID: jobID})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"completed": 1, "failed": 1, "cancel_requested": 1, "cancelled": 1}, counts)
+
+	stored, err := store.Jobs.Get(ctx, job.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "root", stored.CancelledBy)
+
+	assert.Equal(t, http.StatusNotFound, jobRequest(t, h.GetJob, http.MethodGet, "/admin/jobs/x", "0123456789abcdef01234567", nil))
+	assert.Equal(t, http.StatusBadRequest, jobRequest(t, h.GetJob, http.MethodGet, "/admin/jobs/x", "x", nil))
+}
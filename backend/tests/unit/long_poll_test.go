@@ -0,0 +1,106 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/whit3rabbit/beehive/manager/api/handlers"
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
+	"github.com/whit3rabbit/beehive/manager/internal/tasktypes"
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+func TestLongPoll(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	h := handlers.NewHandler(store, testCredentialBox, tasktypes.Builtin(), storage.DispatchPolicy{}, handlers.ArtifactLimits{},
+		handlers.PollLimits{MaxWait: 200 * time.Millisecond, MaxWaiting: 1})
+	e := setupEcho()
+
+	poll := func(wait string) (int, models.TaskPollResponse) {
+		c, rec := newJSONContext(e, http.MethodGet, "/api/task/poll?wait="+wait, nil)
+		c.Set("agent_uuid", "agent-1")
+		require.NoError(t, h.PollTask(c))
+		var resp models.TaskPollResponse
+		_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec.Code, resp
+	}
+
+	for _, wait := range []string{"soon", "-1"} {
+		code, _ := poll(wait)
+		assert.Equal(t, http.StatusBadRequest, code, wait)
+	}
+
+	started := time.Now()
+	code, resp := poll("60")
+	require.Equal(t, http.StatusOK, code)
+	assert.Nil(t, resp.Task)
+	assert.GreaterOrEqual(t, time.Since(started), 200*time.Millisecond, "The poll is held while no task is queued")
+	assert.Less(t, time.Since(started), 5*time.Second, "The wait is capped by the server")
+
+	h = handlers.NewHandler(store, testCredentialBox, tasktypes.Builtin(), storage.DispatchPolicy{}, handlers.ArtifactLimits{},
+		handlers.PollLimits{MaxWait: 10 * time.Second, MaxWaiting: 1})
+	type result struct {
+		code int
+		resp models.TaskPollResponse
+	}
+	held := make(chan result)
+	go func() {
+		code, resp := poll("60")
+		held <- result{code, resp}
+	}()
+	// Let the first poll start waiting
+	time.Sleep(50 * time.Millisecond)
+	started = time.Now()
+	code, resp = poll("60")
+	require.Equal(t, http.StatusOK, code)
+	assert.Nil(t, resp.Task)
+	assert.Less(t, time.Since(started), time.Second, "Polls beyond the cap answer at once")
+
+	task := models.Task{AgentID: "agent-1", Type: "command_shell", Status: "queued", CreatedAt: time.Now()}
+	require.NoError(t, store.Tasks.Create(ctx, &task))
+	select {
+	case r := <-held:
+		require.Equal(t, http.StatusOK, r.code)
+		require.NotNil(t, r.resp.Task, "The held poll wakes up for the new task")
+		assert.Equal(t, task.ID.Hex(), r.resp.Task.TaskID)
+	case <-time.After(5 * time.Second):
+		t.Fatal("The held poll was not woken")
+	}
+}
+
+func TestTaskNotifier(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	now := time.Now()
+
+	woken := func(ch <-chan struct{}) bool {
+		select {
+		case <-ch:
+			return true
+		case <-time.After(50 * time.Millisecond):
+			return false
+		}
+	}
+	agent1, stop1 := store.TaskChanges.Subscribe("agent-1")
+	defer stop1()
+	agent2, stop2 := store.TaskChanges.Subscribe("agent-2")
+	defer stop2()
+
+	tasks := queueTasks(t, store, 1, now, func(task *models.Task) {})
+	assert.True(t, woken(agent1), "Queued tasks wake their agent")
+	assert.False(t, woken(agent2), "Only their agent")
+
+	_, err := store.Tasks.ClaimNext(ctx, "agent-1", storage.DispatchPolicy{}, now)
+	require.NoError(t, err)
+	assert.False(t, woken(agent1), "Claims wake nobody")
+
+	require.NoError(t, store.Tasks.Finish(ctx, tasks[0].ID, "agent-1", "completed", nil, now))
+	assert.True(t, woken(agent1), "Finished tasks free a slot")
+}
@@ -0,0 +1,184 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/whit3rabbit/beehive/manager/api/handlers"
+	"github.com/whit3rabbit/beehive/manager/internal/secrets"
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
+	"github.com/whit3rabbit/beehive/manager/internal/tasktypes"
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+var testCredentialBox, _ = secrets.NewBox("unit-test-credential-key")
+
+func setupEcho() *echo.Echo {
+	e := echo.New()
+	e.HTTPErrorHandler = handlers.CustomHTTPErrorHandler
+	return e
+}
+
+func setupHandler(store *storage.Store) *handlers.Handler {
+	return handlers.NewHandler(store, testCredentialBox, tasktypes.Builtin(), storage.DispatchPolicy{}, handlers.ArtifactLimits{}, handlers.PollLimits{})
+}
+
+// newJSONContext builds an echo context for a request with an optional JSON body.
+func newJSONContext(e *echo.Echo, method, target string, body interface{}) (echo.Context, *httptest.ResponseRecorder) {
+	var reader *bytes.Reader
+	if body != nil {
+		jsonBytes, _ := json.Marshal(body)
+		reader = bytes.NewReader(jsonBytes)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req := httptest.NewRequest(method, target, reader)
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	return e.NewContext(req, rec), rec
+}
+
+func TestMemoryTaskClaimOrder(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+
+	now := time.Now()
+	older := models.Task{AgentID: "agent-1", Type: "command_shell", Status: "queued", CreatedAt: now.Add(-time.Minute)}
+	newer := models.Task{AgentID: "agent-1", Type: "command_shell", Status: "queued", CreatedAt: now}
+	other := models.Task{AgentID: "agent-2", Type: "command_shell", Status: "queued", CreatedAt: now.Add(-time.Hour)}
+	for _, task := range []*models.Task{&newer, &older, &other} {
+		require.NoError(t, store.Tasks.Create(ctx, task))
+	}
+
+	claimed, err := store.Tasks.ClaimNext(ctx, "agent-1", storage.DispatchPolicy{}, now)
+	require.NoError(t, err)
+	assert.Equal(t, older.ID, claimed.ID, "Should claim the oldest queued task of the agent")
+	assert.Equal(t, "dispatched", claimed.Status)
+	assert.False(t, claimed.StartedAt.IsZero(), "Should set started_at")
+
+	claimed, err = store.Tasks.ClaimNext(ctx, "agent-1", storage.DispatchPolicy{}, now)
+	require.NoError(t, err)
+	assert.Equal(t, newer.ID, claimed.ID)
+
+	_, err = store.Tasks.ClaimNext(ctx, "agent-1", storage.DispatchPolicy{}, now)
+	assert.ErrorIs(t, err, storage.ErrNotFound, "Should report no queued work")
+}
+
+func TestMemoryTaskFinish(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+
+	task := models.Task{AgentID: "agent-1", Type: "command_shell", Status: "queued", CreatedAt: time.Now()}
+	require.NoError(t, store.Tasks.Create(ctx, &task))
+
+	output := &models.Output{Logs: "done"}
+	err := store.Tasks.Finish(ctx, task.ID, "agent-1", "completed", output, time.Now())
+	assert.ErrorIs(t, err, storage.ErrConflict, "Should reject finishing a task that is not running")
+
+	_, err = store.Tasks.ClaimNext(ctx, "agent-1", storage.DispatchPolicy{}, time.Now())
+	require.NoError(t, err)
+
+	err = store.Tasks.Finish(ctx, task.ID, "agent-2", "completed", output, time.Now())
+	assert.ErrorIs(t, err, storage.ErrNotFound, "Should hide tasks owned by other agents")
+
+	require.NoError(t, store.Tasks.Finish(ctx, task.ID, "agent-1", "completed", output, time.Now()))
+	stored, err := store.Tasks.Get(ctx, task.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "completed", stored.Status)
+	assert.Equal(t, "done", stored.Output.Logs)
+}
+
+func TestMemoryAgentLookup(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+
+	agent := models.Agent{UUID: "agent-1", Hostname: "host", APIKey: "key-1"}
+	require.NoError(t, store.Agents.Upsert(ctx, &agent))
+
+	found, err := store.Agents.GetByAPIKey(ctx, "key-1")
+	require.NoError(t, err)
+	assert.Equal(t, "agent-1", found.UUID)
+
+	duplicate := models.Agent{UUID: "agent-2", APIKey: "key-1"}
+	assert.ErrorIs(t, store.Agents.Upsert(ctx, &duplicate), storage.ErrDuplicate)
+
+	require.NoError(t, store.Agents.Heartbeat(ctx, "agent-1", time.Now()))
+	found, err = store.Agents.GetByUUID(ctx, "agent-1")
+	require.NoError(t, err)
+	assert.Equal(t, "active", found.Status)
+}
+
+func TestAPITaskPollAndUpdate(t *testing.T) {
+	e := setupEcho()
+	h := setupHandler(storage.NewMemoryStore())
+
+	// Queue a task for the agent
+	c, rec := newJSONContext(e, http.MethodPost, "/api/task/create", handlers.TaskRequest{
+		Task: models.Task{
+			AgentID:    "agent-1",
+			Type:       "command_shell",
+			Parameters: map[string]interface{}{"command": "hostname"},
+		},
+	})
+	require.NoError(t, h.CreateTask(c))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var created models.TaskCreationResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &created))
+
+	// Poll as the agent
+	c, rec = newJSONContext(e, http.MethodGet, "/api/task/poll", nil)
+	c.Set("agent_uuid", "agent-1")
+	require.NoError(t, h.PollTask(c))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var polled models.TaskPollResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &polled))
+	require.NotNil(t, polled.Task, "Should hand out the queued task")
+	assert.Equal(t, created.TaskID, polled.Task.TaskID)
+
+	// A second poll finds nothing
+	c, rec = newJSONContext(e, http.MethodGet, "/api/task/poll", nil)
+	c.Set("agent_uuid", "agent-1")
+	require.NoError(t, h.PollTask(c))
+	polled = models.TaskPollResponse{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &polled))
+	assert.Nil(t, polled.Task)
+
+	// Another agent cannot report on the task
+	update := models.TaskUpdateRequest{TaskID: created.TaskID, Status: "success", Output: &models.Output{Logs: "ok"}}
+	c, rec = newJSONContext(e, http.MethodPost, "/api/task/update", update)
+	c.Set("agent_uuid", "agent-2")
+	require.NoError(t, h.UpdateTask(c))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	// The owner can
+	c, rec = newJSONContext(e, http.MethodPost, "/api/task/update", update)
+	c.Set("agent_uuid", "agent-1")
+	require.NoError(t, h.UpdateTask(c))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// And only once
+	c, rec = newJSONContext(e, http.MethodPost, "/api/task/update", update)
+	c.Set("agent_uuid", "agent-1")
+	require.NoError(t, h.UpdateTask(c))
+	assert.Equal(t, http.StatusConflict, rec.Code)
+
+	c, rec = newJSONContext(e, http.MethodGet, "/api/task/status/"+created.TaskID, nil)
+	c.SetParamNames("task_id")
+	c.SetParamValues(created.TaskID)
+	require.NoError(t, h.GetTaskStatus(c))
+	var task models.Task
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &task))
+	assert.Equal(t, "completed", task.Status)
+	assert.Equal(t, "ok", task.Output.Logs)
+}
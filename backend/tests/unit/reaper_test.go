@@ -0,0 +1,75 @@
+package unit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/whit3rabbit/beehive/manager/internal/config"
+	"github.com/whit3rabbit/beehive/manager/internal/reaper"
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+func TestReaperSweep(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	now := time.Now()
+
+	for uuid, lastSeen := range map[string]time.Time{
+		"fresh":  now.Add(-30 * time.Second),
+		"quiet":  now.Add(-5 * time.Minute),
+		"silent": now.Add(-time.Hour),
+	} {
+		require.NoError(t, store.Agents.Create(ctx, &models.Agent{UUID: uuid, KeyID: "key-" + uuid, Status: "active", LastSeen: lastSeen}))
+	}
+
+	overdue := models.Task{AgentID: "fresh", Type: "scan", Status: "queued", Timeout: 60, CreatedAt: now}
+	noTimeout := models.Task{AgentID: "fresh", Type: "scan", Status: "queued", CreatedAt: now.Add(time.Second)}
+	orphaned := models.Task{AgentID: "silent", Type: "scan", Status: "queued", CreatedAt: now}
+	for _, task := range []*models.Task{&overdue, &noTimeout, &orphaned} {
+		require.NoError(t, store.Tasks.Create(ctx, task))
+	}
+	for _, agentID := range []string{"fresh", "fresh", "silent"} {
+		_, err := store.Tasks.ClaimNext(ctx, agentID, storage.DispatchPolicy{}, now.Add(-2*time.Minute))
+		require.NoError(t, err)
+	}
+
+	r := reaper.New(store, config.ReaperConfig{
+		IntervalSeconds:          1,
+		InactiveAfterSeconds:     120,
+		DisconnectedAfterSeconds: 900,
+		RequeueOrphanedTasks:     true,
+	})
+	result, err := r.Sweep(ctx, now)
+	require.NoError(t, err)
+	assert.Equal(t, reaper.Result{TimedOutTasks: 1, InactiveAgents: 1, DisconnectedAgents: 1, RequeuedTasks: 1}, result)
+
+	status := func(uuid string) string {
+		agent, err := store.Agents.GetByUUID(ctx, uuid)
+		require.NoError(t, err)
+		return agent.Status
+	}
+	assert.Equal(t, "active", status("fresh"))
+	assert.Equal(t, "inactive", status("quiet"))
+	assert.Equal(t, "disconnected", status("silent"))
+
+	task, err := store.Tasks.Get(ctx, overdue.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "timeout", task.Status)
+	task, err = store.Tasks.Get(ctx, noTimeout.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "dispatched", task.Status, "Tasks without a timeout are never timed out")
+	task, err = store.Tasks.Get(ctx, orphaned.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "queued", task.Status)
+	assert.True(t, task.StartedAt.IsZero())
+
+	// A second sweep finds nothing left to do
+	result, err = r.Sweep(ctx, now)
+	require.NoError(t, err)
+	assert.Equal(t, reaper.Result{}, result)
+}
@@ -0,0 +1,210 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/whit3rabbit/beehive/manager/internal/config"
+	"github.com/whit3rabbit/beehive/manager/internal/rollout"
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+func TestRolloutPlan(t *testing.T) {
+	agents := []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"}
+	sizes := func(waves []models.RolloutWave) []int {
+		var out []int
+		for _, wave := range waves {
+			out = append(out, len(wave.AgentIDs))
+		}
+		return out
+	}
+
+	byPercent := models.RolloutPolicy{BatchPercent: 30}
+	require.NoError(t, byPercent.Validate())
+	assert.Equal(t, []int{3, 3, 3, 1}, sizes(byPercent.Plan(agents)))
+
+	bySize := models.RolloutPolicy{BatchSize: 4, MaxFailureRate: 0.1}
+	require.NoError(t, bySize.Validate())
+	waves := bySize.Plan(agents)
+	assert.Equal(t, []int{4, 4, 2}, sizes(waves))
+	assert.Equal(t, 3, waves[2].Number)
+	assert.Equal(t, []string{"i", "j"}, waves[2].AgentIDs)
+
+	for _, invalid := range []models.RolloutPolicy{
+		{},
+		{BatchSize: 2, BatchPercent: 10},
+		{BatchPercent: 101},
+		{BatchSize: -1},
+		{BatchSize: 2, MaxFailureRate: 1.5},
+	} {
+		assert.Error(t, invalid.Validate(), "%+v", invalid)
+	}
+}
+
+func TestRollingJob(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	setupJobAgents(t, store)
+	h := setupHandler(store)
+	controller := rollout.New(store, config.RolloutConfig{IntervalSeconds: 1})
+	now := time.Now()
+
+	c, rec := newJSONContext(setupEcho(), http.MethodPost, "/admin/jobs", models.JobRequest{
+		Task:    models.TaskTemplate{Type: "command_shell", Parameters: map[string]interface{}{"command": "apt-get upgrade -y"}},
+		Target:  models.JobTarget{Role: "web"},
+		Rollout: &models.RolloutPolicy{BatchSize: 2, MaxFailureRate: 0.4},
+	})
+	c.Set("admin", "root")
+	require.NoError(t, h.CreateJob(c))
+	require.Equal(t, http.StatusCreated, rec.Code)
+	var created models.JobResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &created))
+	jobID := created.ID.Hex()
+	require.NotNil(t, created.Rollout)
+	assert.Equal(t, models.RolloutRunning, created.Rollout.Status)
+	assert.Equal(t, []string{"web-1", "web-2"}, created.Rollout.Waves[0].AgentIDs)
+	assert.Equal(t, []string{"web-3", "web-4"}, created.Rollout.Waves[1].AgentIDs)
+	assert.Equal(t, int64(2), created.Progress.Total, "Only the first wave is dispatched")
+
+	// finishWave claims and finishes the queued task of each agent
+	finishWave := func(statuses map[string]string) {
+		for agentID, status := range statuses {
+			task, err := store.Tasks.ClaimNext(ctx, agentID, storage.DispatchPolicy{}, now)
+			require.NoError(t, err)
+			require.NoError(t, store.Tasks.Finish(ctx, task.ID, agentID, status, &models.Output{}, now))
+		}
+	}
+	job := func() *models.Job {
+		job, err := store.Jobs.Get(ctx, created.ID)
+		require.NoError(t, err)
+		return job
+	}
+
+	result, err := controller.Step(ctx, now)
+	require.NoError(t, err)
+	assert.Equal(t, rollout.Result{}, result, "The first wave is still running")
+
+	finishWave(map[string]string{"web-1": "completed", "web-2": "completed"})
+	result, err = controller.Step(ctx, now)
+	require.NoError(t, err)
+	assert.Equal(t, rollout.Result{WavesStarted: 1}, result)
+	assert.Equal(t, 2, job().Rollout.CurrentWave)
+	counts, err := store.Tasks.CountByStatus(ctx, storage.TaskFilter{JobID: jobID, Wave: 2})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"queued": 2}, counts)
+
+	finishWave(map[string]string{"web-3": "completed", "web-4": "failed"})
+	result, err = controller.Step(ctx, now)
+	require.NoError(t, err)
+	assert.Equal(t, rollout.Result{Halted: 1}, result)
+	halted := job().Rollout
+	assert.Equal(t, models.RolloutHalted, halted.Status)
+	assert.Equal(t, "wave 2 failure rate 50% exceeded 40%", halted.HaltReason)
+	assert.Equal(t, int64(1), halted.Waves[1].Failed)
+	assert.Equal(t, 0.5, halted.Waves[1].FailureRate)
+
+	var resp models.JobResponse
+	require.Equal(t, http.StatusOK, jobRequest(t, h.ResumeJob, http.MethodPost, "/admin/jobs/"+jobID+"/resume", jobID, &resp))
+	assert.Equal(t, models.RolloutCompleted, resp.Rollout.Status, "The halted wave was the last")
+	assert.True(t, resp.Progress.Done)
+
+	assert.Equal(t, http.StatusConflict, jobRequest(t, h.AbortJob, http.MethodPost, "/admin/jobs/"+jobID+"/abort", jobID, nil),
+		"Finished rollouts cannot be aborted")
+
+	var trail []string
+	for _, event := range job().Rollout.Events {
+		trail = append(trail, event.Status+" "+event.Actor+" "+event.Reason)
+	}
+	assert.Equal(t, []string{
+		"running admin:root wave 1 started",
+		"running system:rollout wave 2 started",
+		"halted system:rollout wave 2 failure rate 50% exceeded 40%",
+		"completed admin:root all waves finished",
+	}, trail)
+}
+
+func TestRolloutAbortAndRecovery(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	setupJobAgents(t, store)
+	h := setupHandler(store)
+	controller := rollout.New(store, config.RolloutConfig{IntervalSeconds: 1})
+	now := time.Now()
+
+	// A manager that stored the job but stopped before creating the tasks of the first wave
+	job := models.Job{
+		Name:      "upgrade",
+		Task:      models.TaskTemplate{Type: "command_shell", Parameters: map[string]interface{}{"command": "upgrade"}},
+		TaskCount: 4,
+		CreatedBy: "root",
+		CreatedAt: now,
+	}
+	rollout.Start(&job, models.RolloutPolicy{BatchPercent: 50}, []string{"web-1", "web-2", "web-3", "web-4"}, "admin:root", now)
+	require.NoError(t, store.Jobs.Create(ctx, &job))
+
+	_, err := controller.Step(ctx, now)
+	require.NoError(t, err)
+	counts, err := store.Tasks.CountByStatus(ctx, storage.TaskFilter{JobID: job.ID.Hex()})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"queued": 2}, counts, "The missing tasks are created")
+
+	_, err = controller.Step(ctx, now)
+	require.NoError(t, err)
+	counts, err = store.Tasks.CountByStatus(ctx, storage.TaskFilter{JobID: job.ID.Hex()})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"queued": 2}, counts, "Tasks are not created twice")
+
+	require.Equal(t, http.StatusOK, jobRequest(t, h.CancelJob, http.MethodPost, "/admin/jobs/"+job.ID.Hex()+"/cancel", job.ID.Hex(), nil))
+
+	stored, err := store.Jobs.Get(ctx, job.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.RolloutAborted, stored.Rollout.Status)
+	assert.Equal(t, "job cancelled", stored.Rollout.Events[len(stored.Rollout.Events)-1].Reason)
+
+	result, err := controller.Step(ctx, now)
+	require.NoError(t, err)
+	assert.Equal(t, rollout.Result{}, result, "Aborted rollouts start no further waves")
+	counts, err = store.Tasks.CountByStatus(ctx, storage.TaskFilter{JobID: job.ID.Hex()})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"cancelled": 2}, counts)
+
+	_, err = rollout.Resume(ctx, store, job.ID, "admin:root", now)
+	assert.ErrorIs(t, err, rollout.ErrRolloutStatus)
+}
+
+func TestRolloutStepContinuesAfterError(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	setupJobAgents(t, store)
+	store.Tasks = brokenAgentTasks{store.Tasks, "web-1"}
+	controller := rollout.New(store, config.RolloutConfig{IntervalSeconds: 1})
+	now := time.Now()
+
+	// Two rollouts whose first wave still needs its tasks, one of which cannot be created
+	jobs := make([]models.Job, 2)
+	for i, agentID := range []string{"web-1", "web-2"} {
+		jobs[i] = models.Job{
+			Name:      "upgrade " + agentID,
+			Task:      models.TaskTemplate{Type: "command_shell", Parameters: map[string]interface{}{"command": "upgrade"}},
+			TaskCount: 1,
+			CreatedBy: "root",
+			CreatedAt: now,
+		}
+		rollout.Start(&jobs[i], models.RolloutPolicy{BatchSize: 1}, []string{agentID}, "admin:root", now)
+		require.NoError(t, store.Jobs.Create(ctx, &jobs[i]))
+	}
+
+	_, err := controller.Step(ctx, now)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), jobs[0].ID.Hex())
+	counts, err := store.Tasks.CountByStatus(ctx, storage.TaskFilter{JobID: jobs[1].ID.Hex()})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"queued": 1}, counts, "The failing rollout does not hold up the other")
+}
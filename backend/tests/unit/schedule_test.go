@@ -0,0 +1,283 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/whit3rabbit/beehive/manager/internal/config"
+	"github.com/whit3rabbit/beehive/manager/internal/scheduler"
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+var testSchedulerConfig = config.SchedulerConfig{IntervalSeconds: 1, MisfireGraceSeconds: 300}
+
+func newSchedule(name, cron string) models.Schedule {
+	return models.Schedule{
+		Name:    name,
+		Task:    models.TaskTemplate{Type: "command_shell", Parameters: map[string]interface{}{"command": "uptime"}},
+		Cron:    cron,
+		Target:  models.ScheduleTarget{AgentID: "agent-1"},
+		Enabled: true,
+	}
+}
+
+func TestScheduleNextRun(t *testing.T) {
+	now := time.Date(2024, 3, 9, 12, 0, 0, 0, time.UTC)
+
+	schedule := newSchedule("morning", "30 9 * * *")
+	schedule.Timezone = "America/New_York"
+	require.NoError(t, scheduler.Prepare(&schedule, now))
+	assert.Equal(t, models.MisfireRunOnce, schedule.Misfire)
+	assert.Equal(t, time.Date(2024, 3, 9, 14, 30, 0, 0, time.UTC), schedule.NextRunAt, "09:30 EST is 14:30 UTC")
+
+	next, err := scheduler.NextRun(&schedule, schedule.NextRunAt)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 3, 10, 13, 30, 0, 0, time.UTC), next, "Daylight saving time starts on March 10")
+
+	oneShot := newSchedule("once", "")
+	oneShot.RunAt = now.Add(time.Hour)
+	require.NoError(t, scheduler.Prepare(&oneShot, now))
+	assert.Equal(t, "UTC", oneShot.Timezone)
+	assert.Equal(t, now.Add(time.Hour), oneShot.NextRunAt)
+
+	for name, change := range map[string]func(*models.Schedule){
+		"no name":          func(s *models.Schedule) { s.Name = "" },
+		"bad cron":         func(s *models.Schedule) { s.Cron = "every minute" },
+		"cron and run_at":  func(s *models.Schedule) { s.RunAt = now.Add(time.Hour) },
+		"past run_at":      func(s *models.Schedule) { s.Cron = ""; s.RunAt = now.Add(-time.Hour) },
+		"bad timezone":     func(s *models.Schedule) { s.Timezone = "Mars/Olympus" },
+		"two targets":      func(s *models.Schedule) { s.Target.Role = "web" },
+		"no target":        func(s *models.Schedule) { s.Target = models.ScheduleTarget{} },
+		"bad misfire":      func(s *models.Schedule) { s.Misfire = "later" },
+		"bad retry policy": func(s *models.Schedule) { s.Task.Retry = &models.RetryPolicy{} },
+	} {
+		invalid := newSchedule("invalid", "*/5 * * * *")
+		change(&invalid)
+		assert.Error(t, scheduler.Prepare(&invalid, now), name)
+	}
+}
+
+func TestSchedulerFiresOccurrenceOnce(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	now := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	schedule := newSchedule("every five minutes", "*/5 * * * *")
+	schedule.CreatedBy = "root"
+	require.NoError(t, scheduler.Prepare(&schedule, now))
+	require.NoError(t, store.Schedules.Create(ctx, &schedule))
+
+	s := scheduler.New(store, testSchedulerConfig)
+	result, err := s.Tick(ctx, now.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, scheduler.Result{}, result, "Nothing is due yet")
+
+	fireAt := now.Add(5*time.Minute + time.Second)
+	result, err = s.Tick(ctx, fireAt)
+	require.NoError(t, err)
+	assert.Equal(t, scheduler.Result{Fired: 1, TasksCreated: 1}, result)
+
+	page, err := store.Tasks.List(ctx, storage.TaskQuery{Filter: storage.TaskFilter{AgentID: "agent-1"}, Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, page.Tasks, 1)
+	task := page.Tasks[0]
+	assert.Equal(t, "queued", task.Status)
+	assert.Equal(t, "root", task.CreatedBy)
+	assert.Equal(t, schedule.ID.Hex(), task.ScheduleID)
+	assert.Equal(t, now.Add(5*time.Minute), task.ScheduledFor)
+	assert.Equal(t, models.ActorScheduler, task.Events[0].Actor)
+
+	stored, err := store.Schedules.Get(ctx, schedule.ID)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(10*time.Minute), stored.NextRunAt)
+	assert.Equal(t, fireAt, stored.LastRunAt)
+
+	// A second manager that read the schedule before it was advanced fires the same occurrence
+	require.NoError(t, store.Schedules.Replace(ctx, &schedule))
+	result, err = s.Tick(ctx, fireAt)
+	require.NoError(t, err)
+	assert.Equal(t, 0, result.TasksCreated)
+	page, err = store.Tasks.List(ctx, storage.TaskQuery{Filter: storage.TaskFilter{AgentID: "agent-1"}, Limit: 10})
+	require.NoError(t, err)
+	assert.Len(t, page.Tasks, 1, "The occurrence is not fired twice")
+}
+
+func TestSchedulerMisfirePolicies(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	now := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	runOnce := newSchedule("run once", "0 * * * *")
+	skip := newSchedule("skip", "0 * * * *")
+	skip.Misfire = models.MisfireSkip
+	skip.Target.AgentID = "agent-2"
+	for _, schedule := range []*models.Schedule{&runOnce, &skip} {
+		require.NoError(t, scheduler.Prepare(schedule, now))
+		require.NoError(t, store.Schedules.Create(ctx, schedule))
+	}
+
+	// No manager ran for five hours
+	later := now.Add(5*time.Hour + 10*time.Minute)
+	result, err := scheduler.New(store, testSchedulerConfig).Tick(ctx, later)
+	require.NoError(t, err)
+	assert.Equal(t, scheduler.Result{Fired: 1, Skipped: 1, TasksCreated: 1}, result)
+
+	for _, schedule := range []models.Schedule{runOnce, skip} {
+		stored, err := store.Schedules.Get(ctx, schedule.ID)
+		require.NoError(t, err)
+		assert.Equal(t, time.Date(2024, 1, 1, 16, 0, 0, 0, time.UTC), stored.NextRunAt, schedule.Name)
+	}
+	skipped, err := store.Schedules.Get(ctx, skip.ID)
+	require.NoError(t, err)
+	assert.True(t, skipped.LastRunAt.IsZero())
+}
+
+func TestSchedulerTargets(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	now := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	for uuid, status := range map[string]string{"web-1": "active", "web-2": "inactive", "web-3": "decommissioned"} {
+		require.NoError(t, store.Agents.Create(ctx, &models.Agent{UUID: uuid, KeyID: "key-" + uuid, Role: "web", Status: status}))
+	}
+	require.NoError(t, store.Agents.Create(ctx, &models.Agent{UUID: "db-1", KeyID: "key-db-1", Role: "db", Status: "active"}))
+
+	byRole := newSchedule("by role", "")
+	byRole.RunAt = now.Add(time.Minute)
+	byRole.Target = models.ScheduleTarget{Role: "web"}
+	require.NoError(t, scheduler.Prepare(&byRole, now))
+	require.NoError(t, store.Schedules.Create(ctx, &byRole))
+
+	result, err := scheduler.New(store, testSchedulerConfig).Tick(ctx, now.Add(2*time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, scheduler.Result{Fired: 1, TasksCreated: 2}, result)
+
+	page, err := store.Tasks.List(ctx, storage.TaskQuery{Limit: 10})
+	require.NoError(t, err)
+	var agents []string
+	for _, task := range page.Tasks {
+		agents = append(agents, task.AgentID)
+	}
+	assert.ElementsMatch(t, []string{"web-1", "web-2"}, agents)
+
+	stored, err := store.Schedules.Get(ctx, byRole.ID)
+	require.NoError(t, err)
+	assert.True(t, stored.NextRunAt.IsZero(), "A one-shot schedule runs once")
+	due, err := store.Schedules.Due(ctx, now.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, due)
+}
+
+// brokenAgentTasks fails to create tasks for one agent, as a database error would.
+type brokenAgentTasks struct {
+	storage.TaskStore
+	agentID string
+}
+
+func (s brokenAgentTasks) Create(ctx context.Context, task *models.Task) error {
+	if task.AgentID == s.agentID {
+		return errors.New("database unavailable")
+	}
+	return s.TaskStore.Create(ctx, task)
+}
+
+func TestSchedulerContinuesAfterError(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	now := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	store.Tasks = brokenAgentTasks{store.Tasks, "agent-1"}
+
+	broken := newSchedule("broken", "*/5 * * * *")
+	healthy := newSchedule("healthy", "*/5 * * * *")
+	healthy.Target.AgentID = "agent-2"
+	for _, schedule := range []*models.Schedule{&broken, &healthy} {
+		require.NoError(t, scheduler.Prepare(schedule, now))
+		require.NoError(t, store.Schedules.Create(ctx, schedule))
+	}
+
+	result, err := scheduler.New(store, testSchedulerConfig).Tick(ctx, now.Add(5*time.Minute))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), broken.ID.Hex())
+	assert.Equal(t, scheduler.Result{Fired: 1, TasksCreated: 1}, result, "The failing schedule does not hold up the other")
+
+	stored, err := store.Schedules.Get(ctx, broken.ID)
+	require.NoError(t, err)
+	assert.Equal(t, broken.NextRunAt, stored.NextRunAt, "The failed occurrence is tried again")
+	stored, err = store.Schedules.Get(ctx, healthy.ID)
+	require.NoError(t, err)
+	assert.True(t, stored.NextRunAt.After(healthy.NextRunAt))
+}
+
+func TestScheduleHandlers(t *testing.T) {
+	e := setupEcho()
+	store := storage.NewMemoryStore()
+	h := setupHandler(store)
+	require.NoError(t, store.Roles.Create(context.Background(), &models.Role{Name: "web"}))
+
+	create := func(req models.ScheduleRequest) (int, models.Schedule) {
+		c, rec := newJSONContext(e, http.MethodPost, "/admin/schedules", req)
+		c.Set("admin", "root")
+		require.NoError(t, h.CreateSchedule(c))
+		var schedule models.Schedule
+		if rec.Code == http.StatusCreated {
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &schedule))
+		}
+		return rec.Code, schedule
+	}
+	valid := models.ScheduleRequest{
+		Name:   "disk usage",
+		Task:   models.TaskTemplate{Type: "command_shell", Parameters: map[string]interface{}{"command": " df -h "}},
+		Cron:   "@hourly",
+		Target: models.ScheduleTarget{Role: "web"},
+	}
+
+	code, schedule := create(valid)
+	require.Equal(t, http.StatusCreated, code)
+	assert.True(t, schedule.Enabled)
+	assert.Equal(t, "root", schedule.CreatedBy)
+	assert.Equal(t, "df -h", schedule.Task.Parameters["command"], "Parameters are normalized")
+	assert.False(t, schedule.NextRunAt.IsZero())
+
+	unknownRole := valid
+	unknownRole.Target = models.ScheduleTarget{Role: "db"}
+	code, _ = create(unknownRole)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	badType := valid
+	badType.Task.Type = "format_disk"
+	code, _ = create(badType)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	disabled := false
+	replacement := valid
+	replacement.Enabled = &disabled
+	c, rec := newJSONContext(e, http.MethodPut, "/admin/schedules/"+schedule.ID.Hex(), replacement)
+	c.SetParamNames("schedule_id")
+	c.SetParamValues(schedule.ID.Hex())
+	require.NoError(t, h.ReplaceSchedule(c))
+	require.Equal(t, http.StatusOK, rec.Code)
+	stored, err := store.Schedules.Get(context.Background(), schedule.ID)
+	require.NoError(t, err)
+	assert.False(t, stored.Enabled)
+	assert.Equal(t, "root", stored.CreatedBy)
+
+	c, rec = newJSONContext(e, http.MethodDelete, "/admin/schedules/"+schedule.ID.Hex(), nil)
+	c.SetParamNames("schedule_id")
+	c.SetParamValues(schedule.ID.Hex())
+	require.NoError(t, h.DeleteSchedule(c))
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+
+	c, rec = newJSONContext(e, http.MethodGet, "/admin/schedules/"+schedule.ID.Hex(), nil)
+	c.SetParamNames("schedule_id")
+	c.SetParamValues(schedule.ID.Hex())
+	require.NoError(t, h.GetSchedule(c))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
@@ -0,0 +1,153 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/whit3rabbit/beehive/manager/api/handlers"
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+func seedTasks(t *testing.T, store *storage.Store) []models.Task {
+	ctx := context.Background()
+	now := time.Now()
+	statuses := []string{"queued", "running", "completed", "failed", "queued", "completed"}
+	tasks := make([]models.Task, len(statuses))
+	for i, status := range statuses {
+		tasks[i] = models.Task{
+			AgentID:    fmt.Sprintf("agent-%d", i%2),
+			Type:       "command_shell",
+			Parameters: map[string]interface{}{"command": fmt.Sprintf("echo task-%d", i), "env": map[string]interface{}{"SHELL": "/bin/bash"}},
+			Status:     status,
+			Timeout:    30,
+			CreatedAt:  now.Add(time.Duration(i) * time.Second),
+			UpdatedAt:  now.Add(time.Duration(i) * time.Second),
+			CreatedBy:  "admin",
+		}
+		require.NoError(t, store.Tasks.Create(ctx, &tasks[i]))
+	}
+	return tasks
+}
+
+func listTasks(t *testing.T, h *handlers.Handler, query string) (int, models.TaskListResponse) {
+	c, rec := newJSONContext(setupEcho(), http.MethodGet, "/admin/tasks?"+query, nil)
+	require.NoError(t, h.ListTasks(c))
+
+	var resp models.TaskListResponse
+	if rec.Code == http.StatusOK {
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	}
+	return rec.Code, resp
+}
+
+func TestListTasks(t *testing.T) {
+	store := storage.NewMemoryStore()
+	tasks := seedTasks(t, store)
+	h := setupHandler(store)
+
+	// Newest first, two per page
+	var seen []string
+	cursor := ""
+	for pages := 0; pages < 10; pages++ {
+		code, resp := listTasks(t, h, "limit=2&cursor="+cursor)
+		require.Equal(t, http.StatusOK, code)
+		assert.Equal(t, int64(6), resp.Total)
+		for _, task := range resp.Tasks {
+			seen = append(seen, task.ID.Hex())
+		}
+		if resp.NextCursor == "" {
+			break
+		}
+		cursor = resp.NextCursor
+	}
+	require.Len(t, seen, 6)
+	assert.Equal(t, tasks[5].ID.Hex(), seen[0])
+	assert.Equal(t, tasks[0].ID.Hex(), seen[5])
+
+	_, resp := listTasks(t, h, "agent_id=agent-0&status=queued")
+	require.Len(t, resp.Tasks, 2)
+
+	// Free text covers nested parameters and ignores case
+	_, resp = listTasks(t, h, "q="+url.QueryEscape("ECHO TASK-3"))
+	require.Len(t, resp.Tasks, 1)
+	assert.Equal(t, tasks[3].ID, resp.Tasks[0].ID)
+	_, resp = listTasks(t, h, "q=/bin/bash")
+	assert.Len(t, resp.Tasks, 6)
+
+	created := tasks[2].CreatedAt.Add(time.Millisecond).UTC().Format(time.RFC3339Nano)
+	_, resp = listTasks(t, h, "order=asc&created_after="+url.QueryEscape(created))
+	require.Len(t, resp.Tasks, 3)
+	assert.Equal(t, tasks[3].ID, resp.Tasks[0].ID)
+
+	code, _ := listTasks(t, h, "sort=status")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestBulkCancelTasks(t *testing.T) {
+	store := storage.NewMemoryStore()
+	seedTasks(t, store)
+	h := setupHandler(store)
+	e := setupEcho()
+
+	c, rec := newJSONContext(e, http.MethodPost, "/admin/tasks/cancel", map[string]interface{}{})
+	require.NoError(t, h.BulkCancelTasks(c))
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "An empty filter needs an explicit all")
+
+	c, rec = newJSONContext(e, http.MethodPost, "/admin/tasks/cancel", map[string]interface{}{"agent_id": "agent-0"})
+	require.NoError(t, h.BulkCancelTasks(c))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var resp models.TaskBulkCancelResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, int64(2), resp.Cancelled, "Only the queued tasks of agent-0 are active")
+
+	_, list := listTasks(t, h, "status=cancelled")
+	assert.Len(t, list.Tasks, 2)
+
+	c, rec = newJSONContext(e, http.MethodPost, "/admin/tasks/cancel", map[string]interface{}{"all": true})
+	require.NoError(t, h.BulkCancelTasks(c))
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, int64(1), resp.Cancelled, "Only the running task of agent-1 was left")
+}
+
+func TestRerunTask(t *testing.T) {
+	store := storage.NewMemoryStore()
+	tasks := seedTasks(t, store)
+	h := setupHandler(store)
+	e := setupEcho()
+
+	rerun := func(id string) (int, models.TaskCreationResponse) {
+		c, rec := newJSONContext(e, http.MethodPost, "/admin/tasks/"+id+"/rerun", nil)
+		c.SetParamNames("task_id")
+		c.SetParamValues(id)
+		c.Set("admin", "operator")
+		require.NoError(t, h.RerunTask(c))
+		var resp models.TaskCreationResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec.Code, resp
+	}
+
+	code, _ := rerun(tasks[1].ID.Hex())
+	assert.Equal(t, http.StatusConflict, code, "Running tasks cannot be re-run")
+
+	code, resp := rerun(tasks[3].ID.Hex())
+	require.Equal(t, http.StatusCreated, code)
+
+	_, list := listTasks(t, h, "created_by=operator")
+	require.Len(t, list.Tasks, 1)
+	clone := list.Tasks[0]
+	assert.Equal(t, resp.TaskID, clone.ID.Hex())
+	assert.Equal(t, tasks[3].ID.Hex(), clone.RerunOf)
+	assert.Equal(t, "queued", clone.Status)
+	assert.Equal(t, tasks[3].AgentID, clone.AgentID)
+	assert.Equal(t, tasks[3].Parameters["command"], clone.Parameters["command"])
+	assert.Nil(t, clone.Output)
+}
@@ -0,0 +1,101 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/whit3rabbit/beehive/manager/internal/config"
+	"github.com/whit3rabbit/beehive/manager/internal/reaper"
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+func TestCooperativeCancel(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	h := setupHandler(store)
+	e := setupEcho()
+	now := time.Now()
+	require.NoError(t, store.Agents.Create(ctx, &models.Agent{UUID: "agent-1", KeyID: "key-1", Status: "active", LastSeen: now}))
+
+	tasks := queueTasks(t, store, 2, now, func(task *models.Task) {})
+	for range tasks {
+		_, err := store.Tasks.ClaimNext(ctx, "agent-1", storage.DispatchPolicy{}, now)
+		require.NoError(t, err)
+	}
+	for _, task := range tasks {
+		c, rec := newJSONContext(e, http.MethodPost, "/api/task/cancel/"+task.ID.Hex(), nil)
+		c.SetParamNames("task_id")
+		c.SetParamValues(task.ID.Hex())
+		c.Set("agent_uuid", "agent-0")
+		require.NoError(t, h.CancelTask(c))
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+	want := []string{tasks[0].ID.Hex(), tasks[1].ID.Hex()}
+
+	c, rec := newJSONContext(e, http.MethodGet, "/api/task/poll", nil)
+	c.Set("agent_uuid", "agent-1")
+	require.NoError(t, h.PollTask(c))
+	var polled models.TaskPollResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &polled))
+	assert.Nil(t, polled.Task)
+	assert.ElementsMatch(t, want, polled.CancelTasks, "The poll tells the agent what to stop")
+
+	c, rec = newJSONContext(e, http.MethodPost, "/api/agent/heartbeat", models.HeartbeatRequest{UUID: "agent-1", Timestamp: now})
+	c.Set("agent_uuid", "agent-1")
+	require.NoError(t, h.AgentHeartbeat(c))
+	var heartbeat models.HeartbeatResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &heartbeat))
+	assert.ElementsMatch(t, want, heartbeat.CancelTasks, "So does the heartbeat")
+
+	ack := func(agentID, taskID string) int {
+		c, rec := newJSONContext(e, http.MethodPost, "/api/task/cancel/"+taskID+"/ack", models.TaskCancelAckRequest{
+			Output: &models.Output{Logs: "stopped"},
+		})
+		c.SetParamNames("task_id")
+		c.SetParamValues(taskID)
+		c.Set("agent_uuid", agentID)
+		require.NoError(t, h.AcknowledgeCancel(c))
+		return rec.Code
+	}
+	assert.Equal(t, http.StatusNotFound, ack("agent-2", tasks[0].ID.Hex()), "Only the task's agent acknowledges")
+	assert.Equal(t, http.StatusOK, ack("agent-1", tasks[0].ID.Hex()))
+	assert.Equal(t, http.StatusConflict, ack("agent-1", tasks[0].ID.Hex()))
+
+	task, err := store.Tasks.Get(ctx, tasks[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.TaskStatusCancelled, task.Status)
+	assert.Equal(t, "stopped", task.Output.Logs)
+
+	c, rec = newJSONContext(e, http.MethodPost, "/api/task/update", models.TaskUpdateRequest{
+		TaskID: tasks[0].ID.Hex(), Status: "success", Output: &models.Output{Logs: "done"},
+	})
+	c.Set("agent_uuid", "agent-1")
+	require.NoError(t, h.UpdateTask(c))
+	assert.Equal(t, http.StatusConflict, rec.Code, "Late results are rejected")
+	assert.Contains(t, rec.Body.String(), "Task was cancelled")
+
+	// The second task is never acknowledged
+	cfg := config.ReaperConfig{IntervalSeconds: 1, InactiveAfterSeconds: 120, DisconnectedAfterSeconds: 900, CancelGraceSeconds: 300}
+	result, err := reaper.New(store, cfg).Sweep(ctx, now.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Zero(t, result.CancelledTasks, "The agent still has time to stop the task")
+	result, err = reaper.New(store, cfg).Sweep(ctx, now.Add(10*time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), result.CancelledTasks)
+
+	task, err = store.Tasks.Get(ctx, tasks[1].ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.TaskStatusCancelled, task.Status)
+	assert.Equal(t, models.ActorReaper, task.Events[len(task.Events)-1].Actor)
+
+	ids, err := store.Tasks.CancelRequested(ctx, "agent-1")
+	require.NoError(t, err)
+	assert.Empty(t, ids, "Nothing is left for the agent to stop")
+}
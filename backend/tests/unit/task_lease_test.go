@@ -0,0 +1,187 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/whit3rabbit/beehive/manager/api/handlers"
+	"github.com/whit3rabbit/beehive/manager/internal/config"
+	"github.com/whit3rabbit/beehive/manager/internal/reaper"
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
+	"github.com/whit3rabbit/beehive/manager/internal/tasktypes"
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+func TestTaskLeases(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	policy := storage.DispatchPolicy{Lease: time.Minute}
+	h := handlers.NewHandler(store, testCredentialBox, tasktypes.Builtin(), policy, handlers.ArtifactLimits{}, handlers.PollLimits{})
+	e := setupEcho()
+	now := time.Now()
+	require.NoError(t, store.Agents.Create(ctx, &models.Agent{UUID: "agent-1", KeyID: "key-1", Status: "active", LastSeen: now}))
+
+	tasks := queueTasks(t, store, 2, now, func(task *models.Task) {})
+	for range tasks {
+		claimed, err := store.Tasks.ClaimNext(ctx, "agent-1", policy, now)
+		require.NoError(t, err)
+		require.NotNil(t, claimed)
+		assert.WithinDuration(t, now.Add(time.Minute), claimed.LeaseExpiresAt, time.Second)
+	}
+
+	renew := func(agentID, taskID string) (int, models.TaskLeaseResponse) {
+		c, rec := newJSONContext(e, http.MethodPost, "/api/task/lease/"+taskID, nil)
+		c.SetParamNames("task_id")
+		c.SetParamValues(taskID)
+		c.Set("agent_uuid", agentID)
+		require.NoError(t, h.RenewTaskLease(c))
+		var resp models.TaskLeaseResponse
+		_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec.Code, resp
+	}
+	code, _ := renew("agent-2", tasks[0].ID.Hex())
+	assert.Equal(t, http.StatusNotFound, code, "Only the task's agent renews its lease")
+	code, lease := renew("agent-1", tasks[0].ID.Hex())
+	require.Equal(t, http.StatusOK, code)
+	assert.True(t, lease.LeaseExpiresAt.After(now.Add(time.Minute)))
+
+	c, rec := newJSONContext(e, http.MethodPost, "/api/agent/heartbeat", models.HeartbeatRequest{UUID: "agent-1", Timestamp: now})
+	c.Set("agent_uuid", "agent-1")
+	require.NoError(t, h.AgentHeartbeat(c))
+	var heartbeat models.HeartbeatResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &heartbeat))
+	require.NotNil(t, heartbeat.LeaseExpiresAt, "Heartbeats renew every lease the agent holds")
+	task, err := store.Tasks.Get(ctx, tasks[1].ID)
+	require.NoError(t, err)
+	assert.True(t, task.LeaseExpiresAt.Equal(*heartbeat.LeaseExpiresAt))
+
+	cfg := config.ReaperConfig{IntervalSeconds: 1, InactiveAfterSeconds: 3600, DisconnectedAfterSeconds: 7200}
+	result, err := reaper.New(store, cfg).Sweep(ctx, time.Now().Add(30*time.Second))
+	require.NoError(t, err)
+	assert.Zero(t, result.ExpiredLeases, "Leases were renewed")
+
+	result, err = reaper.New(store, cfg).Sweep(ctx, time.Now().Add(5*time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), result.ExpiredLeases)
+
+	task, err = store.Tasks.Get(ctx, tasks[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.TaskStatusQueued, task.Status)
+	assert.Equal(t, "agent-1", task.AgentID, "Without reassignment the task waits for its agent")
+	assert.True(t, task.LeaseExpiresAt.IsZero())
+	require.Len(t, task.Attempts, 1, "The lost attempt is recorded")
+	assert.Equal(t, "lease expired", task.Attempts[0].Reason)
+
+	code, _ = renew("agent-1", tasks[0].ID.Hex())
+	assert.Equal(t, http.StatusNotFound, code, "A lost task cannot be renewed")
+
+	disabled := setupHandler(store)
+	c, rec = newJSONContext(e, http.MethodPost, "/api/task/lease/"+tasks[0].ID.Hex(), nil)
+	c.SetParamNames("task_id")
+	c.SetParamValues(tasks[0].ID.Hex())
+	c.Set("agent_uuid", "agent-1")
+	require.NoError(t, disabled.RenewTaskLease(c))
+	assert.Equal(t, http.StatusConflict, rec.Code)
+}
+
+func TestReassignExpiredLeases(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	policy := storage.DispatchPolicy{Lease: time.Minute}
+	now := time.Now()
+	for _, agent := range []models.Agent{
+		{UUID: "agent-1", KeyID: "key-1", Role: "scanner", Status: "active", LastSeen: now},
+		{UUID: "agent-2", KeyID: "key-2", Role: "scanner", Status: "active", LastSeen: now},
+		{UUID: "agent-3", KeyID: "key-3", Role: "scanner", Status: "active", LastSeen: now},
+		{UUID: "agent-4", KeyID: "key-4", Role: "builder", Status: "active", LastSeen: now},
+	} {
+		agent := agent
+		require.NoError(t, store.Agents.Create(ctx, &agent))
+	}
+
+	// agent-2 is busier than agent-3
+	busy := models.Task{AgentID: "agent-2", Type: "command_shell", Status: "queued", CreatedAt: now}
+	require.NoError(t, store.Tasks.Create(ctx, &busy))
+	_, err := store.Tasks.ClaimNext(ctx, "agent-2", storage.DispatchPolicy{}, now)
+	require.NoError(t, err)
+
+	lost := models.Task{AgentID: "agent-1", Type: "command_shell", Status: "queued", CreatedAt: now}
+	require.NoError(t, store.Tasks.Create(ctx, &lost))
+	job := models.Task{AgentID: "agent-1", Type: "command_shell", Status: "queued", CreatedAt: now.Add(time.Second), JobID: "job-1"}
+	require.NoError(t, store.Tasks.Create(ctx, &job))
+	for i := 0; i < 2; i++ {
+		_, err := store.Tasks.ClaimNext(ctx, "agent-1", policy, now.Add(time.Duration(i)*time.Second))
+		require.NoError(t, err)
+	}
+
+	cfg := config.ReaperConfig{IntervalSeconds: 1, InactiveAfterSeconds: 3600, DisconnectedAfterSeconds: 7200, ReassignExpiredLeases: true}
+	result, err := reaper.New(store, cfg).Sweep(ctx, now.Add(5*time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), result.ExpiredLeases)
+
+	task, err := store.Tasks.Get(ctx, lost.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.TaskStatusQueued, task.Status)
+	assert.Equal(t, "agent-3", task.AgentID, "The least busy agent of the same role takes over")
+	require.Len(t, task.Attempts, 1)
+	assert.Equal(t, "agent-1", task.Attempts[0].AgentID)
+
+	task, err = store.Tasks.Get(ctx, job.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "agent-1", task.AgentID, "Tasks of jobs stay with their agent")
+}
+
+func TestRequeueExpiredUniqueness(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	policy := storage.DispatchPolicy{Lease: time.Minute}
+	now := time.Now()
+	occurrence := now.Truncate(time.Hour)
+	for _, agent := range []models.Agent{
+		{UUID: "agent-1", KeyID: "key-1", Role: "scanner", Status: "active", LastSeen: now},
+		{UUID: "agent-2", KeyID: "key-2", Role: "scanner", Status: "active", LastSeen: now},
+	} {
+		agent := agent
+		require.NoError(t, store.Agents.Create(ctx, &agent))
+	}
+
+	// agent-2 already has its own task for the occurrence and the wave
+	for _, task := range []models.Task{
+		{AgentID: "agent-2", ScheduleID: "schedule-1", ScheduledFor: occurrence},
+		{AgentID: "agent-2", JobID: "job-1", Wave: 1},
+	} {
+		task.Type, task.Status, task.CreatedAt = "command_shell", "queued", now.Add(time.Hour)
+		require.NoError(t, store.Tasks.Create(ctx, &task))
+	}
+	scheduled := models.Task{AgentID: "agent-1", Type: "command_shell", Status: "queued", CreatedAt: now, ScheduleID: "schedule-1", ScheduledFor: occurrence}
+	require.NoError(t, store.Tasks.Create(ctx, &scheduled))
+	wave := models.Task{AgentID: "agent-1", Type: "command_shell", Status: "queued", CreatedAt: now.Add(time.Second), JobID: "job-1", Wave: 1}
+	require.NoError(t, store.Tasks.Create(ctx, &wave))
+	for i := 0; i < 2; i++ {
+		_, err := store.Tasks.ClaimNext(ctx, "agent-1", policy, now.Add(time.Duration(i)*time.Second))
+		require.NoError(t, err)
+	}
+
+	later := now.Add(5 * time.Minute)
+	assert.ErrorIs(t, store.Tasks.RequeueExpired(ctx, scheduled.ID, "agent-2", later), storage.ErrDuplicate)
+	assert.ErrorIs(t, store.Tasks.RequeueExpired(ctx, wave.ID, "agent-2", later), storage.ErrDuplicate)
+	task, err := store.Tasks.Get(ctx, scheduled.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.TaskStatusDispatched, task.Status, "A clash leaves the task as it was")
+
+	// The reaper falls back to the agent that lost the task
+	cfg := config.ReaperConfig{IntervalSeconds: 1, InactiveAfterSeconds: 3600, DisconnectedAfterSeconds: 7200, ReassignExpiredLeases: true}
+	result, err := reaper.New(store, cfg).Sweep(ctx, later)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), result.ExpiredLeases)
+	task, err = store.Tasks.Get(ctx, scheduled.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.TaskStatusQueued, task.Status)
+	assert.Equal(t, "agent-1", task.AgentID)
+}
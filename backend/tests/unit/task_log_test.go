@@ -0,0 +1,196 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/whit3rabbit/beehive/manager/api/handlers"
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+func appendLog(t *testing.T, h *handlers.Handler, agentID, taskID string, body interface{}) (int, models.TaskLogAppendResponse) {
+	c, rec := newJSONContext(setupEcho(), http.MethodPost, "/api/task/logs/"+taskID, body)
+	c.SetParamNames("task_id")
+	c.SetParamValues(taskID)
+	c.Set("agent_uuid", agentID)
+	require.NoError(t, h.AppendTaskLog(c))
+	var resp models.TaskLogAppendResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	return rec.Code, resp
+}
+
+func readLog(t *testing.T, h *handlers.Handler, taskID, query, lastEventID string) (int, string) {
+	c, rec := newJSONContext(setupEcho(), http.MethodGet, "/admin/tasks/"+taskID+"/logs?"+query, nil)
+	if lastEventID != "" {
+		c.Request().Header.Set("Last-Event-ID", lastEventID)
+	}
+	c.SetParamNames("task_id")
+	c.SetParamValues(taskID)
+	require.NoError(t, h.GetTaskLog(c))
+	return rec.Code, rec.Body.String()
+}
+
+func TestAppendTaskLog(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	h := setupHandler(store)
+
+	task := queueTasks(t, store, 1, time.Now(), func(task *models.Task) {})[0]
+	id := task.ID.Hex()
+	chunk := func(seq int64, stream, data string) map[string]interface{} {
+		return map[string]interface{}{"sequence": seq, "stream": stream, "data": data}
+	}
+
+	code, _ := appendLog(t, h, "agent-1", id, chunk(0, "stdout", "starting\n"))
+	assert.Equal(t, http.StatusConflict, code, "Queued tasks have no log yet")
+
+	_, err := store.Tasks.ClaimNext(ctx, "agent-1", storage.DispatchPolicy{}, time.Now())
+	require.NoError(t, err)
+
+	code, _ = appendLog(t, h, "agent-2", id, chunk(0, "stdout", "starting\n"))
+	assert.Equal(t, http.StatusNotFound, code, "Only the task's agent may append")
+	code, _ = appendLog(t, h, "agent-1", id, map[string]interface{}{"data": "no sequence"})
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = appendLog(t, h, "agent-1", id, chunk(0, "stdin", "x"))
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = appendLog(t, h, "agent-1", id, chunk(0, "stdout", strings.Repeat("x", handlers.MaxLogChunkSize+1)))
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// Chunks may arrive out of order and be resent
+	code, resp := appendLog(t, h, "agent-1", id, chunk(1, "stderr", "warning\n"))
+	require.Equal(t, http.StatusOK, code)
+	assert.False(t, resp.Duplicate)
+	code, _ = appendLog(t, h, "agent-1", id, chunk(0, "", "starting\n"))
+	require.Equal(t, http.StatusOK, code)
+	code, resp = appendLog(t, h, "agent-1", id, chunk(1, "stderr", "warning\n"))
+	require.Equal(t, http.StatusOK, code)
+	assert.True(t, resp.Duplicate, "Resent chunks are acknowledged once")
+
+	code, body := readLog(t, h, id, "", "")
+	require.Equal(t, http.StatusOK, code)
+	var page models.TaskLogResponse
+	require.NoError(t, json.Unmarshal([]byte(body), &page))
+	require.Len(t, page.Chunks, 2)
+	assert.Equal(t, 1, page.Attempt)
+	assert.Equal(t, "stdout", page.Chunks[0].Stream)
+	assert.Equal(t, "starting\n", page.Chunks[0].Data)
+	assert.Equal(t, int64(2), page.NextSequence)
+
+	code, body = readLog(t, h, id, "from=1&limit=1", "")
+	require.Equal(t, http.StatusOK, code)
+	page = models.TaskLogResponse{}
+	require.NoError(t, json.Unmarshal([]byte(body), &page))
+	require.Len(t, page.Chunks, 1)
+	assert.Equal(t, "stderr", page.Chunks[0].Stream)
+
+	code, _ = readLog(t, h, id, "limit=0", "")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestFollowTaskLog(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	h := setupHandler(store)
+	interval := handlers.LogFollowInterval
+	handlers.LogFollowInterval = 10 * time.Millisecond
+	defer func() { handlers.LogFollowInterval = interval }()
+
+	task := queueTasks(t, store, 1, time.Now(), func(task *models.Task) {})[0]
+	id := task.ID.Hex()
+	_, err := store.Tasks.ClaimNext(ctx, "agent-1", storage.DispatchPolicy{}, time.Now())
+	require.NoError(t, err)
+	code, _ := appendLog(t, h, "agent-1", id, map[string]interface{}{"sequence": 0, "data": "line 1\n"})
+	require.Equal(t, http.StatusOK, code)
+
+	type result struct {
+		code int
+		body string
+	}
+	followed := make(chan result)
+	go func() {
+		code, body := readLog(t, h, id, "follow=true", "")
+		followed <- result{code, body}
+	}()
+
+	// The stream picks up chunks appended while it runs, even below one it already sent, and
+	// ends with the attempt
+	time.Sleep(30 * time.Millisecond)
+	code, _ = appendLog(t, h, "agent-1", id, map[string]interface{}{"sequence": 2, "data": "line 3\n"})
+	require.Equal(t, http.StatusOK, code)
+	time.Sleep(30 * time.Millisecond)
+	code, _ = appendLog(t, h, "agent-1", id, map[string]interface{}{"sequence": 1, "stream": "stderr", "data": "line 2\n"})
+	require.Equal(t, http.StatusOK, code)
+	require.NoError(t, store.Tasks.Start(ctx, task.ID, "agent-1", time.Now()))
+	require.NoError(t, store.Tasks.Finish(ctx, task.ID, "agent-1", "completed", &models.Output{}, time.Now()))
+
+	select {
+	case res := <-followed:
+		assert.Equal(t, http.StatusOK, res.code)
+		assert.Contains(t, res.body, "id: 0\nevent: stdout\ndata: ")
+		assert.Contains(t, res.body, "id: 1\nevent: stderr\ndata: ")
+		assert.Contains(t, res.body, `line 2\n`)
+		assert.Equal(t, 1, strings.Count(res.body, "id: 2\n"), "Chunks are sent once")
+		assert.Less(t, strings.Index(res.body, "id: 2\n"), strings.Index(res.body, "id: 1\n"))
+		assert.True(t, strings.HasSuffix(res.body, "event: end\ndata: {\"next_sequence\":3}\n\n"))
+	case <-time.After(5 * time.Second):
+		t.Fatal("The log stream did not end with the task")
+	}
+
+	// A reconnecting client resumes after the last event it saw
+	code, body := readLog(t, h, id, "follow=true", "0")
+	require.Equal(t, http.StatusOK, code)
+	assert.NotContains(t, body, "id: 0\n")
+	assert.Contains(t, body, "id: 1\n")
+}
+
+func TestFollowTaskLogGap(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	h := setupHandler(store)
+	interval, gapTimeout := handlers.LogFollowInterval, handlers.LogGapTimeout
+	handlers.LogFollowInterval, handlers.LogGapTimeout = 10*time.Millisecond, 30*time.Millisecond
+	defer func() { handlers.LogFollowInterval, handlers.LogGapTimeout = interval, gapTimeout }()
+
+	task := queueTasks(t, store, 1, time.Now(), func(task *models.Task) {})[0]
+	id := task.ID.Hex()
+	_, err := store.Tasks.ClaimNext(ctx, "agent-1", storage.DispatchPolicy{}, time.Now())
+	require.NoError(t, err)
+	for _, seq := range []int{0, 2} {
+		code, _ := appendLog(t, h, "agent-1", id, map[string]interface{}{"sequence": seq, "data": "line\n"})
+		require.Equal(t, http.StatusOK, code)
+	}
+
+	followed := make(chan string)
+	go func() {
+		_, body := readLog(t, h, id, "follow=true", "")
+		followed <- body
+	}()
+
+	// The stream moves past a gap left unfilled for too long and keeps following the log
+	time.Sleep(100 * time.Millisecond)
+	for _, seq := range []int{1, 3} {
+		code, _ := appendLog(t, h, "agent-1", id, map[string]interface{}{"sequence": seq, "data": "late\n"})
+		require.Equal(t, http.StatusOK, code)
+	}
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, store.Tasks.Start(ctx, task.ID, "agent-1", time.Now()))
+	require.NoError(t, store.Tasks.Finish(ctx, task.ID, "agent-1", "completed", &models.Output{}, time.Now()))
+
+	select {
+	case body := <-followed:
+		assert.Contains(t, body, "id: 2\n")
+		assert.Contains(t, body, "id: 3\n")
+		assert.NotContains(t, body, "id: 1\n", "A chunk filling an abandoned gap is not sent")
+		assert.True(t, strings.HasSuffix(body, "event: end\ndata: {\"next_sequence\":4}\n\n"))
+	case <-time.After(5 * time.Second):
+		t.Fatal("The log stream did not end with the task")
+	}
+}
@@ -0,0 +1,149 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/whit3rabbit/beehive/manager/api/handlers"
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
+	"github.com/whit3rabbit/beehive/manager/internal/tasktypes"
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+func number(n float64) models.TaskOutput {
+	return models.TaskOutput{Type: models.ValueTypeNumber, Value: n}
+}
+
+func text(s string) models.TaskOutput {
+	return models.TaskOutput{Type: models.ValueTypeString, Value: s}
+}
+
+func TestTaskResultValidation(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	types := tasktypes.Builtin()
+	require.NoError(t, types.Register(tasktypes.TaskType{
+		Name:   "port_scan",
+		Schema: json.RawMessage(`{"type": "object"}`),
+		ResultSchema: json.RawMessage(`{
+			"type": "object",
+			"properties": {"open_ports": {"type": "integer", "minimum": 0}},
+			"required": ["open_ports"]
+		}`),
+	}))
+	h := handlers.NewHandler(store, testCredentialBox, types, storage.DispatchPolicy{}, handlers.ArtifactLimits{}, handlers.PollLimits{})
+	e := setupEcho()
+
+	tasks := queueTasks(t, store, 2, time.Now(), func(task *models.Task) { task.Type = "port_scan" })
+	for range tasks {
+		_, err := store.Tasks.ClaimNext(ctx, "agent-1", storage.DispatchPolicy{}, time.Now())
+		require.NoError(t, err)
+	}
+
+	update := func(task models.Task, status string, results map[string]models.TaskOutput) int {
+		c, rec := newJSONContext(e, http.MethodPost, "/api/task/update", models.TaskUpdateRequest{
+			TaskID: task.ID.Hex(), Status: status, Output: &models.Output{Logs: "done", Results: results},
+		})
+		c.Set("agent_uuid", "agent-1")
+		require.NoError(t, h.UpdateTask(c))
+		return rec.Code
+	}
+	assert.Equal(t, http.StatusBadRequest, update(tasks[0], "success", map[string]models.TaskOutput{
+		"open_ports": {Type: models.ValueTypeNumber, Value: "3"},
+	}), "Values must be of their declared type")
+	assert.Equal(t, http.StatusBadRequest, update(tasks[0], "success", map[string]models.TaskOutput{
+		"open.ports": number(3),
+	}), "Names must not contain dots")
+	assert.Equal(t, http.StatusBadRequest, update(tasks[0], "success", map[string]models.TaskOutput{
+		"open_ports": number(-1),
+	}), "Results must match the schema of the task type")
+	assert.Equal(t, http.StatusBadRequest, update(tasks[0], "success", nil), "Successful tasks report the required results")
+	assert.Equal(t, http.StatusOK, update(tasks[1], "failure", nil), "Failed tasks may report no results")
+
+	assert.Equal(t, http.StatusOK, update(tasks[0], "success", map[string]models.TaskOutput{
+		"open_ports": number(3), "banner": text("OpenSSH"),
+	}))
+	task, err := store.Tasks.Get(ctx, tasks[0].ID)
+	require.NoError(t, err)
+	require.NotNil(t, task.Output)
+	assert.Equal(t, text("OpenSSH"), task.Output.Results["banner"])
+}
+
+func TestQueryTaskResults(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	h := setupHandler(store)
+	e := setupEcho()
+	now := time.Now()
+
+	results := []map[string]models.TaskOutput{
+		{"open_ports": number(3), "host": text("a")},
+		{"open_ports": number(0), "host": text("b")},
+		{"open_ports": number(5), "host": text("c")},
+		{"host": text("d")},
+	}
+	for i, agentID := range []string{"agent-1", "agent-2", "agent-1", "agent-2"} {
+		task := models.Task{AgentID: agentID, Type: "command_shell", Status: "queued", CreatedAt: now}
+		require.NoError(t, store.Tasks.Create(ctx, &task))
+		_, err := store.Tasks.ClaimNext(ctx, agentID, storage.DispatchPolicy{}, now)
+		require.NoError(t, err)
+		finishedAt := now.Add(time.Duration(i) * time.Second)
+		require.NoError(t, store.Tasks.Finish(ctx, task.ID, agentID, "completed", &models.Output{Results: results[i]}, finishedAt))
+	}
+
+	query := func(body interface{}) (int, models.TaskResultQueryResponse) {
+		c, rec := newJSONContext(e, http.MethodPost, "/admin/tasks/results", body)
+		require.NoError(t, h.QueryTaskResults(c))
+		var resp models.TaskResultQueryResponse
+		_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec.Code, resp
+	}
+
+	code, resp := query(map[string]interface{}{
+		"where": []map[string]interface{}{{"field": "open_ports", "op": "gt", "value": 0}},
+	})
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, resp.Tasks, 2)
+	assert.Equal(t, "c", resp.Tasks[0].Results["host"].Value, "Most recently updated first")
+	assert.Equal(t, "a", resp.Tasks[1].Results["host"].Value)
+
+	code, resp = query(map[string]interface{}{
+		"where": []map[string]interface{}{{"field": "open_ports", "op": "exists", "value": false}},
+	})
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, resp.Tasks, 1)
+	assert.Equal(t, "d", resp.Tasks[0].Results["host"].Value)
+
+	code, resp = query(map[string]interface{}{
+		"group_by": "agent_id",
+		"aggregates": []map[string]interface{}{
+			{"field": "open_ports", "op": "sum"},
+			{"field": "open_ports", "op": "avg"},
+			{"field": "open_ports", "op": "max"},
+		},
+	})
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, resp.Groups, 2)
+	assert.Equal(t, "agent-1", resp.Groups[0].Key)
+	assert.Equal(t, int64(2), resp.Groups[0].Count)
+	assert.Equal(t, map[string]float64{"sum_open_ports": 8, "avg_open_ports": 4, "max_open_ports": 5}, resp.Groups[0].Values)
+	assert.Equal(t, "agent-2", resp.Groups[1].Key)
+	assert.Equal(t, map[string]float64{"sum_open_ports": 0, "avg_open_ports": 0, "max_open_ports": 0}, resp.Groups[1].Values,
+		"Tasks without the result are left out of the aggregates")
+
+	for _, body := range []map[string]interface{}{
+		{"where": []map[string]interface{}{{"field": "results.open_ports", "op": "gt", "value": 0}}},
+		{"where": []map[string]interface{}{{"field": "open_ports", "op": "regex", "value": "."}}},
+		{"group_by": "parameters"},
+		{"limit": handlers.MaxResultQueryLimit + 1},
+	} {
+		code, _ := query(body)
+		assert.Equal(t, http.StatusBadRequest, code, "%v", body)
+	}
+}
@@ -0,0 +1,151 @@
+package unit
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/whit3rabbit/beehive/manager/api/handlers"
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	fixed := models.RetryPolicy{MaxAttempts: 3, DelaySeconds: 10}
+	require.NoError(t, fixed.Validate())
+	assert.Equal(t, models.BackoffFixed, fixed.Backoff)
+	assert.Equal(t, []string{"failed", "timeout"}, fixed.RetryOn)
+	assert.Equal(t, 10*time.Second, fixed.Delay(1))
+	assert.Equal(t, 10*time.Second, fixed.Delay(3))
+
+	exponential := models.RetryPolicy{MaxAttempts: 5, Backoff: "exponential", DelaySeconds: 10, MaxDelaySeconds: 60}
+	require.NoError(t, exponential.Validate())
+	assert.Equal(t, 10*time.Second, exponential.Delay(1))
+	assert.Equal(t, 20*time.Second, exponential.Delay(2))
+	assert.Equal(t, 40*time.Second, exponential.Delay(3))
+	assert.Equal(t, 60*time.Second, exponential.Delay(4), "Delays are capped")
+
+	jittered := models.RetryPolicy{MaxAttempts: 2, DelaySeconds: 10, Jitter: 0.5}
+	require.NoError(t, jittered.Validate())
+	for i := 0; i < 20; i++ {
+		delay := jittered.Delay(1)
+		assert.True(t, delay > 5*time.Second && delay <= 10*time.Second, "delay %s", delay)
+	}
+
+	for _, invalid := range []models.RetryPolicy{
+		{MaxAttempts: 0},
+		{MaxAttempts: 3, Backoff: "linear"},
+		{MaxAttempts: 3, DelaySeconds: -1},
+		{MaxAttempts: 3, Jitter: 2},
+		{MaxAttempts: 3, RetryOn: []string{"completed"}},
+	} {
+		assert.Error(t, invalid.Validate(), "%+v", invalid)
+	}
+}
+
+func TestTaskRetries(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	now := time.Now()
+
+	task := models.Task{
+		AgentID:   "agent-1",
+		Type:      "command_shell",
+		Status:    "queued",
+		CreatedAt: now,
+		Retry:     &models.RetryPolicy{MaxAttempts: 2, Backoff: "fixed", DelaySeconds: 60, RetryOn: []string{"failed"}},
+	}
+	require.NoError(t, store.Tasks.Create(ctx, &task))
+
+	claimed, err := store.Tasks.ClaimNext(ctx, "agent-1", storage.DispatchPolicy{}, now)
+	require.NoError(t, err)
+	assert.Equal(t, 1, claimed.Attempt)
+
+	require.NoError(t, store.Tasks.Finish(ctx, task.ID, "agent-1", "failed", &models.Output{Error: "boom"}, now))
+	stored, err := store.Tasks.Get(ctx, task.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "queued", stored.Status, "A retryable failure is queued again")
+	assert.Equal(t, now.Add(time.Minute), stored.NextRetryAt)
+	require.Len(t, stored.Attempts, 1)
+	assert.Equal(t, models.TaskAttempt{
+		Number: 1, AgentID: "agent-1", Status: "failed", StartedAt: now, FinishedAt: now, Output: &models.Output{Error: "boom"},
+	}, stored.Attempts[0])
+	assert.Equal(t, "retry 2 of 2 after failed", stored.Events[len(stored.Events)-1].Reason)
+
+	_, err = store.Tasks.ClaimNext(ctx, "agent-1", storage.DispatchPolicy{}, now.Add(30*time.Second))
+	assert.ErrorIs(t, err, storage.ErrNotFound, "Retries wait for their delay")
+
+	later := now.Add(2 * time.Minute)
+	claimed, err = store.Tasks.ClaimNext(ctx, "agent-1", storage.DispatchPolicy{}, later)
+	require.NoError(t, err)
+	assert.Equal(t, 2, claimed.Attempt)
+	assert.True(t, claimed.NextRetryAt.IsZero())
+
+	require.NoError(t, store.Tasks.Finish(ctx, task.ID, "agent-1", "failed", &models.Output{Error: "boom"}, later))
+	stored, err = store.Tasks.Get(ctx, task.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "failed", stored.Status, "The last attempt stays failed")
+	assert.Len(t, stored.Attempts, 2)
+}
+
+func TestTaskRetryOnTimeout(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	now := time.Now()
+
+	newTask := func(retryOn ...string) *models.Task {
+		task := &models.Task{
+			AgentID:   "agent-1",
+			Type:      "command_shell",
+			Status:    "queued",
+			Timeout:   10,
+			CreatedAt: now,
+			Retry:     &models.RetryPolicy{MaxAttempts: 3, RetryOn: retryOn},
+		}
+		require.NoError(t, store.Tasks.Create(ctx, task))
+		_, err := store.Tasks.ClaimNext(ctx, "agent-1", storage.DispatchPolicy{}, now)
+		require.NoError(t, err)
+		return task
+	}
+	retried := newTask("timeout")
+	notRetried := newTask("failed")
+	cancelling := newTask("timeout")
+	_, err := store.Tasks.Transition(ctx, cancelling.ID, "cancel_requested", models.TaskEvent{Actor: "admin:root", Timestamp: now})
+	require.NoError(t, err)
+
+	changed, err := store.Tasks.TimeoutOverdue(ctx, now.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), changed)
+
+	for task, want := range map[*models.Task]string{retried: "queued", notRetried: "timeout", cancelling: "timeout"} {
+		stored, err := store.Tasks.Get(ctx, task.ID)
+		require.NoError(t, err)
+		assert.Equal(t, want, stored.Status)
+		require.Len(t, stored.Attempts, 1)
+		assert.Equal(t, "timeout", stored.Attempts[0].Status)
+	}
+}
+
+func TestCreateTaskValidatesRetryPolicy(t *testing.T) {
+	e := setupEcho()
+	h := setupHandler(storage.NewMemoryStore())
+
+	create := func(retry *models.RetryPolicy) int {
+		c, rec := newJSONContext(e, http.MethodPost, "/api/task/create", handlers.TaskRequest{
+			Task: models.Task{
+				AgentID:    "agent-1",
+				Type:       "command_shell",
+				Parameters: map[string]interface{}{"command": "hostname"},
+				Retry:      retry,
+			},
+		})
+		require.NoError(t, h.CreateTask(c))
+		return rec.Code
+	}
+	assert.Equal(t, http.StatusOK, create(&models.RetryPolicy{MaxAttempts: 3, Backoff: "exponential", DelaySeconds: 5, Jitter: 0.2}))
+	assert.Equal(t, http.StatusBadRequest, create(&models.RetryPolicy{MaxAttempts: 100}))
+}
@@ -0,0 +1,128 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/whit3rabbit/beehive/manager/api/handlers"
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+func TestTaskTransitions(t *testing.T) {
+	cases := []struct {
+		from, to string
+		allowed  bool
+	}{
+		{"", "queued", true},
+		{"queued", "dispatched", true},
+		{"queued", "running", false},
+		{"queued", "completed", false},
+		{"dispatched", "running", true},
+		{"running", "completed", true},
+		{"running", "cancel_requested", true},
+		{"cancel_requested", "cancelled", true},
+		{"cancel_requested", "running", false},
+		{"completed", "queued", false},
+		{"cancelled", "running", false},
+	}
+	for _, tc := range cases {
+		assert.Equal(t, tc.allowed, models.CanTransition(tc.from, tc.to), "%q -> %q", tc.from, tc.to)
+	}
+
+	task := models.Task{Status: "completed"}
+	err := task.Transition("running", models.ActorSystem, "", time.Now())
+	assert.ErrorIs(t, err, models.ErrIllegalTransition)
+	assert.Equal(t, "completed", task.Status, "A rejected transition leaves the task alone")
+	assert.Empty(t, task.Events)
+}
+
+func TestStoreRejectsIllegalTransition(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+
+	task := models.Task{AgentID: "agent-1", Type: "scan", Status: "completed", CreatedAt: time.Now()}
+	require.NoError(t, store.Tasks.Create(ctx, &task))
+
+	_, err := store.Tasks.Transition(ctx, task.ID, "queued", models.TaskEvent{Actor: models.ActorSystem, Timestamp: time.Now()})
+	assert.ErrorIs(t, err, storage.ErrConflict)
+	assert.ErrorIs(t, err, models.ErrIllegalTransition)
+
+	err = store.Tasks.Start(ctx, task.ID, "agent-1", time.Now())
+	assert.ErrorIs(t, err, storage.ErrConflict)
+}
+
+func TestTaskHistory(t *testing.T) {
+	e := setupEcho()
+	h := setupHandler(storage.NewMemoryStore())
+
+	c, rec := newJSONContext(e, http.MethodPost, "/api/task/create", handlers.TaskRequest{
+		Task: models.Task{AgentID: "agent-1", Type: "command_shell", Parameters: map[string]interface{}{"command": "sleep 60"}},
+	})
+	c.Set("agent_uuid", "agent-0")
+	require.NoError(t, h.CreateTask(c))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var created models.TaskCreationResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &created))
+
+	c, rec = newJSONContext(e, http.MethodGet, "/api/task/poll", nil)
+	c.Set("agent_uuid", "agent-1")
+	require.NoError(t, h.PollTask(c))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	update := func(status string, output *models.Output) int {
+		c, rec := newJSONContext(e, http.MethodPost, "/api/task/update", models.TaskUpdateRequest{
+			TaskID: created.TaskID, Status: status, Output: output,
+		})
+		c.Set("agent_uuid", "agent-1")
+		require.NoError(t, h.UpdateTask(c))
+		return rec.Code
+	}
+	assert.Equal(t, http.StatusOK, update("running", nil))
+	assert.Equal(t, http.StatusConflict, update("running", nil), "A running task cannot start again")
+
+	cancelTask := func() (int, models.TaskCancelResponse) {
+		c, rec := newJSONContext(e, http.MethodPost, "/api/task/cancel/"+created.TaskID, nil)
+		c.SetParamNames("task_id")
+		c.SetParamValues(created.TaskID)
+		c.Set("agent_uuid", "agent-0")
+		require.NoError(t, h.CancelTask(c))
+		var resp models.TaskCancelResponse
+		_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec.Code, resp
+	}
+	code, resp := cancelTask()
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "cancel_requested", resp.Status, "A running task is stopped by its agent")
+
+	assert.Equal(t, http.StatusOK, update("failure", &models.Output{Error: "interrupted"}))
+	code, _ = cancelTask()
+	assert.Equal(t, http.StatusConflict, code, "Finished tasks cannot be cancelled")
+
+	c, rec = newJSONContext(e, http.MethodGet, "/api/task/status/"+created.TaskID, nil)
+	c.SetParamNames("task_id")
+	c.SetParamValues(created.TaskID)
+	require.NoError(t, h.GetTaskStatus(c))
+	var task models.Task
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &task))
+
+	require.Len(t, task.Events, 5)
+	var steps [][3]string
+	for _, event := range task.Events {
+		steps = append(steps, [3]string{event.From, event.To, event.Actor})
+		assert.False(t, event.Timestamp.IsZero())
+	}
+	assert.Equal(t, [][3]string{
+		{"", "queued", "agent:agent-0"},
+		{"queued", "dispatched", "agent:agent-1"},
+		{"dispatched", "running", "agent:agent-1"},
+		{"running", "cancel_requested", "agent:agent-0"},
+		{"cancel_requested", "failed", "agent:agent-1"},
+	}, steps)
+}
@@ -0,0 +1,111 @@
+package unit
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/whit3rabbit/beehive/manager/api/handlers"
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
+	"github.com/whit3rabbit/beehive/manager/internal/tasktypes"
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+func TestBuiltinTaskTypes(t *testing.T) {
+	registry := tasktypes.Builtin()
+
+	params, err := registry.Validate("command_shell", map[string]interface{}{"command": "  whoami \n"})
+	require.NoError(t, err)
+	assert.Equal(t, "whoami", params["command"], "Commands are trimmed")
+
+	_, err = registry.Validate("command_shell", map[string]interface{}{"cmd": "whoami"})
+	var invalid *tasktypes.ValidationError
+	require.ErrorAs(t, err, &invalid)
+	assert.NotEmpty(t, invalid.Problems)
+
+	params, err = registry.Validate("file_operation", map[string]interface{}{"operation": "READ", "path": "/etc/hosts"})
+	require.NoError(t, err)
+	assert.Equal(t, "read", params["operation"])
+
+	_, err = registry.Validate("file_operation", map[string]interface{}{"operation": "write", "path": "/tmp/x"})
+	assert.ErrorAs(t, err, &invalid, "Writes need content")
+
+	_, err = registry.Validate("scan", nil)
+	assert.ErrorIs(t, err, tasktypes.ErrUnknownType)
+}
+
+func TestTaskTypesFromDirectory(t *testing.T) {
+	dir := t.TempDir()
+	custom := `{"name": "ping", "description": "Pings a host.", "schema": {
+		"type": "object",
+		"properties": {"host": {"type": "string"}, "count": {"type": "integer", "minimum": 1}},
+		"required": ["host"]
+	}}`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "ping.json"), []byte(custom), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "README.txt"), []byte("ignored"), 0o600))
+
+	registry := tasktypes.Builtin()
+	loaded, err := registry.LoadDir(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ping"}, loaded)
+
+	_, err = registry.Validate("ping", map[string]interface{}{"host": "example.com", "count": 3})
+	assert.NoError(t, err)
+	_, err = registry.Validate("ping", map[string]interface{}{"host": "example.com", "count": 0})
+	assert.Error(t, err)
+
+	loaded, err = tasktypes.NewRegistry().LoadDir(filepath.Join(dir, "missing"))
+	assert.NoError(t, err, "A missing directory is not an error")
+	assert.Empty(t, loaded)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "broken.json"), []byte(`{"name": "broken", "schema": {"type": 5}}`), 0o600))
+	_, err = tasktypes.NewRegistry().LoadDir(dir)
+	assert.Error(t, err, "Invalid schemas are reported")
+}
+
+func TestCreateTaskValidatesParameters(t *testing.T) {
+	e := setupEcho()
+	h := setupHandler(storage.NewMemoryStore())
+
+	create := func(taskType string, params map[string]interface{}) (int, string) {
+		c, rec := newJSONContext(e, http.MethodPost, "/api/task/create", handlers.TaskRequest{
+			Task: models.Task{AgentID: "agent-1", Type: taskType, Parameters: params},
+		})
+		require.NoError(t, h.CreateTask(c))
+		return rec.Code, rec.Body.String()
+	}
+
+	code, _ := create("browser_automation", map[string]interface{}{"script": "open('https://example.com')"})
+	assert.Equal(t, http.StatusOK, code)
+
+	code, body := create("browser_automation", map[string]interface{}{})
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, body, "script")
+
+	code, body = create("scan", map[string]interface{}{"target": "localhost"})
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, body, "Invalid task type")
+}
+
+func TestListTaskTypes(t *testing.T) {
+	e := setupEcho()
+	h := setupHandler(storage.NewMemoryStore())
+
+	c, rec := newJSONContext(e, http.MethodGet, "/admin/task-types", nil)
+	require.NoError(t, h.ListTaskTypes(c))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var resp models.TaskTypeListResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	var names []string
+	for _, taskType := range resp.TaskTypes {
+		names = append(names, taskType.Name)
+		assert.True(t, json.Valid(taskType.Schema))
+	}
+	assert.Equal(t, []string{"browser_automation", "command_shell", "file_operation", "ui_automation"}, names)
+}
@@ -0,0 +1,282 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+
+	"github.com/whit3rabbit/beehive/manager/api/handlers"
+	"github.com/whit3rabbit/beehive/manager/internal/secrets"
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+// portScan declares a required host and an optional port with a default.
+func portScan() models.TemplateRequest {
+	return models.TemplateRequest{
+		Name: "port-check",
+		Task: models.TemplateTask{
+			Type:       "command_shell",
+			Parameters: map[string]interface{}{"command": "nc -z {{ host }} {{port}}"},
+			Timeout:    60,
+		},
+		Variables: []models.TemplateVariable{
+			{Name: "host", Type: models.VariableString},
+			{Name: "port", Type: models.VariableInteger, Default: 22},
+		},
+	}
+}
+
+func createTemplate(t *testing.T, h *handlers.Handler, req models.TemplateRequest) (int, models.Template) {
+	t.Helper()
+	c, rec := newJSONContext(setupEcho(), http.MethodPost, "/admin/templates", req)
+	c.Set("admin", "root")
+	require.NoError(t, h.CreateTemplate(c))
+	var created models.Template
+	if rec.Code == http.StatusCreated {
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &created))
+	}
+	return rec.Code, created
+}
+
+func TestTemplateRender(t *testing.T) {
+	req := portScan()
+	template := req.Template()
+	require.NoError(t, template.Validate())
+
+	task, err := template.Render(map[string]interface{}{"host": "db-1"})
+	require.NoError(t, err)
+	assert.Equal(t, "nc -z db-1 22", task.Parameters["command"])
+	assert.Equal(t, 60, task.Timeout)
+
+	// A parameter that is exactly one placeholder keeps the type of the value
+	typed := models.Template{
+		Name:      "typed",
+		Task:      models.TaskTemplate{Type: "x", Parameters: map[string]interface{}{"port": "{{port}}", "args": []interface{}{"-p", "{{ port }}"}}},
+		Variables: []models.TemplateVariable{{Name: "port", Type: models.VariableInteger}},
+	}
+	require.NoError(t, typed.Validate())
+	task, err = typed.Render(map[string]interface{}{"port": float64(8080)})
+	require.NoError(t, err)
+	assert.Equal(t, float64(8080), task.Parameters["port"])
+	assert.Equal(t, []interface{}{"-p", float64(8080)}, task.Parameters["args"])
+	assert.Equal(t, "{{port}}", typed.Task.Parameters["port"], "Rendering leaves the template alone")
+
+	for name, values := range map[string]map[string]interface{}{
+		"missing required":  {},
+		"wrong type":        {"host": "db-1", "port": "ssh"},
+		"fractional":        {"host": "db-1", "port": 22.5},
+		"unknown variable":  {"host": "db-1", "user": "root"},
+		"non-string string": {"host": true},
+	} {
+		_, err := template.Render(values)
+		assert.Error(t, err, name)
+	}
+
+	for name, invalid := range map[string]models.Template{
+		"name":       {Name: "Port Check", Task: models.TaskTemplate{Type: "x"}},
+		"type":       {Name: "a"},
+		"undeclared": {Name: "a", Task: models.TaskTemplate{Type: "x", Parameters: map[string]interface{}{"command": "{{ nope }}"}}},
+		"var type":   {Name: "a", Task: models.TaskTemplate{Type: "x"}, Variables: []models.TemplateVariable{{Name: "v", Type: "list"}}},
+		"duplicate":  {Name: "a", Task: models.TaskTemplate{Type: "x"}, Variables: []models.TemplateVariable{{Name: "v", Type: "string"}, {Name: "v", Type: "string"}}},
+		"default":    {Name: "a", Task: models.TaskTemplate{Type: "x"}, Variables: []models.TemplateVariable{{Name: "v", Type: "boolean", Default: "yes"}}},
+	} {
+		assert.Error(t, invalid.Validate(), name)
+	}
+}
+
+func TestTemplateVersionsAndInstantiate(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	setupJobAgents(t, store)
+	h := setupHandler(store)
+
+	code, first := createTemplate(t, h, portScan())
+	require.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, 1, first.Version)
+
+	changed := portScan()
+	changed.Task.Parameters = map[string]interface{}{"command": "nc -zv {{ host }} {{port}}"}
+	code, second := createTemplate(t, h, changed)
+	require.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, 2, second.Version)
+
+	invalid := portScan()
+	invalid.Task.Type = "no_such_type"
+	code, _ = createTemplate(t, h, invalid)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	versions, err := store.Templates.Versions(ctx, "port-check")
+	require.NoError(t, err)
+	assert.Len(t, versions, 2)
+
+	instantiate := func(req models.TemplateInstantiateRequest) (int, models.Task) {
+		c, rec := newJSONContext(setupEcho(), http.MethodPost, "/admin/templates/port-check/instantiate", req)
+		c.SetParamNames("name")
+		c.SetParamValues("port-check")
+		c.Set("admin", "root")
+		require.NoError(t, h.InstantiateTemplate(c))
+		var task models.Task
+		if rec.Code == http.StatusCreated {
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &task))
+		}
+		return rec.Code, task
+	}
+
+	code, task := instantiate(models.TemplateInstantiateRequest{AgentID: "web-1", Variables: map[string]interface{}{"host": "db-1", "port": 5432}})
+	require.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, "nc -zv db-1 5432", task.Parameters["command"])
+	assert.Equal(t, models.TaskStatusQueued, task.Status)
+	assert.Equal(t, "port-check", task.TemplateName)
+	assert.Equal(t, 2, task.TemplateVersion)
+	assert.Equal(t, "root", task.CreatedBy)
+
+	code, task = instantiate(models.TemplateInstantiateRequest{AgentID: "web-1", Version: 1, Variables: map[string]interface{}{"host": "db-1"}})
+	require.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, "nc -z db-1 22", task.Parameters["command"])
+
+	code, _ = instantiate(models.TemplateInstantiateRequest{AgentID: "web-1"})
+	assert.Equal(t, http.StatusBadRequest, code, "host has no default")
+	code, _ = instantiate(models.TemplateInstantiateRequest{AgentID: "web-5", Variables: map[string]interface{}{"host": "db-1"}})
+	assert.Equal(t, http.StatusBadRequest, code, "Decommissioned agents get no tasks")
+	code, _ = instantiate(models.TemplateInstantiateRequest{AgentID: "web-1", Version: 3, Variables: map[string]interface{}{"host": "db-1"}})
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestTemplateExportImport(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	h := setupHandler(store)
+
+	code, _ := createTemplate(t, h, portScan())
+	require.Equal(t, http.StatusCreated, code)
+
+	c, rec := newJSONContext(setupEcho(), http.MethodGet, "/admin/templates/export", nil)
+	require.NoError(t, h.ExportTemplates(c))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/yaml", rec.Header().Get(echo.HeaderContentType))
+
+	var file models.TemplateFile
+	require.NoError(t, yaml.Unmarshal(rec.Body.Bytes(), &file))
+	require.Len(t, file.Templates, 1)
+	assert.Equal(t, "port-check", file.Templates[0].Name)
+	assert.Contains(t, rec.Body.String(), "{{ host }}")
+
+	importYAML := func(body string) int {
+		req := httptest.NewRequest(http.MethodPost, "/admin/templates/import", bytes.NewReader([]byte(body)))
+		req.Header.Set(echo.HeaderContentType, "application/yaml")
+		rec := httptest.NewRecorder()
+		c := setupEcho().NewContext(req, rec)
+		c.Set("admin", "root")
+		require.NoError(t, h.ImportTemplates(c))
+		return rec.Code
+	}
+
+	// Importing the export stores the next version
+	assert.Equal(t, http.StatusCreated, importYAML(rec.Body.String()))
+	latest, err := store.Templates.Get(ctx, "port-check", 0)
+	require.NoError(t, err)
+	assert.Equal(t, 2, latest.Version)
+	assert.Equal(t, "nc -z {{ host }} {{port}}", latest.Task.Parameters["command"])
+	assert.Equal(t, 22, latest.Variables[1].Default)
+
+	assert.Equal(t, http.StatusCreated, importYAML(`
+templates:
+  - name: uptime
+    task:
+      type: command_shell
+      parameters:
+        command: uptime
+      retry:
+        max_attempts: 2
+        delay_seconds: 10
+`))
+	uptime, err := store.Templates.Get(ctx, "uptime", 0)
+	require.NoError(t, err)
+	assert.Equal(t, 2, uptime.Task.Retry.MaxAttempts)
+
+	// One invalid template rejects the whole import
+	assert.Equal(t, http.StatusBadRequest, importYAML(`
+templates:
+  - name: disk
+    task: {type: command_shell, parameters: {command: df -h}}
+  - name: broken
+    task: {type: command_shell, parameters: {}}
+`))
+	_, err = store.Templates.Get(ctx, "disk", 0)
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	assert.Equal(t, http.StatusBadRequest, importYAML("templates:\n  - name: x\n    tsk: {}\n"), "Unknown fields are rejected")
+}
+
+func TestRoleDefaultTasks(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	setupJobAgents(t, store)
+	h := setupHandler(store)
+
+	code, _ := createTemplate(t, h, models.TemplateRequest{
+		Name:      "inventory",
+		Task:      models.TemplateTask{Type: "command_shell", Parameters: map[string]interface{}{"command": "inventory --format {{ format }}"}},
+		Variables: []models.TemplateVariable{{Name: "format", Type: models.VariableString, Default: "json"}},
+	})
+	require.Equal(t, http.StatusCreated, code)
+	code, _ = createTemplate(t, h, portScan())
+	require.Equal(t, http.StatusCreated, code)
+
+	createRole := func(role models.Role) int {
+		c, rec := newJSONContext(setupEcho(), http.MethodPost, "/admin/roles", role)
+		require.NoError(t, h.CreateRole(c))
+		return rec.Code
+	}
+	assert.Equal(t, http.StatusBadRequest, createRole(models.Role{Name: "bad", DefaultTasks: []string{"missing"}}))
+	assert.Equal(t, http.StatusBadRequest, createRole(models.Role{Name: "bad", DefaultTasks: []string{"port-check"}}),
+		"Default tasks cannot need variable values")
+	require.Equal(t, http.StatusCreated, createRole(models.Role{Name: "collector", DefaultTasks: []string{"inventory"}}))
+
+	tasksOf := func(agentID string) []models.Task {
+		tasks, err := store.Tasks.ListByAgent(ctx, agentID)
+		require.NoError(t, err)
+		return tasks
+	}
+
+	// Assigning the role creates the default tasks once
+	role := "collector"
+	for i := 0; i < 2; i++ {
+		c, rec := newJSONContext(setupEcho(), http.MethodPatch, "/admin/agents/web-1", models.AgentUpdateRequest{Role: &role})
+		c.SetParamNames("uuid")
+		c.SetParamValues("web-1")
+		c.Set("admin", "root")
+		require.NoError(t, h.UpdateAgent(c))
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+	tasks := tasksOf("web-1")
+	require.Len(t, tasks, 1)
+	assert.Equal(t, "inventory --format json", tasks[0].Parameters["command"])
+	assert.Equal(t, "inventory", tasks[0].TemplateName)
+	assert.Equal(t, models.ActorRole, tasks[0].Events[0].Actor)
+
+	// Enrolling with a token for the role does too
+	require.NoError(t, store.EnrollmentTokens.Create(ctx, &models.EnrollmentToken{
+		TokenHash: secrets.Hash("collector-token"),
+		Role:      "collector",
+		MaxUses:   1,
+		ExpiresAt: time.Now().Add(time.Hour),
+		CreatedBy: "root",
+	}))
+	c, rec := newJSONContext(setupEcho(), http.MethodPost, "/api/agent/enroll",
+		models.EnrollmentRequest{Token: "collector-token", UUID: "collector-1", Hostname: "host", MacHash: "mac"})
+	require.NoError(t, h.EnrollAgent(c))
+	require.Equal(t, http.StatusOK, rec.Code)
+	tasks = tasksOf("collector-1")
+	require.Len(t, tasks, 1)
+	assert.Equal(t, "root", tasks[0].CreatedBy)
+}
@@ -0,0 +1,258 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/whit3rabbit/beehive/manager/internal/config"
+	"github.com/whit3rabbit/beehive/manager/internal/storage"
+	"github.com/whit3rabbit/beehive/manager/internal/workflow"
+	"github.com/whit3rabbit/beehive/manager/models"
+)
+
+func shellNode(id, command string, dependsOn ...string) models.WorkflowNode {
+	return models.WorkflowNode{
+		ID:        id,
+		Task:      models.TaskTemplate{Type: "command_shell", Parameters: map[string]interface{}{"command": command}},
+		DependsOn: dependsOn,
+	}
+}
+
+// remediation scans a host, fixes it only if the scan found something, verifies the fix, and
+// reports the scan whatever its outcome.
+func remediation() models.WorkflowRequest {
+	fix := shellNode("fix", "fix.sh", "scan")
+	fix.When = []models.WorkflowCondition{{Node: "scan", Field: "logs.findings", Op: models.ConditionNotEquals, Value: "0"}}
+	report := shellNode("report", "report.sh", "scan")
+	report.When = []models.WorkflowCondition{{Node: "scan", Status: []string{"completed", "failed", "timeout"}}}
+	return models.WorkflowRequest{
+		Name: "remediate",
+		Nodes: []models.WorkflowNode{
+			shellNode("scan", "scan.sh"),
+			fix,
+			shellNode("verify", "scan.sh --verify", "fix"),
+			report,
+		},
+	}
+}
+
+func TestWorkflowValidate(t *testing.T) {
+	req := remediation()
+	valid := models.Workflow{Name: req.Name, Nodes: req.Nodes}
+	require.NoError(t, valid.Validate())
+	assert.Equal(t, []string{"completed"}, valid.Nodes[1].When[0].Status, "Conditions default to completed")
+	assert.Equal(t, map[string]int{"scan": 0, "fix": 1, "verify": 2, "report": 1}, models.WorkflowLevels(valid.Nodes))
+
+	cyclic := shellNode("a", "true", "b")
+	conditionOnStranger := shellNode("c", "true", "a")
+	conditionOnStranger.When = []models.WorkflowCondition{{Node: "b"}}
+	badOp := shellNode("c", "true", "a")
+	badOp.When = []models.WorkflowCondition{{Node: "a", Field: "logs", Op: "like"}}
+	for name, nodes := range map[string][]models.WorkflowNode{
+		"no nodes":              nil,
+		"missing id":            {shellNode("", "true")},
+		"duplicate id":          {shellNode("a", "true"), shellNode("a", "true")},
+		"unknown dependency":    {shellNode("a", "true", "z")},
+		"self dependency":       {shellNode("a", "true", "a")},
+		"cycle":                 {cyclic, shellNode("b", "true", "a")},
+		"condition on stranger": {shellNode("a", "true"), shellNode("b", "true"), conditionOnStranger},
+		"unknown op":            {shellNode("a", "true"), badOp},
+	} {
+		wf := models.Workflow{Name: "broken", Nodes: nodes}
+		assert.Error(t, wf.Validate(), name)
+	}
+}
+
+func TestWorkflowConditionMatches(t *testing.T) {
+	output := &models.Output{Logs: `{"findings": 2, "host": {"os": "debian"}, "cve": null}`}
+	for _, tc := range []struct {
+		cond   models.WorkflowCondition
+		status string
+		want   bool
+	}{
+		{models.WorkflowCondition{Status: []string{"completed"}}, "completed", true},
+		{models.WorkflowCondition{Status: []string{"completed"}}, "failed", false},
+		{models.WorkflowCondition{Status: []string{"completed"}, Field: "logs.findings", Op: "equals", Value: "2"}, "completed", true},
+		{models.WorkflowCondition{Status: []string{"completed"}, Field: "logs.host.os", Op: "equals", Value: "debian"}, "completed", true},
+		{models.WorkflowCondition{Status: []string{"completed"}, Field: "logs.cve", Op: "empty"}, "completed", true},
+		{models.WorkflowCondition{Status: []string{"completed"}, Field: "logs.missing.key", Op: "not_empty"}, "completed", false},
+		{models.WorkflowCondition{Status: []string{"completed"}, Field: "logs", Op: "contains", Value: "debian"}, "completed", true},
+		{models.WorkflowCondition{Status: []string{"completed"}, Field: "error", Op: "empty"}, "completed", true},
+	} {
+		assert.Equal(t, tc.want, tc.cond.Matches(tc.status, output), "%+v", tc.cond)
+	}
+}
+
+func TestWorkflowRun(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	setupJobAgents(t, store)
+	h := setupHandler(store)
+	engine := workflow.New(store, config.WorkflowConfig{IntervalSeconds: 1})
+	now := time.Now()
+
+	c, rec := newJSONContext(setupEcho(), http.MethodPost, "/admin/workflows", remediation())
+	c.Set("admin", "root")
+	require.NoError(t, h.CreateWorkflow(c))
+	require.Equal(t, http.StatusCreated, rec.Code)
+	var wf models.Workflow
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &wf))
+
+	c, rec = newJSONContext(setupEcho(), http.MethodPost, "/admin/workflows/"+wf.ID.Hex()+"/runs",
+		models.WorkflowRunRequest{Target: models.JobTarget{AgentIDs: []string{"web-1", "web-2"}}})
+	c.SetParamNames("workflow_id")
+	c.SetParamValues(wf.ID.Hex())
+	c.Set("admin", "root")
+	require.NoError(t, h.StartWorkflow(c))
+	require.Equal(t, http.StatusCreated, rec.Code)
+	var started models.WorkflowRunListResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &started))
+	require.Len(t, started.Runs, 2)
+
+	runs := map[string]primitive.ObjectID{}
+	for _, run := range started.Runs {
+		runs[run.AgentID] = run.ID
+		assert.Equal(t, "queued", run.Nodes[0].Status, "Nodes without dependencies start right away")
+		assert.Equal(t, "pending", run.Nodes[1].Status)
+	}
+
+	nodes := func(agentID string) map[string]models.WorkflowNodeState {
+		var resp models.WorkflowRunResponse
+		code := runRequest(t, h.GetWorkflowRun, runs[agentID].Hex(), &resp)
+		require.Equal(t, http.StatusOK, code)
+		states := map[string]models.WorkflowNodeState{}
+		for _, state := range resp.Nodes {
+			states[state.ID] = state
+		}
+		return states
+	}
+	finishNode := func(agentID, node, status, logs string) {
+		taskID, err := primitive.ObjectIDFromHex(nodes(agentID)[node].TaskID)
+		require.NoError(t, err)
+		_, err = store.Tasks.Transition(ctx, taskID, "dispatched", models.TaskEvent{Actor: "agent:" + agentID, Timestamp: now})
+		require.NoError(t, err)
+		require.NoError(t, store.Tasks.Finish(ctx, taskID, agentID, status, &models.Output{Logs: logs}, now))
+	}
+	step := func() workflow.Result {
+		result, err := engine.Step(ctx, now)
+		require.NoError(t, err)
+		return result
+	}
+
+	finishNode("web-1", "scan", "completed", `{"findings": 2}`)
+	finishNode("web-2", "scan", "completed", `{"findings": 0}`)
+	assert.Equal(t, workflow.Result{NodesStarted: 3, NodesSkipped: 2}, step())
+
+	web1 := nodes("web-1")
+	assert.Equal(t, "queued", web1["fix"].Status)
+	assert.Equal(t, "pending", web1["verify"].Status)
+	web2 := nodes("web-2")
+	assert.Equal(t, "skipped", web2["fix"].Status)
+	assert.Equal(t, "condition on node scan not met", web2["fix"].Reason)
+	assert.Equal(t, "skipped", web2["verify"].Status, "Skips cascade downstream")
+	assert.Equal(t, "upstream node fix skipped", web2["verify"].Reason)
+
+	task, err := store.Tasks.Get(ctx, mustObjectID(t, web1["fix"].TaskID))
+	require.NoError(t, err)
+	assert.Equal(t, "web-1", task.AgentID)
+	assert.Equal(t, runs["web-1"].Hex(), task.WorkflowRunID)
+	assert.Equal(t, "fix", task.WorkflowNode)
+	assert.Equal(t, "root", task.CreatedBy)
+	assert.Equal(t, models.ActorWorkflow, task.Events[0].Actor)
+
+	finishNode("web-2", "report", "completed", "")
+	finishNode("web-1", "report", "completed", "")
+	finishNode("web-1", "fix", "failed", "")
+	assert.Equal(t, workflow.Result{NodesSkipped: 1, RunsFinished: 2}, step())
+
+	var resp models.WorkflowRunResponse
+	require.Equal(t, http.StatusOK, runRequest(t, h.GetWorkflowRun, runs["web-1"].Hex(), &resp))
+	assert.Equal(t, models.WorkflowFailed, resp.Status)
+	assert.Equal(t, "upstream node fix failed", nodes("web-1")["verify"].Reason)
+	resp = models.WorkflowRunResponse{}
+	require.Equal(t, http.StatusOK, runRequest(t, h.GetWorkflowRun, runs["web-2"].Hex(), &resp))
+	assert.Equal(t, models.WorkflowCompleted, resp.Status, "Skipped nodes do not fail a run")
+
+	assert.Equal(t, []models.WorkflowGraphNode{
+		{ID: "scan", Type: "command_shell", Status: "completed", TaskID: resp.Nodes[0].TaskID},
+		{ID: "fix", Type: "command_shell", Status: "skipped", Reason: "condition on node scan not met", Level: 1},
+		{ID: "verify", Type: "command_shell", Status: "skipped", Reason: "upstream node fix skipped", Level: 2},
+		{ID: "report", Type: "command_shell", Status: "completed", TaskID: resp.Nodes[3].TaskID, Level: 1},
+	}, resp.Graph.Nodes)
+	assert.Equal(t, []models.WorkflowGraphEdge{
+		{From: "scan", To: "fix", Conditional: true},
+		{From: "fix", To: "verify"},
+		{From: "scan", To: "report", Conditional: true},
+	}, resp.Graph.Edges)
+
+	assert.Equal(t, workflow.Result{}, step(), "Finished runs are left alone")
+}
+
+func TestWorkflowRunCancelAndRecovery(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	setupJobAgents(t, store)
+	h := setupHandler(store)
+	engine := workflow.New(store, config.WorkflowConfig{IntervalSeconds: 1})
+	now := time.Now()
+
+	req := remediation()
+	wf := &models.Workflow{ID: primitive.NewObjectID(), Name: req.Name, Nodes: req.Nodes}
+	require.NoError(t, wf.Validate())
+
+	// A manager that stored the run and its first node but stopped before creating the task
+	run := workflow.NewRun(wf, "web-3", "root", now)
+	run.Nodes[0].Status = "queued"
+	run.Nodes[0].TaskID = primitive.NewObjectID().Hex()
+	require.NoError(t, store.WorkflowRuns.Create(ctx, run))
+
+	result, err := engine.Step(ctx, now)
+	require.NoError(t, err)
+	assert.Equal(t, workflow.Result{}, result)
+	task, err := store.Tasks.Get(ctx, mustObjectID(t, run.Nodes[0].TaskID))
+	require.NoError(t, err, "The missing task is created")
+	assert.Equal(t, "scan", task.WorkflowNode)
+
+	var resp models.WorkflowRunResponse
+	require.Equal(t, http.StatusOK, runRequest(t, h.CancelWorkflowRun, run.ID.Hex(), &resp))
+	assert.Equal(t, models.WorkflowCancelled, resp.Status)
+	assert.Equal(t, "root", resp.CancelledBy)
+	for _, state := range resp.Nodes {
+		assert.Equal(t, "cancelled", state.Status, state.ID)
+	}
+	assert.Equal(t, "run cancelled", resp.Nodes[1].Reason)
+	task, err = store.Tasks.Get(ctx, task.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "cancelled", task.Status, "Cancellation reaches started nodes")
+
+	assert.Equal(t, http.StatusConflict, runRequest(t, h.CancelWorkflowRun, run.ID.Hex(), nil))
+	assert.Equal(t, http.StatusNotFound, runRequest(t, h.GetWorkflowRun, primitive.NewObjectID().Hex(), nil))
+}
+
+func runRequest(t *testing.T, handler echo.HandlerFunc, runID string, out interface{}) int {
+	t.Helper()
+	c, rec := newJSONContext(setupEcho(), http.MethodGet, "/admin/workflow-runs/"+runID, nil)
+	c.SetParamNames("run_id")
+	c.SetParamValues(runID)
+	c.Set("admin", "root")
+	require.NoError(t, handler(c))
+	if out != nil && rec.Code == http.StatusOK {
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), out))
+	}
+	return rec.Code
+}
+
+func mustObjectID(t *testing.T, hex string) primitive.ObjectID {
+	t.Helper()
+	id, err := primitive.ObjectIDFromHex(hex)
+	require.NoError(t, err)
+	return id
+}